@@ -0,0 +1,177 @@
+// Package accesslog writes one structured record per client connection, as
+// JSON lines or logfmt, to stdout, a size-rotated file, or syslog.
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FormatJSON   = "json"
+	FormatLogfmt = "logfmt"
+)
+
+// Decisions recorded in Record.Decision.
+const (
+	DecisionAccept = "accept"
+	DecisionReject = "reject"
+	// DecisionError means the connection was allowed but could not be proxied,
+	// e.g. because the backend dial failed.
+	DecisionError = "error"
+)
+
+// Record describes one client connection from accept to close.
+type Record struct {
+	Server     string    `json:"server"`
+	Listen     string    `json:"listen"`
+	ClientIP   string    `json:"clientIP"`
+	ClientPort string    `json:"clientPort"`
+	Country    string    `json:"country"`
+	Region     string    `json:"region"`
+	Cache      string    `json:"cache"`
+	ASN        uint32    `json:"asn,omitempty"`
+	Decision   string    `json:"decision"`
+	Reason     string    `json:"reason,omitempty"`
+	Backend    string    `json:"backend"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	DurationMS int64     `json:"durationMs"`
+	BytesUp    int64     `json:"bytesUp"`
+	BytesDown  int64     `json:"bytesDown"`
+}
+
+// Logger serializes records to its output. It is safe for concurrent use.
+type Logger struct {
+	format string
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+// New returns a Logger writing records to w in format.
+func New(w io.Writer, format string) (*Logger, error) {
+	format = strings.ToLower(strings.TrimSpace(format))
+	if format == "" {
+		format = FormatJSON
+	}
+	if format != FormatJSON && format != FormatLogfmt {
+		return nil, fmt.Errorf("unknown access log format %q (expected json or logfmt)", format)
+	}
+	return &Logger{format: format, w: w}, nil
+}
+
+// Open creates a Logger for dest: "stdout", "syslog", or a file path. Files are
+// rotated once they reach maxSize bytes (0 disables rotation), keeping
+// maxBackups old files as path.1 ... path.N.
+func Open(dest, format string, maxSize int64, maxBackups int) (*Logger, error) {
+	var w io.Writer
+	var closer io.Closer
+	switch dest {
+	case "stdout", "-":
+		w = os.Stdout
+	case "syslog":
+		sw, err := newSyslogWriter()
+		if err != nil {
+			return nil, fmt.Errorf("failed to open syslog: %v", err)
+		}
+		w, closer = sw, sw
+	default:
+		f, err := newRotatingFile(dest, maxSize, maxBackups)
+		if err != nil {
+			return nil, err
+		}
+		w, closer = f, f
+	}
+	l, err := New(w, format)
+	if err != nil {
+		if closer != nil {
+			_ = closer.Close()
+		}
+		return nil, err
+	}
+	l.closer = closer
+	return l, nil
+}
+
+// Log writes r as a single line.
+func (l *Logger) Log(r Record) {
+	var line []byte
+	if l.format == FormatLogfmt {
+		line = appendLogfmt(nil, r)
+	} else {
+		var err error
+		line, err = json.Marshal(r)
+		if err != nil {
+			return
+		}
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.w.Write(line)
+}
+
+func (l *Logger) Close() error {
+	if l.closer == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closer.Close()
+}
+
+func appendLogfmt(b []byte, r Record) []byte {
+	pairs := []struct{ k, v string }{
+		{"server", r.Server},
+		{"listen", r.Listen},
+		{"client_ip", r.ClientIP},
+		{"client_port", r.ClientPort},
+		{"country", r.Country},
+		{"region", r.Region},
+		{"cache", r.Cache},
+		{"asn", formatASN(r.ASN)},
+		{"decision", r.Decision},
+		{"reason", r.Reason},
+		{"backend", r.Backend},
+		{"start", r.Start.Format(time.RFC3339Nano)},
+		{"end", r.End.Format(time.RFC3339Nano)},
+		{"duration_ms", strconv.FormatInt(r.DurationMS, 10)},
+		{"bytes_up", strconv.FormatInt(r.BytesUp, 10)},
+		{"bytes_down", strconv.FormatInt(r.BytesDown, 10)},
+	}
+	for i, p := range pairs {
+		if p.k == "asn" && p.v == "" {
+			// Only lookups that report a network carry an ASN.
+			continue
+		}
+		if i > 0 {
+			b = append(b, ' ')
+		}
+		b = append(b, p.k...)
+		b = append(b, '=')
+		b = appendLogfmtValue(b, p.v)
+	}
+	return b
+}
+
+func formatASN(asn uint32) string {
+	if asn == 0 {
+		return ""
+	}
+	return strconv.FormatUint(uint64(asn), 10)
+}
+
+func appendLogfmtValue(b []byte, v string) []byte {
+	if v != "" && !strings.ContainsAny(v, " =\"\\\t\r\n") {
+		return append(b, v...)
+	}
+	return strconv.AppendQuote(b, v)
+}
@@ -0,0 +1,134 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testRecord() Record {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	return Record{
+		Server:     "web",
+		Listen:     "0.0.0.0:443",
+		ClientIP:   "203.0.113.7",
+		ClientPort: "51234",
+		Country:    "US",
+		Region:     "CA",
+		Cache:      "cached",
+		Decision:   DecisionReject,
+		Reason:     "country or region denied",
+		Backend:    "10.0.0.5:443",
+		Start:      start,
+		End:        start.Add(1500 * time.Millisecond),
+		DurationMS: 1500,
+		BytesUp:    10,
+		BytesDown:  20,
+	}
+}
+
+func TestLoggerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := New(&buf, "json")
+	assert.NoError(t, err)
+	l.Log(testRecord())
+	l.Log(testRecord())
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	assert.Len(t, lines, 2)
+	var got Record
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &got))
+	assert.Equal(t, testRecord(), got)
+	assert.Contains(t, lines[0], `"durationMs":1500`)
+}
+
+func TestLoggerLogfmt(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := New(&buf, "logfmt")
+	assert.NoError(t, err)
+	l.Log(testRecord())
+
+	want := `server=web listen=0.0.0.0:443 client_ip=203.0.113.7 client_port=51234 country=US region=CA cache=cached ` +
+		`decision=reject reason="country or region denied" backend=10.0.0.5:443 ` +
+		`start=2024-05-01T12:00:00Z end=2024-05-01T12:00:01.5Z duration_ms=1500 bytes_up=10 bytes_down=20` + "\n"
+	assert.Equal(t, want, buf.String())
+
+	buf.Reset()
+	r := testRecord()
+	r.Reason = ""
+	l.Log(r)
+	assert.Contains(t, buf.String(), ` reason="" `)
+}
+
+func TestLoggerUnknownFormat(t *testing.T) {
+	_, err := New(&bytes.Buffer{}, "xml")
+	assert.Error(t, err)
+}
+
+func TestOpenFileRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	l, err := Open(path, "json", 600, 2)
+	assert.NoError(t, err)
+	defer l.Close()
+
+	// Each record is a little over 300 bytes, so every second record rotates.
+	for i := 0; i < 7; i++ {
+		l.Log(testRecord())
+	}
+	assert.NoError(t, l.Close())
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		data, err := os.ReadFile(name)
+		assert.NoError(t, err, name)
+		assert.LessOrEqual(t, len(data), 600, name)
+		assert.NotEmpty(t, data, name)
+	}
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestOpenFileRotateFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	// A non-empty directory in the way of the backup makes the rename fail.
+	assert.NoError(t, os.MkdirAll(filepath.Join(path+".1", "busy"), 0o700))
+	l, err := Open(path, "json", 600, 1)
+	assert.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		l.Log(testRecord())
+	}
+	assert.NoError(t, l.Close())
+
+	// Logging carries on in the current file.
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, strings.Count(string(data), "\n"))
+
+	// Once the way is clear, rotation resumes.
+	assert.NoError(t, os.RemoveAll(path+".1"))
+	l, err = Open(path, "json", 600, 1)
+	assert.NoError(t, err)
+	l.Log(testRecord())
+	assert.NoError(t, l.Close())
+	_, err = os.Stat(path + ".1")
+	assert.NoError(t, err)
+}
+
+func TestOpenFileAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	for i := 0; i < 2; i++ {
+		l, err := Open(path, "logfmt", 0, 0)
+		assert.NoError(t, err)
+		l.Log(testRecord())
+		assert.NoError(t, l.Close())
+	}
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(data), "\n"))
+}
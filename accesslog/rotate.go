@@ -0,0 +1,119 @@
+package accesslog
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+// rotatingFile is an append-only file that is renamed to path.1 (shifting
+// older backups up) once it grows past maxSize.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+	// limit is the size that triggers the next rotation: maxSize, or further
+	// out after a failed rotation so it isn't retried on every write.
+	limit int64
+	// failed is set after a rotation failed, so the failure is only logged
+	// once until a rotation succeeds.
+	failed bool
+}
+
+func newRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups, limit: maxSize}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, size, err := openAppend(r.path)
+	if err != nil {
+		return err
+	}
+	r.f = f
+	r.size = size
+	return nil
+}
+
+func openAppend(path string) (*os.File, int64, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open access log: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, 0, fmt.Errorf("failed to stat access log: %v", err)
+	}
+	return f, info.Size(), nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return 0, os.ErrClosed
+	}
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.limit {
+		if err := r.rotate(); err != nil {
+			// Keep writing to the current file and try again once it has
+			// grown by another maxSize.
+			if !r.failed {
+				log.Printf("%v; writing to %s without rotating", err, r.path)
+				r.failed = true
+			}
+			r.limit = r.size + r.maxSize
+		} else {
+			r.failed = false
+			r.limit = r.maxSize
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file aside and opens a new one. The old handle
+// stays open until the new file is, so a failure leaves r.f usable.
+func (r *rotatingFile) rotate() error {
+	if r.maxBackups <= 0 {
+		if err := os.Remove(r.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to rotate access log: %v", err)
+		}
+	} else {
+		_ = os.Remove(fmt.Sprintf("%s.%d", r.path, r.maxBackups))
+		for i := r.maxBackups - 1; i >= 1; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		if err := os.Rename(r.path, r.path+".1"); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to rotate access log: %v", err)
+		}
+	}
+	f, size, err := openAppend(r.path)
+	if err != nil {
+		return err
+	}
+	_ = r.f.Close()
+	r.f = f
+	r.size = size
+	return nil
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
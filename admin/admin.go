@@ -0,0 +1,324 @@
+// Package admin serves GeoProxy's local control API: inspect servers, active
+// connections and the ip-api cache, close connections, and manage temporary
+// allow/deny entries and bans.
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"geoproxy/ban"
+	"geoproxy/config"
+	"geoproxy/handler"
+	"geoproxy/ipapi"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2"
+)
+
+// API holds the state the admin endpoints read and change. Nil fields disable
+// the matching endpoints.
+type API struct {
+	Servers   func() []config.ServerConfig
+	Conns     *handler.ConnRegistry
+	Cache     *lru.Cache[string, ipapi.Reply]
+	TempRules *handler.TempRules
+	Bans      *ban.List
+}
+
+type cacheEntry struct {
+	IP    string      `json:"ip"`
+	Reply ipapi.Reply `json:"reply"`
+}
+
+type banRequest struct {
+	IP       string `json:"ip"`
+	Duration string `json:"duration"`
+	Reason   string `json:"reason"`
+}
+
+type tempRuleRequest struct {
+	List   string `json:"list"`
+	Server string `json:"server"`
+	Entry  string `json:"entry"`
+	TTL    string `json:"ttl"`
+}
+
+func (a *API) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /servers", a.listServers)
+	mux.HandleFunc("GET /connections", a.listConnections)
+	mux.HandleFunc("DELETE /connections/{id}", a.killConnection)
+	mux.HandleFunc("GET /cache", a.listCache)
+	mux.HandleFunc("GET /cache/{ip}", a.getCache)
+	mux.HandleFunc("DELETE /cache", a.purgeCache)
+	mux.HandleFunc("DELETE /cache/{ip}", a.deleteCache)
+	mux.HandleFunc("GET /rules/temporary", a.listTempRules)
+	mux.HandleFunc("POST /rules/temporary", a.addTempRule)
+	mux.HandleFunc("DELETE /rules/temporary", a.removeTempRule)
+	mux.HandleFunc("GET /bans", a.listBans)
+	mux.HandleFunc("POST /bans", a.addBan)
+	mux.HandleFunc("DELETE /bans", a.removeBan)
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, format string, args ...any) {
+	writeJSON(w, status, map[string]string{"error": fmt.Sprintf(format, args...)})
+}
+
+func (a *API) listServers(w http.ResponseWriter, _ *http.Request) {
+	if a.Servers == nil {
+		writeError(w, http.StatusNotFound, "server listing not available")
+		return
+	}
+	writeJSON(w, http.StatusOK, a.Servers())
+}
+
+func (a *API) listConnections(w http.ResponseWriter, _ *http.Request) {
+	if a.Conns == nil {
+		writeError(w, http.StatusNotFound, "connection tracking not available")
+		return
+	}
+	writeJSON(w, http.StatusOK, a.Conns.List())
+}
+
+func (a *API) killConnection(w http.ResponseWriter, r *http.Request) {
+	if a.Conns == nil {
+		writeError(w, http.StatusNotFound, "connection tracking not available")
+		return
+	}
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid connection id %q", r.PathValue("id"))
+		return
+	}
+	if !a.Conns.Kill(id) {
+		writeError(w, http.StatusNotFound, "no active connection with id %d", id)
+		return
+	}
+	log.Printf("admin: closed connection %d", id)
+	writeJSON(w, http.StatusOK, map[string]uint64{"closed": id})
+}
+
+func (a *API) listCache(w http.ResponseWriter, _ *http.Request) {
+	if a.Cache == nil {
+		writeError(w, http.StatusNotFound, "ip cache not available")
+		return
+	}
+	keys := a.Cache.Keys()
+	entries := make([]cacheEntry, 0, len(keys))
+	for _, ip := range keys {
+		if reply, ok := a.Cache.Peek(ip); ok {
+			entries = append(entries, cacheEntry{IP: ip, Reply: reply})
+		}
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func (a *API) getCache(w http.ResponseWriter, r *http.Request) {
+	if a.Cache == nil {
+		writeError(w, http.StatusNotFound, "ip cache not available")
+		return
+	}
+	ip := r.PathValue("ip")
+	reply, ok := a.Cache.Peek(ip)
+	if !ok {
+		writeError(w, http.StatusNotFound, "%s is not cached", ip)
+		return
+	}
+	writeJSON(w, http.StatusOK, cacheEntry{IP: ip, Reply: reply})
+}
+
+func (a *API) purgeCache(w http.ResponseWriter, _ *http.Request) {
+	if a.Cache == nil {
+		writeError(w, http.StatusNotFound, "ip cache not available")
+		return
+	}
+	n := a.Cache.Len()
+	a.Cache.Purge()
+	log.Printf("admin: purged %d ip cache entries", n)
+	writeJSON(w, http.StatusOK, map[string]int{"purged": n})
+}
+
+func (a *API) deleteCache(w http.ResponseWriter, r *http.Request) {
+	if a.Cache == nil {
+		writeError(w, http.StatusNotFound, "ip cache not available")
+		return
+	}
+	ip := r.PathValue("ip")
+	if !a.Cache.Remove(ip) {
+		writeError(w, http.StatusNotFound, "%s is not cached", ip)
+		return
+	}
+	log.Printf("admin: removed %s from ip cache", ip)
+	writeJSON(w, http.StatusOK, map[string]string{"removed": ip})
+}
+
+func (a *API) listTempRules(w http.ResponseWriter, _ *http.Request) {
+	if a.TempRules == nil {
+		writeError(w, http.StatusNotFound, "temporary rules not available")
+		return
+	}
+	writeJSON(w, http.StatusOK, a.TempRules.List())
+}
+
+func (a *API) addTempRule(w http.ResponseWriter, r *http.Request) {
+	if a.TempRules == nil {
+		writeError(w, http.StatusNotFound, "temporary rules not available")
+		return
+	}
+	var req tempRuleRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body: %v", err)
+		return
+	}
+	ttl, err := time.ParseDuration(req.TTL)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid ttl %q: %v", req.TTL, err)
+		return
+	}
+	rule, err := a.TempRules.Add(strings.ToLower(req.List), req.Server, req.Entry, ttl)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return
+	}
+	log.Printf("admin: added temporary %s entry %s server: %q until %s", rule.List, rule.Entry, rule.Server, rule.ExpiresAt.Format(time.RFC3339))
+	writeJSON(w, http.StatusCreated, rule)
+}
+
+func (a *API) removeTempRule(w http.ResponseWriter, r *http.Request) {
+	if a.TempRules == nil {
+		writeError(w, http.StatusNotFound, "temporary rules not available")
+		return
+	}
+	q := r.URL.Query()
+	list, server, entry := strings.ToLower(q.Get("list")), q.Get("server"), q.Get("entry")
+	if !a.TempRules.Remove(list, server, entry) {
+		writeError(w, http.StatusNotFound, "no temporary %s entry %q", list, entry)
+		return
+	}
+	log.Printf("admin: removed temporary %s entry %s server: %q", list, entry, server)
+	writeJSON(w, http.StatusOK, map[string]string{"removed": entry})
+}
+
+func (a *API) listBans(w http.ResponseWriter, _ *http.Request) {
+	if a.Bans == nil {
+		writeError(w, http.StatusNotFound, "ban list not available")
+		return
+	}
+	writeJSON(w, http.StatusOK, a.Bans.List())
+}
+
+func (a *API) addBan(w http.ResponseWriter, r *http.Request) {
+	if a.Bans == nil {
+		writeError(w, http.StatusNotFound, "ban list not available")
+		return
+	}
+	var req banRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body: %v", err)
+		return
+	}
+	if _, err := netip.ParseAddr(strings.TrimSpace(req.IP)); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid ip %q", req.IP)
+		return
+	}
+	var d time.Duration
+	if req.Duration != "" {
+		var err error
+		if d, err = time.ParseDuration(req.Duration); err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid duration %q", req.Duration)
+			return
+		}
+	}
+	reason := req.Reason
+	if reason == "" {
+		reason = "banned via admin API"
+	}
+	writeJSON(w, http.StatusCreated, a.Bans.Ban(strings.TrimSpace(req.IP), d, reason))
+}
+
+// removeBan takes the address or ban key in the ip query parameter, since ban
+// keys may be prefixes containing a slash.
+func (a *API) removeBan(w http.ResponseWriter, r *http.Request) {
+	if a.Bans == nil {
+		writeError(w, http.StatusNotFound, "ban list not available")
+		return
+	}
+	ip := r.URL.Query().Get("ip")
+	if !a.Bans.Unban(ip) {
+		writeError(w, http.StatusNotFound, "%s is not banned", ip)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"unbanned": ip})
+}
+
+// Listen opens the admin listener. addr is either "unix:/path/to/socket" or a
+// host:port on a loopback address; the API has no authentication, so anything
+// else is refused.
+func Listen(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		// Remove a socket left behind by a previous run.
+		if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			_ = os.Remove(path)
+		}
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(path, 0o600); err != nil {
+			_ = l.Close()
+			return nil, err
+		}
+		return l, nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid admin address %q: %v", addr, err)
+	}
+	if host != "localhost" {
+		ip := net.ParseIP(host)
+		if ip == nil || !ip.IsLoopback() {
+			return nil, fmt.Errorf("admin address %q must be a unix socket or a loopback address", addr)
+		}
+	}
+	return net.Listen("tcp", addr)
+}
+
+// Serve runs the API on addr until ctx is done. It returns once the listener
+// is bound, with the address it bound to.
+func (a *API) Serve(ctx context.Context, addr string) (net.Addr, error) {
+	l, err := Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Handler: a.Handler(), ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+	go func() {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Printf("admin listener on %s stopped: %v", l.Addr(), err)
+		}
+	}()
+	return l.Addr(), nil
+}
@@ -0,0 +1,204 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"geoproxy/ban"
+	"geoproxy/config"
+	"geoproxy/handler"
+	"geoproxy/ipapi"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAPI(t *testing.T) (*API, *httptest.Server) {
+	t.Helper()
+	cache, err := lru.New[string, ipapi.Reply](16)
+	if err != nil {
+		t.Fatalf("new cache: %v", err)
+	}
+	api := &API{
+		Servers: func() []config.ServerConfig {
+			return []config.ServerConfig{{Name: "web", ListenIP: "0.0.0.0", ListenPort: "443", AllowedCountries: []string{"US"}}}
+		},
+		Conns:     handler.NewConnRegistry(),
+		Cache:     cache,
+		TempRules: handler.NewTempRules(),
+		Bans:      ban.New(ban.Policy{Duration: time.Hour, IPv4Prefix: 24}),
+	}
+	srv := httptest.NewServer(api.Handler())
+	t.Cleanup(srv.Close)
+	return api, srv
+}
+
+func do(t *testing.T, method, url, body string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(data)
+}
+
+func TestListServers(t *testing.T) {
+	_, srv := newTestAPI(t)
+	status, body := do(t, "GET", srv.URL+"/servers", "")
+	assert.Equal(t, http.StatusOK, status)
+	var servers []config.ServerConfig
+	assert.NoError(t, json.Unmarshal([]byte(body), &servers))
+	assert.Equal(t, "web", servers[0].Name)
+	assert.Equal(t, []string{"US"}, servers[0].AllowedCountries)
+}
+
+func TestCacheEndpoints(t *testing.T) {
+	api, srv := newTestAPI(t)
+	api.Cache.Add("1.2.3.4", ipapi.Reply{CountryCode: "US", Region: "CA", ExpiresAt: time.Now().Add(time.Hour)})
+	api.Cache.Add("5.6.7.8", ipapi.Reply{FailureUntil: time.Now().Add(time.Minute)})
+
+	status, body := do(t, "GET", srv.URL+"/cache", "")
+	assert.Equal(t, http.StatusOK, status)
+	var entries []cacheEntry
+	assert.NoError(t, json.Unmarshal([]byte(body), &entries))
+	assert.Len(t, entries, 2)
+
+	status, body = do(t, "GET", srv.URL+"/cache/1.2.3.4", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, `"countryCode": "US"`)
+
+	status, _ = do(t, "DELETE", srv.URL+"/cache/1.2.3.4", "")
+	assert.Equal(t, http.StatusOK, status)
+	status, _ = do(t, "GET", srv.URL+"/cache/1.2.3.4", "")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	status, body = do(t, "DELETE", srv.URL+"/cache", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, `"purged": 1`)
+	assert.Equal(t, 0, api.Cache.Len())
+}
+
+func TestTempRuleEndpoints(t *testing.T) {
+	api, srv := newTestAPI(t)
+
+	status, body := do(t, "POST", srv.URL+"/rules/temporary", `{"list":"deny","entry":"203.0.113.0/24","ttl":"10m"}`)
+	assert.Equal(t, http.StatusCreated, status, body)
+	assert.True(t, api.TempRules.Match(handler.TempDeny, "web", "203.0.113.9"))
+
+	status, body = do(t, "POST", srv.URL+"/rules/temporary", `{"list":"allow","server":"web","entry":"198.51.100.1","ttl":"1h"}`)
+	assert.Equal(t, http.StatusCreated, status, body)
+
+	status, body = do(t, "GET", srv.URL+"/rules/temporary", "")
+	assert.Equal(t, http.StatusOK, status)
+	var rules []handler.TempRule
+	assert.NoError(t, json.Unmarshal([]byte(body), &rules))
+	assert.Len(t, rules, 2)
+
+	for _, bad := range []string{
+		`{"list":"deny","entry":"bogus","ttl":"10m"}`,
+		`{"list":"maybe","entry":"1.2.3.4","ttl":"10m"}`,
+		`{"list":"deny","entry":"1.2.3.4","ttl":"forever"}`,
+		`not json`,
+	} {
+		status, _ = do(t, "POST", srv.URL+"/rules/temporary", bad)
+		assert.Equal(t, http.StatusBadRequest, status, bad)
+	}
+
+	status, _ = do(t, "DELETE", srv.URL+"/rules/temporary?list=deny&entry=203.0.113.0/24", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.False(t, api.TempRules.Match(handler.TempDeny, "web", "203.0.113.9"))
+	status, _ = do(t, "DELETE", srv.URL+"/rules/temporary?list=deny&entry=203.0.113.0/24", "")
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestBanEndpoints(t *testing.T) {
+	api, srv := newTestAPI(t)
+
+	status, body := do(t, "POST", srv.URL+"/bans", `{"ip":"203.0.113.9","duration":"10m"}`)
+	assert.Equal(t, http.StatusCreated, status, body)
+	assert.Contains(t, body, `"key": "203.0.113.0/24"`)
+	assert.True(t, api.Bans.Banned("203.0.113.200"))
+
+	status, body = do(t, "GET", srv.URL+"/bans", "")
+	assert.Equal(t, http.StatusOK, status)
+	var bans []ban.Ban
+	assert.NoError(t, json.Unmarshal([]byte(body), &bans))
+	if assert.Len(t, bans, 1) {
+		assert.Equal(t, "banned via admin API", bans[0].Reason)
+	}
+
+	for _, bad := range []string{
+		`{"ip":"bogus"}`,
+		`{"ip":"1.2.3.4","duration":"-1m"}`,
+		`not json`,
+	} {
+		status, _ = do(t, "POST", srv.URL+"/bans", bad)
+		assert.Equal(t, http.StatusBadRequest, status, bad)
+	}
+
+	status, _ = do(t, "DELETE", srv.URL+"/bans?ip=203.0.113.0/24", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.False(t, api.Bans.Banned("203.0.113.9"))
+	status, _ = do(t, "DELETE", srv.URL+"/bans?ip=203.0.113.9", "")
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestConnectionEndpoints(t *testing.T) {
+	_, srv := newTestAPI(t)
+
+	status, body := do(t, "GET", srv.URL+"/connections", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "[]\n", body)
+
+	status, _ = do(t, "DELETE", srv.URL+"/connections/42", "")
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = do(t, "DELETE", srv.URL+"/connections/abc", "")
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestListenRejectsNonLoopback(t *testing.T) {
+	_, err := Listen("0.0.0.0:0")
+	assert.Error(t, err)
+	_, err = Listen("192.0.2.1:0")
+	assert.Error(t, err)
+
+	l, err := Listen("127.0.0.1:0")
+	assert.NoError(t, err)
+	_ = l.Close()
+}
+
+func TestServeUnixSocket(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	api, _ := newTestAPI(t)
+	sock := filepath.Join(t.TempDir(), "admin.sock")
+
+	_, err := api.Serve(ctx, "unix:"+sock)
+	if err != nil {
+		t.Fatalf("Serve: %v", err)
+	}
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		},
+	}}
+	resp, err := client.Get("http://admin/servers")
+	if err != nil {
+		t.Fatalf("GET /servers: %v", err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
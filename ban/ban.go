@@ -0,0 +1,493 @@
+// Package ban keeps a list of temporarily banned client IPs (or prefixes) and
+// bans clients automatically when they are rejected or connect too often,
+// fail2ban-style.
+package ban
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"geoproxy/common"
+	"log"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Policy controls when and for how long clients are banned.
+type Policy struct {
+	// Duration is how long a ban lasts.
+	Duration time.Duration
+	// MaxRejections bans a client rejected this many times within
+	// RejectionWindow. 0 disables.
+	MaxRejections   int
+	RejectionWindow time.Duration
+	// MaxConnections bans a client that opens this many connections within
+	// ConnectionWindow. 0 disables.
+	MaxConnections   int
+	ConnectionWindow time.Duration
+	// IPv4Prefix and IPv6Prefix widen bans and counters from single addresses
+	// to prefixes (e.g. 24 and 64). 0 means a single address.
+	IPv4Prefix int
+	IPv6Prefix int
+}
+
+// Ban is one active ban.
+type Ban struct {
+	Key       string    `json:"key"`
+	Reason    string    `json:"reason"`
+	BannedAt  time.Time `json:"bannedAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type counter struct {
+	conns   []time.Time
+	rejects []time.Time
+	last    time.Time
+}
+
+// List is safe for concurrent use by every server.
+type List struct {
+	// File, when set, is rewritten by RunSaves whenever a ban is added or
+	// removed.
+	File string
+
+	// saves has a pending request for RunSaves to rewrite File.
+	saves chan struct{}
+
+	mu     sync.Mutex
+	policy Policy
+	bans   map[string]Ban
+	// widths counts the bans by family and prefix length, so that Banned
+	// can find bans made under an earlier IPv4Prefix or IPv6Prefix.
+	widths    map[width]int
+	counters  map[string]*counter
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func New(p Policy) *List {
+	return &List{
+		policy:   p,
+		bans:     make(map[string]Ban),
+		widths:   make(map[width]int),
+		counters: make(map[string]*counter),
+		saves:    make(chan struct{}, 1),
+		now:      time.Now,
+	}
+}
+
+// SetPolicy replaces the policy, e.g. after a configuration reload. Bans
+// made under the old prefixes stay in force until they expire. Counters move
+// to the new prefixes, except those of a prefix that got narrower, which
+// can't be split up and start over.
+func (l *List) SetPolicy(p Policy) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	old := l.policy
+	l.policy = p
+	if old.IPv4Prefix == p.IPv4Prefix && old.IPv6Prefix == p.IPv6Prefix {
+		return
+	}
+	counters := make(map[string]*counter, len(l.counters))
+	for k, c := range l.counters {
+		prefix, ok := parseKey(k)
+		if !ok {
+			counters[k] = c
+			continue
+		}
+		if prefix.Bits() < l.bits(prefix.Addr()) {
+			continue
+		}
+		key := keyOf(prefix.Addr(), l.bits(prefix.Addr()))
+		if prev, ok := counters[key]; ok {
+			c = mergeCounters(prev, c)
+		}
+		counters[key] = c
+	}
+	l.counters = counters
+}
+
+// bits returns the prefix length addr is counted and banned under, or the
+// full address length for single addresses.
+func (l *List) bits(addr netip.Addr) int {
+	bits := l.policy.IPv6Prefix
+	if addr.Is4() {
+		bits = l.policy.IPv4Prefix
+	}
+	if bits <= 0 || bits > addr.BitLen() {
+		return addr.BitLen()
+	}
+	return bits
+}
+
+// key returns the address or prefix ip is counted and banned under.
+func (l *List) key(ip string) string {
+	addr, ok := parseAddr(ip)
+	if !ok {
+		return ip
+	}
+	return keyOf(addr, l.bits(addr))
+}
+
+// banKeysLocked returns the keys of the bans that could cover ip: its key
+// under the current policy, then its prefix at every other length a ban has.
+func (l *List) banKeysLocked(ip string) []string {
+	keys := []string{l.key(ip)}
+	addr, ok := parseAddr(ip)
+	if !ok {
+		return keys
+	}
+	for w := range l.widths {
+		if w.is4 != addr.Is4() || w.bits == l.bits(addr) {
+			continue
+		}
+		keys = append(keys, keyOf(addr, w.bits))
+	}
+	return keys
+}
+
+// Banned reports whether ip is currently banned.
+func (l *List) Banned(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	banned := false
+	for _, key := range l.banKeysLocked(ip) {
+		b, ok := l.bans[key]
+		if !ok {
+			continue
+		}
+		if now.Before(b.ExpiresAt) {
+			banned = true
+			continue
+		}
+		l.deleteBanLocked(key)
+		log.Printf("ban on %s expired", key)
+		l.saveLocked()
+	}
+	return banned
+}
+
+// RecordConnection counts a new connection from ip and bans it if that
+// crosses MaxConnections. It reports whether ip got banned.
+func (l *List) RecordConnection(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	p := l.policy
+	if p.MaxConnections <= 0 {
+		return false
+	}
+	now := l.now()
+	key := l.key(ip)
+	c := l.counterLocked(key, now)
+	c.conns = append(prune(c.conns, now.Add(-p.ConnectionWindow)), now)
+	if len(c.conns) < p.MaxConnections {
+		return false
+	}
+	l.banLocked(key, fmt.Sprintf("%d connections within %s", len(c.conns), p.ConnectionWindow), now, p.Duration)
+	return true
+}
+
+// RecordRejection counts a rejected connection from ip and bans it if that
+// crosses MaxRejections. It reports whether ip got banned.
+func (l *List) RecordRejection(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	p := l.policy
+	if p.MaxRejections <= 0 {
+		return false
+	}
+	now := l.now()
+	key := l.key(ip)
+	c := l.counterLocked(key, now)
+	c.rejects = append(prune(c.rejects, now.Add(-p.RejectionWindow)), now)
+	if len(c.rejects) < p.MaxRejections {
+		return false
+	}
+	l.banLocked(key, fmt.Sprintf("%d rejected connections within %s", len(c.rejects), p.RejectionWindow), now, p.Duration)
+	return true
+}
+
+// Ban bans ip (or its prefix) for d, or for the policy duration if d is 0.
+func (l *List) Ban(ip string, d time.Duration, reason string) Ban {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if d <= 0 {
+		d = l.policy.Duration
+	}
+	return l.banLocked(l.key(ip), reason, l.now(), d)
+}
+
+// Unban lifts the bans covering ip and reports whether there were any.
+func (l *List) Unban(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// Accept the ban key itself, e.g. "203.0.113.0/24".
+	keys := append(l.banKeysLocked(ip), ip)
+	unbanned := false
+	for _, key := range keys {
+		if _, ok := l.bans[key]; !ok {
+			continue
+		}
+		l.deleteBanLocked(key)
+		log.Printf("unbanned %s", key)
+		unbanned = true
+	}
+	if unbanned {
+		l.saveLocked()
+	}
+	return unbanned
+}
+
+// List returns the active bans, soonest expiry first.
+func (l *List) List() []Ban {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	out := make([]Ban, 0, len(l.bans))
+	for _, b := range l.bans {
+		if now.Before(b.ExpiresAt) {
+			out = append(out, b)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].ExpiresAt.Equal(out[j].ExpiresAt) {
+			return out[i].ExpiresAt.Before(out[j].ExpiresAt)
+		}
+		return out[i].Key < out[j].Key
+	})
+	return out
+}
+
+func (l *List) banLocked(key, reason string, now time.Time, d time.Duration) Ban {
+	b := Ban{Key: key, Reason: reason, BannedAt: now, ExpiresAt: now.Add(d)}
+	l.putBanLocked(b)
+	delete(l.counters, key)
+	log.Printf("banned %s until %s: %s", key, b.ExpiresAt.Format(time.RFC3339), reason)
+	l.saveLocked()
+	return b
+}
+
+// putBanLocked adds or replaces b, keeping widths up to date.
+func (l *List) putBanLocked(b Ban) {
+	if _, ok := l.bans[b.Key]; !ok {
+		if w, ok := widthOf(b.Key); ok {
+			l.widths[w]++
+		}
+	}
+	l.bans[b.Key] = b
+}
+
+// deleteBanLocked removes the ban on key, keeping widths up to date.
+func (l *List) deleteBanLocked(key string) {
+	if _, ok := l.bans[key]; !ok {
+		return
+	}
+	delete(l.bans, key)
+	if w, ok := widthOf(key); ok {
+		if l.widths[w]--; l.widths[w] <= 0 {
+			delete(l.widths, w)
+		}
+	}
+}
+
+// counterLocked returns the counter for key, dropping idle counters now and
+// then so one-off clients don't accumulate.
+func (l *List) counterLocked(key string, now time.Time) *counter {
+	window := max(l.policy.ConnectionWindow, l.policy.RejectionWindow)
+	if now.Sub(l.lastSweep) > window {
+		for k, c := range l.counters {
+			if now.Sub(c.last) > window {
+				delete(l.counters, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	c, ok := l.counters[key]
+	if !ok {
+		c = &counter{}
+		l.counters[key] = c
+	}
+	c.last = now
+	return c
+}
+
+// mergeCounters combines two counters that end up under the same key.
+func mergeCounters(a, b *counter) *counter {
+	return &counter{
+		conns:   mergeTimes(a.conns, b.conns),
+		rejects: mergeTimes(a.rejects, b.rejects),
+		last:    maxTime(a.last, b.last),
+	}
+}
+
+// mergeTimes merges two ascending timestamp lists into one.
+func mergeTimes(a, b []time.Time) []time.Time {
+	out := make([]time.Time, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		if b[0].Before(a[0]) {
+			out, b = append(out, b[0]), b[1:]
+		} else {
+			out, a = append(out, a[0]), a[1:]
+		}
+	}
+	out = append(out, a...)
+	return append(out, b...)
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
+
+// width is the family and prefix length of a ban key; a single address has
+// its full length.
+type width struct {
+	is4  bool
+	bits int
+}
+
+func widthOf(key string) (width, bool) {
+	prefix, ok := parseKey(key)
+	if !ok {
+		return width{}, false
+	}
+	return width{is4: prefix.Addr().Is4(), bits: prefix.Bits()}, true
+}
+
+// parseKey parses a ban or counter key, an address or a prefix, as a prefix.
+func parseKey(key string) (netip.Prefix, bool) {
+	if strings.Contains(key, "/") {
+		prefix, err := netip.ParsePrefix(key)
+		return prefix.Masked(), err == nil
+	}
+	addr, err := netip.ParseAddr(key)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), true
+}
+
+func parseAddr(ip string) (netip.Addr, bool) {
+	addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap().WithZone(""), true
+}
+
+// keyOf returns addr's key at prefix length bits: the address itself at its
+// full length, otherwise the prefix.
+func keyOf(addr netip.Addr, bits int) string {
+	if bits >= addr.BitLen() {
+		return addr.String()
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return addr.String()
+	}
+	return prefix.String()
+}
+
+// prune drops timestamps before cutoff; ts is in ascending order.
+func prune(ts []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(ts) && ts[i].Before(cutoff) {
+		i++
+	}
+	return ts[i:]
+}
+
+type banFile struct {
+	Bans []Ban `json:"bans"`
+}
+
+// saveLocked asks RunSaves to rewrite File. It doesn't block, so connections
+// never wait for the disk; requests made while a save is pending are merged.
+func (l *List) saveLocked() {
+	if l.File == "" {
+		return
+	}
+	select {
+	case l.saves <- struct{}{}:
+	default:
+	}
+}
+
+// RunSaves rewrites File after bans change until ctx is done, then saves any
+// change still pending.
+func (l *List) RunSaves(ctx context.Context) {
+	for {
+		select {
+		case <-l.saves:
+			l.save()
+		case <-ctx.Done():
+			select {
+			case <-l.saves:
+				l.save()
+			default:
+			}
+			return
+		}
+	}
+}
+
+// save writes the unexpired bans to File. Only the snapshot is taken under
+// l.mu; the write happens outside it.
+func (l *List) save() {
+	l.mu.Lock()
+	now := l.now()
+	snap := banFile{Bans: make([]Ban, 0, len(l.bans))}
+	for _, b := range l.bans {
+		if now.Before(b.ExpiresAt) {
+			snap.Bans = append(snap.Bans, b)
+		}
+	}
+	l.mu.Unlock()
+
+	data, err := json.Marshal(snap)
+	if err == nil {
+		err = common.WriteFileAtomic(l.File, data)
+	}
+	if err != nil {
+		log.Printf("failed to save ban list: %v", err)
+	}
+}
+
+// Load adds the unexpired bans saved in File and returns how many were
+// loaded. A missing file is not an error.
+func (l *List) Load() (int, error) {
+	if l.File == "" {
+		return 0, nil
+	}
+	data, err := os.ReadFile(l.File)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to read ban list: %v", err)
+	}
+	var snap banFile
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return 0, fmt.Errorf("failed to decode ban list: %v", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	loaded := 0
+	for _, b := range snap.Bans {
+		if b.Key == "" || !now.Before(b.ExpiresAt) {
+			continue
+		}
+		l.putBanLocked(b)
+		loaded++
+	}
+	return loaded, nil
+}
@@ -0,0 +1,150 @@
+package ban
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestList(p Policy) (*List, *fakeClock) {
+	clock := &fakeClock{t: time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)}
+	l := New(p)
+	l.now = clock.now
+	return l, clock
+}
+
+func TestRecordRejectionBansAfterThreshold(t *testing.T) {
+	l, clock := newTestList(Policy{Duration: time.Hour, MaxRejections: 3, RejectionWindow: time.Minute})
+
+	assert.False(t, l.RecordRejection("1.2.3.4"))
+	assert.False(t, l.RecordRejection("1.2.3.4"))
+	assert.False(t, l.Banned("1.2.3.4"))
+	assert.True(t, l.RecordRejection("1.2.3.4"))
+	assert.True(t, l.Banned("1.2.3.4"))
+	assert.False(t, l.Banned("1.2.3.5"))
+
+	clock.advance(time.Hour)
+	assert.False(t, l.Banned("1.2.3.4"))
+	assert.Empty(t, l.List())
+}
+
+func TestRecordRejectionWindowSlides(t *testing.T) {
+	l, clock := newTestList(Policy{Duration: time.Hour, MaxRejections: 2, RejectionWindow: time.Minute})
+
+	assert.False(t, l.RecordRejection("1.2.3.4"))
+	clock.advance(2 * time.Minute)
+	assert.False(t, l.RecordRejection("1.2.3.4"))
+	clock.advance(30 * time.Second)
+	assert.True(t, l.RecordRejection("1.2.3.4"))
+}
+
+func TestRecordConnectionBansAfterThreshold(t *testing.T) {
+	l, _ := newTestList(Policy{Duration: time.Minute, MaxConnections: 2, ConnectionWindow: time.Second})
+
+	assert.False(t, l.RecordConnection("2001:db8::1"))
+	assert.True(t, l.RecordConnection("2001:db8::1"))
+	assert.True(t, l.Banned("2001:db8::1"))
+
+	// Disabled triggers never ban.
+	l.SetPolicy(Policy{Duration: time.Minute})
+	for i := 0; i < 10; i++ {
+		assert.False(t, l.RecordConnection("2001:db8::2"))
+		assert.False(t, l.RecordRejection("2001:db8::2"))
+	}
+}
+
+func TestPrefixBans(t *testing.T) {
+	l, _ := newTestList(Policy{Duration: time.Hour, MaxRejections: 2, RejectionWindow: time.Minute, IPv4Prefix: 24, IPv6Prefix: 64})
+
+	assert.False(t, l.RecordRejection("203.0.113.1"))
+	assert.True(t, l.RecordRejection("::ffff:203.0.113.2"))
+	assert.True(t, l.Banned("203.0.113.250"))
+	assert.False(t, l.Banned("203.0.114.1"))
+
+	b := l.Ban("2001:db8:1:2::5", 0, "manual")
+	assert.Equal(t, "2001:db8:1:2::/64", b.Key)
+	assert.True(t, l.Banned("2001:db8:1:2:ffff::1"))
+
+	assert.True(t, l.Unban("203.0.113.0/24"))
+	assert.True(t, l.Unban("2001:db8:1:2::9"))
+	assert.False(t, l.Unban("198.51.100.1"))
+	assert.Empty(t, l.List())
+}
+
+func TestSetPolicyPrefixChange(t *testing.T) {
+	l, clock := newTestList(Policy{Duration: time.Hour, MaxRejections: 3, RejectionWindow: time.Minute})
+
+	l.Ban("203.0.113.5", 0, "manual")
+	assert.False(t, l.RecordRejection("198.51.100.1"))
+	assert.False(t, l.RecordRejection("198.51.100.2"))
+
+	// Widening keeps the address ban and pools the counters of the /24.
+	l.SetPolicy(Policy{Duration: time.Hour, MaxRejections: 3, RejectionWindow: time.Minute, IPv4Prefix: 24})
+	assert.True(t, l.Banned("203.0.113.5"))
+	assert.False(t, l.Banned("203.0.113.6"))
+	assert.True(t, l.RecordRejection("198.51.100.3"))
+	assert.True(t, l.Banned("198.51.100.200"))
+
+	// Narrowing keeps the prefix ban covering the whole /24.
+	l.SetPolicy(Policy{Duration: time.Hour, MaxRejections: 3, RejectionWindow: time.Minute})
+	assert.True(t, l.Banned("198.51.100.9"))
+	assert.True(t, l.Banned("203.0.113.5"))
+	assert.Len(t, l.List(), 2)
+
+	assert.True(t, l.Unban("198.51.100.9"))
+	assert.False(t, l.Banned("198.51.100.200"))
+
+	clock.advance(time.Hour)
+	assert.False(t, l.Banned("203.0.113.5"))
+	assert.Empty(t, l.bans)
+	assert.Empty(t, l.widths)
+}
+
+func TestPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+	l, clock := newTestList(Policy{Duration: time.Hour})
+	l.File = path
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		l.RunSaves(ctx)
+		close(done)
+	}()
+	l.Ban("1.2.3.4", 0, "manual")
+	l.Ban("5.6.7.8", time.Minute, "short")
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}, time.Second, time.Millisecond)
+	// Stopping saves whatever is still pending.
+	cancel()
+	<-done
+
+	restored, restoredClock := newTestList(Policy{Duration: time.Hour})
+	restored.File = path
+	restoredClock.t = clock.t.Add(2 * time.Minute)
+	n, err := restored.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.True(t, restored.Banned("1.2.3.4"))
+	assert.False(t, restored.Banned("5.6.7.8"))
+
+	missing, _ := newTestList(Policy{})
+	missing.File = filepath.Join(t.TempDir(), "missing.json")
+	n, err = missing.Load()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	assert.NoError(t, os.WriteFile(path, []byte("not json"), 0o600))
+	_, err = restored.Load()
+	assert.Error(t, err)
+}
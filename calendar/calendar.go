@@ -0,0 +1,241 @@
+// Package calendar holds dated events, such as public holidays and
+// maintenance windows, and reads them from iCalendar (.ics) files.
+package calendar
+
+import (
+	"sort"
+	"time"
+)
+
+// Event is a period, optionally repeated by Recurrence. End is exclusive.
+//
+// A floating event is wall-clock time in whatever zone it is checked in, like
+// all-day events and local times in iCalendar; its Start and End hold the
+// wall-clock fields in UTC. Other events are fixed instants, and their
+// recurrences are computed in Start's location.
+type Event struct {
+	Name       string
+	Start      time.Time
+	End        time.Time
+	Floating   bool
+	Recurrence *Recurrence
+}
+
+// Frequency is the unit a recurrence repeats in.
+type Frequency int
+
+const (
+	Daily Frequency = iota + 1
+	Weekly
+	Monthly
+	Yearly
+)
+
+// Recurrence repeats an event every Interval units of Freq, starting with the
+// event itself. A monthly or yearly occurrence that falls on a day the month
+// doesn't have, e.g. the 31st or February 29th, is skipped.
+type Recurrence struct {
+	Freq Frequency
+	// Interval is the step between occurrences; 0 means 1.
+	Interval int
+	// Count limits the number of occurrences; 0 means no limit.
+	Count int
+	// Until is the latest start of an occurrence; zero means no limit. It
+	// is floating when the event is.
+	Until time.Time
+	// ByDay lists the days of a weekly recurrence, in weeks starting on
+	// Monday. Empty means the day of Start.
+	ByDay []time.Weekday
+	// Except holds the starts of occurrences that are left out.
+	Except []time.Time
+}
+
+// Active reports whether now falls within an occurrence of the event. For a
+// floating event, now must already be in the zone the event is read in.
+func (e *Event) Active(now time.Time) bool {
+	if e.Floating {
+		now = floating(now)
+	}
+	if now.Before(e.Start) {
+		return false
+	}
+	if e.Recurrence == nil {
+		return now.Before(e.End)
+	}
+	return e.Recurrence.covers(e.Start, e.End.Sub(e.Start), now)
+}
+
+// Next returns the first start or end of an occurrence after now, or the zero
+// time if there is none, so callers can find when Active changes without
+// checking every minute. It may also return starts that Count, Until or
+// Except leave out, but never misses a change. As for Active, now must be in
+// the zone a floating event is read in; the result is in now's location.
+func (e *Event) Next(now time.Time) time.Time {
+	if !e.Floating {
+		return e.next(now)
+	}
+	next := e.next(floating(now))
+	if next.IsZero() {
+		return next
+	}
+	return time.Date(next.Year(), next.Month(), next.Day(), next.Hour(), next.Minute(), next.Second(), next.Nanosecond(), now.Location())
+}
+
+func (e *Event) next(now time.Time) time.Time {
+	var best time.Time
+	consider := func(t time.Time) {
+		if t.After(now) && (best.IsZero() || t.Before(best)) {
+			best = t
+		}
+	}
+	if e.Recurrence == nil {
+		consider(e.Start)
+		consider(e.End)
+		return best
+	}
+	r := e.Recurrence
+	length := e.End.Sub(e.Start)
+	now = now.In(e.Start.Location())
+	interval := max(r.Interval, 1)
+	firsts, _ := r.firsts(e.Start)
+	for _, first := range firsts {
+		// From the earliest occurrence that may still be running to a few
+		// past now, enough to get over skipped days such as February 29th.
+		from := max(r.latest(first, now.Add(-length), interval)-1, 0)
+		to := max(r.latest(first, now, interval), 0) + 9
+		for k := from; k <= to; k++ {
+			if occ, ok := r.occurrence(first, k, interval); ok {
+				consider(occ)
+				consider(occ.Add(length))
+			}
+		}
+	}
+	return best
+}
+
+// floating returns t's wall-clock fields in UTC.
+func floating(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+// covers reports whether an occurrence of length starting at or after start
+// contains now. It walks back from the latest occurrence that starts by now
+// until one ends before now, so it costs a handful of steps however long
+// the recurrence has been running.
+func (r *Recurrence) covers(start time.Time, length time.Duration, now time.Time) bool {
+	if length <= 0 {
+		return false
+	}
+	now = now.In(start.Location())
+	interval := max(r.Interval, 1)
+	firsts, skipped := r.firsts(start)
+	for pos, first := range firsts {
+		for k := r.latest(first, now, interval); k >= 0; k-- {
+			occ, ok := r.occurrence(first, k, interval)
+			if !ok || occ.After(now) {
+				continue
+			}
+			if !occ.Add(length).After(now) {
+				break
+			}
+			if occ.Before(start) {
+				continue
+			}
+			if r.Count > 0 && k*len(firsts)+pos-skipped >= r.Count {
+				continue
+			}
+			if !r.Until.IsZero() && occ.After(r.Until) {
+				continue
+			}
+			if r.excluded(occ) {
+				continue
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// firsts returns the first occurrence of each sub-series: start itself, or
+// for a weekly recurrence by day, each listed day of start's week. skipped is
+// how many of those fall before start and so don't occur.
+func (r *Recurrence) firsts(start time.Time) (firsts []time.Time, skipped int) {
+	if r.Freq != Weekly || len(r.ByDay) == 0 {
+		return []time.Time{start}, 0
+	}
+	offsets := make([]int, 0, len(r.ByDay))
+	seen := map[int]bool{}
+	for _, d := range r.ByDay {
+		if o := mondayOffset(d); !seen[o] {
+			seen[o] = true
+			offsets = append(offsets, o)
+		}
+	}
+	sort.Ints(offsets)
+	monday := start.AddDate(0, 0, -mondayOffset(start.Weekday()))
+	for _, o := range offsets {
+		first := monday.AddDate(0, 0, o)
+		if first.Before(start) {
+			skipped++
+		}
+		firsts = append(firsts, first)
+	}
+	return firsts, skipped
+}
+
+func mondayOffset(d time.Weekday) int {
+	return (int(d) + 6) % 7
+}
+
+// latest estimates the index of the last occurrence starting by now from
+// the calendar distance between first and now. It may be one too high; the
+// caller skips occurrences that start after now.
+func (r *Recurrence) latest(first, now time.Time, interval int) int {
+	if now.Before(first) {
+		return -1
+	}
+	switch r.Freq {
+	case Daily:
+		return daysBetween(first, now) / interval
+	case Weekly:
+		return daysBetween(first, now) / (7 * interval)
+	case Monthly:
+		return ((now.Year()-first.Year())*12 + int(now.Month()-first.Month())) / interval
+	case Yearly:
+		return (now.Year() - first.Year()) / interval
+	}
+	return -1
+}
+
+func daysBetween(a, b time.Time) int {
+	da := time.Date(a.Year(), a.Month(), a.Day(), 0, 0, 0, 0, time.UTC)
+	db := time.Date(b.Year(), b.Month(), b.Day(), 0, 0, 0, 0, time.UTC)
+	return int(db.Sub(da).Hours() / 24)
+}
+
+// occurrence returns the k-th occurrence of the sub-series starting at first.
+// ok is false when that day doesn't exist in its month.
+func (r *Recurrence) occurrence(first time.Time, k, interval int) (time.Time, bool) {
+	switch r.Freq {
+	case Daily:
+		return first.AddDate(0, 0, k*interval), true
+	case Weekly:
+		return first.AddDate(0, 0, 7*k*interval), true
+	case Monthly:
+		t := first.AddDate(0, k*interval, 0)
+		return t, t.Day() == first.Day()
+	case Yearly:
+		t := first.AddDate(k*interval, 0, 0)
+		return t, t.Day() == first.Day()
+	}
+	return time.Time{}, false
+}
+
+func (r *Recurrence) excluded(occ time.Time) bool {
+	for _, x := range r.Except {
+		if x.Equal(occ) {
+			return true
+		}
+	}
+	return false
+}
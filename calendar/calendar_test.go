@@ -0,0 +1,183 @@
+package calendar
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func date(y int, m time.Month, d, h, min int) time.Time {
+	return time.Date(y, m, d, h, min, 0, 0, time.UTC)
+}
+
+func TestEventActive(t *testing.T) {
+	maintenance := Event{Start: date(2024, 6, 3, 2, 0), End: date(2024, 6, 3, 6, 0), Floating: true}
+	assert.False(t, maintenance.Active(date(2024, 6, 3, 1, 59)))
+	assert.True(t, maintenance.Active(date(2024, 6, 3, 2, 0)))
+	assert.False(t, maintenance.Active(date(2024, 6, 3, 6, 0)))
+
+	// A floating event is wall-clock time in the zone of now.
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	assert.NoError(t, err)
+	assert.True(t, maintenance.Active(time.Date(2024, 6, 3, 3, 0, 0, 0, berlin)))
+	assert.False(t, maintenance.Active(time.Date(2024, 6, 3, 3, 0, 0, 0, berlin).UTC()))
+
+	// A fixed event is the same instant everywhere.
+	fixed := Event{Start: date(2024, 6, 3, 0, 0), End: date(2024, 6, 3, 4, 0)}
+	assert.True(t, fixed.Active(time.Date(2024, 6, 3, 5, 0, 0, 0, berlin)))
+	assert.False(t, fixed.Active(time.Date(2024, 6, 3, 1, 0, 0, 0, berlin)))
+}
+
+func TestRecurrence(t *testing.T) {
+	tests := []struct {
+		name  string
+		event Event
+		now   time.Time
+		want  bool
+	}{
+		{
+			name:  "yearly holiday",
+			event: Event{Start: date(2000, 12, 25, 0, 0), End: date(2000, 12, 26, 0, 0), Floating: true, Recurrence: &Recurrence{Freq: Yearly}},
+			now:   date(2024, 12, 25, 15, 0),
+			want:  true,
+		},
+		{
+			name:  "yearly holiday, next day",
+			event: Event{Start: date(2000, 12, 25, 0, 0), End: date(2000, 12, 26, 0, 0), Floating: true, Recurrence: &Recurrence{Freq: Yearly}},
+			now:   date(2024, 12, 26, 0, 0),
+			want:  false,
+		},
+		{
+			name:  "yearly leap day skips common years",
+			event: Event{Start: date(2024, 2, 29, 0, 0), End: date(2024, 3, 1, 0, 0), Recurrence: &Recurrence{Freq: Yearly}},
+			now:   date(2025, 3, 1, 12, 0),
+			want:  false,
+		},
+		{
+			name:  "monthly on the 31st skips short months",
+			event: Event{Start: date(2024, 1, 31, 0, 0), End: date(2024, 2, 1, 0, 0), Recurrence: &Recurrence{Freq: Monthly}},
+			now:   date(2024, 3, 2, 12, 0),
+			want:  false,
+		},
+		{
+			name:  "monthly on the 31st",
+			event: Event{Start: date(2024, 1, 31, 0, 0), End: date(2024, 2, 1, 0, 0), Recurrence: &Recurrence{Freq: Monthly}},
+			now:   date(2024, 3, 31, 12, 0),
+			want:  true,
+		},
+		{
+			name:  "daily overnight window",
+			event: Event{Start: date(2024, 1, 1, 22, 0), End: date(2024, 1, 2, 2, 0), Recurrence: &Recurrence{Freq: Daily}},
+			now:   date(2024, 8, 9, 1, 0),
+			want:  true,
+		},
+		{
+			name:  "every other week",
+			event: Event{Start: date(2024, 1, 1, 0, 0), End: date(2024, 1, 2, 0, 0), Recurrence: &Recurrence{Freq: Weekly, Interval: 2}},
+			now:   date(2024, 1, 8, 12, 0),
+			want:  false,
+		},
+		{
+			name:  "every other week, second occurrence",
+			event: Event{Start: date(2024, 1, 1, 0, 0), End: date(2024, 1, 2, 0, 0), Recurrence: &Recurrence{Freq: Weekly, Interval: 2}},
+			now:   date(2024, 1, 15, 12, 0),
+			want:  true,
+		},
+		{
+			name: "weekly by day",
+			event: Event{Start: date(2024, 1, 3, 9, 0), End: date(2024, 1, 3, 10, 0),
+				Recurrence: &Recurrence{Freq: Weekly, ByDay: []time.Weekday{time.Monday, time.Wednesday}}},
+			now:  date(2024, 1, 8, 9, 30),
+			want: true,
+		},
+		{
+			name: "weekly by day before the start",
+			event: Event{Start: date(2024, 1, 3, 9, 0), End: date(2024, 1, 3, 10, 0),
+				Recurrence: &Recurrence{Freq: Weekly, ByDay: []time.Weekday{time.Monday, time.Wednesday}}},
+			now:  date(2024, 1, 1, 9, 30),
+			want: false,
+		},
+		{
+			// Wed 3rd, Mon 8th and Wed 10th; Mon 15th is the fourth.
+			name: "weekly by day with count",
+			event: Event{Start: date(2024, 1, 3, 9, 0), End: date(2024, 1, 3, 10, 0),
+				Recurrence: &Recurrence{Freq: Weekly, ByDay: []time.Weekday{time.Monday, time.Wednesday}, Count: 3}},
+			now:  date(2024, 1, 15, 9, 30),
+			want: false,
+		},
+		{
+			name: "weekly by day with count, last occurrence",
+			event: Event{Start: date(2024, 1, 3, 9, 0), End: date(2024, 1, 3, 10, 0),
+				Recurrence: &Recurrence{Freq: Weekly, ByDay: []time.Weekday{time.Monday, time.Wednesday}, Count: 3}},
+			now:  date(2024, 1, 10, 9, 30),
+			want: true,
+		},
+		{
+			name:  "until",
+			event: Event{Start: date(2024, 1, 1, 0, 0), End: date(2024, 1, 2, 0, 0), Recurrence: &Recurrence{Freq: Daily, Until: date(2024, 1, 5, 0, 0)}},
+			now:   date(2024, 1, 6, 12, 0),
+			want:  false,
+		},
+		{
+			name: "excluded occurrence",
+			event: Event{Start: date(2024, 1, 1, 0, 0), End: date(2024, 1, 2, 0, 0),
+				Recurrence: &Recurrence{Freq: Daily, Except: []time.Time{date(2024, 1, 3, 0, 0)}}},
+			now:  date(2024, 1, 3, 12, 0),
+			want: false,
+		},
+	}
+	for _, tc := range tests {
+		assert.Equal(t, tc.want, tc.event.Active(tc.now), tc.name)
+	}
+}
+
+func TestRecurrenceAcrossDST(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	assert.NoError(t, err)
+	// A fixed 09:00-10:00 Berlin meeting stays at 09:00 local after the
+	// change to summer time.
+	e := Event{
+		Start:      time.Date(2024, 3, 1, 9, 0, 0, 0, berlin),
+		End:        time.Date(2024, 3, 1, 10, 0, 0, 0, berlin),
+		Recurrence: &Recurrence{Freq: Daily},
+	}
+	assert.True(t, e.Active(date(2024, 3, 1, 8, 30)))
+	assert.True(t, e.Active(date(2024, 4, 1, 7, 30)))
+	assert.False(t, e.Active(date(2024, 4, 1, 8, 30)))
+}
+
+func TestEventNext(t *testing.T) {
+	maintenance := Event{Start: date(2024, 6, 3, 2, 0), End: date(2024, 6, 3, 6, 0), Floating: true}
+	assert.Equal(t, date(2024, 6, 3, 2, 0), maintenance.Next(date(2024, 6, 1, 0, 0)))
+	assert.Equal(t, date(2024, 6, 3, 6, 0), maintenance.Next(date(2024, 6, 3, 2, 0)))
+	assert.True(t, maintenance.Next(date(2024, 6, 3, 6, 0)).IsZero())
+
+	// A floating event changes at wall-clock time in the zone of now.
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	assert.NoError(t, err)
+	assert.True(t, time.Date(2024, 6, 3, 2, 0, 0, 0, berlin).Equal(maintenance.Next(time.Date(2024, 6, 3, 1, 0, 0, 0, berlin))))
+
+	daily := Event{Start: date(2024, 1, 1, 22, 0), End: date(2024, 1, 2, 2, 0), Recurrence: &Recurrence{Freq: Daily}}
+	assert.Equal(t, date(2024, 8, 9, 2, 0), daily.Next(date(2024, 8, 9, 1, 0)))
+	assert.Equal(t, date(2024, 8, 9, 22, 0), daily.Next(date(2024, 8, 9, 2, 0)))
+
+	leapDay := Event{Start: date(2024, 2, 29, 0, 0), End: date(2024, 3, 1, 0, 0), Recurrence: &Recurrence{Freq: Yearly}}
+	assert.Equal(t, date(2028, 2, 29, 0, 0), leapDay.Next(date(2024, 3, 1, 0, 0)))
+
+	byDay := Event{Start: date(2024, 1, 3, 9, 0), End: date(2024, 1, 3, 10, 0),
+		Recurrence: &Recurrence{Freq: Weekly, ByDay: []time.Weekday{time.Monday, time.Wednesday}}}
+	assert.Equal(t, date(2024, 1, 8, 9, 0), byDay.Next(date(2024, 1, 3, 10, 0)))
+
+	// Every change Next reports matches Active, over a month of a weekly
+	// event that runs for longer than its interval.
+	long := Event{Start: date(2024, 1, 1, 12, 0), End: date(2024, 1, 9, 0, 0), Recurrence: &Recurrence{Freq: Weekly}}
+	now := date(2024, 1, 1, 0, 0)
+	for now.Before(date(2024, 2, 1, 0, 0)) {
+		next := long.Next(now)
+		for m := now.Add(time.Minute); m.Before(next); m = m.Add(time.Hour) {
+			assert.Equal(t, long.Active(now), long.Active(m), m)
+		}
+		now = next
+	}
+}
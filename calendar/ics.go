@@ -0,0 +1,423 @@
+package calendar
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxFileBytes caps the size of one .ics file.
+const MaxFileBytes = 16 << 20
+
+// untitled names events without a SUMMARY.
+const untitled = "untitled event"
+
+// Load reads the events of the iCalendar file at path.
+func Load(path string) ([]Event, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open calendar %s: %v", path, err)
+	}
+	defer f.Close()
+	events, err := Parse(io.LimitReader(f, MaxFileBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("calendar %s: %v", path, err)
+	}
+	return events, nil
+}
+
+// Parse reads the VEVENTs of an iCalendar (RFC 5545) stream. Times with a
+// TZID or a trailing Z are fixed instants; dates and local times are
+// floating. Cancelled events are skipped.
+//
+// RRULE is limited to what can be computed without a full recurrence
+// engine: FREQ DAILY, WEEKLY, MONTHLY or YEARLY with INTERVAL, COUNT, UNTIL,
+// and BYDAY as plain days for WEEKLY. BYMONTH and BYMONTHDAY are accepted
+// when they repeat DTSTART's month and day. Any other part fails the whole
+// file, as does an unknown TZID, rather than silently dropping the event.
+// EXDATE is supported; a modified occurrence (RECURRENCE-ID) is read as an
+// event of its own.
+func Parse(r io.Reader) ([]Event, error) {
+	lines, err := unfold(r)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		events []Event
+		ev     *vevent
+		depth  int
+	)
+	for _, l := range lines {
+		name, params, value, err := splitProperty(l.text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", l.num, err)
+		}
+		switch {
+		case name == "BEGIN" && strings.EqualFold(value, "VEVENT") && ev == nil:
+			ev = &vevent{line: l.num}
+			continue
+		case name == "END" && strings.EqualFold(value, "VEVENT") && ev != nil && depth == 0:
+			e, ok, err := ev.event()
+			if err != nil {
+				return nil, fmt.Errorf("event at line %d: %v", ev.line, err)
+			}
+			if ok {
+				events = append(events, e)
+			}
+			ev = nil
+			continue
+		}
+		if ev == nil {
+			continue
+		}
+		// Skip components nested in the event, e.g. VALARM.
+		switch name {
+		case "BEGIN":
+			depth++
+			continue
+		case "END":
+			depth--
+			continue
+		}
+		if depth > 0 {
+			continue
+		}
+		p := property{params: params, value: value}
+		switch name {
+		case "SUMMARY":
+			ev.summary = unescape(value)
+		case "DTSTART":
+			ev.start = &p
+		case "DTEND":
+			ev.end = &p
+		case "DURATION":
+			ev.duration = &p
+		case "RRULE":
+			ev.rrule = value
+		case "EXDATE":
+			ev.exdates = append(ev.exdates, p)
+		case "STATUS":
+			ev.status = strings.ToUpper(value)
+		}
+	}
+	if ev != nil {
+		return nil, fmt.Errorf("event at line %d: missing END:VEVENT", ev.line)
+	}
+	return events, nil
+}
+
+type line struct {
+	num  int
+	text string
+}
+
+// unfold joins continuation lines, which start with a space or tab, onto
+// the line before them.
+func unfold(r io.Reader) ([]line, error) {
+	var lines []line
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	read := 0
+	for num := 1; sc.Scan(); num++ {
+		read += len(sc.Bytes()) + 1
+		if read > MaxFileBytes {
+			return nil, fmt.Errorf("calendar is larger than %d bytes", MaxFileBytes)
+		}
+		text := strings.TrimRight(sc.Text(), "\r")
+		if (strings.HasPrefix(text, " ") || strings.HasPrefix(text, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1].text += text[1:]
+			continue
+		}
+		if text == "" {
+			continue
+		}
+		lines = append(lines, line{num: num, text: text})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
+
+// splitProperty splits "NAME;PARAM=value:VALUE". Parameter values may be
+// quoted and contain ':' or ';'.
+func splitProperty(text string) (string, map[string]string, string, error) {
+	inQuote := false
+	colon := -1
+	for i, c := range text {
+		if c == '"' {
+			inQuote = !inQuote
+		} else if c == ':' && !inQuote {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return "", nil, "", fmt.Errorf("invalid content line %q", text)
+	}
+	head, value := text[:colon], text[colon+1:]
+	var parts []string
+	inQuote = false
+	last := 0
+	for i, c := range head {
+		if c == '"' {
+			inQuote = !inQuote
+		} else if c == ';' && !inQuote {
+			parts = append(parts, head[last:i])
+			last = i + 1
+		}
+	}
+	parts = append(parts, head[last:])
+	params := map[string]string{}
+	for _, p := range parts[1:] {
+		k, v, _ := strings.Cut(p, "=")
+		params[strings.ToUpper(k)] = strings.Trim(v, `"`)
+	}
+	return strings.ToUpper(parts[0]), params, value, nil
+}
+
+func unescape(s string) string {
+	r := strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, " ", `\N`, " ")
+	return strings.TrimSpace(r.Replace(s))
+}
+
+type property struct {
+	params map[string]string
+	value  string
+}
+
+// vevent collects the properties of one VEVENT.
+type vevent struct {
+	line     int
+	summary  string
+	start    *property
+	end      *property
+	duration *property
+	rrule    string
+	exdates  []property
+	status   string
+}
+
+// event converts the collected properties. ok is false for a cancelled
+// event.
+func (v *vevent) event() (Event, bool, error) {
+	if v.status == "CANCELLED" {
+		return Event{}, false, nil
+	}
+	if v.start == nil {
+		return Event{}, false, fmt.Errorf("missing DTSTART")
+	}
+	e := Event{Name: v.summary}
+	if e.Name == "" {
+		e.Name = untitled
+	}
+	var allDay bool
+	var err error
+	e.Start, e.Floating, allDay, err = parseTime(v.start.value, v.start.params)
+	if err != nil {
+		return e, false, fmt.Errorf("DTSTART: %v", err)
+	}
+	switch {
+	case v.end != nil:
+		var floating bool
+		e.End, floating, _, err = parseTime(v.end.value, v.end.params)
+		if err != nil {
+			return e, false, fmt.Errorf("DTEND: %v", err)
+		}
+		if floating != e.Floating {
+			return e, false, fmt.Errorf("DTSTART and DTEND mix local and fixed times")
+		}
+	case v.duration != nil:
+		d, err := parseDuration(v.duration.value)
+		if err != nil {
+			return e, false, fmt.Errorf("DURATION: %v", err)
+		}
+		e.End = e.Start.Add(d)
+	case allDay:
+		e.End = e.Start.AddDate(0, 0, 1)
+	default:
+		e.End = e.Start
+	}
+	if e.End.Before(e.Start) {
+		return e, false, fmt.Errorf("ends before it starts")
+	}
+	if v.rrule != "" {
+		if e.Recurrence, err = parseRRule(v.rrule, e.Start, e.Floating); err != nil {
+			return e, false, fmt.Errorf("RRULE: %v", err)
+		}
+		for _, x := range v.exdates {
+			for _, value := range strings.Split(x.value, ",") {
+				t, _, _, err := parseTime(value, x.params)
+				if err != nil {
+					return e, false, fmt.Errorf("EXDATE: %v", err)
+				}
+				e.Recurrence.Except = append(e.Recurrence.Except, t)
+			}
+		}
+	}
+	return e, true, nil
+}
+
+// parseTime parses a DATE or DATE-TIME value. Floating values hold their
+// wall-clock fields in UTC.
+func parseTime(value string, params map[string]string) (t time.Time, floating, allDay bool, err error) {
+	value = strings.TrimSpace(value)
+	if params["VALUE"] == "DATE" || len(value) == len("20060102") {
+		t, err = time.Parse("20060102", value)
+		return t, true, true, err
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err = time.Parse("20060102T150405Z", value)
+		return t, false, false, err
+	}
+	if tzid := params["TZID"]; tzid != "" {
+		loc, err := time.LoadLocation(tzid)
+		if err != nil {
+			return t, false, false, fmt.Errorf("unknown TZID %q", tzid)
+		}
+		t, err = time.ParseInLocation("20060102T150405", value, loc)
+		return t, false, false, err
+	}
+	t, err = time.Parse("20060102T150405", value)
+	return t, true, false, err
+}
+
+// parseDuration parses a duration such as "P1D", "PT2H30M" or "P2W".
+func parseDuration(value string) (time.Duration, error) {
+	s := strings.TrimPrefix(strings.TrimSpace(value), "+")
+	if !strings.HasPrefix(s, "P") {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	s = s[1:]
+	var d time.Duration
+	inTime := false
+	num := ""
+	for _, c := range s {
+		switch {
+		case c >= '0' && c <= '9':
+			num += string(c)
+			continue
+		case c == 'T':
+			inTime = true
+			continue
+		}
+		n, err := strconv.Atoi(num)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+		num = ""
+		switch {
+		case c == 'W' && !inTime:
+			d += time.Duration(n) * 7 * 24 * time.Hour
+		case c == 'D' && !inTime:
+			d += time.Duration(n) * 24 * time.Hour
+		case c == 'H' && inTime:
+			d += time.Duration(n) * time.Hour
+		case c == 'M' && inTime:
+			d += time.Duration(n) * time.Minute
+		case c == 'S' && inTime:
+			d += time.Duration(n) * time.Second
+		default:
+			return 0, fmt.Errorf("invalid duration %q", value)
+		}
+	}
+	if num != "" {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	return d, nil
+}
+
+var (
+	frequencies = map[string]Frequency{"DAILY": Daily, "WEEKLY": Weekly, "MONTHLY": Monthly, "YEARLY": Yearly}
+	weekdays    = map[string]time.Weekday{
+		"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+		"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+	}
+)
+
+// parseRRule parses the supported subset of RRULE for an event starting at
+// start.
+func parseRRule(value string, start time.Time, floating bool) (*Recurrence, error) {
+	r := &Recurrence{}
+	var byDay, byMonth, byMonthDay string
+	for _, part := range strings.Split(value, ";") {
+		k, v, _ := strings.Cut(part, "=")
+		k = strings.ToUpper(strings.TrimSpace(k))
+		v = strings.ToUpper(strings.TrimSpace(v))
+		switch k {
+		case "FREQ":
+			f, ok := frequencies[v]
+			if !ok {
+				return nil, fmt.Errorf("unsupported FREQ %s", v)
+			}
+			r.Freq = f
+		case "INTERVAL", "COUNT":
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid %s %q", k, v)
+			}
+			if k == "INTERVAL" {
+				r.Interval = n
+			} else {
+				r.Count = n
+			}
+		case "UNTIL":
+			until, untilFloating, allDay, err := parseTime(v, nil)
+			if err != nil {
+				return nil, fmt.Errorf("invalid UNTIL %q", v)
+			}
+			if allDay {
+				// A date includes every occurrence starting that day.
+				until = until.AddDate(0, 0, 1).Add(-time.Nanosecond)
+			}
+			if untilFloating && !floating {
+				// A local UNTIL is read in the event's zone. The opposite,
+				// a fixed UNTIL for a floating event, is read as UTC.
+				until = time.Date(until.Year(), until.Month(), until.Day(), until.Hour(),
+					until.Minute(), until.Second(), until.Nanosecond(), start.Location())
+			}
+			r.Until = until
+		case "BYDAY":
+			byDay = v
+		case "BYMONTH":
+			byMonth = v
+		case "BYMONTHDAY":
+			byMonthDay = v
+		case "WKST":
+			if v != "MO" {
+				return nil, fmt.Errorf("unsupported WKST %s", v)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported part %s", k)
+		}
+	}
+	if r.Freq == 0 {
+		return nil, fmt.Errorf("missing FREQ")
+	}
+	if r.Count > 0 && !r.Until.IsZero() {
+		return nil, fmt.Errorf("COUNT and UNTIL are exclusive")
+	}
+	if byDay != "" {
+		if r.Freq != Weekly {
+			return nil, fmt.Errorf("BYDAY is only supported with FREQ=WEEKLY")
+		}
+		for _, d := range strings.Split(byDay, ",") {
+			wd, ok := weekdays[d]
+			if !ok {
+				return nil, fmt.Errorf("unsupported BYDAY %s", d)
+			}
+			r.ByDay = append(r.ByDay, wd)
+		}
+	}
+	if byMonth != "" && (r.Freq != Yearly || byMonth != strconv.Itoa(int(start.Month()))) {
+		return nil, fmt.Errorf("unsupported BYMONTH %s", byMonth)
+	}
+	if byMonthDay != "" && (r.Freq < Monthly || byMonthDay != strconv.Itoa(start.Day())) {
+		return nil, fmt.Errorf("unsupported BYMONTHDAY %s", byMonthDay)
+	}
+	return r, nil
+}
@@ -0,0 +1,140 @@
+package calendar
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const holidays = "BEGIN:VCALENDAR\r\n" +
+	"VERSION:2.0\r\n" +
+	"PRODID:-//Example//Holidays//EN\r\n" +
+	"BEGIN:VTIMEZONE\r\n" +
+	"TZID:Europe/Berlin\r\n" +
+	"BEGIN:STANDARD\r\n" +
+	"DTSTART:19701025T030000\r\n" +
+	"END:STANDARD\r\n" +
+	"END:VTIMEZONE\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:christmas@example.com\r\n" +
+	"DTSTART;VALUE=DATE:20001225\r\n" +
+	"DTEND;VALUE=DATE:20001227\r\n" +
+	"RRULE:FREQ=YEARLY;BYMONTH=12;BYMONTHDAY=25\r\n" +
+	"SUMMARY:Christmas\\, Boxing Day\r\n" +
+	"BEGIN:VALARM\r\n" +
+	"TRIGGER:-PT15M\r\n" +
+	"DTSTART:20000101T000000\r\n" +
+	"END:VALARM\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"DTSTART;TZID=\"Europe/Berlin\":20240603T020000\r\n" +
+	"DURATION:PT4H\r\n" +
+	"SUMMARY:Database maintenance on th\r\n" +
+	" e primary\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"DTSTART:20240101T180000\r\n" +
+	"DTEND:20240101T190000\r\n" +
+	"RRULE:FREQ=WEEKLY;BYDAY=MO,TH;UNTIL=20240229\r\n" +
+	"EXDATE:20240104T180000,20240108T180000\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"DTSTART;VALUE=DATE:20240501\r\n" +
+	"SUMMARY:Cancelled party\r\n" +
+	"STATUS:CANCELLED\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+func TestParse(t *testing.T) {
+	events, err := Parse(strings.NewReader(holidays))
+	assert.NoError(t, err)
+	if !assert.Len(t, events, 3) {
+		return
+	}
+
+	christmas := events[0]
+	assert.Equal(t, "Christmas, Boxing Day", christmas.Name)
+	assert.True(t, christmas.Floating)
+	assert.True(t, christmas.Active(date(2031, 12, 26, 23, 59)))
+	assert.False(t, christmas.Active(date(2031, 12, 27, 0, 0)))
+
+	maintenance := events[1]
+	assert.Equal(t, "Database maintenance on the primary", maintenance.Name)
+	assert.False(t, maintenance.Floating)
+	// 02:00 CEST is 00:00 UTC.
+	assert.True(t, maintenance.Active(date(2024, 6, 3, 0, 0)))
+	assert.False(t, maintenance.Active(date(2024, 6, 3, 4, 0)))
+
+	meeting := events[2]
+	assert.Equal(t, untitled, meeting.Name)
+	assert.True(t, meeting.Active(date(2024, 1, 11, 18, 30)))
+	assert.False(t, meeting.Active(date(2024, 1, 8, 18, 30)))
+	assert.False(t, meeting.Active(date(2024, 1, 10, 18, 30)))
+	assert.True(t, meeting.Active(date(2024, 2, 29, 18, 30)))
+	assert.False(t, meeting.Active(date(2024, 3, 4, 18, 30)))
+}
+
+func TestParseErrors(t *testing.T) {
+	event := func(lines ...string) string {
+		return "BEGIN:VCALENDAR\nBEGIN:VEVENT\n" + strings.Join(lines, "\n") + "\nEND:VEVENT\nEND:VCALENDAR\n"
+	}
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"no start", event("SUMMARY:x"), "missing DTSTART"},
+		{"bad date", event("DTSTART:2024-01-01"), "DTSTART"},
+		{"unknown zone", event("DTSTART;TZID=W. Europe Standard Time:20240101T090000"), "unknown TZID"},
+		{"mixed end", event("DTSTART:20240101T090000", "DTEND:20240101T100000Z"), "mix local and fixed"},
+		{"ends early", event("DTSTART:20240101T090000", "DTEND:20240101T080000"), "ends before it starts"},
+		{"bad duration", event("DTSTART:20240101T090000", "DURATION:1H"), "DURATION"},
+		{"ordinal day", event("DTSTART:20241128", "RRULE:FREQ=YEARLY;BYMONTH=11;BYDAY=4TH"), "BYDAY is only supported"},
+		{"other month", event("DTSTART:20241128", "RRULE:FREQ=YEARLY;BYMONTH=12"), "unsupported BYMONTH"},
+		{"set position", event("DTSTART:20241128", "RRULE:FREQ=MONTHLY;BYSETPOS=-1"), "unsupported part BYSETPOS"},
+		{"hourly", event("DTSTART:20241128", "RRULE:FREQ=HOURLY"), "unsupported FREQ"},
+		{"unterminated", "BEGIN:VEVENT\nDTSTART:20241128\n", "missing END:VEVENT"},
+		{"garbage", "BEGIN:VCALENDAR\nnot a property\n", "line 2"},
+	}
+	for _, tc := range tests {
+		_, err := Parse(strings.NewReader(tc.content))
+		if assert.Error(t, err, tc.name) {
+			assert.Contains(t, err.Error(), tc.want, tc.name)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "holidays.ics")
+	assert.NoError(t, os.WriteFile(path, []byte(holidays), 0o600))
+	events, err := Load(path)
+	assert.NoError(t, err)
+	assert.Len(t, events, 3)
+
+	_, err = Load(filepath.Join(t.TempDir(), "missing.ics"))
+	assert.Error(t, err)
+}
+
+func TestParseDuration(t *testing.T) {
+	for value, want := range map[string]time.Duration{
+		"P1D":      24 * time.Hour,
+		"P2W":      14 * 24 * time.Hour,
+		"PT2H30M":  2*time.Hour + 30*time.Minute,
+		"P1DT12H":  36 * time.Hour,
+		"+PT90S":   90 * time.Second,
+		"PT0S":     0,
+		"P1DT1H1M": 25*time.Hour + time.Minute,
+	} {
+		d, err := parseDuration(value)
+		assert.NoError(t, err, value)
+		assert.Equal(t, want, d, value)
+	}
+	for _, value := range []string{"", "1D", "PT1D", "P1H", "P1", "-P1D"} {
+		_, err := parseDuration(value)
+		assert.Error(t, err, value)
+	}
+}
@@ -0,0 +1,29 @@
+package common
+
+import "math"
+
+// earthRadiusKm is the mean Earth radius used for great-circle distances.
+const earthRadiusKm = 6371.0
+
+// DistanceKm returns the great-circle (haversine) distance between two points
+// given in decimal degrees.
+func DistanceKm(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := rad(lat2 - lat1)
+	dLon := rad(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(rad(lat1))*math.Cos(rad(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// GeoRadius is a circle of RadiusKm around a point.
+type GeoRadius struct {
+	Lat      float64
+	Lon      float64
+	RadiusKm float64
+}
+
+// Contains reports whether the point lat/lon lies within the circle.
+func (r GeoRadius) Contains(lat, lon float64) bool {
+	return DistanceKm(r.Lat, r.Lon, lat, lon) <= r.RadiusKm
+}
@@ -0,0 +1,25 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDistanceKm(t *testing.T) {
+	// Seattle to Portland, OR is about 234 km.
+	assert.InDelta(t, 234, DistanceKm(47.6062, -122.3321, 45.5152, -122.6784), 2)
+	// London to New York is about 5570 km.
+	assert.InDelta(t, 5570, DistanceKm(51.5074, -0.1278, 40.7128, -74.0060), 10)
+	assert.Equal(t, 0.0, DistanceKm(10, 20, 10, 20))
+	// Antipodes are half the circumference apart.
+	assert.InDelta(t, 20015, DistanceKm(0, 0, 0, 180), 1)
+	// Crossing the antimeridian takes the short way round.
+	assert.InDelta(t, 222, DistanceKm(0, 179, 0, -179), 1)
+}
+
+func TestGeoRadiusContains(t *testing.T) {
+	seattle := GeoRadius{Lat: 47.6062, Lon: -122.3321, RadiusKm: 50}
+	assert.True(t, seattle.Contains(47.6101, -122.2015))  // Bellevue
+	assert.False(t, seattle.Contains(45.5152, -122.6784)) // Portland
+}
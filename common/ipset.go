@@ -0,0 +1,163 @@
+package common
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// IPMatcher reports whether an address belongs to a list of IPs and CIDRs.
+type IPMatcher interface {
+	Contains(ip string) bool
+}
+
+// IPSet is a compiled set of IPs and CIDRs. Lookups walk a binary trie, so
+// they cost at most one step per address bit however many entries the set
+// holds. IPv4-mapped IPv6 addresses and entries are treated as IPv4.
+//
+// An IPSet is read-only once built and safe for concurrent use.
+type IPSet struct {
+	v4  ipTrie
+	v6  ipTrie
+	len int
+}
+
+// NewIPSet compiles entries, each an IP or CIDR. Blank entries are skipped.
+func NewIPSet(entries []string) (*IPSet, error) {
+	s := &IPSet{}
+	for _, entry := range entries {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		prefix, err := ParseIPOrPrefix(entry)
+		if err != nil {
+			return nil, err
+		}
+		s.Add(prefix)
+	}
+	return s, nil
+}
+
+// Add inserts prefix. It must not be called once the set is in use.
+func (s *IPSet) Add(prefix netip.Prefix) {
+	addr := prefix.Addr()
+	if addr.Is4() {
+		b := addr.As4()
+		s.v4.insert(b[:], prefix.Bits())
+	} else {
+		b := addr.As16()
+		s.v6.insert(b[:], prefix.Bits())
+	}
+	s.len++
+}
+
+// Len returns the number of entries added.
+func (s *IPSet) Len() int {
+	if s == nil {
+		return 0
+	}
+	return s.len
+}
+
+// Contains reports whether ip is in the set. Unparseable input is not.
+func (s *IPSet) Contains(ip string) bool {
+	if s == nil || s.len == 0 {
+		return false
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	return s.ContainsAddr(addr)
+}
+
+func (s *IPSet) ContainsAddr(addr netip.Addr) bool {
+	if s == nil {
+		return false
+	}
+	addr = addr.Unmap()
+	if addr.Is4() {
+		b := addr.As4()
+		return s.v4.contains(b[:])
+	}
+	b := addr.As16()
+	return s.v6.contains(b[:])
+}
+
+// ParseIPOrPrefix parses an IP or CIDR entry into a masked prefix; a plain IP
+// becomes a /32 or /128. IPv4-mapped IPv6 entries are converted to IPv4.
+func ParseIPOrPrefix(entry string) (netip.Prefix, error) {
+	entry = strings.TrimSpace(entry)
+	if prefix, err := netip.ParsePrefix(entry); err == nil {
+		addr := prefix.Addr()
+		if addr.Is4In6() && prefix.Bits() >= 96 {
+			return netip.PrefixFrom(addr.Unmap(), prefix.Bits()-96).Masked(), nil
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid IP/CIDR %q", entry)
+	}
+	addr = addr.Unmap().WithZone("")
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// ipTrie is a binary trie stored in a flat slice. Node 0 is the root, so a
+// zero child index means "no child".
+type ipTrie struct {
+	nodes []trieNode
+}
+
+type trieNode struct {
+	child [2]uint32
+	// term marks the end of a prefix; everything below it is covered.
+	term bool
+}
+
+func bitAt(b []byte, i int) int {
+	return int(b[i/8]>>(7-i%8)) & 1
+}
+
+func (t *ipTrie) insert(b []byte, bits int) {
+	if len(t.nodes) == 0 {
+		t.nodes = append(t.nodes, trieNode{})
+	}
+	n := uint32(0)
+	for i := 0; i < bits; i++ {
+		if t.nodes[n].term {
+			// Already covered by a shorter prefix.
+			return
+		}
+		bit := bitAt(b, i)
+		next := t.nodes[n].child[bit]
+		if next == 0 {
+			t.nodes = append(t.nodes, trieNode{})
+			next = uint32(len(t.nodes) - 1)
+			t.nodes[n].child[bit] = next
+		}
+		n = next
+	}
+	t.nodes[n].term = true
+	// Longer prefixes below this one are now redundant.
+	t.nodes[n].child = [2]uint32{}
+}
+
+func (t *ipTrie) contains(b []byte) bool {
+	if len(t.nodes) == 0 {
+		return false
+	}
+	n := uint32(0)
+	for i := 0; ; i++ {
+		if t.nodes[n].term {
+			return true
+		}
+		if i == len(b)*8 {
+			return false
+		}
+		n = t.nodes[n].child[bitAt(b, i)]
+		if n == 0 {
+			return false
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package common
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIPSet(t *testing.T) {
+	set, err := NewIPSet([]string{
+		"10.0.0.0/8",
+		" 192.0.2.1 ",
+		"",
+		"2001:db8::/32",
+		"::ffff:198.51.100.0/120",
+		"10.1.0.0/16", // covered by 10.0.0.0/8
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 5, set.Len())
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.255.0.1", true},
+		{"11.0.0.1", false},
+		{"192.0.2.1", true},
+		{"192.0.2.2", false},
+		{"::ffff:192.0.2.1", true},
+		{"198.51.100.77", true},
+		{"::ffff:198.51.100.77", true},
+		{"198.51.101.1", false},
+		{"2001:db8:1::1", true},
+		{"2001:db9::1", false},
+		{"fe80::1%eth0", false},
+		{"not-an-ip", false},
+	}
+	for _, tc := range tests {
+		assert.Equal(t, tc.want, set.Contains(tc.ip), tc.ip)
+	}
+
+	_, err = NewIPSet([]string{"10.0.0.0/33"})
+	assert.Error(t, err)
+	_, err = NewIPSet([]string{"bogus"})
+	assert.Error(t, err)
+}
+
+func TestIPSetCatchAll(t *testing.T) {
+	set, err := NewIPSet([]string{"0.0.0.0/0", "fe80::1"})
+	assert.NoError(t, err)
+	assert.True(t, set.Contains("203.0.113.1"))
+	assert.True(t, set.Contains("fe80::1%eth0"))
+	assert.False(t, set.Contains("fe80::2"))
+
+	var empty *IPSet
+	assert.False(t, empty.Contains("1.2.3.4"))
+	assert.Equal(t, 0, empty.Len())
+}
+
+// TestIPSetMatchesCheckSubnets cross-checks the trie against the linear scan.
+func TestIPSetMatchesCheckSubnets(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	entries := randomEntries(rng, 500)
+	set, err := NewIPSet(entries)
+	assert.NoError(t, err)
+	checker := &CheckIPs{}
+	for i := 0; i < 2000; i++ {
+		ip := randomIP(rng)
+		assert.Equal(t, checker.CheckSubnets(entries, ip), set.Contains(ip), ip)
+	}
+}
+
+func randomIP(rng *rand.Rand) string {
+	if rng.Intn(4) == 0 {
+		return fmt.Sprintf("2001:db8:%x:%x::%x", rng.Intn(16), rng.Intn(65536), rng.Intn(65536))
+	}
+	return fmt.Sprintf("%d.%d.%d.%d", 10+rng.Intn(4), rng.Intn(256), rng.Intn(256), rng.Intn(256))
+}
+
+func randomEntries(rng *rand.Rand, n int) []string {
+	entries := make([]string, 0, n)
+	for len(entries) < n {
+		switch rng.Intn(4) {
+		case 0:
+			entries = append(entries, fmt.Sprintf("2001:db8:%x:%x::/64", rng.Intn(16), rng.Intn(65536)))
+		case 1:
+			entries = append(entries, randomIP(rng))
+		default:
+			entries = append(entries, fmt.Sprintf("%d.%d.%d.0/24", 10+rng.Intn(4), rng.Intn(256), rng.Intn(256)))
+		}
+	}
+	return entries
+}
+
+func benchmarkLookups(b *testing.B, n int, contains func(entries []string) func(string) bool) {
+	rng := rand.New(rand.NewSource(1))
+	entries := randomEntries(rng, n)
+	ips := make([]string, 1024)
+	for i := range ips {
+		ips[i] = randomIP(rng)
+	}
+	lookup := contains(entries)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lookup(ips[i%len(ips)])
+	}
+}
+
+func BenchmarkCheckSubnets(b *testing.B) {
+	for _, n := range []int{10, 1000, 50000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			benchmarkLookups(b, n, func(entries []string) func(string) bool {
+				checker := &CheckIPs{}
+				return func(ip string) bool { return checker.CheckSubnets(entries, ip) }
+			})
+		})
+	}
+}
+
+func BenchmarkIPSet(b *testing.B) {
+	for _, n := range []int{10, 1000, 50000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			benchmarkLookups(b, n, func(entries []string) func(string) bool {
+				set, err := NewIPSet(entries)
+				if err != nil {
+					b.Fatalf("NewIPSet: %v", err)
+				}
+				return set.Contains
+			})
+		})
+	}
+}
+
+func BenchmarkNewIPSet(b *testing.B) {
+	entries := randomEntries(rand.New(rand.NewSource(1)), 50000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := NewIPSet(entries); err != nil {
+			b.Fatalf("NewIPSet: %v", err)
+		}
+	}
+}
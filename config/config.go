@@ -3,18 +3,121 @@ package config
 import (
 	"fmt"
 	"net"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
 type Config struct {
-	Servers []ServerConfig `yaml:"servers"`
-	APIKey  string         `yaml:"apiKey"`
+	Servers           []ServerConfig `yaml:"servers"`
+	APIKey            string         `yaml:"apiKey"`
+	GeoProvider       string         `yaml:"geoProvider"`
+	MMDBPath          string         `yaml:"mmdbPath"`
+	MMDBCheckInterval time.Duration  `yaml:"mmdbCheckInterval"`
+	GeoChain          GeoChainConfig `yaml:"geoChain"`
+	// CacheFile, when set, persists the ip-api cache across restarts.
+	CacheFile             string        `yaml:"cacheFile"`
+	CacheSnapshotInterval time.Duration `yaml:"cacheSnapshotInterval"`
+	Ban                   BanConfig     `yaml:"ban"`
+	// ListRefreshInterval is how often alwaysAllowedFiles/alwaysDeniedFiles are
+	// checked for changes (files) or re-fetched (URLs).
+	ListRefreshInterval time.Duration `yaml:"listRefreshInterval"`
+	// TorExitList is the file or URL of the Tor exit list used by servers with
+	// denyTor. It defaults to DefaultTorExitList and is refreshed every
+	// ListRefreshInterval.
+	TorExitList string `yaml:"torExitList"`
 }
 
+// BanConfig enables automatic, temporary bans of clients that are rejected or
+// connect too often. Bans apply to every server.
+type BanConfig struct {
+	Duration         time.Duration `yaml:"duration"`
+	MaxRejections    int           `yaml:"maxRejections"`
+	RejectionWindow  time.Duration `yaml:"rejectionWindow"`
+	MaxConnections   int           `yaml:"maxConnections"`
+	ConnectionWindow time.Duration `yaml:"connectionWindow"`
+	IPv4Prefix       int           `yaml:"ipv4Prefix"`
+	IPv6Prefix       int           `yaml:"ipv6Prefix"`
+	// File, when set, persists active bans across restarts.
+	File string `yaml:"file"`
+}
+
+// Enabled reports whether any automatic ban trigger is configured.
+func (b BanConfig) Enabled() bool {
+	return b.MaxRejections > 0 || b.MaxConnections > 0
+}
+
+// GeoChainConfig configures geoProvider: chain, which combines several lookup
+// sources.
+type GeoChainConfig struct {
+	Mode      string              `yaml:"mode"`
+	Quorum    int                 `yaml:"quorum"`
+	Providers []GeoProviderConfig `yaml:"providers"`
+}
+
+type GeoProviderConfig struct {
+	Type          string           `yaml:"type"`
+	Path          string           `yaml:"path"`
+	CheckInterval time.Duration    `yaml:"checkInterval"`
+	Entries       []StaticGeoEntry `yaml:"entries"`
+}
+
+// GeoRadiusConfig is a circle of RadiusKm around Lat/Lon. Name is only used in
+// error messages.
+type GeoRadiusConfig struct {
+	Name     string  `yaml:"name"`
+	Lat      float64 `yaml:"lat"`
+	Lon      float64 `yaml:"lon"`
+	RadiusKm float64 `yaml:"radiusKm"`
+}
+
+type StaticGeoEntry struct {
+	CIDR    string `yaml:"cidr"`
+	Country string `yaml:"country"`
+	Region  string `yaml:"region"`
+}
+
+const (
+	GeoProviderIPAPI = "ipapi"
+	GeoProviderMMDB  = "mmdb"
+	GeoProviderChain = "chain"
+
+	// Chain-only provider types. "ipapi" in a chain follows apiKey like the
+	// top-level provider does.
+	GeoProviderIPAPIPro  = "ipapi-pro"
+	GeoProviderIPAPIFree = "ipapi-free"
+	GeoProviderStatic    = "static"
+
+	// DefaultTorExitList is the Tor Project's bulk exit list, one address per
+	// line.
+	DefaultTorExitList = "https://check.torproject.org/torbulkexitlist"
+
+	ActionAllow = "allow"
+	ActionDeny  = "deny"
+
+	// TimezoneClient as a server's timezone reads its schedules in each
+	// client's own time zone, as reported by the geolocation provider.
+	TimezoneClient = "client"
+
+	ChainModeFallback     = "fallback"
+	ChainModeFirstSuccess = "first-success"
+	ChainModeConsensus    = "consensus"
+
+	BalanceRoundRobin       = "round-robin"
+	BalanceLeastConnections = "least-connections"
+	BalanceRandom           = "random"
+	BalanceSourceIPHash     = "source-ip-hash"
+
+	// MaxBackendWeight bounds a backend's weight.
+	MaxBackendWeight = 1000
+)
+
 type ServerConfig struct {
+	Name                 string   `yaml:"name"`
 	ListenIP             string   `yaml:"listenIP"`
 	ListenPort           string   `yaml:"listenPort"`
 	BackendIP            string   `yaml:"backendIP"`
@@ -23,8 +126,18 @@ type ServerConfig struct {
 	AllowedRegions       []string `yaml:"allowedRegions"`
 	AlwaysAllowed        []string `yaml:"alwaysAllowed"`
 	AlwaysDenied         []string `yaml:"alwaysDenied"`
+	AlwaysAllowedFiles   []string `yaml:"alwaysAllowedFiles"`
+	AlwaysDeniedFiles    []string `yaml:"alwaysDeniedFiles"`
 	DeniedCountries      []string `yaml:"deniedCountries"`
 	DeniedRegions        []string `yaml:"deniedRegions"`
+	AllowedASNs          []string `yaml:"allowedASNs"`
+	DeniedASNs           []string `yaml:"deniedASNs"`
+	AllowedOrgs          []string `yaml:"allowedOrgs"`
+	DeniedOrgs           []string `yaml:"deniedOrgs"`
+	DenyHosting          bool     `yaml:"denyHosting"`
+	DenyProxy            bool     `yaml:"denyProxy"`
+	DenyMobile           bool     `yaml:"denyMobile"`
+	DenyTor              bool     `yaml:"denyTor"`
 	RecvProxyProtocol    bool     `yaml:"recvProxyProtocol"`
 	SendProxyProtocol    bool     `yaml:"sendProxyProtocol"`
 	ProxyProtocolVersion int      `yaml:"proxyProtocolVersion"`
@@ -34,6 +147,95 @@ type ServerConfig struct {
 	EndDate              string   `yaml:"endDate"`
 	StartTime            string   `yaml:"startTime"`
 	EndTime              string   `yaml:"endTime"`
+	OnLookupFailure      string   `yaml:"onLookupFailure"`
+	LookupFailureAllowed []string `yaml:"lookupFailureAllowed"`
+
+	// AllowedCities and AllowedRadius narrow the allowed countries and regions
+	// to clients in one of the cities or within one of the circles.
+	AllowedCities []string          `yaml:"allowedCities"`
+	AllowedRadius []GeoRadiusConfig `yaml:"allowedRadius"`
+
+	// Rules replace allowedCountries, allowedRegions, deniedCountries,
+	// deniedRegions and the schedule fields with an ordered list. The first
+	// matching rule decides; DefaultAction (default deny) applies otherwise.
+	Rules         []RuleConfig `yaml:"rules"`
+	DefaultAction string       `yaml:"defaultAction"`
+
+	// Timezone is the IANA zone, e.g. "Europe/Berlin", that every schedule of
+	// the server is read in. Empty means the host's local zone, "client" the
+	// client's zone from the lookup.
+	Timezone string `yaml:"timezone"`
+	// Schedules are time windows; connections are only allowed while one of
+	// them is active.
+	Schedules []ScheduleConfig `yaml:"schedules"`
+	// Exceptions are dates and periods, such as public holidays, during
+	// which connections are denied whatever the schedule or rules say.
+	// CalendarFiles adds the events of local iCalendar (.ics) files.
+	Exceptions    []ExceptionConfig `yaml:"exceptions"`
+	CalendarFiles []string          `yaml:"calendarFiles"`
+	// EnforceScheduleOnActive closes established connections when the
+	// schedule, exceptions or rules stop allowing them, after
+	// ScheduleGracePeriod. Otherwise they are only checked when they open.
+	EnforceScheduleOnActive bool          `yaml:"enforceScheduleOnActive"`
+	ScheduleGracePeriod     time.Duration `yaml:"scheduleGracePeriod"`
+	// Backends replace backendIP and backendPort with several backends that
+	// LoadBalancing (default round-robin) spreads the connections over.
+	Backends      []BackendConfig `yaml:"backends"`
+	LoadBalancing string          `yaml:"loadBalancing"`
+}
+
+// BackendConfig is one entry of a server's backends. Weight (default 1)
+// scales the backend's share of the connections.
+type BackendConfig struct {
+	IP     string `yaml:"ip"`
+	Port   string `yaml:"port"`
+	Weight int    `yaml:"weight"`
+}
+
+// UnmarshalYAML defaults Weight to 1, so that an explicit weight of 0 can be
+// told apart from a missing one.
+func (b *BackendConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type backendConfig BackendConfig
+	p := backendConfig{Weight: 1}
+	if err := unmarshal(&p); err != nil {
+		return err
+	}
+	*b = BackendConfig(p)
+	return nil
+}
+
+// RuleConfig is one entry of a server's rules. A rule matches when every
+// condition it sets matches; an empty rule matches every client.
+type RuleConfig struct {
+	Action    string          `yaml:"action"`
+	Tag       string          `yaml:"tag"`
+	CIDRs     []string        `yaml:"cidrs"`
+	Countries []string        `yaml:"countries"`
+	Regions   []string        `yaml:"regions"`
+	ASNs      []string        `yaml:"asns"`
+	Schedule  *ScheduleConfig `yaml:"schedule"`
+	// Invert applies the action to clients that don't match.
+	Invert bool `yaml:"invert"`
+}
+
+// ScheduleConfig is a time window in the same format as the server-level
+// schedule fields, except that days and dates may be combined.
+type ScheduleConfig struct {
+	DaysOfWeek []string `yaml:"daysOfWeek"`
+	StartDate  string   `yaml:"startDate"`
+	EndDate    string   `yaml:"endDate"`
+	StartTime  string   `yaml:"startTime"`
+	EndTime    string   `yaml:"endTime"`
+}
+
+// ExceptionConfig is one calendar exception: a whole Date, or Start to End,
+// each "2006-01-02" or "2006-01-02 15:04". An End without a time includes
+// that day.
+type ExceptionConfig struct {
+	Name  string `yaml:"name"`
+	Date  string `yaml:"date"`
+	Start string `yaml:"start"`
+	End   string `yaml:"end"`
 }
 
 func ReadConfig(path string) (*Config, error) {
@@ -48,24 +250,428 @@ func ReadConfig(path string) (*Config, error) {
 		return nil, err
 	}
 
+	config.GeoProvider = strings.ToLower(strings.TrimSpace(config.GeoProvider))
+	if config.GeoProvider == "" {
+		config.GeoProvider = GeoProviderIPAPI
+	}
+	switch config.GeoProvider {
+	case GeoProviderIPAPI:
+	case GeoProviderMMDB:
+		if strings.TrimSpace(config.MMDBPath) == "" {
+			return nil, fmt.Errorf("mmdbPath is required when geoProvider is %q", GeoProviderMMDB)
+		}
+	case GeoProviderChain:
+		if err := validateGeoChain(&config.GeoChain, config.APIKey); err != nil {
+			return nil, fmt.Errorf("geoChain: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("invalid geoProvider %q (expected %q, %q or %q)", config.GeoProvider, GeoProviderIPAPI, GeoProviderMMDB, GeoProviderChain)
+	}
+	if config.MMDBCheckInterval < 0 {
+		return nil, fmt.Errorf("mmdbCheckInterval must be >= 0")
+	}
+	config.CacheFile = strings.TrimSpace(config.CacheFile)
+	if config.CacheSnapshotInterval < 0 {
+		return nil, fmt.Errorf("cacheSnapshotInterval must be >= 0")
+	}
+	if config.ListRefreshInterval < 0 {
+		return nil, fmt.Errorf("listRefreshInterval must be >= 0")
+	}
+	if err := validateBan(&config.Ban); err != nil {
+		return nil, fmt.Errorf("ban: %w", err)
+	}
+	config.TorExitList = strings.TrimSpace(config.TorExitList)
+	if config.TorExitList != "" {
+		if err := validateListLocations([]string{config.TorExitList}); err != nil {
+			return nil, fmt.Errorf("torExitList: %w", err)
+		}
+	}
+
 	for i := range config.Servers {
 		server := &config.Servers[i]
 		if err := validateTrustedProxies(server.TrustedProxies); err != nil {
 			return nil, fmt.Errorf("server %d trustedProxies: %w", i, err)
 		}
-		if err := validateIPOrCIDREntries(server.AlwaysAllowed); err != nil {
+		if err := ValidateIPOrCIDREntries(server.AlwaysAllowed); err != nil {
 			return nil, fmt.Errorf("server %d alwaysAllowed: %w", i, err)
 		}
-		if err := validateIPOrCIDREntries(server.AlwaysDenied); err != nil {
+		if err := ValidateIPOrCIDREntries(server.AlwaysDenied); err != nil {
 			return nil, fmt.Errorf("server %d alwaysDenied: %w", i, err)
 		}
 		server.AlwaysAllowed = normalizeIPOrCIDREntries(server.AlwaysAllowed)
 		server.AlwaysDenied = normalizeIPOrCIDREntries(server.AlwaysDenied)
+		if err := validateListLocations(server.AlwaysAllowedFiles); err != nil {
+			return nil, fmt.Errorf("server %d alwaysAllowedFiles: %w", i, err)
+		}
+		if err := validateListLocations(server.AlwaysDeniedFiles); err != nil {
+			return nil, fmt.Errorf("server %d alwaysDeniedFiles: %w", i, err)
+		}
+		server.AlwaysAllowedFiles = normalizeListLocations(server.AlwaysAllowedFiles)
+		server.AlwaysDeniedFiles = normalizeListLocations(server.AlwaysDeniedFiles)
+		if server.AllowedASNs, err = normalizeASNs(server.AllowedASNs); err != nil {
+			return nil, fmt.Errorf("server %d allowedASNs: %w", i, err)
+		}
+		if server.DeniedASNs, err = normalizeASNs(server.DeniedASNs); err != nil {
+			return nil, fmt.Errorf("server %d deniedASNs: %w", i, err)
+		}
+		if err := validateOrgs(server.AllowedOrgs); err != nil {
+			return nil, fmt.Errorf("server %d allowedOrgs: %w", i, err)
+		}
+		if err := validateOrgs(server.DeniedOrgs); err != nil {
+			return nil, fmt.Errorf("server %d deniedOrgs: %w", i, err)
+		}
+		if server.AllowedCities, err = normalizeCities(server.AllowedCities); err != nil {
+			return nil, fmt.Errorf("server %d allowedCities: %w", i, err)
+		}
+		if err := validateRadius(server.AllowedRadius); err != nil {
+			return nil, fmt.Errorf("server %d allowedRadius: %w", i, err)
+		}
+		server.Timezone = strings.TrimSpace(server.Timezone)
+		if strings.EqualFold(server.Timezone, TimezoneClient) {
+			server.Timezone = TimezoneClient
+		} else if server.Timezone != "" {
+			if _, err := time.LoadLocation(server.Timezone); err != nil {
+				return nil, fmt.Errorf("server %d timezone: %w", i, err)
+			}
+		}
+		if len(server.Schedules) > 0 && (len(server.DaysOfWeek) > 0 || server.StartDate != "" ||
+			server.EndDate != "" || server.StartTime != "" || server.EndTime != "") {
+			return nil, fmt.Errorf("server %d schedules cannot be combined with daysOfWeek, startDate/endDate or startTime/endTime", i)
+		}
+		if err := validateExceptions(server.Exceptions); err != nil {
+			return nil, fmt.Errorf("server %d exceptions: %w", i, err)
+		}
+		for j, f := range server.CalendarFiles {
+			server.CalendarFiles[j] = strings.TrimSpace(f)
+			if server.CalendarFiles[j] == "" {
+				return nil, fmt.Errorf("server %d calendarFiles: empty path", i)
+			}
+		}
+		if server.ScheduleGracePeriod < 0 {
+			return nil, fmt.Errorf("server %d scheduleGracePeriod must not be negative", i)
+		}
+		if server.ScheduleGracePeriod > 0 && !server.EnforceScheduleOnActive {
+			return nil, fmt.Errorf("server %d scheduleGracePeriod requires enforceScheduleOnActive", i)
+		}
+		if err := validateRules(server); err != nil {
+			return nil, fmt.Errorf("server %d %w", i, err)
+		}
+		if err := validateBackends(server); err != nil {
+			return nil, fmt.Errorf("server %d %w", i, err)
+		}
+		if server.DenyTor && config.TorExitList == "" {
+			config.TorExitList = DefaultTorExitList
+		}
+
+		server.OnLookupFailure = strings.ToLower(strings.TrimSpace(server.OnLookupFailure))
+		if server.OnLookupFailure == "" {
+			server.OnLookupFailure = "deny"
+		}
+		switch server.OnLookupFailure {
+		case "deny", "allow":
+			if len(server.LookupFailureAllowed) > 0 {
+				return nil, fmt.Errorf("server %d lookupFailureAllowed requires onLookupFailure: fallback", i)
+			}
+		case "fallback":
+			if len(server.LookupFailureAllowed) == 0 {
+				return nil, fmt.Errorf("server %d onLookupFailure: fallback requires lookupFailureAllowed", i)
+			}
+		default:
+			return nil, fmt.Errorf("server %d onLookupFailure: invalid value %q (expected deny, allow or fallback)", i, server.OnLookupFailure)
+		}
+		if err := ValidateIPOrCIDREntries(server.LookupFailureAllowed); err != nil {
+			return nil, fmt.Errorf("server %d lookupFailureAllowed: %w", i, err)
+		}
+		server.LookupFailureAllowed = normalizeIPOrCIDREntries(server.LookupFailureAllowed)
 	}
 
 	return &config, nil
 }
 
+func validateGeoChain(chain *GeoChainConfig, apiKey string) error {
+	chain.Mode = strings.ToLower(strings.TrimSpace(chain.Mode))
+	if chain.Mode == "" {
+		chain.Mode = ChainModeFallback
+	}
+	switch chain.Mode {
+	case ChainModeFallback, ChainModeFirstSuccess, ChainModeConsensus:
+	default:
+		return fmt.Errorf("invalid mode %q (expected %q, %q or %q)", chain.Mode, ChainModeFallback, ChainModeFirstSuccess, ChainModeConsensus)
+	}
+	if len(chain.Providers) == 0 {
+		return fmt.Errorf("at least one provider is required")
+	}
+	if chain.Quorum < 0 || chain.Quorum > len(chain.Providers) {
+		return fmt.Errorf("quorum %d must be between 0 and the number of providers (%d)", chain.Quorum, len(chain.Providers))
+	}
+	if chain.Quorum != 0 && chain.Mode != ChainModeConsensus {
+		return fmt.Errorf("quorum is only valid with mode %q", ChainModeConsensus)
+	}
+	for i := range chain.Providers {
+		p := &chain.Providers[i]
+		p.Type = strings.ToLower(strings.TrimSpace(p.Type))
+		switch p.Type {
+		case GeoProviderIPAPI, GeoProviderIPAPIFree:
+		case GeoProviderIPAPIPro:
+			if apiKey == "" {
+				return fmt.Errorf("provider %d: %q requires apiKey", i, p.Type)
+			}
+		case GeoProviderMMDB:
+			if strings.TrimSpace(p.Path) == "" {
+				return fmt.Errorf("provider %d: path is required for %q", i, p.Type)
+			}
+			if p.CheckInterval < 0 {
+				return fmt.Errorf("provider %d: checkInterval must be >= 0", i)
+			}
+		case GeoProviderStatic:
+			if len(p.Entries) == 0 {
+				return fmt.Errorf("provider %d: entries are required for %q", i, p.Type)
+			}
+			for _, e := range p.Entries {
+				if err := ValidateIPOrCIDREntries([]string{e.CIDR}); err != nil {
+					return fmt.Errorf("provider %d: %w", i, err)
+				}
+				if strings.TrimSpace(e.Country) == "" {
+					return fmt.Errorf("provider %d: entry %q has no country", i, e.CIDR)
+				}
+			}
+		default:
+			return fmt.Errorf("provider %d: invalid type %q", i, p.Type)
+		}
+	}
+	return nil
+}
+
+func validateBan(b *BanConfig) error {
+	b.File = strings.TrimSpace(b.File)
+	if b.MaxRejections < 0 {
+		return fmt.Errorf("maxRejections must be >= 0")
+	}
+	if b.MaxConnections < 0 {
+		return fmt.Errorf("maxConnections must be >= 0")
+	}
+	if b.Duration < 0 || b.RejectionWindow < 0 || b.ConnectionWindow < 0 {
+		return fmt.Errorf("durations must be >= 0")
+	}
+	if b.IPv4Prefix < 0 || b.IPv4Prefix > 32 {
+		return fmt.Errorf("ipv4Prefix must be between 0 and 32")
+	}
+	if b.IPv6Prefix < 0 || b.IPv6Prefix > 128 {
+		return fmt.Errorf("ipv6Prefix must be between 0 and 128")
+	}
+	if b.Duration == 0 {
+		b.Duration = time.Hour
+	}
+	if b.MaxRejections > 0 && b.RejectionWindow == 0 {
+		b.RejectionWindow = 10 * time.Minute
+	}
+	if b.MaxConnections > 0 && b.ConnectionWindow == 0 {
+		b.ConnectionWindow = time.Minute
+	}
+	return nil
+}
+
+// normalizeASNs accepts "AS15169", "as15169" or "15169" and returns the bare
+// numbers.
+func normalizeASNs(entries []string) ([]string, error) {
+	normalized := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		num := strings.TrimSpace(entry)
+		if len(num) > 2 && strings.EqualFold(num[:2], "AS") {
+			num = num[2:]
+		}
+		n, err := strconv.ParseUint(num, 10, 32)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("invalid ASN %q", entry)
+		}
+		normalized = append(normalized, strconv.FormatUint(n, 10))
+	}
+	return normalized, nil
+}
+
+// validateRules normalizes the rules and default action. Schedules are
+// parsed, and checked, when the server is built.
+func validateRules(server *ServerConfig) error {
+	server.DefaultAction = strings.ToLower(strings.TrimSpace(server.DefaultAction))
+	if len(server.Rules) == 0 {
+		if server.DefaultAction != "" {
+			return fmt.Errorf("defaultAction requires rules")
+		}
+		return nil
+	}
+	switch server.DefaultAction {
+	case "":
+		server.DefaultAction = ActionDeny
+	case ActionAllow, ActionDeny:
+	default:
+		return fmt.Errorf("defaultAction: invalid value %q (expected allow or deny)", server.DefaultAction)
+	}
+	if len(server.AllowedCountries) > 0 || len(server.AllowedRegions) > 0 ||
+		len(server.DeniedCountries) > 0 || len(server.DeniedRegions) > 0 ||
+		len(server.DaysOfWeek) > 0 || server.StartDate != "" || server.EndDate != "" ||
+		server.StartTime != "" || server.EndTime != "" || len(server.Schedules) > 0 {
+		return fmt.Errorf("rules cannot be combined with the country, region or schedule fields")
+	}
+	for j := range server.Rules {
+		rule := &server.Rules[j]
+		rule.Action = strings.ToLower(strings.TrimSpace(rule.Action))
+		if rule.Action != ActionAllow && rule.Action != ActionDeny {
+			return fmt.Errorf("rule %d: invalid action %q (expected allow or deny)", j+1, rule.Action)
+		}
+		rule.Tag = strings.TrimSpace(rule.Tag)
+		if err := ValidateIPOrCIDREntries(rule.CIDRs); err != nil {
+			return fmt.Errorf("rule %d cidrs: %w", j+1, err)
+		}
+		rule.CIDRs = normalizeIPOrCIDREntries(rule.CIDRs)
+		var err error
+		if rule.ASNs, err = normalizeASNs(rule.ASNs); err != nil {
+			return fmt.Errorf("rule %d asns: %w", j+1, err)
+		}
+	}
+	return nil
+}
+
+// normalizeCities accepts "Seattle" or "Portland, US" and returns them
+// lower-case as "seattle" and "portland,us".
+func normalizeCities(entries []string) ([]string, error) {
+	normalized := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		city, country, hasCountry := strings.Cut(entry, ",")
+		city = strings.ToLower(strings.TrimSpace(city))
+		country = strings.ToLower(strings.TrimSpace(country))
+		if city == "" {
+			return nil, fmt.Errorf("invalid city %q", entry)
+		}
+		if !hasCountry {
+			normalized = append(normalized, city)
+			continue
+		}
+		if len(country) != 2 {
+			return nil, fmt.Errorf("invalid city %q (expected \"City\" or \"City, CC\")", entry)
+		}
+		normalized = append(normalized, city+","+country)
+	}
+	return normalized, nil
+}
+
+// validateExceptions trims the entries and checks that each has a name and
+// either a date or a start and end. The dates themselves are parsed when the
+// server is built.
+func validateExceptions(entries []ExceptionConfig) error {
+	for i := range entries {
+		e := &entries[i]
+		e.Name = strings.TrimSpace(e.Name)
+		e.Date = strings.TrimSpace(e.Date)
+		e.Start = strings.TrimSpace(e.Start)
+		e.End = strings.TrimSpace(e.End)
+		if e.Name == "" {
+			return fmt.Errorf("entry %d has no name", i+1)
+		}
+		if (e.Date == "") == (e.Start == "" && e.End == "") {
+			return fmt.Errorf("%q needs either date or start and end", e.Name)
+		}
+		if e.Date == "" && (e.Start == "" || e.End == "") {
+			return fmt.Errorf("%q needs both start and end", e.Name)
+		}
+	}
+	return nil
+}
+
+func validateBackends(server *ServerConfig) error {
+	server.LoadBalancing = strings.ToLower(strings.TrimSpace(server.LoadBalancing))
+	if len(server.Backends) == 0 {
+		if server.LoadBalancing != "" {
+			return fmt.Errorf("loadBalancing requires backends")
+		}
+		return nil
+	}
+	if server.BackendIP != "" || server.BackendPort != "" {
+		return fmt.Errorf("backends cannot be combined with backendIP/backendPort")
+	}
+	switch server.LoadBalancing {
+	case "":
+		server.LoadBalancing = BalanceRoundRobin
+	case BalanceRoundRobin, BalanceLeastConnections, BalanceRandom, BalanceSourceIPHash:
+	default:
+		return fmt.Errorf("loadBalancing: invalid value %q (expected %q, %q, %q or %q)", server.LoadBalancing,
+			BalanceRoundRobin, BalanceLeastConnections, BalanceRandom, BalanceSourceIPHash)
+	}
+	for j := range server.Backends {
+		b := &server.Backends[j]
+		b.IP = strings.TrimSpace(b.IP)
+		b.Port = strings.TrimSpace(b.Port)
+		if b.IP == "" || b.Port == "" {
+			return fmt.Errorf("backends: entry %d needs ip and port", j+1)
+		}
+		if b.Weight < 1 || b.Weight > MaxBackendWeight {
+			return fmt.Errorf("backends: entry %d weight must be between 1 and %d", j+1, MaxBackendWeight)
+		}
+	}
+	return nil
+}
+
+func validateRadius(entries []GeoRadiusConfig) error {
+	for j, r := range entries {
+		name := r.Name
+		if name == "" {
+			name = fmt.Sprintf("entry %d", j)
+		}
+		if r.Lat < -90 || r.Lat > 90 {
+			return fmt.Errorf("%s: lat must be between -90 and 90", name)
+		}
+		if r.Lon < -180 || r.Lon > 180 {
+			return fmt.Errorf("%s: lon must be between -180 and 180", name)
+		}
+		if r.RadiusKm <= 0 {
+			return fmt.Errorf("%s: radiusKm must be > 0", name)
+		}
+	}
+	return nil
+}
+
+func validateOrgs(entries []string) error {
+	for _, entry := range entries {
+		if strings.TrimSpace(entry) == "" {
+			return fmt.Errorf("empty organization")
+		}
+	}
+	return nil
+}
+
+// validateListLocations checks list file entries: a path, or an http(s) URL
+// with a host. Whether they can be loaded is checked when the server starts.
+func validateListLocations(entries []string) error {
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			return fmt.Errorf("empty list location")
+		}
+		if strings.Contains(entry, "://") {
+			u, err := url.Parse(entry)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("invalid list URL %q (expected http:// or https://)", entry)
+			}
+		}
+	}
+	return nil
+}
+
+// normalizeListLocations trims the list files and URLs and drops repeats, so
+// a list named twice is only loaded once.
+func normalizeListLocations(entries []string) []string {
+	normalized := make([]string, 0, len(entries))
+	seen := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if seen[entry] {
+			continue
+		}
+		seen[entry] = true
+		normalized = append(normalized, entry)
+	}
+	return normalized
+}
+
 func validateTrustedProxies(entries []string) error {
 	for _, entry := range entries {
 		if entry == "" {
@@ -81,7 +687,8 @@ func validateTrustedProxies(entries []string) error {
 	return nil
 }
 
-func validateIPOrCIDREntries(entries []string) error {
+// ValidateIPOrCIDREntries checks that every entry is a plain IP or a CIDR.
+func ValidateIPOrCIDREntries(entries []string) error {
 	for _, entry := range entries {
 		entry = strings.TrimSpace(entry)
 		if entry == "" {
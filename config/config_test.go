@@ -4,6 +4,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -141,6 +142,49 @@ func TestReadConfigNormalizesAlwaysLists(t *testing.T) {
 	}
 }
 
+func TestReadConfigLookupFailurePolicy(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	base := `servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "8080"
+    backendIP: "10.0.0.1"
+    backendPort: "9090"
+    allowedCountries: ["US"]
+`
+
+	assert.NoError(t, os.WriteFile(path, []byte(base), 0o600))
+	cfg, err := ReadConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "deny", cfg.Servers[0].OnLookupFailure)
+
+	assert.NoError(t, os.WriteFile(path, []byte(base+`    onLookupFailure: "Fallback"
+    lookupFailureAllowed: [" 10.0.0.0/8 "]
+`), 0o600))
+	cfg, err = ReadConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "fallback", cfg.Servers[0].OnLookupFailure)
+	assert.Equal(t, []string{"10.0.0.0/8"}, cfg.Servers[0].LookupFailureAllowed)
+
+	invalid := []string{
+		base + `    onLookupFailure: "maybe"
+`,
+		base + `    onLookupFailure: "fallback"
+`,
+		base + `    onLookupFailure: "allow"
+    lookupFailureAllowed: ["10.0.0.0/8"]
+`,
+		base + `    onLookupFailure: "fallback"
+    lookupFailureAllowed: ["bogus"]
+`,
+	}
+	for _, content := range invalid {
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		_, err = ReadConfig(path)
+		assert.Error(t, err, content)
+	}
+}
+
 func TestValidateTrustedProxies(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -167,3 +211,558 @@ func TestValidateTrustedProxies(t *testing.T) {
 		})
 	}
 }
+
+func TestReadConfigGeoProvider(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+
+	err := os.WriteFile(path, []byte(`servers: []`), 0o600)
+	assert.NoError(t, err)
+	cfg, err := ReadConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, GeoProviderIPAPI, cfg.GeoProvider)
+
+	err = os.WriteFile(path, []byte(`geoProvider: " MMDB "
+mmdbPath: "/var/lib/GeoIP/GeoLite2-City.mmdb"
+mmdbCheckInterval: "5m"
+servers: []
+`), 0o600)
+	assert.NoError(t, err)
+	cfg, err = ReadConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, GeoProviderMMDB, cfg.GeoProvider)
+	assert.Equal(t, "/var/lib/GeoIP/GeoLite2-City.mmdb", cfg.MMDBPath)
+	assert.Equal(t, 5*time.Minute, cfg.MMDBCheckInterval)
+
+	err = os.WriteFile(path, []byte(`geoProvider: "mmdb"
+servers: []
+`), 0o600)
+	assert.NoError(t, err)
+	_, err = ReadConfig(path)
+	assert.Error(t, err)
+
+	err = os.WriteFile(path, []byte(`geoProvider: "geoip"
+servers: []
+`), 0o600)
+	assert.NoError(t, err)
+	_, err = ReadConfig(path)
+	assert.Error(t, err)
+}
+
+func TestReadConfigGeoChain(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+
+	err := os.WriteFile(path, []byte(`apiKey: "abc"
+geoProvider: "chain"
+geoChain:
+  mode: "Consensus"
+  quorum: 2
+  providers:
+    - type: "mmdb"
+      path: "/var/lib/GeoIP/GeoLite2-City.mmdb"
+    - type: "ipapi-pro"
+    - type: "ipapi-free"
+    - type: "static"
+      entries:
+        - cidr: "10.0.0.0/8"
+          country: "US"
+          region: "CA"
+servers: []
+`), 0o600)
+	assert.NoError(t, err)
+	cfg, err := ReadConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, GeoProviderChain, cfg.GeoProvider)
+	assert.Equal(t, ChainModeConsensus, cfg.GeoChain.Mode)
+	assert.Len(t, cfg.GeoChain.Providers, 4)
+	assert.Equal(t, "US", cfg.GeoChain.Providers[3].Entries[0].Country)
+
+	invalid := []string{
+		`geoProvider: "chain"
+servers: []
+`,
+		`geoProvider: "chain"
+geoChain:
+  mode: "vote"
+  providers: [{type: "ipapi"}]
+servers: []
+`,
+		`geoProvider: "chain"
+geoChain:
+  providers: [{type: "ipapi-pro"}]
+servers: []
+`,
+		`geoProvider: "chain"
+geoChain:
+  mode: "consensus"
+  quorum: 3
+  providers: [{type: "ipapi"}, {type: "ipapi-free"}]
+servers: []
+`,
+		`geoProvider: "chain"
+geoChain:
+  providers: [{type: "static", entries: [{cidr: "nope", country: "US"}]}]
+servers: []
+`,
+		`geoProvider: "chain"
+geoChain:
+  providers: [{type: "mmdb"}]
+servers: []
+`,
+	}
+	for _, content := range invalid {
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		_, err = ReadConfig(path)
+		assert.Error(t, err, content)
+	}
+}
+
+func TestReadConfigBan(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+
+	assert.NoError(t, os.WriteFile(path, []byte("servers: []\n"), 0o600))
+	cfg, err := ReadConfig(path)
+	assert.NoError(t, err)
+	assert.False(t, cfg.Ban.Enabled())
+
+	assert.NoError(t, os.WriteFile(path, []byte(`ban:
+  maxRejections: 5
+  maxConnections: 100
+  ipv4Prefix: 24
+  file: " bans.json "
+servers: []
+`), 0o600))
+	cfg, err = ReadConfig(path)
+	assert.NoError(t, err)
+	assert.True(t, cfg.Ban.Enabled())
+	assert.Equal(t, time.Hour, cfg.Ban.Duration)
+	assert.Equal(t, 10*time.Minute, cfg.Ban.RejectionWindow)
+	assert.Equal(t, time.Minute, cfg.Ban.ConnectionWindow)
+	assert.Equal(t, 24, cfg.Ban.IPv4Prefix)
+	assert.Equal(t, "bans.json", cfg.Ban.File)
+
+	invalid := []string{
+		"ban:\n  maxRejections: -1\nservers: []\n",
+		"ban:\n  duration: -1s\nservers: []\n",
+		"ban:\n  ipv4Prefix: 33\nservers: []\n",
+		"ban:\n  ipv6Prefix: 129\nservers: []\n",
+	}
+	for _, content := range invalid {
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		_, err = ReadConfig(path)
+		assert.Error(t, err, content)
+	}
+}
+
+func TestReadConfigListFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	base := `listRefreshInterval: 10m
+servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "8080"
+    backendIP: "10.0.0.1"
+    backendPort: "9090"
+    allowedCountries: ["US"]
+`
+
+	assert.NoError(t, os.WriteFile(path, []byte(base+`    alwaysAllowedFiles: [" /etc/geoproxy/egress.txt ", "/etc/geoproxy/egress.txt"]
+    alwaysDeniedFiles: ["https://www.spamhaus.org/drop/drop.txt"]
+`), 0o600))
+	cfg, err := ReadConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 10*time.Minute, cfg.ListRefreshInterval)
+	assert.Equal(t, []string{"/etc/geoproxy/egress.txt"}, cfg.Servers[0].AlwaysAllowedFiles)
+	assert.Equal(t, []string{"https://www.spamhaus.org/drop/drop.txt"}, cfg.Servers[0].AlwaysDeniedFiles)
+
+	invalid := []string{
+		base + `    alwaysDeniedFiles: ["ftp://example.com/drop.txt"]
+`,
+		base + `    alwaysDeniedFiles: ["https://"]
+`,
+		base + `    alwaysAllowedFiles: [""]
+`,
+		"listRefreshInterval: -1m\nservers: []\n",
+	}
+	for _, content := range invalid {
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		_, err = ReadConfig(path)
+		assert.Error(t, err, content)
+	}
+}
+
+func TestReadConfigASNRules(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	base := `servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "8080"
+    backendIP: "10.0.0.1"
+    backendPort: "9090"
+    allowedCountries: ["US"]
+`
+
+	assert.NoError(t, os.WriteFile(path, []byte(base+`    allowedASNs: ["AS15169", "as13335", " 16509 "]
+    deniedASNs: ["14061"]
+    deniedOrgs: ["DigitalOcean"]
+`), 0o600))
+	cfg, err := ReadConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"15169", "13335", "16509"}, cfg.Servers[0].AllowedASNs)
+	assert.Equal(t, []string{"14061"}, cfg.Servers[0].DeniedASNs)
+	assert.Equal(t, []string{"DigitalOcean"}, cfg.Servers[0].DeniedOrgs)
+
+	invalid := []string{
+		base + `    allowedASNs: ["AS"]
+`,
+		base + `    deniedASNs: ["0"]
+`,
+		base + `    deniedASNs: ["4294967296"]
+`,
+		base + `    allowedOrgs: [" "]
+`,
+	}
+	for _, content := range invalid {
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		_, err = ReadConfig(path)
+		assert.Error(t, err, content)
+	}
+}
+
+func TestReadConfigTorExitList(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	server := `servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "8080"
+    backendIP: "10.0.0.1"
+    backendPort: "9090"
+    allowedCountries: ["US"]
+`
+
+	assert.NoError(t, os.WriteFile(path, []byte(server), 0o600))
+	cfg, err := ReadConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "", cfg.TorExitList)
+
+	assert.NoError(t, os.WriteFile(path, []byte(server+"    denyTor: true\n"), 0o600))
+	cfg, err = ReadConfig(path)
+	assert.NoError(t, err)
+	assert.True(t, cfg.Servers[0].DenyTor)
+	assert.Equal(t, DefaultTorExitList, cfg.TorExitList)
+
+	assert.NoError(t, os.WriteFile(path, []byte("torExitList: \" /var/lib/tor/exits.txt \"\n"+server+"    denyTor: true\n"), 0o600))
+	cfg, err = ReadConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "/var/lib/tor/exits.txt", cfg.TorExitList)
+
+	assert.NoError(t, os.WriteFile(path, []byte("torExitList: \"ftp://example.com/exits\"\n"+server), 0o600))
+	_, err = ReadConfig(path)
+	assert.Error(t, err)
+}
+
+func TestReadConfigLocationRules(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	base := `servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "8080"
+    backendIP: "10.0.0.1"
+    backendPort: "9090"
+    allowedCountries: ["US"]
+`
+
+	assert.NoError(t, os.WriteFile(path, []byte(base+`    allowedCities: ["Seattle", " Portland , US "]
+    allowedRadius:
+      - name: seattle
+        lat: 47.6062
+        lon: -122.3321
+        radiusKm: 50
+`), 0o600))
+	cfg, err := ReadConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"seattle", "portland,us"}, cfg.Servers[0].AllowedCities)
+	assert.Equal(t, []GeoRadiusConfig{{Name: "seattle", Lat: 47.6062, Lon: -122.3321, RadiusKm: 50}}, cfg.Servers[0].AllowedRadius)
+
+	invalid := []string{
+		base + `    allowedCities: [" "]
+`,
+		base + `    allowedCities: ["Portland, Oregon"]
+`,
+		base + `    allowedRadius: [{lat: 91, lon: 0, radiusKm: 10}]
+`,
+		base + `    allowedRadius: [{lat: 0, lon: -181, radiusKm: 10}]
+`,
+		base + `    allowedRadius: [{lat: 10, lon: 10}]
+`,
+	}
+	for _, content := range invalid {
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		_, err = ReadConfig(path)
+		assert.Error(t, err, content)
+	}
+}
+
+func TestReadConfigRules(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	base := `servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "8080"
+    backendIP: "10.0.0.1"
+    backendPort: "9090"
+`
+
+	assert.NoError(t, os.WriteFile(path, []byte(base+`    rules:
+      - action: " Allow "
+        tag: " de-weekdays "
+        countries: ["de"]
+        schedule:
+          daysOfWeek: ["Mon", "Tue", "Wed", "Thu", "Fri"]
+      - action: deny
+        cidrs: [" 198.51.100.0/24 "]
+        asns: ["AS14061"]
+        invert: true
+`), 0o600))
+	cfg, err := ReadConfig(path)
+	assert.NoError(t, err)
+	server := cfg.Servers[0]
+	assert.Equal(t, ActionDeny, server.DefaultAction)
+	if assert.Len(t, server.Rules, 2) {
+		assert.Equal(t, ActionAllow, server.Rules[0].Action)
+		assert.Equal(t, "de-weekdays", server.Rules[0].Tag)
+		assert.Equal(t, []string{"Mon", "Tue", "Wed", "Thu", "Fri"}, server.Rules[0].Schedule.DaysOfWeek)
+		assert.Equal(t, []string{"198.51.100.0/24"}, server.Rules[1].CIDRs)
+		assert.Equal(t, []string{"14061"}, server.Rules[1].ASNs)
+		assert.True(t, server.Rules[1].Invert)
+	}
+
+	invalid := []string{
+		base + `    rules: [{action: maybe}]
+`,
+		base + `    rules: [{action: allow, cidrs: ["bogus"]}]
+`,
+		base + `    rules: [{action: allow, asns: ["ASX"]}]
+`,
+		base + `    rules: [{action: allow}]
+    defaultAction: block
+`,
+		base + `    defaultAction: allow
+    allowedCountries: ["US"]
+`,
+		base + `    rules: [{action: allow}]
+    allowedCountries: ["US"]
+`,
+		base + `    rules: [{action: allow}]
+    startTime: "09:00"
+    endTime: "17:00"
+`,
+		base + `    rules: [{action: allow, country: ["US"]}]
+`,
+	}
+	for _, content := range invalid {
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		_, err = ReadConfig(path)
+		assert.Error(t, err, content)
+	}
+}
+
+func TestReadConfigSchedules(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	base := `servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "8080"
+    backendIP: "10.0.0.1"
+    backendPort: "9090"
+    allowedCountries: ["DE"]
+`
+
+	assert.NoError(t, os.WriteFile(path, []byte(base+`    timezone: " Europe/Berlin "
+    schedules:
+      - daysOfWeek: ["Mon", "Fri"]
+        startTime: "08:00"
+        endTime: "18:00"
+      - daysOfWeek: ["Sat"]
+        startDate: "2024-09-01"
+        endDate: "2024-12-31"
+`), 0o600))
+	cfg, err := ReadConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "Europe/Berlin", cfg.Servers[0].Timezone)
+	assert.Len(t, cfg.Servers[0].Schedules, 2)
+
+	assert.NoError(t, os.WriteFile(path, []byte(base+`    timezone: "Client"
+`), 0o600))
+	cfg, err = ReadConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, TimezoneClient, cfg.Servers[0].Timezone)
+
+	invalid := []string{
+		base + `    timezone: "Mars/Olympus_Mons"
+`,
+		base + `    schedules: [{startTime: "08:00", endTime: "18:00"}]
+    daysOfWeek: ["Mon"]
+`,
+		base + `    schedules: [{startTime: "08:00", endTime: "18:00"}]
+    startTime: "08:00"
+    endTime: "18:00"
+`,
+	}
+	for _, content := range invalid {
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		_, err = ReadConfig(path)
+		assert.Error(t, err, content)
+	}
+}
+
+func TestReadConfigExceptions(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	base := `servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "8080"
+    backendIP: "10.0.0.1"
+    backendPort: "9090"
+    allowedCountries: ["DE"]
+`
+
+	assert.NoError(t, os.WriteFile(path, []byte(base+`    exceptions:
+      - name: " Christmas "
+        date: "2024-12-25"
+      - name: "Maintenance"
+        start: "2024-06-03 02:00"
+        end: "2024-06-03 06:00"
+    calendarFiles: [" holidays.ics "]
+`), 0o600))
+	cfg, err := ReadConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "Christmas", cfg.Servers[0].Exceptions[0].Name)
+	assert.Equal(t, "2024-06-03 02:00", cfg.Servers[0].Exceptions[1].Start)
+	assert.Equal(t, []string{"holidays.ics"}, cfg.Servers[0].CalendarFiles)
+
+	invalid := []string{
+		`    exceptions: [{date: "2024-12-25"}]
+`,
+		`    exceptions: [{name: "x"}]
+`,
+		`    exceptions: [{name: "x", date: "2024-12-25", start: "2024-12-25"}]
+`,
+		`    exceptions: [{name: "x", start: "2024-12-25"}]
+`,
+		`    calendarFiles: [""]
+`,
+	}
+	for _, content := range invalid {
+		assert.NoError(t, os.WriteFile(path, []byte(base+content), 0o600))
+		_, err = ReadConfig(path)
+		assert.Error(t, err, content)
+	}
+}
+
+func TestReadConfigEnforceSchedule(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	base := `servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "8080"
+    backendIP: "10.0.0.1"
+    backendPort: "9090"
+    allowedCountries: ["DE"]
+    startTime: "08:00"
+    endTime: "18:00"
+`
+
+	assert.NoError(t, os.WriteFile(path, []byte(base+`    enforceScheduleOnActive: true
+    scheduleGracePeriod: 5m
+`), 0o600))
+	cfg, err := ReadConfig(path)
+	assert.NoError(t, err)
+	assert.True(t, cfg.Servers[0].EnforceScheduleOnActive)
+	assert.Equal(t, 5*time.Minute, cfg.Servers[0].ScheduleGracePeriod)
+
+	for _, content := range []string{
+		`    scheduleGracePeriod: 5m
+`,
+		`    enforceScheduleOnActive: true
+    scheduleGracePeriod: -5m
+`,
+	} {
+		assert.NoError(t, os.WriteFile(path, []byte(base+content), 0o600))
+		_, err = ReadConfig(path)
+		assert.Error(t, err, content)
+	}
+}
+
+func TestReadConfigBackends(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	base := `servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "2222"
+    allowedCountries: ["DE"]
+`
+
+	assert.NoError(t, os.WriteFile(path, []byte(base+`    loadBalancing: " Source-IP-Hash "
+    backends:
+      - ip: "10.0.0.1"
+        port: "22"
+        weight: 3
+      - ip: " 10.0.0.2 "
+        port: "22"
+`), 0o600))
+	cfg, err := ReadConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, BalanceSourceIPHash, cfg.Servers[0].LoadBalancing)
+	assert.Equal(t, []BackendConfig{{IP: "10.0.0.1", Port: "22", Weight: 3}, {IP: "10.0.0.2", Port: "22", Weight: 1}},
+		cfg.Servers[0].Backends)
+
+	assert.NoError(t, os.WriteFile(path, []byte(base+`    backends:
+      - ip: "10.0.0.1"
+        port: "22"
+`), 0o600))
+	cfg, err = ReadConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, BalanceRoundRobin, cfg.Servers[0].LoadBalancing)
+
+	for _, content := range []string{
+		`    backendIP: "10.0.0.9"
+    backends:
+      - ip: "10.0.0.1"
+        port: "22"
+`,
+		`    backends:
+      - ip: "10.0.0.1"
+`,
+		`    backends:
+      - ip: "10.0.0.1"
+        port: "22"
+        weight: -1
+`,
+		`    backends:
+      - ip: "10.0.0.1"
+        port: "22"
+        weight: 0
+`,
+		`    backends:
+      - ip: "10.0.0.1"
+        port: "22"
+        weight: 1001
+`,
+		`    loadBalancing: "fastest"
+    backends:
+      - ip: "10.0.0.1"
+        port: "22"
+`,
+		`    backendIP: "10.0.0.1"
+    backendPort: "22"
+    loadBalancing: "random"
+`,
+	} {
+		assert.NoError(t, os.WriteFile(path, []byte(base+content), 0o600))
+		_, err = ReadConfig(path)
+		assert.Error(t, err, content)
+	}
+}
@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"geoproxy/accesslog"
+	"geoproxy/mocks"
+	"io"
+	"testing"
+
+	"github.com/pires/go-proxyproto"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingAccessLog struct {
+	records []accesslog.Record
+}
+
+func (r *recordingAccessLog) Log(rec accesslog.Record) {
+	r.records = append(r.records, rec)
+}
+
+func TestHandlerAccessLog(t *testing.T) {
+	log := &recordingAccessLog{}
+	newHandler := func(country string) *ClientHandler {
+		return &ClientHandler{
+			AllowedCountries: map[string]bool{"US": true},
+			IPApiClient:      &GetCountryCodeMock{ReturnCountry: country, ReturnRegion: "CA", ReturnCached: "cached"},
+			TransferFunc: func(client Connection, backend Connection, _ *proxyproto.Header) {
+				_, _ = io.Copy(io.Discard, client)
+				_, _ = io.Copy(io.Discard, backend)
+			},
+			BackendDialer: &staticDialer{conn: &payloadConn{MockNetConn: mocks.MockNetConn{IPVersion: 4}, payload: []byte("pong!")}},
+			BackendAddr:   "10.0.0.5",
+			BackendPort:   "443",
+			ServerName:    "web",
+			ListenAddr:    "0.0.0.0:443",
+			AccessLog:     log,
+		}
+	}
+
+	newHandler("US").HandleClient(context.Background(), &payloadConn{MockNetConn: mocks.MockNetConn{IPVersion: 4}, payload: []byte("ping")})
+	newHandler("CN").HandleClient(context.Background(), &mocks.MockNetConn{IPVersion: 4})
+	failing := newHandler("US")
+	failing.BackendDialer = &staticDialer{err: fmt.Errorf("refused")}
+	failing.HandleClient(context.Background(), &mocks.MockNetConn{IPVersion: 4})
+
+	if !assert.Len(t, log.records, 3) {
+		return
+	}
+	accepted := log.records[0]
+	assert.Equal(t, "web", accepted.Server)
+	assert.Equal(t, "0.0.0.0:443", accepted.Listen)
+	assert.Equal(t, "127.0.0.1", accepted.ClientIP)
+	assert.Equal(t, "8080", accepted.ClientPort)
+	assert.Equal(t, "US", accepted.Country)
+	assert.Equal(t, "CA", accepted.Region)
+	assert.Equal(t, "cached", accepted.Cache)
+	assert.Equal(t, accesslog.DecisionAccept, accepted.Decision)
+	assert.Equal(t, "10.0.0.5:443", accepted.Backend)
+	assert.Equal(t, int64(4), accepted.BytesUp)
+	assert.Equal(t, int64(5), accepted.BytesDown)
+	assert.False(t, accepted.Start.IsZero())
+	assert.False(t, accepted.End.Before(accepted.Start))
+
+	assert.Equal(t, accesslog.DecisionReject, log.records[1].Decision)
+	assert.Equal(t, "country or region denied", log.records[1].Reason)
+	assert.Equal(t, accesslog.DecisionError, log.records[2].Decision)
+	assert.Equal(t, "backend dial failed", log.records[2].Reason)
+}
@@ -0,0 +1,201 @@
+package handler
+
+import (
+	"hash/fnv"
+	"math"
+	"math/rand/v2"
+	"net"
+	"sort"
+	"sync/atomic"
+)
+
+// Strategies for Balancer.
+const (
+	BalanceRoundRobin       = "round-robin"
+	BalanceLeastConnections = "least-connections"
+	BalanceRandom           = "random"
+	BalanceSourceIPHash     = "source-ip-hash"
+)
+
+// Backend is one of a server's backends. Weight scales its share of the
+// connections; values below 1 count as 1.
+type Backend struct {
+	Addr   string
+	Port   string
+	Weight int
+
+	active atomic.Int64
+}
+
+// Address returns the backend's host:port.
+func (b *Backend) Address() string {
+	return net.JoinHostPort(b.Addr, b.Port)
+}
+
+// Active returns the number of connections currently proxied to b.
+func (b *Backend) Active() int64 {
+	return b.active.Load()
+}
+
+func (b *Backend) weight() int {
+	return max(b.Weight, 1)
+}
+
+// Balancer spreads a server's connections over its backends. It is shared
+// by all of the server's handlers and safe for concurrent use.
+type Balancer struct {
+	strategy string
+	backends []*Backend
+	// slots is one weighted round of backend indexes, interleaved so that a
+	// heavy backend doesn't get its whole share in a row.
+	slots []int
+	total int
+	next  atomic.Uint64
+}
+
+// NewBalancer returns a balancer over backends. An unknown strategy falls
+// back to round-robin.
+func NewBalancer(strategy string, backends []*Backend) *Balancer {
+	b := &Balancer{strategy: strategy, backends: backends}
+	for _, be := range backends {
+		b.total += be.weight()
+	}
+	b.slots = smoothRound(backends, b.total)
+	return b
+}
+
+// smoothRound lays out one round of smooth weighted round-robin: weights 5, 1
+// and 1 give a, a, b, a, c, a, a rather than a, a, a, a, a, b, c.
+func smoothRound(backends []*Backend, total int) []int {
+	current := make([]int, len(backends))
+	slots := make([]int, 0, total)
+	for range total {
+		best := 0
+		for i, be := range backends {
+			current[i] += be.weight()
+			if current[i] > current[best] {
+				best = i
+			}
+		}
+		current[best] -= total
+		slots = append(slots, best)
+	}
+	return slots
+}
+
+// Backends returns the backends in configuration order.
+func (b *Balancer) Backends() []*Backend {
+	return b.backends
+}
+
+// Reuse returns old in place of b when both balance over the same backends,
+// in the same order and with the same weights, so that a reload keeps the
+// connection counts and the round-robin position. When only the strategy
+// differs, it returns a balancer with b's strategy over old's backends, which
+// keeps the counts. Otherwise, or when old is nil, it returns b.
+func (b *Balancer) Reuse(old *Balancer) *Balancer {
+	if b == nil || old == nil || len(b.backends) != len(old.backends) {
+		return b
+	}
+	for i, be := range b.backends {
+		o := old.backends[i]
+		if be.Addr != o.Addr || be.Port != o.Port || be.weight() != o.weight() {
+			return b
+		}
+	}
+	if b.strategy == old.strategy {
+		return old
+	}
+	return NewBalancer(b.strategy, old.backends)
+}
+
+// Order returns every backend in the order a connection from ip should try
+// them: the strategy's pick first, then the rest as fallbacks should the
+// dial fail. For source-ip-hash, the fallbacks are the client's next
+// choices, so a client keeps landing on the same backend while the ones
+// before it are down.
+func (b *Balancer) Order(ip string) []*Backend {
+	if len(b.backends) == 0 {
+		return nil
+	}
+	var first int
+	switch b.strategy {
+	case BalanceSourceIPHash:
+		return b.byHash(ip)
+	case BalanceLeastConnections:
+		first = b.leastConnections()
+	case BalanceRandom:
+		first = b.random()
+	default:
+		first = b.slots[b.next.Add(1)%uint64(len(b.slots))]
+	}
+	order := make([]*Backend, 0, len(b.backends))
+	for i := range b.backends {
+		order = append(order, b.backends[(first+i)%len(b.backends)])
+	}
+	return order
+}
+
+// leastConnections picks the backend with the fewest active connections per
+// unit of weight. Ties rotate, so idle backends share the load.
+func (b *Balancer) leastConnections() int {
+	start := int(b.next.Add(1) % uint64(len(b.backends)))
+	best := start
+	for i := 1; i < len(b.backends); i++ {
+		c := (start + i) % len(b.backends)
+		// active/weight < best's active/weight, without dividing.
+		if b.backends[c].Active()*int64(b.backends[best].weight()) <
+			b.backends[best].Active()*int64(b.backends[c].weight()) {
+			best = c
+		}
+	}
+	return best
+}
+
+func (b *Balancer) random() int {
+	n := rand.IntN(b.total)
+	for i, be := range b.backends {
+		if n < be.weight() {
+			return i
+		}
+		n -= be.weight()
+	}
+	return len(b.backends) - 1
+}
+
+// byHash ranks the backends by weighted rendezvous hashing of ip and their
+// address. A client's ranking only depends on the backends themselves, so
+// adding or removing one moves just the clients that gain or lose it.
+func (b *Balancer) byHash(ip string) []*Backend {
+	type ranked struct {
+		backend *Backend
+		score   float64
+	}
+	scores := make([]ranked, len(b.backends))
+	for i, be := range b.backends {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(ip))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(be.Address()))
+		// A uniform value in (0, 1); -weight/ln(u) is the weighted score.
+		u := (float64(mix64(h.Sum64())>>11) + 0.5) / (1 << 53)
+		scores[i] = ranked{be, -float64(be.weight()) / math.Log(u)}
+	}
+	sort.SliceStable(scores, func(i, j int) bool { return scores[i].score > scores[j].score })
+	order := make([]*Backend, len(scores))
+	for i, s := range scores {
+		order[i] = s.backend
+	}
+	return order
+}
+
+// mix64 spreads the bits of an FNV hash, whose high bits barely change
+// between keys that only differ at the end, such as neighbouring addresses.
+func mix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
@@ -0,0 +1,177 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func backends(weights ...int) []*Backend {
+	out := make([]*Backend, 0, len(weights))
+	for i, w := range weights {
+		out = append(out, &Backend{Addr: fmt.Sprintf("10.0.0.%d", i+1), Port: "22", Weight: w})
+	}
+	return out
+}
+
+// picks counts how often each backend comes first in n orders, by address.
+func picks(b *Balancer, n int, ip func(int) string) map[string]int {
+	counts := map[string]int{}
+	for i := range n {
+		order := b.Order(ip(i))
+		counts[order[0].Addr]++
+	}
+	return counts
+}
+
+func clientIP(i int) string {
+	return fmt.Sprintf("192.0.%d.%d", i/256, i%256)
+}
+
+func TestBalancerRoundRobin(t *testing.T) {
+	b := NewBalancer(BalanceRoundRobin, backends(2, 1, 0))
+	assert.Equal(t, map[string]int{"10.0.0.1": 40, "10.0.0.2": 20, "10.0.0.3": 20}, picks(b, 80, clientIP))
+
+	// The weighted share is interleaved rather than handed out in a row.
+	b = NewBalancer(BalanceRoundRobin, backends(5, 1, 1))
+	assert.Equal(t, []int{0, 0, 1, 0, 2, 0, 0}, b.slots)
+
+	order := b.Order("192.0.2.1")
+	assert.Len(t, order, 3)
+	assert.ElementsMatch(t, b.Backends(), order)
+}
+
+func TestBalancerLeastConnections(t *testing.T) {
+	b := NewBalancer(BalanceLeastConnections, backends(1, 1, 1))
+	b.backends[0].active.Store(2)
+	b.backends[2].active.Store(1)
+	assert.Equal(t, "10.0.0.2", b.Order("192.0.2.1")[0].Addr)
+
+	// Idle backends take turns.
+	b.backends[0].active.Store(0)
+	b.backends[2].active.Store(0)
+	assert.Equal(t, map[string]int{"10.0.0.1": 10, "10.0.0.2": 10, "10.0.0.3": 10}, picks(b, 30, clientIP))
+
+	// Connections count per unit of weight: 2 of 4 beats 1 of 1.
+	b = NewBalancer(BalanceLeastConnections, backends(4, 1))
+	b.backends[0].active.Store(2)
+	b.backends[1].active.Store(1)
+	assert.Equal(t, "10.0.0.1", b.Order("192.0.2.1")[0].Addr)
+}
+
+func TestBalancerRandom(t *testing.T) {
+	b := NewBalancer(BalanceRandom, backends(3, 1))
+	counts := picks(b, 4000, clientIP)
+	assert.InDelta(t, 3000, counts["10.0.0.1"], 300)
+	assert.InDelta(t, 1000, counts["10.0.0.2"], 300)
+}
+
+func TestBalancerSourceIPHash(t *testing.T) {
+	b := NewBalancer(BalanceSourceIPHash, backends(1, 1, 1))
+	first := b.Order("198.51.100.7")
+	for range 10 {
+		assert.Equal(t, first, b.Order("198.51.100.7"))
+	}
+	assert.Len(t, first, 3)
+
+	counts := picks(b, 3000, clientIP)
+	for _, be := range b.Backends() {
+		assert.InDelta(t, 1000, counts[be.Addr], 150, be.Addr)
+	}
+
+	// Removing a backend only moves the clients that were on it.
+	two := NewBalancer(BalanceSourceIPHash, b.Backends()[:2])
+	for i := range 1000 {
+		was := b.Order(clientIP(i))
+		if was[0] != b.Backends()[2] {
+			assert.Same(t, was[0], two.Order(clientIP(i))[0], clientIP(i))
+		} else {
+			// They fall back to their second choice.
+			assert.Same(t, was[1], two.Order(clientIP(i))[0], clientIP(i))
+		}
+	}
+
+	weighted := NewBalancer(BalanceSourceIPHash, backends(3, 1))
+	counts = picks(weighted, 4000, clientIP)
+	assert.InDelta(t, 3000, counts["10.0.0.1"], 300)
+}
+
+type failingDialer struct {
+	down   map[string]bool
+	dialed []string
+}
+
+func (d *failingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.dialed = append(d.dialed, address)
+	if d.down[address] {
+		return nil, errors.New("connection refused")
+	}
+	return newBlockingConn(), nil
+}
+
+func TestHandlerBalancerFailover(t *testing.T) {
+	balancer := NewBalancer(BalanceSourceIPHash, backends(1, 1, 1))
+	order := balancer.Order("127.0.0.1")
+	dialer := &failingDialer{down: map[string]bool{order[0].Address(): true}}
+	log := &recordingAccessLog{}
+	h := &ClientHandler{
+		AlwaysAllowedSet: ipSet(t, "127.0.0.1"),
+		TransferFunc:     TransferFuncMock,
+		BackendDialer:    dialer,
+		Balancer:         balancer,
+		AccessLog:        log,
+	}
+	h.HandleClient(context.Background(), newBlockingConn())
+
+	assert.Equal(t, []string{order[0].Address(), order[1].Address()}, dialer.dialed)
+	assert.Equal(t, order[1].Addr, h.BackendAddr)
+	if assert.Len(t, log.records, 1) {
+		assert.Equal(t, order[1].Address(), log.records[0].Backend)
+	}
+	// The connection is over, so nothing is counted as active.
+	for _, be := range balancer.Backends() {
+		assert.Zero(t, be.Active())
+	}
+
+	// With every backend down the client is dropped.
+	dialer = &failingDialer{down: map[string]bool{}}
+	for _, be := range balancer.Backends() {
+		dialer.down[be.Address()] = true
+	}
+	log = &recordingAccessLog{}
+	h = &ClientHandler{
+		AlwaysAllowedSet: ipSet(t, "127.0.0.1"),
+		TransferFunc:     TransferFuncMock,
+		BackendDialer:    dialer,
+		Balancer:         balancer,
+		AccessLog:        log,
+	}
+	h.HandleClient(context.Background(), newBlockingConn())
+	assert.Len(t, dialer.dialed, 3)
+	if assert.Len(t, log.records, 1) {
+		assert.Equal(t, "backend dial failed", log.records[0].Reason)
+	}
+}
+
+func TestHandlerBalancerRejectLogsNoBackend(t *testing.T) {
+	log := &recordingAccessLog{}
+	h := &ClientHandler{
+		AlwaysDeniedSet: ipSet(t, "127.0.0.1"),
+		TransferFunc:    TransferFuncMock,
+		BackendDialer:   &failingDialer{},
+		Balancer:        NewBalancer(BalanceRoundRobin, backends(1, 1)),
+		ServerName:      "web",
+		AccessLog:       log,
+	}
+	h.HandleClient(context.Background(), newBlockingConn())
+
+	assert.Equal(t, "backends of web", h.destination())
+	if assert.Len(t, log.records, 1) {
+		assert.Equal(t, "Always denied", log.records[0].Reason)
+		assert.Empty(t, log.records[0].Backend)
+	}
+}
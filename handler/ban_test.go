@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"geoproxy/ban"
+	"geoproxy/mocks"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandlerBans(t *testing.T) {
+	bans := ban.New(ban.Policy{Duration: time.Hour, MaxRejections: 2, RejectionWindow: time.Minute})
+	newHandler := func(geo *GetCountryCodeMock) *ClientHandler {
+		return &ClientHandler{
+			AllowedCountries: map[string]bool{"US": true},
+			IPApiClient:      geo,
+			TransferFunc:     TransferFuncMock,
+			BackendDialer:    &staticDialer{conn: &mocks.MockNetConn{IPVersion: 4}},
+			BackendAddr:      "127.0.0.1",
+			BackendPort:      "8080",
+			Bans:             bans,
+		}
+	}
+
+	// Lookup failures don't count towards a ban.
+	for i := 0; i < 3; i++ {
+		h := newHandler(&GetCountryCodeMock{Err: errors.New("boom")})
+		h.HandleClient(context.Background(), &mocks.MockNetConn{IPVersion: 4})
+		assert.False(t, h.accepted)
+	}
+	assert.False(t, bans.Banned("127.0.0.1"))
+
+	for i := 0; i < 2; i++ {
+		h := newHandler(&GetCountryCodeMock{ReturnCountry: "CN"})
+		h.HandleClient(context.Background(), &mocks.MockNetConn{IPVersion: 4})
+		assert.Equal(t, "country or region denied", h.DeniedReason)
+	}
+	assert.True(t, bans.Banned("127.0.0.1"))
+
+	// A banned client is rejected before the geo lookup.
+	h := newHandler(&GetCountryCodeMock{ReturnCountry: "US"})
+	h.HandleClient(context.Background(), &mocks.MockNetConn{IPVersion: 4})
+	assert.False(t, h.accepted)
+	assert.Equal(t, ReasonBanned, h.DeniedReason)
+	assert.Equal(t, "--", h.cached)
+
+	// alwaysAllowed is exempt.
+	h = newHandler(&GetCountryCodeMock{ReturnCountry: "CN"})
+	h.AlwaysAllowedSet = ipSet(t, "127.0.0.1")
+	h.HandleClient(context.Background(), &mocks.MockNetConn{IPVersion: 4})
+	assert.True(t, h.accepted)
+}
+
+func TestHandlerConnectionRateBan(t *testing.T) {
+	bans := ban.New(ban.Policy{Duration: time.Hour, MaxConnections: 3, ConnectionWindow: time.Minute})
+	var reasons []string
+	for i := 0; i < 4; i++ {
+		h := &ClientHandler{
+			AllowedCountries: map[string]bool{"US": true},
+			IPApiClient:      &GetCountryCodeMock{ReturnCountry: "US"},
+			TransferFunc:     TransferFuncMock,
+			BackendDialer:    &staticDialer{conn: &mocks.MockNetConn{IPVersion: 4}},
+			BackendAddr:      "127.0.0.1",
+			BackendPort:      "8080",
+			Bans:             bans,
+		}
+		h.HandleClient(context.Background(), &mocks.MockNetConn{IPVersion: 4})
+		reasons = append(reasons, h.DeniedReason)
+	}
+	assert.Equal(t, []string{"", "", ReasonBanned, ReasonBanned}, reasons)
+}
@@ -0,0 +1,137 @@
+package handler
+
+import (
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ConnLimiter bounds concurrent client connections per source. Acquire reports
+// whether a new connection from ip may proceed; every successful Acquire must be
+// paired with a Release for the same ip.
+type ConnLimiter interface {
+	Acquire(ip string) bool
+	Release(ip string)
+}
+
+// ConnCount is a snapshot of the connections currently held by one limiter key.
+type ConnCount struct {
+	Key   string
+	Count int
+}
+
+// PerIPConnLimiter counts active connections per source IP, or per source prefix
+// when aggregation is enabled. A max of 0 disables limiting but still tracks
+// counts so Top keeps working.
+type PerIPConnLimiter struct {
+	max        int
+	ipv4Prefix int
+	ipv6Prefix int
+
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func NewPerIPConnLimiter(max int) *PerIPConnLimiter {
+	return NewPrefixConnLimiter(max, 32, 128)
+}
+
+// NewPrefixConnLimiter groups IPv4 clients by their leading ipv4Bits and IPv6
+// clients by their leading ipv6Bits (e.g. 24 and 64), so a single network can't
+// dodge the limit by rotating addresses.
+func NewPrefixConnLimiter(max int, ipv4Bits int, ipv6Bits int) *PerIPConnLimiter {
+	if max < 0 {
+		max = 0
+	}
+	if ipv4Bits <= 0 || ipv4Bits > 32 {
+		ipv4Bits = 32
+	}
+	if ipv6Bits <= 0 || ipv6Bits > 128 {
+		ipv6Bits = 128
+	}
+	return &PerIPConnLimiter{
+		max:        max,
+		ipv4Prefix: ipv4Bits,
+		ipv6Prefix: ipv6Bits,
+		counts:     make(map[string]int),
+	}
+}
+
+func (l *PerIPConnLimiter) Acquire(ip string) bool {
+	key := l.key(ip)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max > 0 && l.counts[key] >= l.max {
+		return false
+	}
+	l.counts[key]++
+	return true
+}
+
+func (l *PerIPConnLimiter) Release(ip string) {
+	key := l.key(ip)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n, ok := l.counts[key]
+	if !ok {
+		return
+	}
+	if n <= 1 {
+		delete(l.counts, key)
+		return
+	}
+	l.counts[key] = n - 1
+}
+
+// Count returns the number of connections currently held by the key ip maps to.
+func (l *PerIPConnLimiter) Count(ip string) int {
+	key := l.key(ip)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.counts[key]
+}
+
+// Top returns up to n keys holding the most connections, busiest first. Ties are
+// ordered by key so the output is stable. n <= 0 returns every key.
+func (l *PerIPConnLimiter) Top(n int) []ConnCount {
+	l.mu.Lock()
+	out := make([]ConnCount, 0, len(l.counts))
+	for k, c := range l.counts {
+		out = append(out, ConnCount{Key: k, Count: c})
+	}
+	l.mu.Unlock()
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Key < out[j].Key
+	})
+	if n > 0 && len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+func (l *PerIPConnLimiter) key(ip string) string {
+	ip = strings.TrimSpace(ip)
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		// Unparseable input still gets its own bucket rather than bypassing the limit.
+		return ip
+	}
+	addr = addr.Unmap().WithZone("")
+	bits := l.ipv6Prefix
+	if addr.Is4() {
+		bits = l.ipv4Prefix
+	}
+	if bits == addr.BitLen() {
+		return addr.String()
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return addr.String()
+	}
+	return prefix.String()
+}
@@ -0,0 +1,153 @@
+package handler
+
+import (
+	"context"
+	"geoproxy/mocks"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPerIPConnLimiterAcquireRelease(t *testing.T) {
+	l := NewPerIPConnLimiter(2)
+
+	assert.True(t, l.Acquire("1.2.3.4"))
+	assert.True(t, l.Acquire("1.2.3.4"))
+	assert.False(t, l.Acquire("1.2.3.4"))
+	assert.True(t, l.Acquire("1.2.3.5"))
+	assert.Equal(t, 2, l.Count("1.2.3.4"))
+
+	l.Release("1.2.3.4")
+	assert.True(t, l.Acquire("1.2.3.4"))
+
+	l.Release("1.2.3.4")
+	l.Release("1.2.3.4")
+	l.Release("1.2.3.5")
+	assert.Equal(t, 0, l.Count("1.2.3.4"))
+	assert.Empty(t, l.Top(0))
+}
+
+func TestPerIPConnLimiterReleaseUnknownIsNoop(t *testing.T) {
+	l := NewPerIPConnLimiter(1)
+	l.Release("1.2.3.4")
+	assert.Equal(t, 0, l.Count("1.2.3.4"))
+	assert.True(t, l.Acquire("1.2.3.4"))
+	assert.False(t, l.Acquire("1.2.3.4"))
+}
+
+func TestPerIPConnLimiterZeroDisablesLimit(t *testing.T) {
+	l := NewPerIPConnLimiter(0)
+	for i := 0; i < 100; i++ {
+		assert.True(t, l.Acquire("1.2.3.4"))
+	}
+	assert.Equal(t, 100, l.Count("1.2.3.4"))
+}
+
+func TestPerIPConnLimiterNormalizesAddresses(t *testing.T) {
+	l := NewPerIPConnLimiter(1)
+	assert.True(t, l.Acquire("1.2.3.4"))
+	assert.False(t, l.Acquire("::ffff:1.2.3.4"))
+	assert.True(t, l.Acquire("fe80::1%eth0"))
+	assert.False(t, l.Acquire("fe80::1"))
+}
+
+func TestPrefixConnLimiterAggregates(t *testing.T) {
+	l := NewPrefixConnLimiter(2, 24, 64)
+
+	assert.True(t, l.Acquire("10.0.0.1"))
+	assert.True(t, l.Acquire("10.0.0.2"))
+	assert.False(t, l.Acquire("10.0.0.3"))
+	assert.True(t, l.Acquire("10.0.1.1"))
+
+	assert.True(t, l.Acquire("2001:db8::1"))
+	assert.True(t, l.Acquire("2001:db8::ffff:1"))
+	assert.False(t, l.Acquire("2001:db8::2"))
+	assert.True(t, l.Acquire("2001:db8:0:1::1"))
+
+	assert.Equal(t, 2, l.Count("10.0.0.200"))
+	l.Release("10.0.0.99")
+	assert.Equal(t, 1, l.Count("10.0.0.1"))
+}
+
+func TestPerIPConnLimiterTop(t *testing.T) {
+	l := NewPrefixConnLimiter(0, 24, 64)
+	for i := 0; i < 3; i++ {
+		l.Acquire("10.0.0.1")
+	}
+	l.Acquire("10.0.1.1")
+	l.Acquire("10.0.2.1")
+	l.Acquire("10.0.2.2")
+
+	top := l.Top(2)
+	assert.Equal(t, []ConnCount{
+		{Key: "10.0.0.0/24", Count: 3},
+		{Key: "10.0.2.0/24", Count: 2},
+	}, top)
+
+	all := l.Top(0)
+	assert.Len(t, all, 3)
+	assert.Equal(t, ConnCount{Key: "10.0.1.0/24", Count: 1}, all[2])
+}
+
+func TestPerIPConnLimiterConcurrent(t *testing.T) {
+	const max = 5
+	l := NewPerIPConnLimiter(max)
+
+	var held int32
+	var peak int32
+	var wg sync.WaitGroup
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				if !l.Acquire("1.2.3.4") {
+					continue
+				}
+				n := atomic.AddInt32(&held, 1)
+				for {
+					p := atomic.LoadInt32(&peak)
+					if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+						break
+					}
+				}
+				_ = l.Top(1)
+				atomic.AddInt32(&held, -1)
+				l.Release("1.2.3.4")
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.LessOrEqual(t, int(peak), max)
+	assert.Equal(t, 0, l.Count("1.2.3.4"))
+}
+
+func TestHandleClientConnLimiterRejectsAndReleases(t *testing.T) {
+	l := NewPerIPConnLimiter(1)
+	newHandler := func() *ClientHandler {
+		return &ClientHandler{
+			AllowedCountries: map[string]bool{"US": true},
+			IPApiClient:      &GetCountryCodeMock{ReturnCountry: "US"},
+			TransferFunc:     TransferFuncMock,
+			BackendDialer:    &staticDialer{conn: &mocks.MockNetConn{IPVersion: 4}},
+			BackendAddr:      "127.0.0.1",
+			BackendPort:      "8080",
+			ConnLimiter:      l,
+		}
+	}
+
+	assert.True(t, l.Acquire("127.0.0.1"))
+	h := newHandler()
+	h.HandleClient(context.Background(), &mocks.MockNetConn{IPVersion: 4})
+	assert.False(t, h.accepted)
+	assert.Equal(t, "too many concurrent connections from source IP", h.DeniedReason)
+	l.Release("127.0.0.1")
+
+	h = newHandler()
+	h.HandleClient(context.Background(), &mocks.MockNetConn{IPVersion: 4})
+	assert.True(t, h.accepted)
+	assert.Equal(t, 0, l.Count("127.0.0.1"))
+}
@@ -0,0 +1,35 @@
+package handler
+
+import (
+	"geoproxy/metrics"
+	"sync/atomic"
+)
+
+// countingConn counts the bytes read from a connection, i.e. the bytes flowing
+// out of it towards the other side of the proxy.
+type countingConn struct {
+	Connection
+	n     *atomic.Int64
+	total *metrics.Counter
+}
+
+func withByteCount(c Connection, n *atomic.Int64, total *metrics.Counter) Connection {
+	return &countingConn{Connection: c, n: n, total: total}
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Connection.Read(b)
+	if n > 0 {
+		c.n.Add(int64(n))
+		c.total.Add(uint64(n))
+	}
+	return n, err
+}
+
+func (c *countingConn) CloseWrite() error {
+	return closeWrite(c.Connection)
+}
+
+func (c *countingConn) CloseRead() error {
+	return closeRead(c.Connection)
+}
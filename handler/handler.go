@@ -2,17 +2,29 @@ package handler
 
 import (
 	"context"
+	"errors"
+	"geoproxy/accesslog"
 	"geoproxy/common"
 	"geoproxy/ipapi"
+	"geoproxy/metrics"
+	"geoproxy/rules"
 	"io"
 	"log"
 	"net"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	proxyproto "github.com/pires/go-proxyproto"
 )
 
+// Policies for OnLookupFailure, applied when the geolocation lookup errors.
+const (
+	LookupFailureDeny     = "deny"
+	LookupFailureAllow    = "allow"
+	LookupFailureFallback = "fallback"
+)
+
 type Handler interface {
 	HandleClient(context.Context, Connection)
 }
@@ -22,16 +34,16 @@ type ClientHandler struct {
 	AllowedRegions       map[string]bool
 	DeniedCountries      map[string]bool
 	DeniedRegions        map[string]bool
-	AlwaysAllowed        []string
-	AlwaysDenied         []string
 	IPApiClient          ipapi.IPAPI
-	CheckIps             common.CheckIP
 	TransferFunc         func(Connection, Connection, *proxyproto.Header)
 	BackendDialer        BackendDialer
 	BackendAddr          string
 	BackendPort          string
 	countryCode          string
 	region               string
+	reply                ipapi.Reply
+	looked               bool
+	lookupErr            error
 	cached               string
 	clientConn           Connection
 	accepted             bool
@@ -47,8 +59,89 @@ type ClientHandler struct {
 	DaysOfWeek           map[time.Weekday]bool
 	Now                  time.Time
 	DeniedReason         string
+	AllowedReason        string
 	IdleTimeout          time.Duration
 	ConnLimiter          ConnLimiter
+	OnLookupFailure      string
+	// AlwaysAllowedSet, AlwaysDeniedSet and LookupFailureAllowedSet are the
+	// compiled alwaysAllowed, alwaysDenied and lookupFailureAllowed lists. A
+	// nil set matches nothing.
+	AlwaysAllowedSet        common.IPMatcher
+	AlwaysDeniedSet         common.IPMatcher
+	LookupFailureAllowedSet common.IPMatcher
+	// AllowedASNs and DeniedASNs restrict clients by autonomous system, and
+	// AllowedOrgs and DeniedOrgs by lower-case substrings of the AS name,
+	// organization or ISP. They apply after the country and region check.
+	AllowedASNs map[uint32]bool
+	DeniedASNs  map[uint32]bool
+	AllowedOrgs []string
+	DeniedOrgs  []string
+	// DenyHosting, DenyProxy and DenyMobile reject clients that the lookup
+	// flags as a hosting provider, a proxy/VPN/Tor exit, or a cellular network.
+	DenyHosting bool
+	DenyProxy   bool
+	DenyMobile  bool
+	// AllowedCities ("seattle" or "portland,us") and AllowedRadius narrow
+	// the country and region check: when either is set, the client must be
+	// in one of the cities or within one of the circles.
+	AllowedCities map[string]bool
+	AllowedRadius []common.GeoRadius
+	// Rules decides which clients are allowed once the lists, bans and Tor
+	// check have passed. When nil, the legacy country, region and schedule
+	// fields above are translated into rules for each connection.
+	Rules *rules.Set
+	// DenyTor rejects clients on the TorExits list before any lookup.
+	DenyTor  bool
+	TorExits common.IPMatcher
+	// EnforceScheduleOnActive closes connections that Rules allowed once the
+	// rules stop allowing the client, e.g. when its schedule window ends,
+	// after ScheduleGracePeriod.
+	EnforceScheduleOnActive bool
+	ScheduleGracePeriod     time.Duration
+	// Balancer, when set, picks the backend for each connection instead of
+	// BackendAddr and BackendPort, failing over to the next backend when a
+	// dial fails.
+	Balancer *Balancer
+	// ServerName labels this handler's metrics and access log records. It is
+	// the server's configured name, or its listen address.
+	ServerName string
+	ListenAddr string
+	AccessLog  AccessLogger
+	// Conns, when set, tracks proxied connections for the admin API.
+	Conns *ConnRegistry
+	// TempRules holds runtime deny/allow entries checked next to
+	// AlwaysDeniedSet and AlwaysAllowedSet.
+	TempRules *TempRules
+	// Bans, when set, rejects banned clients before any lookup and counts
+	// connections and rejections towards automatic bans.
+	Bans         BanList
+	lookupFailed bool
+	clientPort   string
+	killed       atomic.Bool
+	startedAt    time.Time
+	bytesUp      atomic.Int64
+	bytesDown    atomic.Int64
+	// ruleSet is the rule set that allowed the connection, nil when something
+	// else did.
+	ruleSet        *rules.Set
+	scheduleClosed atomic.Bool
+}
+
+// ReasonBanned is the deny reason for clients on the ban list.
+const ReasonBanned = "banned"
+
+// BanList is the dynamic ban list shared by every server.
+type BanList interface {
+	Banned(ip string) bool
+	// RecordConnection and RecordRejection report whether the event got the
+	// client banned.
+	RecordConnection(ip string) bool
+	RecordRejection(ip string) bool
+}
+
+// AccessLogger receives one record per connection once it is finished.
+type AccessLogger interface {
+	Log(accesslog.Record)
 }
 
 func (h *ClientHandler) HandleClient(ctx context.Context, ClientConn Connection) {
@@ -62,7 +155,7 @@ func (h *ClientHandler) HandleClient(ctx context.Context, ClientConn Connection)
 
 	clientAddr := ClientConn.RemoteAddr().String()
 
-	ip, _, err := net.SplitHostPort(clientAddr)
+	ip, port, err := net.SplitHostPort(clientAddr)
 	if err != nil {
 		log.Printf("Failed to split host port: %v", err)
 		_ = ClientConn.Close()
@@ -74,6 +167,8 @@ func (h *ClientHandler) HandleClient(ctx context.Context, ClientConn Connection)
 
 	h.clientAddr = clientAddr
 	h.clientIP = ip
+	h.clientPort = port
+	h.startedAt = time.Now()
 	h.countryCode = "--"
 	h.region = "--"
 	h.cached = "--"
@@ -89,130 +184,296 @@ func (h *ClientHandler) HandleClient(ctx context.Context, ClientConn Connection)
 		defer h.ConnLimiter.Release(ip)
 	}
 
-	if len(h.AlwaysDenied) > 0 {
-		if h.CheckIps.CheckSubnets(h.AlwaysDenied, ip) {
-			h.accepted = false
-			h.DeniedReason = "Always denied"
-			h.processConnection(ctx)
-			return
-		}
+	if inSet(h.AlwaysDeniedSet, ip) {
+		h.accepted = false
+		h.DeniedReason = "Always denied"
+		h.processConnection(ctx)
+		return
 	}
 
-	if len(h.AlwaysAllowed) > 0 {
-		if h.CheckIps.CheckSubnets(h.AlwaysAllowed, ip) {
-			h.accepted = true
-			h.processConnection(ctx)
-			return
-		}
+	if h.TempRules != nil && h.TempRules.Match(TempDeny, h.ServerName, ip) {
+		h.accepted = false
+		h.DeniedReason = "temporarily denied"
+		h.processConnection(ctx)
+		return
 	}
 
-	now := h.Now
-	if now.IsZero() {
-		now = time.Now()
+	if inSet(h.AlwaysAllowedSet, ip) {
+		h.accepted = true
+		h.processConnection(ctx)
+		return
 	}
-	if (!h.StartDate.IsZero() && !h.EndDate.IsZero()) || (!h.StartTime.IsZero() && !h.EndTime.IsZero()) || len(h.DaysOfWeek) > 0 {
-		if !h.StartDate.IsZero() && !h.EndDate.IsZero() {
-			ok, err := common.CheckDateRange(h.StartDate, h.EndDate, now)
-			if err != nil {
-				log.Printf("Failed to check date range: %v", err)
-				_ = ClientConn.Close()
-				return
-			}
-			if !ok {
-				h.accepted = false
-				h.DeniedReason = "connection not allowed on this date"
-				h.processConnection(ctx)
-				return
-			}
-		}
-		if len(h.DaysOfWeek) > 0 {
-			if !h.DaysOfWeek[now.Weekday()] {
-				h.accepted = false
-				h.DeniedReason = "connection not allowed on this day"
-				h.processConnection(ctx)
-				return
-			}
-		}
-		if !h.StartTime.IsZero() && !h.EndTime.IsZero() {
-			ok, err := common.CheckTime(h.StartTime, h.EndTime, now)
-			if err != nil {
-				log.Printf("Failed to check time: %v", err)
-				_ = ClientConn.Close()
-				return
-			}
-			if !ok {
-				h.accepted = false
-				h.DeniedReason = "connection not allowed at this time"
-				h.processConnection(ctx)
-				return
-			}
-		}
+
+	if h.TempRules != nil && h.TempRules.Match(TempAllow, h.ServerName, ip) {
+		h.accepted = true
+		h.AllowedReason = "temporarily allowed"
+		h.processConnection(ctx)
+		return
 	}
 
-	h.countryCode, h.region, h.cached, err = h.IPApiClient.GetCountryCode(ctx, ip)
-	if err != nil {
-		log.Printf("ipapi connection error: %v", err)
+	if h.Bans != nil && (h.Bans.Banned(ip) || h.Bans.RecordConnection(ip)) {
 		h.accepted = false
-		h.DeniedReason = "ipapi error"
+		h.DeniedReason = ReasonBanned
 		h.processConnection(ctx)
 		return
 	}
-	normalizedCountry := strings.ToUpper(strings.TrimSpace(h.countryCode))
-	normalizedRegion := strings.ToUpper(strings.TrimSpace(h.region))
 
-	countryAccepted := false
-	regionAccepted := true
+	if h.DenyTor && h.TorExits != nil && h.TorExits.Contains(ip) {
+		h.accepted = false
+		h.DeniedReason = "Tor exit denied"
+		h.processConnection(ctx)
+		return
+	}
 
-	if _, ok := h.DeniedCountries[normalizedCountry]; ok {
-		countryAccepted = false
-	} else {
-		if _, ok := h.AllowedCountries[normalizedCountry]; ok {
-			countryAccepted = true
-			if len(h.DeniedRegions) > 0 {
-				if _, ok := h.DeniedRegions[normalizedRegion]; ok {
-					regionAccepted = false
-				}
-			} else {
-				if len(h.AllowedRegions) > 0 {
-					if _, ok := h.AllowedRegions[normalizedRegion]; !ok {
-						regionAccepted = false
-					}
-				}
-			}
+	now := h.now()
+	set := h.Rules
+	if set == nil {
+		set = rules.FromLegacy(rules.Legacy{
+			AllowedCountries: h.AllowedCountries,
+			AllowedRegions:   h.AllowedRegions,
+			DeniedCountries:  h.DeniedCountries,
+			DeniedRegions:    h.DeniedRegions,
+			StartDate:        h.StartDate,
+			EndDate:          h.EndDate,
+			StartTime:        h.StartTime,
+			EndTime:          h.EndTime,
+			DaysOfWeek:       h.DaysOfWeek,
+		})
+	}
+	decision, err := set.Evaluate(ip, now, func() (ipapi.Reply, error) {
+		return h.lookup(ctx, ip)
+	})
+	if err == nil && decision.Action == rules.Allow && h.hasGeoFilters() && !h.looked {
+		// The deciding rule didn't need the lookup, but the filters below do.
+		_, err = h.lookup(ctx, ip)
+	}
+	if err != nil {
+		// Hitting our own quota says nothing about the client, so it gets its own
+		// reason to keep it apart from real lookup failures in the logs.
+		cause := "ipapi error"
+		if errors.Is(err, ipapi.ErrRateLimited) {
+			log.Printf("ipapi rate limited: %v", err)
+			cause = "ipapi rate limited"
+		} else {
+			log.Printf("ipapi connection error: %v", err)
 		}
+		h.lookupFailed = true
+		h.applyLookupFailurePolicy(ip, cause)
+		h.processConnection(ctx)
+		return
 	}
 
-	h.accepted = countryAccepted && regionAccepted
+	h.accepted = decision.Action == rules.Allow
 	if !h.accepted {
-		h.DeniedReason = "country or region denied"
+		h.DeniedReason = decision.Reason
+	} else if !h.locationAllowed() {
+		h.accepted = false
+		h.DeniedReason = "location not allowed"
+	} else if reason := h.networkDenied(); reason != "" {
+		h.accepted = false
+		h.DeniedReason = reason
+	} else {
+		h.AllowedReason = decision.Reason
+		h.ruleSet = set
 	}
 	h.processConnection(ctx)
 }
 
+// now is the time rules are evaluated at: Now when set, else the wall clock.
+func (h *ClientHandler) now() time.Time {
+	if h.Now.IsZero() {
+		return time.Now()
+	}
+	return h.Now
+}
+
+// lookup geolocates the client once per connection.
+func (h *ClientHandler) lookup(ctx context.Context, ip string) (ipapi.Reply, error) {
+	if h.looked {
+		return h.reply, h.lookupErr
+	}
+	h.looked = true
+	h.reply, h.cached, h.lookupErr = ipapi.Lookup(ctx, h.IPApiClient, ip)
+	if h.lookupErr == nil {
+		h.countryCode, h.region = h.reply.CountryCode, h.reply.Region
+	}
+	return h.reply, h.lookupErr
+}
+
+// hasGeoFilters reports whether any check that runs after the rules needs
+// the lookup.
+func (h *ClientHandler) hasGeoFilters() bool {
+	return len(h.AllowedCities) > 0 || len(h.AllowedRadius) > 0 ||
+		h.DenyProxy || h.DenyHosting || h.DenyMobile ||
+		len(h.AllowedASNs) > 0 || len(h.DeniedASNs) > 0 ||
+		len(h.AllowedOrgs) > 0 || len(h.DeniedOrgs) > 0
+}
+
+// locationAllowed applies AllowedCities and AllowedRadius. A client whose
+// lookup has no city or coordinates doesn't match them.
+func (h *ClientHandler) locationAllowed() bool {
+	if len(h.AllowedCities) == 0 && len(h.AllowedRadius) == 0 {
+		return true
+	}
+	if city := strings.ToLower(h.reply.City); city != "" {
+		if h.AllowedCities[city] || h.AllowedCities[city+","+strings.ToLower(h.reply.CountryCode)] {
+			return true
+		}
+	}
+	if h.reply.HasLocation() {
+		for _, r := range h.AllowedRadius {
+			if r.Contains(h.reply.Lat, h.reply.Lon) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// networkDenied applies the proxy/hosting/mobile flags and the ASN and
+// organization rules and returns the deny
+// reason, or "" when the client passes. A provider that doesn't report ASNs
+// (ASN 0) never matches an allowed ASN.
+func (h *ClientHandler) networkDenied() string {
+	switch {
+	case h.DenyProxy && h.reply.Proxy:
+		return "proxy denied"
+	case h.DenyHosting && h.reply.Hosting:
+		return "hosting denied"
+	case h.DenyMobile && h.reply.Mobile:
+		return "mobile denied"
+	}
+	asn := h.reply.ASN
+	if h.DeniedASNs[asn] {
+		return "ASN denied"
+	}
+	if len(h.AllowedASNs) > 0 && !h.AllowedASNs[asn] {
+		return "ASN not allowed"
+	}
+	if len(h.DeniedOrgs) > 0 && h.orgMatches(h.DeniedOrgs) {
+		return "organization denied"
+	}
+	if len(h.AllowedOrgs) > 0 && !h.orgMatches(h.AllowedOrgs) {
+		return "organization not allowed"
+	}
+	return ""
+}
+
+func (h *ClientHandler) orgMatches(substrings []string) bool {
+	names := []string{
+		strings.ToLower(h.reply.ASName),
+		strings.ToLower(h.reply.Org),
+		strings.ToLower(h.reply.ISP),
+	}
+	for _, sub := range substrings {
+		for _, name := range names {
+			if name != "" && strings.Contains(name, sub) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// inSet reports whether set contains ip; a nil set contains nothing.
+func inSet(set common.IPMatcher, ip string) bool {
+	return set != nil && set.Contains(ip)
+}
+
+func (h *ClientHandler) applyLookupFailurePolicy(ip string, cause string) {
+	switch h.OnLookupFailure {
+	case LookupFailureAllow:
+		h.accepted = true
+		h.AllowedReason = cause + "; allowed by onLookupFailure policy"
+	case LookupFailureFallback:
+		if inSet(h.LookupFailureAllowedSet, ip) {
+			h.accepted = true
+			h.AllowedReason = cause + "; allowed by lookupFailureAllowed"
+			return
+		}
+		h.accepted = false
+		h.DeniedReason = cause + "; not in lookupFailureAllowed"
+	default:
+		h.accepted = false
+		h.DeniedReason = cause
+	}
+}
+
 func (h *ClientHandler) processConnection(ctx context.Context) {
 	if h.accepted {
 		if h.BackendDialer == nil {
 			log.Printf("no backend dialer configured; dropping connection from %s", h.clientAddr)
 			_ = h.clientConn.Close()
+			h.logAccess(accesslog.DecisionError, "no backend dialer configured")
 			return
 		}
-		backendTuple := net.JoinHostPort(h.BackendAddr, h.BackendPort)
-		backendConn, err := h.BackendDialer.DialContext(ctx, "tcp", backendTuple)
+		backendConn, backend, err := h.dialBackend(ctx)
 		if err != nil {
-			log.Printf("failed to connect to backend %s: %v", backendTuple, err)
 			_ = h.clientConn.Close()
+			h.logAccess(accesslog.DecisionError, "backend dial failed")
 			return
 		}
+		backendTuple := net.JoinHostPort(h.BackendAddr, h.BackendPort)
+		if backend != nil {
+			backend.active.Add(1)
+			defer backend.active.Add(-1)
+		}
+
+		if h.AllowedReason != "" {
+			log.Printf("accepted connection from %s country: %s region: %s to %s:%s %s reason: %s",
+				h.clientAddr,
+				h.countryCode,
+				h.region,
+				h.BackendAddr,
+				h.BackendPort,
+				h.cached,
+				h.AllowedReason)
+		} else {
+			log.Printf("accepted connection from %s country: %s region: %s to %s:%s %s",
+				h.clientAddr,
+				h.countryCode,
+				h.region,
+				h.BackendAddr,
+				h.BackendPort,
+				h.cached)
+		}
+		metrics.ConnectionsAccepted.With(h.ServerName).Inc()
+		active := metrics.ActiveConnections.With(h.ServerName)
+		active.Inc()
+		defer active.Dec()
 
-		log.Printf("accepted connection from %s country: %s region: %s to %s:%s %s",
-			h.clientAddr,
-			h.countryCode,
-			h.region,
-			h.BackendAddr,
-			h.BackendPort,
-			h.cached)
 		clientConn := withConnLimits(h.clientConn, h.IdleTimeout, h.MaxConnLifetime)
 		backendWrapped := withConnLimits(Connection(backendConn), h.IdleTimeout, h.MaxConnLifetime)
+		clientConn = withByteCount(clientConn, &h.bytesUp, metrics.BytesTransferred.With(h.ServerName, metrics.ClientToBackend))
+		backendWrapped = withByteCount(backendWrapped, &h.bytesDown, metrics.BytesTransferred.With(h.ServerName, metrics.BackendToClient))
+
+		if h.Conns != nil {
+			id := h.Conns.add(&trackedConn{
+				info: ActiveConn{
+					Server:  h.ServerName,
+					Client:  h.clientAddr,
+					Country: h.countryCode,
+					Region:  h.region,
+					Backend: backendTuple,
+					Start:   h.startedAt,
+				},
+				bytesUp:   &h.bytesUp,
+				bytesDown: &h.bytesDown,
+				kill: func() {
+					h.killed.Store(true)
+					_ = h.clientConn.Close()
+					_ = backendConn.Close()
+				},
+			})
+			defer h.Conns.remove(id)
+		}
+		if h.EnforceScheduleOnActive && h.ruleSet != nil {
+			stop := h.enforceSchedule(ctx, func() {
+				_ = h.clientConn.Close()
+				_ = backendConn.Close()
+			})
+			defer stop()
+		}
 
 		var hdr *proxyproto.Header
 		if h.SendProxyProtocol {
@@ -227,17 +488,102 @@ func (h *ClientHandler) processConnection(ctx context.Context) {
 			h.BackendAddr,
 			h.BackendPort,
 			h.cached)
+		reason := h.AllowedReason
+		if h.killed.Load() {
+			reason = "closed via admin API"
+		} else if h.scheduleClosed.Load() {
+			reason = ReasonScheduleEnd
+		}
+		h.logAccess(accesslog.DecisionAccept, reason)
 	} else {
-		log.Printf("rejected connection from %s country: %s region: %s to %s:%s %s reason: %s",
+		metrics.ConnectionsRejected.With(h.ServerName, h.DeniedReason).Inc()
+		log.Printf("rejected connection from %s country: %s region: %s to %s %s reason: %s",
 			h.clientAddr,
 			h.countryCode,
 			h.region,
-			h.BackendAddr,
-			h.BackendPort,
+			h.destination(),
 			h.cached,
 			h.DeniedReason)
 		_ = h.clientConn.Close()
+		h.logAccess(accesslog.DecisionReject, h.DeniedReason)
+		// Lookup failures say nothing about the client, and a banned client
+		// stays banned until the ban expires.
+		if h.Bans != nil && !h.lookupFailed && h.DeniedReason != ReasonBanned {
+			h.Bans.RecordRejection(h.clientIP)
+		}
+	}
+}
+
+// dialBackend connects to BackendAddr:BackendPort or, with a Balancer, to
+// the first of the balancer's backends that answers, and points BackendAddr
+// and BackendPort at it. backend is nil without a Balancer.
+func (h *ClientHandler) dialBackend(ctx context.Context) (conn net.Conn, backend *Backend, err error) {
+	if h.Balancer == nil {
+		backendTuple := net.JoinHostPort(h.BackendAddr, h.BackendPort)
+		conn, err = h.BackendDialer.DialContext(ctx, "tcp", backendTuple)
+		if err != nil {
+			metrics.BackendDialFailures.With(h.ServerName).Inc()
+			log.Printf("failed to connect to backend %s: %v", backendTuple, err)
+		}
+		return conn, nil, err
+	}
+	err = errors.New("no backends configured")
+	for _, backend = range h.Balancer.Order(h.clientIP) {
+		h.BackendAddr, h.BackendPort = backend.Addr, backend.Port
+		conn, err = h.BackendDialer.DialContext(ctx, "tcp", backend.Address())
+		if err == nil {
+			return conn, backend, nil
+		}
+		metrics.BackendDialFailures.With(h.ServerName).Inc()
+		log.Printf("failed to connect to backend %s: %v", backend.Address(), err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, nil, err
+}
+
+// destination names where a connection goes in log lines: the backend, or
+// the server's backends while the Balancer hasn't picked one.
+func (h *ClientHandler) destination() string {
+	if h.Balancer != nil && h.BackendAddr == "" {
+		return "backends of " + h.ServerName
+	}
+	return h.BackendAddr + ":" + h.BackendPort
+}
+
+// backendAddress is the backend for the access log. It is empty while the
+// Balancer hasn't picked one.
+func (h *ClientHandler) backendAddress() string {
+	if h.Balancer != nil && h.BackendAddr == "" {
+		return ""
+	}
+	return net.JoinHostPort(h.BackendAddr, h.BackendPort)
+}
+
+func (h *ClientHandler) logAccess(decision string, reason string) {
+	if h.AccessLog == nil {
+		return
 	}
+	end := time.Now()
+	h.AccessLog.Log(accesslog.Record{
+		Server:     h.ServerName,
+		Listen:     h.ListenAddr,
+		ClientIP:   h.clientIP,
+		ClientPort: h.clientPort,
+		Country:    h.countryCode,
+		Region:     h.region,
+		Cache:      h.cached,
+		ASN:        h.reply.ASN,
+		Decision:   decision,
+		Reason:     reason,
+		Backend:    h.backendAddress(),
+		Start:      h.startedAt,
+		End:        end,
+		DurationMS: end.Sub(h.startedAt).Milliseconds(),
+		BytesUp:    h.bytesUp.Load(),
+		BytesDown:  h.bytesDown.Load(),
+	})
 }
 
 func TransferData(ClientConn Connection, BackendConn Connection, h *proxyproto.Header) {
@@ -3,6 +3,7 @@ package handler
 import (
 	"context"
 	"fmt"
+	"geoproxy/ipapi"
 )
 
 type GetCountryCodeMock struct {
@@ -10,9 +11,44 @@ type GetCountryCodeMock struct {
 	ReturnCountry string
 	ReturnRegion  string
 	ReturnCached  string
+	// Err, when set, is returned as the lookup error.
+	Err error
+	// The remaining fields are only reported through Lookup.
+	ReturnASN     uint32
+	ReturnOrg     string
+	ReturnProxy   bool
+	ReturnHosting bool
+	ReturnMobile  bool
+	ReturnCity    string
+	ReturnLat     float64
+	ReturnLon     float64
+	ReturnZone    string
+}
+
+func (g *GetCountryCodeMock) Lookup(ctx context.Context, ip string) (ipapi.Reply, string, error) {
+	country, region, cached, err := g.GetCountryCode(ctx, ip)
+	if err != nil {
+		return ipapi.Reply{}, cached, err
+	}
+	return ipapi.Reply{
+		CountryCode: country,
+		Region:      region,
+		ASN:         g.ReturnASN,
+		Org:         g.ReturnOrg,
+		Proxy:       g.ReturnProxy,
+		Hosting:     g.ReturnHosting,
+		Mobile:      g.ReturnMobile,
+		City:        g.ReturnCity,
+		Lat:         g.ReturnLat,
+		Lon:         g.ReturnLon,
+		Timezone:    g.ReturnZone,
+	}, cached, nil
 }
 
 func (g *GetCountryCodeMock) GetCountryCode(_ context.Context, ip string) (string, string, string, error) {
+	if g.Err != nil {
+		return "", "", "-", g.Err
+	}
 	if g.ReturnErr {
 		return "", "", "", nil
 	} else {
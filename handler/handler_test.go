@@ -2,9 +2,12 @@ package handler
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"geoproxy/common"
+	"geoproxy/ipapi"
 	"geoproxy/mocks"
+	"geoproxy/rules"
 	"net"
 	"testing"
 	"time"
@@ -25,6 +28,15 @@ func (d *staticDialer) DialContext(ctx context.Context, network, address string)
 	return d.conn, d.err
 }
 
+func ipSet(t *testing.T, entries ...string) *common.IPSet {
+	t.Helper()
+	set, err := common.NewIPSet(entries)
+	if err != nil {
+		t.Fatalf("NewIPSet: %v", err)
+	}
+	return set
+}
+
 func TestHandler(t *testing.T) {
 	t.Run("TestAlwaysAllowedv4True", func(t *testing.T) {
 		fmt.Println("TestAlwaysAllowedv4True")
@@ -33,10 +45,8 @@ func TestHandler(t *testing.T) {
 			AllowedRegions:   map[string]bool{},
 			DeniedCountries:  map[string]bool{},
 			DeniedRegions:    map[string]bool{},
-			AlwaysAllowed:    []string{"127.0.0.1"},
-			AlwaysDenied:     []string{},
+			AlwaysAllowedSet: ipSet(t, "127.0.0.1"),
 			IPApiClient:      &GetCountryCodeMock{ReturnCountry: "US", ReturnRegion: "CA"},
-			CheckIps:         &MockCheckIP{CheckSubnetsReturn: true, CheckIPTypeReturn: 4, CheckIPTypeErr: false},
 			TransferFunc:     TransferFuncMock,
 			BackendDialer:    &staticDialer{conn: &mocks.MockNetConn{IPVersion: 4}},
 			BackendAddr:      "127.0.0.1",
@@ -53,11 +63,9 @@ func TestHandler(t *testing.T) {
 			AllowedRegions:   map[string]bool{},
 			DeniedCountries:  map[string]bool{},
 			DeniedRegions:    map[string]bool{},
-			AlwaysAllowed:    []string{"fe80::3c9e:f7ff:febc:caa"},
-			AlwaysDenied:     []string{},
+			AlwaysAllowedSet: ipSet(t, "fe80::3c9e:f7ff:febc:caa"),
 			IPApiClient:      &GetCountryCodeMock{ReturnCountry: "US", ReturnRegion: "CA"},
 
-			CheckIps:      &MockCheckIP{CheckSubnetsReturn: true, CheckIPTypeReturn: 4, CheckIPTypeErr: false},
 			TransferFunc:  TransferFuncMock,
 			BackendDialer: &staticDialer{conn: &mocks.MockNetConn{IPVersion: 6}},
 			BackendAddr:   "127.0.0.1",
@@ -74,11 +82,9 @@ func TestHandler(t *testing.T) {
 			AllowedRegions:   map[string]bool{},
 			DeniedCountries:  map[string]bool{},
 			DeniedRegions:    map[string]bool{},
-			AlwaysAllowed:    []string{"127.0.0.1"},
-			AlwaysDenied:     []string{},
+			AlwaysAllowedSet: ipSet(t, "127.0.0.2"),
 			IPApiClient:      &GetCountryCodeMock{ReturnCountry: "US", ReturnRegion: "CA"},
 
-			CheckIps:      &MockCheckIP{CheckSubnetsReturn: false, CheckIPTypeReturn: 4, CheckIPTypeErr: false},
 			TransferFunc:  TransferFuncMock,
 			BackendDialer: &staticDialer{conn: &mocks.MockNetConn{IPVersion: 4}},
 			BackendAddr:   "127.0.0.1",
@@ -95,11 +101,9 @@ func TestHandler(t *testing.T) {
 			AllowedRegions:   map[string]bool{},
 			DeniedCountries:  map[string]bool{},
 			DeniedRegions:    map[string]bool{},
-			AlwaysAllowed:    []string{},
-			AlwaysDenied:     []string{"127.0.0.1"},
+			AlwaysDeniedSet:  ipSet(t, "127.0.0.1"),
 			IPApiClient:      &GetCountryCodeMock{ReturnCountry: "US", ReturnRegion: "CA"},
 
-			CheckIps:      &MockCheckIP{CheckSubnetsReturn: true, CheckIPTypeReturn: 4, CheckIPTypeErr: false},
 			TransferFunc:  TransferFuncMock,
 			BackendDialer: &staticDialer{conn: &mocks.MockNetConn{IPVersion: 4}},
 			BackendAddr:   "127.0.0.1",
@@ -116,12 +120,10 @@ func TestHandler(t *testing.T) {
 			AllowedRegions:   map[string]bool{},
 			DeniedCountries:  map[string]bool{},
 			DeniedRegions:    map[string]bool{},
-			AlwaysAllowed:    []string{},
-			AlwaysDenied:     []string{"fe80::3c9e:f7ff:febc:caa"},
+			AlwaysDeniedSet:  ipSet(t, "fe80::3c9e:f7ff:febc:caa"),
 
 			IPApiClient: &GetCountryCodeMock{ReturnCountry: "US", ReturnRegion: "CA"},
 
-			CheckIps:      &MockCheckIP{CheckSubnetsReturn: true, CheckIPTypeReturn: 4, CheckIPTypeErr: false},
 			TransferFunc:  TransferFuncMock,
 			BackendDialer: &staticDialer{conn: &mocks.MockNetConn{IPVersion: 6}},
 			BackendAddr:   "127.0.0.1",
@@ -138,12 +140,10 @@ func TestHandler(t *testing.T) {
 			AllowedRegions:   map[string]bool{},
 			DeniedCountries:  map[string]bool{},
 			DeniedRegions:    map[string]bool{},
-			AlwaysAllowed:    []string{},
-			AlwaysDenied:     []string{"127.0.0.1"},
+			AlwaysDeniedSet:  ipSet(t, "127.0.0.2"),
 
 			IPApiClient: &GetCountryCodeMock{ReturnCountry: "US", ReturnRegion: "CA"},
 
-			CheckIps:      &MockCheckIP{CheckSubnetsReturn: false, CheckIPTypeReturn: 4, CheckIPTypeErr: false},
 			TransferFunc:  TransferFuncMock,
 			BackendDialer: &staticDialer{conn: &mocks.MockNetConn{IPVersion: 4}},
 			BackendAddr:   "127.0.0.1",
@@ -160,12 +160,9 @@ func TestHandler(t *testing.T) {
 			AllowedRegions:   map[string]bool{},
 			DeniedCountries:  map[string]bool{"CN": true},
 			DeniedRegions:    map[string]bool{},
-			AlwaysAllowed:    []string{},
-			AlwaysDenied:     []string{},
 
 			IPApiClient: &GetCountryCodeMock{ReturnCountry: "CN", ReturnRegion: "Beijing"},
 
-			CheckIps:      &common.CheckIPs{},
 			TransferFunc:  TransferFuncMock,
 			BackendDialer: &staticDialer{conn: &mocks.MockNetConn{IPVersion: 4}},
 			BackendAddr:   "127.0.0.1",
@@ -182,12 +179,9 @@ func TestHandler(t *testing.T) {
 			AllowedRegions:   map[string]bool{},
 			DeniedCountries:  map[string]bool{},
 			DeniedRegions:    map[string]bool{},
-			AlwaysAllowed:    []string{},
-			AlwaysDenied:     []string{},
 
 			IPApiClient: &GetCountryCodeMock{ReturnCountry: "CN", ReturnRegion: "Beijing"},
 
-			CheckIps:      &common.CheckIPs{},
 			TransferFunc:  TransferFuncMock,
 			BackendDialer: &staticDialer{conn: &mocks.MockNetConn{IPVersion: 4}},
 			BackendAddr:   "127.0.0.1",
@@ -204,12 +198,9 @@ func TestHandler(t *testing.T) {
 			AllowedRegions:   map[string]bool{"BEIJING": true},
 			DeniedCountries:  map[string]bool{},
 			DeniedRegions:    map[string]bool{},
-			AlwaysAllowed:    []string{},
-			AlwaysDenied:     []string{},
 
 			IPApiClient: &GetCountryCodeMock{ReturnCountry: "CN", ReturnRegion: "Beijing"},
 
-			CheckIps:      &common.CheckIPs{},
 			TransferFunc:  TransferFuncMock,
 			BackendDialer: &staticDialer{conn: &mocks.MockNetConn{IPVersion: 4}},
 			BackendAddr:   "127.0.0.1",
@@ -226,12 +217,9 @@ func TestHandler(t *testing.T) {
 			AllowedRegions:   map[string]bool{"BEIJING": true},
 			DeniedCountries:  map[string]bool{},
 			DeniedRegions:    map[string]bool{},
-			AlwaysAllowed:    []string{},
-			AlwaysDenied:     []string{},
 
 			IPApiClient: &GetCountryCodeMock{ReturnCountry: "cn", ReturnRegion: "beijing"},
 
-			CheckIps:      &common.CheckIPs{},
 			TransferFunc:  TransferFuncMock,
 			BackendDialer: &staticDialer{conn: &mocks.MockNetConn{IPVersion: 4}},
 			BackendAddr:   "127.0.0.1",
@@ -248,12 +236,9 @@ func TestHandler(t *testing.T) {
 			AllowedRegions:   map[string]bool{},
 			DeniedCountries:  map[string]bool{},
 			DeniedRegions:    map[string]bool{"BEIJING": true},
-			AlwaysAllowed:    []string{},
-			AlwaysDenied:     []string{},
 
 			IPApiClient: &GetCountryCodeMock{ReturnCountry: "CN", ReturnRegion: "Beijing"},
 
-			CheckIps:      &common.CheckIPs{},
 			TransferFunc:  TransferFuncMock,
 			BackendDialer: &staticDialer{conn: &mocks.MockNetConn{IPVersion: 4}},
 			BackendAddr:   "127.0.0.1",
@@ -273,12 +258,9 @@ func TestHandler(t *testing.T) {
 			AllowedRegions:   map[string]bool{},
 			DeniedCountries:  map[string]bool{},
 			DeniedRegions:    map[string]bool{},
-			AlwaysAllowed:    []string{},
-			AlwaysDenied:     []string{},
 
 			IPApiClient: &GetCountryCodeMock{ReturnCountry: "CN", ReturnRegion: "Beijing"},
 
-			CheckIps:      &common.CheckIPs{},
 			TransferFunc:  TransferFuncMock,
 			BackendDialer: &staticDialer{conn: &mocks.MockNetConn{IPVersion: 4}},
 			BackendAddr:   "127.0.0.1",
@@ -301,12 +283,9 @@ func TestHandler(t *testing.T) {
 			AllowedRegions:   map[string]bool{},
 			DeniedCountries:  map[string]bool{},
 			DeniedRegions:    map[string]bool{},
-			AlwaysAllowed:    []string{},
-			AlwaysDenied:     []string{},
 
 			IPApiClient: &GetCountryCodeMock{ReturnCountry: "CN", ReturnRegion: "Beijing"},
 
-			CheckIps:      &common.CheckIPs{},
 			TransferFunc:  TransferFuncMock,
 			BackendDialer: &staticDialer{conn: &mocks.MockNetConn{IPVersion: 4}},
 			BackendAddr:   "127.0.0.1",
@@ -329,12 +308,9 @@ func TestHandler(t *testing.T) {
 			AllowedRegions:   map[string]bool{},
 			DeniedCountries:  map[string]bool{},
 			DeniedRegions:    map[string]bool{},
-			AlwaysAllowed:    []string{},
-			AlwaysDenied:     []string{},
 
 			IPApiClient: &GetCountryCodeMock{ReturnCountry: "CN", ReturnRegion: "Beijing"},
 
-			CheckIps:      &common.CheckIPs{},
 			TransferFunc:  TransferFuncMock,
 			BackendDialer: &staticDialer{conn: &mocks.MockNetConn{IPVersion: 4}},
 			BackendAddr:   "127.0.0.1",
@@ -357,12 +333,9 @@ func TestHandler(t *testing.T) {
 			AllowedRegions:   map[string]bool{},
 			DeniedCountries:  map[string]bool{},
 			DeniedRegions:    map[string]bool{},
-			AlwaysAllowed:    []string{},
-			AlwaysDenied:     []string{},
 
 			IPApiClient: &GetCountryCodeMock{ReturnCountry: "CN", ReturnRegion: "Beijing"},
 
-			CheckIps:      &common.CheckIPs{},
 			TransferFunc:  TransferFuncMock,
 			BackendDialer: &staticDialer{conn: &mocks.MockNetConn{IPVersion: 4}},
 			BackendAddr:   "127.0.0.1",
@@ -385,12 +358,9 @@ func TestHandler(t *testing.T) {
 			AllowedRegions:   map[string]bool{},
 			DeniedCountries:  map[string]bool{},
 			DeniedRegions:    map[string]bool{},
-			AlwaysAllowed:    []string{},
-			AlwaysDenied:     []string{},
 
 			IPApiClient: &GetCountryCodeMock{ReturnCountry: "CN", ReturnRegion: "Beijing"},
 
-			CheckIps:      &common.CheckIPs{},
 			TransferFunc:  TransferFuncMock,
 			BackendDialer: &staticDialer{conn: &mocks.MockNetConn{IPVersion: 4}},
 			BackendAddr:   "127.0.0.1",
@@ -413,12 +383,9 @@ func TestHandler(t *testing.T) {
 			AllowedRegions:   map[string]bool{},
 			DeniedCountries:  map[string]bool{},
 			DeniedRegions:    map[string]bool{},
-			AlwaysAllowed:    []string{},
-			AlwaysDenied:     []string{},
 
 			IPApiClient: &GetCountryCodeMock{ReturnCountry: "CN", ReturnRegion: "Beijing"},
 
-			CheckIps:      &common.CheckIPs{},
 			TransferFunc:  TransferFuncMock,
 			BackendDialer: &staticDialer{conn: &mocks.MockNetConn{IPVersion: 4}},
 			BackendAddr:   "127.0.0.1",
@@ -439,12 +406,9 @@ func TestHandler(t *testing.T) {
 			AllowedRegions:   map[string]bool{},
 			DeniedCountries:  map[string]bool{},
 			DeniedRegions:    map[string]bool{},
-			AlwaysAllowed:    []string{},
-			AlwaysDenied:     []string{},
 
 			IPApiClient: &GetCountryCodeMock{ReturnCountry: "CN", ReturnRegion: "Beijing"},
 
-			CheckIps:      &common.CheckIPs{},
 			TransferFunc:  TransferFuncMock,
 			BackendDialer: &staticDialer{conn: &mocks.MockNetConn{IPVersion: 4}},
 			BackendAddr:   "127.0.0.1",
@@ -464,12 +428,9 @@ func TestHandler(t *testing.T) {
 			AllowedRegions:   map[string]bool{},
 			DeniedCountries:  map[string]bool{},
 			DeniedRegions:    map[string]bool{},
-			AlwaysAllowed:    []string{},
-			AlwaysDenied:     []string{},
 
 			IPApiClient: &GetCountryCodeMock{ReturnCountry: "CN", ReturnRegion: "Beijing"},
 
-			CheckIps:      &common.CheckIPs{},
 			TransferFunc:  TransferFuncMock,
 			BackendDialer: &staticDialer{conn: &mocks.MockNetConn{IPVersion: 4}},
 			BackendAddr:   "127.0.0.1",
@@ -482,3 +443,425 @@ func TestHandler(t *testing.T) {
 		assert.Equal(t, false, h.accepted)
 	})
 }
+
+func TestHandlerLookupFailurePolicy(t *testing.T) {
+	tests := []struct {
+		name         string
+		policy       string
+		allowed      []string
+		wantAccepted bool
+		wantReason   string
+	}{
+		{name: "default denies", policy: "", wantAccepted: false, wantReason: "ipapi error"},
+		{name: "deny", policy: LookupFailureDeny, wantAccepted: false, wantReason: "ipapi error"},
+		{name: "allow", policy: LookupFailureAllow, wantAccepted: true, wantReason: "ipapi error; allowed by onLookupFailure policy"},
+		{name: "fallback match", policy: LookupFailureFallback, allowed: []string{"127.0.0.0/8"}, wantAccepted: true, wantReason: "ipapi error; allowed by lookupFailureAllowed"},
+		{name: "fallback miss", policy: LookupFailureFallback, allowed: []string{"10.0.0.0/8"}, wantAccepted: false, wantReason: "ipapi error; not in lookupFailureAllowed"},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			h := ClientHandler{
+				AllowedCountries:        map[string]bool{"US": true},
+				IPApiClient:             &GetCountryCodeMock{Err: fmt.Errorf("cached ipapi lookup failure")},
+				TransferFunc:            TransferFuncMock,
+				BackendDialer:           &staticDialer{conn: &mocks.MockNetConn{IPVersion: 4}},
+				BackendAddr:             "127.0.0.1",
+				BackendPort:             "8080",
+				OnLookupFailure:         tc.policy,
+				LookupFailureAllowedSet: ipSet(t, tc.allowed...),
+			}
+			h.HandleClient(context.Background(), &mocks.MockNetConn{IPVersion: 4})
+			assert.Equal(t, tc.wantAccepted, h.accepted)
+			if tc.wantAccepted {
+				assert.Equal(t, tc.wantReason, h.AllowedReason)
+			} else {
+				assert.Equal(t, tc.wantReason, h.DeniedReason)
+			}
+		})
+	}
+}
+
+func TestHandlerRateLimitedLookup(t *testing.T) {
+	newHandler := func(policy string) ClientHandler {
+		return ClientHandler{
+			AllowedCountries: map[string]bool{"US": true},
+			IPApiClient:      &GetCountryCodeMock{Err: fmt.Errorf("failed to get country code: %w", ipapi.ErrRateLimited)},
+			TransferFunc:     TransferFuncMock,
+			BackendDialer:    &staticDialer{conn: &mocks.MockNetConn{IPVersion: 4}},
+			BackendAddr:      "127.0.0.1",
+			BackendPort:      "8080",
+			OnLookupFailure:  policy,
+		}
+	}
+
+	h := newHandler("")
+	h.HandleClient(context.Background(), &mocks.MockNetConn{IPVersion: 4})
+	assert.False(t, h.accepted)
+	assert.Equal(t, "ipapi rate limited", h.DeniedReason)
+
+	h = newHandler(LookupFailureAllow)
+	h.HandleClient(context.Background(), &mocks.MockNetConn{IPVersion: 4})
+	assert.True(t, h.accepted)
+	assert.Equal(t, "ipapi rate limited; allowed by onLookupFailure policy", h.AllowedReason)
+}
+
+func TestHandlerCompiledIPSets(t *testing.T) {
+	newHandler := func() *ClientHandler {
+		return &ClientHandler{
+			AllowedCountries: map[string]bool{"US": true},
+			IPApiClient:      &GetCountryCodeMock{ReturnCountry: "CN"},
+			TransferFunc:     TransferFuncMock,
+			BackendDialer:    &staticDialer{conn: &mocks.MockNetConn{IPVersion: 4}},
+			BackendAddr:      "127.0.0.1",
+			BackendPort:      "8080",
+		}
+	}
+
+	h := newHandler()
+	h.AlwaysDeniedSet = ipSet(t, "127.0.0.0/8")
+	h.AlwaysAllowedSet = ipSet(t, "127.0.0.1")
+	h.HandleClient(context.Background(), &mocks.MockNetConn{IPVersion: 4})
+	assert.False(t, h.accepted)
+	assert.Equal(t, "Always denied", h.DeniedReason)
+
+	h = newHandler()
+	h.AlwaysDeniedSet = ipSet(t)
+	h.AlwaysAllowedSet = ipSet(t, "::ffff:127.0.0.0/104")
+	h.HandleClient(context.Background(), &mocks.MockNetConn{IPVersion: 4})
+	assert.True(t, h.accepted)
+
+	h = newHandler()
+	h.IPApiClient = &GetCountryCodeMock{Err: errors.New("boom")}
+	h.OnLookupFailure = LookupFailureFallback
+	h.LookupFailureAllowedSet = ipSet(t, "127.0.0.0/24")
+	h.HandleClient(context.Background(), &mocks.MockNetConn{IPVersion: 4})
+	assert.True(t, h.accepted)
+	assert.Equal(t, "ipapi error; allowed by lookupFailureAllowed", h.AllowedReason)
+}
+
+func TestHandlerNetworkRules(t *testing.T) {
+	tests := []struct {
+		name         string
+		lookup       *GetCountryCodeMock
+		configure    func(h *ClientHandler)
+		wantAccepted bool
+		wantReason   string
+	}{
+		{
+			name:         "no rules",
+			lookup:       &GetCountryCodeMock{ReturnCountry: "US", ReturnASN: 14061},
+			configure:    func(h *ClientHandler) {},
+			wantAccepted: true,
+		},
+		{
+			name:       "proxy",
+			lookup:     &GetCountryCodeMock{ReturnCountry: "US", ReturnProxy: true, ReturnHosting: true},
+			configure:  func(h *ClientHandler) { h.DenyProxy = true; h.DenyHosting = true },
+			wantReason: "proxy denied",
+		},
+		{
+			name:       "hosting",
+			lookup:     &GetCountryCodeMock{ReturnCountry: "US", ReturnHosting: true},
+			configure:  func(h *ClientHandler) { h.DenyProxy = true; h.DenyHosting = true },
+			wantReason: "hosting denied",
+		},
+		{
+			name:       "mobile",
+			lookup:     &GetCountryCodeMock{ReturnCountry: "US", ReturnMobile: true},
+			configure:  func(h *ClientHandler) { h.DenyMobile = true },
+			wantReason: "mobile denied",
+		},
+		{
+			name:         "flag not denied",
+			lookup:       &GetCountryCodeMock{ReturnCountry: "US", ReturnHosting: true, ReturnMobile: true},
+			configure:    func(h *ClientHandler) { h.DenyProxy = true },
+			wantAccepted: true,
+		},
+		{
+			name:       "flags after country",
+			lookup:     &GetCountryCodeMock{ReturnCountry: "CN", ReturnProxy: true},
+			configure:  func(h *ClientHandler) { h.DenyProxy = true },
+			wantReason: "country or region denied",
+		},
+		{
+			name:       "denied ASN",
+			lookup:     &GetCountryCodeMock{ReturnCountry: "US", ReturnASN: 14061},
+			configure:  func(h *ClientHandler) { h.DeniedASNs = map[uint32]bool{14061: true} },
+			wantReason: "ASN denied",
+		},
+		{
+			name:         "allowed ASN",
+			lookup:       &GetCountryCodeMock{ReturnCountry: "US", ReturnASN: 15169},
+			configure:    func(h *ClientHandler) { h.AllowedASNs = map[uint32]bool{15169: true} },
+			wantAccepted: true,
+		},
+		{
+			name:       "ASN not allowed",
+			lookup:     &GetCountryCodeMock{ReturnCountry: "US", ReturnASN: 14061},
+			configure:  func(h *ClientHandler) { h.AllowedASNs = map[uint32]bool{15169: true} },
+			wantReason: "ASN not allowed",
+		},
+		{
+			name:       "unknown ASN not allowed",
+			lookup:     &GetCountryCodeMock{ReturnCountry: "US"},
+			configure:  func(h *ClientHandler) { h.AllowedASNs = map[uint32]bool{15169: true} },
+			wantReason: "ASN not allowed",
+		},
+		{
+			name:       "denied org",
+			lookup:     &GetCountryCodeMock{ReturnCountry: "US", ReturnOrg: "DigitalOcean, LLC"},
+			configure:  func(h *ClientHandler) { h.DeniedOrgs = []string{"digitalocean"} },
+			wantReason: "organization denied",
+		},
+		{
+			name:       "org not allowed",
+			lookup:     &GetCountryCodeMock{ReturnCountry: "US", ReturnOrg: "DigitalOcean, LLC"},
+			configure:  func(h *ClientHandler) { h.AllowedOrgs = []string{"google"} },
+			wantReason: "organization not allowed",
+		},
+		{
+			name:       "country checked first",
+			lookup:     &GetCountryCodeMock{ReturnCountry: "CN", ReturnASN: 15169},
+			configure:  func(h *ClientHandler) { h.AllowedASNs = map[uint32]bool{15169: true} },
+			wantReason: "country or region denied",
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			h := &ClientHandler{
+				AllowedCountries: map[string]bool{"US": true},
+				IPApiClient:      tc.lookup,
+				TransferFunc:     TransferFuncMock,
+				BackendDialer:    &staticDialer{conn: &mocks.MockNetConn{IPVersion: 4}},
+				BackendAddr:      "127.0.0.1",
+				BackendPort:      "8080",
+			}
+			tc.configure(h)
+			h.HandleClient(context.Background(), &mocks.MockNetConn{IPVersion: 4})
+			assert.Equal(t, tc.wantAccepted, h.accepted)
+			if !tc.wantAccepted {
+				assert.Equal(t, tc.wantReason, h.DeniedReason)
+			}
+		})
+	}
+}
+
+func TestHandlerDenyTor(t *testing.T) {
+	exits, err := common.NewIPSet([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatalf("NewIPSet: %v", err)
+	}
+	newHandler := func(denyTor bool) *ClientHandler {
+		return &ClientHandler{
+			AllowedCountries: map[string]bool{"US": true},
+			// Tor exits are rejected before the lookup, so it is never reached.
+			IPApiClient:   &GetCountryCodeMock{Err: errors.New("unexpected lookup")},
+			TransferFunc:  TransferFuncMock,
+			BackendDialer: &staticDialer{conn: &mocks.MockNetConn{IPVersion: 4}},
+			BackendAddr:   "127.0.0.1",
+			BackendPort:   "8080",
+			DenyTor:       denyTor,
+			TorExits:      exits,
+		}
+	}
+
+	h := newHandler(true)
+	h.HandleClient(context.Background(), &mocks.MockNetConn{IPVersion: 4})
+	assert.False(t, h.accepted)
+	assert.Equal(t, "Tor exit denied", h.DeniedReason)
+
+	h = newHandler(false)
+	h.HandleClient(context.Background(), &mocks.MockNetConn{IPVersion: 4})
+	assert.False(t, h.accepted)
+	assert.Equal(t, "ipapi error", h.DeniedReason)
+
+	h = newHandler(true)
+	h.AlwaysAllowedSet = ipSet(t, "127.0.0.1")
+	h.HandleClient(context.Background(), &mocks.MockNetConn{IPVersion: 4})
+	assert.True(t, h.accepted)
+}
+
+func TestHandlerLocationRules(t *testing.T) {
+	seattle := common.GeoRadius{Lat: 47.6062, Lon: -122.3321, RadiusKm: 50}
+	tests := []struct {
+		name         string
+		lookup       *GetCountryCodeMock
+		cities       []string
+		radius       []common.GeoRadius
+		wantAccepted bool
+		wantReason   string
+	}{
+		{
+			name:         "no rules",
+			lookup:       &GetCountryCodeMock{ReturnCountry: "US"},
+			wantAccepted: true,
+		},
+		{
+			name:         "city",
+			lookup:       &GetCountryCodeMock{ReturnCountry: "US", ReturnCity: "Portland"},
+			cities:       []string{"portland"},
+			wantAccepted: true,
+		},
+		{
+			name:         "city and country",
+			lookup:       &GetCountryCodeMock{ReturnCountry: "US", ReturnCity: "Portland"},
+			cities:       []string{"portland,us"},
+			wantAccepted: true,
+		},
+		{
+			name:       "city in another country",
+			lookup:     &GetCountryCodeMock{ReturnCountry: "US", ReturnCity: "Portland"},
+			cities:     []string{"portland,au"},
+			wantReason: "location not allowed",
+		},
+		{
+			name:         "within radius",
+			lookup:       &GetCountryCodeMock{ReturnCountry: "US", ReturnCity: "Bellevue", ReturnLat: 47.6101, ReturnLon: -122.2015},
+			cities:       []string{"portland"},
+			radius:       []common.GeoRadius{seattle},
+			wantAccepted: true,
+		},
+		{
+			name:       "outside radius",
+			lookup:     &GetCountryCodeMock{ReturnCountry: "US", ReturnCity: "Tacoma", ReturnLat: 47.2529, ReturnLon: -122.4443},
+			radius:     []common.GeoRadius{{Lat: 47.6062, Lon: -122.3321, RadiusKm: 20}},
+			wantReason: "location not allowed",
+		},
+		{
+			name:       "no location",
+			lookup:     &GetCountryCodeMock{ReturnCountry: "US"},
+			radius:     []common.GeoRadius{seattle},
+			wantReason: "location not allowed",
+		},
+		{
+			name:       "country checked first",
+			lookup:     &GetCountryCodeMock{ReturnCountry: "CA", ReturnCity: "Vancouver", ReturnLat: 49.2827, ReturnLon: -123.1207},
+			radius:     []common.GeoRadius{{Lat: 47.6062, Lon: -122.3321, RadiusKm: 500}},
+			wantReason: "country or region denied",
+		},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			h := &ClientHandler{
+				AllowedCountries: map[string]bool{"US": true},
+				AllowedCities:    common.MakeSet(tc.cities),
+				AllowedRadius:    tc.radius,
+				IPApiClient:      tc.lookup,
+				TransferFunc:     TransferFuncMock,
+				BackendDialer:    &staticDialer{conn: &mocks.MockNetConn{IPVersion: 4}},
+				BackendAddr:      "127.0.0.1",
+				BackendPort:      "8080",
+			}
+			h.HandleClient(context.Background(), &mocks.MockNetConn{IPVersion: 4})
+			assert.Equal(t, tc.wantAccepted, h.accepted)
+			if !tc.wantAccepted {
+				assert.Equal(t, tc.wantReason, h.DeniedReason)
+			}
+		})
+	}
+}
+
+func TestHandlerRules(t *testing.T) {
+	office, err := common.NewIPSet([]string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("NewIPSet: %v", err)
+	}
+	weekdays := &rules.Schedule{Windows: []rules.Window{{DaysOfWeek: map[time.Weekday]bool{
+		time.Monday: true, time.Tuesday: true, time.Wednesday: true, time.Thursday: true, time.Friday: true,
+	}}}}
+	set := &rules.Set{
+		Rules: []rules.Rule{
+			{Action: rules.Allow, Tag: "office", CIDRs: office, Schedule: weekdays},
+			{Action: rules.Allow, Countries: map[string]bool{"US": true}},
+			{Action: rules.Deny, Tag: "not US", Countries: map[string]bool{"CN": true}},
+		},
+		Default: rules.Deny,
+	}
+	monday := time.Date(2024, 5, 6, 12, 0, 0, 0, time.UTC)
+	newHandler := func(lookup *GetCountryCodeMock, now time.Time) *ClientHandler {
+		return &ClientHandler{
+			// Ignored once Rules is set.
+			AllowedCountries: map[string]bool{"CN": true},
+			Rules:            set,
+			IPApiClient:      lookup,
+			TransferFunc:     TransferFuncMock,
+			BackendDialer:    &staticDialer{conn: &mocks.MockNetConn{IPVersion: 4}},
+			BackendAddr:      "127.0.0.1",
+			BackendPort:      "8080",
+			Now:              now,
+		}
+	}
+
+	// The office rule decides without a lookup.
+	h := newHandler(&GetCountryCodeMock{Err: errors.New("unexpected lookup")}, monday)
+	h.HandleClient(context.Background(), &mocks.MockNetConn{IPVersion: 4})
+	assert.True(t, h.accepted)
+	assert.Equal(t, "office", h.AllowedReason)
+	assert.Equal(t, "--", h.countryCode)
+
+	h = newHandler(&GetCountryCodeMock{ReturnCountry: "CN"}, monday.AddDate(0, 0, 5))
+	h.HandleClient(context.Background(), &mocks.MockNetConn{IPVersion: 4})
+	assert.False(t, h.accepted)
+	assert.Equal(t, "not US", h.DeniedReason)
+	assert.Equal(t, "CN", h.countryCode)
+
+	h = newHandler(&GetCountryCodeMock{ReturnCountry: "FR"}, monday.AddDate(0, 0, 5))
+	h.HandleClient(context.Background(), &mocks.MockNetConn{IPVersion: 4})
+	assert.False(t, h.accepted)
+	assert.Equal(t, rules.ReasonNoMatch, h.DeniedReason)
+
+	// A lookup failure falls back to onLookupFailure.
+	h = newHandler(&GetCountryCodeMock{Err: errors.New("boom")}, monday.AddDate(0, 0, 5))
+	h.OnLookupFailure = LookupFailureAllow
+	h.HandleClient(context.Background(), &mocks.MockNetConn{IPVersion: 4})
+	assert.True(t, h.accepted)
+	assert.Equal(t, "ipapi error; allowed by onLookupFailure policy", h.AllowedReason)
+
+	// Filters after the rules still get a lookup when the rule didn't need one.
+	h = newHandler(&GetCountryCodeMock{ReturnCountry: "US", ReturnHosting: true}, monday)
+	h.DenyHosting = true
+	h.HandleClient(context.Background(), &mocks.MockNetConn{IPVersion: 4})
+	assert.False(t, h.accepted)
+	assert.Equal(t, "hosting denied", h.DeniedReason)
+}
+
+func TestHandlerClientTimezone(t *testing.T) {
+	// 09:00-17:00 on weekdays, in each client's own zone.
+	set := rules.FromLegacy(rules.Legacy{
+		AllowedCountries: map[string]bool{"US": true, "JP": true},
+		StartTime:        time.Date(0, 1, 1, 9, 0, 0, 0, time.UTC),
+		EndTime:          time.Date(0, 1, 1, 17, 0, 0, 0, time.UTC),
+		ClientZone:       true,
+	})
+	// 15:00 UTC is 11:00 in New York and midnight in Tokyo.
+	now := time.Date(2024, 5, 6, 15, 0, 0, 0, time.UTC)
+	newHandler := func(lookup *GetCountryCodeMock) *ClientHandler {
+		return &ClientHandler{
+			Rules:         set,
+			IPApiClient:   lookup,
+			TransferFunc:  TransferFuncMock,
+			BackendDialer: &staticDialer{conn: &mocks.MockNetConn{IPVersion: 4}},
+			BackendAddr:   "127.0.0.1",
+			BackendPort:   "8080",
+			Now:           now,
+		}
+	}
+
+	h := newHandler(&GetCountryCodeMock{ReturnCountry: "US", ReturnZone: "America/New_York"})
+	h.HandleClient(context.Background(), &mocks.MockNetConn{IPVersion: 4})
+	assert.True(t, h.accepted)
+
+	h = newHandler(&GetCountryCodeMock{ReturnCountry: "JP", ReturnZone: "Asia/Tokyo"})
+	h.HandleClient(context.Background(), &mocks.MockNetConn{IPVersion: 4})
+	assert.False(t, h.accepted)
+	assert.Equal(t, rules.ReasonTime, h.DeniedReason)
+
+	// Without a zone the client is outside the window.
+	h = newHandler(&GetCountryCodeMock{ReturnCountry: "US"})
+	h.HandleClient(context.Background(), &mocks.MockNetConn{IPVersion: 4})
+	assert.False(t, h.accepted)
+	assert.Equal(t, rules.ReasonTime, h.DeniedReason)
+}
@@ -51,35 +51,45 @@ func (c *limitConn) nextDeadline(now time.Time, _ bool) time.Time {
 
 // Optional TCP half-close support (used by TransferData to avoid truncation).
 func (c *limitConn) CloseWrite() error {
-	if cw, ok := c.Connection.(interface{ CloseWrite() error }); ok {
+	return closeWrite(c.Connection)
+}
+
+func (c *limitConn) CloseRead() error {
+	return closeRead(c.Connection)
+}
+
+// closeWrite half-closes c through whichever wrapper exposes the TCP
+// connection, falling back to a full close.
+func closeWrite(c Connection) error {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
 		return cw.CloseWrite()
 	}
-	if tg, ok := c.Connection.(interface{ TCPConn() (*net.TCPConn, bool) }); ok {
+	if tg, ok := c.(interface{ TCPConn() (*net.TCPConn, bool) }); ok {
 		if tcp, ok := tg.TCPConn(); ok {
 			return tcp.CloseWrite()
 		}
 	}
-	if rg, ok := c.Connection.(interface{ Raw() net.Conn }); ok {
+	if rg, ok := c.(interface{ Raw() net.Conn }); ok {
 		if cw, ok := rg.Raw().(interface{ CloseWrite() error }); ok {
 			return cw.CloseWrite()
 		}
 	}
-	return c.Connection.Close()
+	return c.Close()
 }
 
-func (c *limitConn) CloseRead() error {
-	if cr, ok := c.Connection.(interface{ CloseRead() error }); ok {
+func closeRead(c Connection) error {
+	if cr, ok := c.(interface{ CloseRead() error }); ok {
 		return cr.CloseRead()
 	}
-	if tg, ok := c.Connection.(interface{ TCPConn() (*net.TCPConn, bool) }); ok {
+	if tg, ok := c.(interface{ TCPConn() (*net.TCPConn, bool) }); ok {
 		if tcp, ok := tg.TCPConn(); ok {
 			return tcp.CloseRead()
 		}
 	}
-	if rg, ok := c.Connection.(interface{ Raw() net.Conn }); ok {
+	if rg, ok := c.(interface{ Raw() net.Conn }); ok {
 		if cr, ok := rg.Raw().(interface{ CloseRead() error }); ok {
 			return cr.CloseRead()
 		}
 	}
-	return c.Connection.Close()
+	return c.Close()
 }
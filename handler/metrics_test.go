@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"geoproxy/metrics"
+	"geoproxy/mocks"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/pires/go-proxyproto"
+	"github.com/stretchr/testify/assert"
+)
+
+// payloadConn returns payload from the first non-empty Read, then EOF.
+type payloadConn struct {
+	mocks.MockNetConn
+	payload []byte
+}
+
+func (c *payloadConn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if len(c.payload) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, c.payload)
+	c.payload = c.payload[n:]
+	return n, nil
+}
+
+func scrapeMetrics(t *testing.T) string {
+	t.Helper()
+	var b strings.Builder
+	if err := metrics.Default.WriteText(&b); err != nil {
+		t.Fatalf("WriteText: %v", err)
+	}
+	return b.String()
+}
+
+func TestHandlerMetrics(t *testing.T) {
+	drain := func(client Connection, backend Connection, _ *proxyproto.Header) {
+		_, _ = io.Copy(io.Discard, client)
+		_, _ = io.Copy(io.Discard, backend)
+	}
+	newHandler := func(country string) *ClientHandler {
+		return &ClientHandler{
+			AllowedCountries: map[string]bool{"US": true},
+			IPApiClient:      &GetCountryCodeMock{ReturnCountry: country},
+			TransferFunc:     drain,
+			BackendDialer:    &staticDialer{conn: &payloadConn{MockNetConn: mocks.MockNetConn{IPVersion: 4}, payload: []byte("hello world")}},
+			BackendAddr:      "127.0.0.1",
+			BackendPort:      "8080",
+			ServerName:       "metrics-test:1",
+		}
+	}
+
+	newHandler("US").HandleClient(context.Background(), &payloadConn{MockNetConn: mocks.MockNetConn{IPVersion: 4}, payload: []byte("ping")})
+	newHandler("CN").HandleClient(context.Background(), &mocks.MockNetConn{IPVersion: 4})
+	newHandler("CN").HandleClient(context.Background(), &mocks.MockNetConn{IPVersion: 4})
+
+	failing := newHandler("US")
+	failing.BackendDialer = &staticDialer{err: fmt.Errorf("refused")}
+	failing.HandleClient(context.Background(), &mocks.MockNetConn{IPVersion: 4})
+
+	out := scrapeMetrics(t)
+	for _, line := range []string{
+		`geoproxy_connections_accepted_total{server="metrics-test:1"} 1`,
+		`geoproxy_connections_rejected_total{server="metrics-test:1",reason="country or region denied"} 2`,
+		`geoproxy_backend_dial_failures_total{server="metrics-test:1"} 1`,
+		`geoproxy_bytes_total{server="metrics-test:1",direction="client_to_backend"} 4`,
+		`geoproxy_bytes_total{server="metrics-test:1",direction="backend_to_client"} 11`,
+		`geoproxy_active_connections{server="metrics-test:1"} 0`,
+	} {
+		assert.Contains(t, out, line+"\n")
+	}
+}
@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ActiveConn is a snapshot of one proxied connection.
+type ActiveConn struct {
+	ID        uint64    `json:"id"`
+	Server    string    `json:"server"`
+	Client    string    `json:"client"`
+	Country   string    `json:"country"`
+	Region    string    `json:"region"`
+	Backend   string    `json:"backend"`
+	Start     time.Time `json:"start"`
+	Age       string    `json:"age"`
+	BytesUp   int64     `json:"bytesUp"`
+	BytesDown int64     `json:"bytesDown"`
+}
+
+type trackedConn struct {
+	info      ActiveConn
+	bytesUp   *atomic.Int64
+	bytesDown *atomic.Int64
+	kill      func()
+}
+
+// ConnRegistry tracks the connections currently being proxied so they can be
+// listed and closed from the admin API.
+type ConnRegistry struct {
+	mu     sync.Mutex
+	nextID uint64
+	conns  map[uint64]*trackedConn
+}
+
+func NewConnRegistry() *ConnRegistry {
+	return &ConnRegistry{conns: make(map[uint64]*trackedConn)}
+}
+
+func (r *ConnRegistry) add(c *trackedConn) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	c.info.ID = r.nextID
+	r.conns[c.info.ID] = c
+	return c.info.ID
+}
+
+func (r *ConnRegistry) remove(id uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.conns, id)
+}
+
+// List returns the active connections, oldest first.
+func (r *ConnRegistry) List() []ActiveConn {
+	now := time.Now()
+	r.mu.Lock()
+	out := make([]ActiveConn, 0, len(r.conns))
+	for _, c := range r.conns {
+		info := c.info
+		info.Age = now.Sub(info.Start).Round(time.Second).String()
+		info.BytesUp = c.bytesUp.Load()
+		info.BytesDown = c.bytesDown.Load()
+		out = append(out, info)
+	}
+	r.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// Kill closes the connection with the given ID. It reports whether the
+// connection was found.
+func (r *ConnRegistry) Kill(id uint64) bool {
+	r.mu.Lock()
+	c, ok := r.conns[id]
+	r.mu.Unlock()
+	if !ok {
+		return false
+	}
+	c.kill()
+	return true
+}
@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"context"
+	"geoproxy/mocks"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingConn blocks reads until it is closed.
+type blockingConn struct {
+	mocks.MockNetConn
+	closed chan struct{}
+}
+
+func newBlockingConn() *blockingConn {
+	return &blockingConn{MockNetConn: mocks.MockNetConn{IPVersion: 4}, closed: make(chan struct{})}
+}
+
+func (c *blockingConn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	<-c.closed
+	return 0, net.ErrClosed
+}
+
+func (c *blockingConn) Close() error {
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
+	return nil
+}
+
+func TestConnRegistryListAndKill(t *testing.T) {
+	registry := NewConnRegistry()
+	log := &recordingAccessLog{}
+	client := newBlockingConn()
+	h := &ClientHandler{
+		AllowedCountries: map[string]bool{"US": true},
+		IPApiClient:      &GetCountryCodeMock{ReturnCountry: "US", ReturnRegion: "CA"},
+		TransferFunc: func(c Connection, _ Connection, _ *proxyproto.Header) {
+			_, _ = c.Read(make([]byte, 1))
+		},
+		BackendDialer: &staticDialer{conn: newBlockingConn()},
+		BackendAddr:   "10.0.0.5",
+		BackendPort:   "443",
+		ServerName:    "web",
+		Conns:         registry,
+		AccessLog:     log,
+	}
+
+	done := make(chan struct{})
+	go func() {
+		h.HandleClient(context.Background(), client)
+		close(done)
+	}()
+
+	var conns []ActiveConn
+	assert.Eventually(t, func() bool {
+		conns = registry.List()
+		return len(conns) == 1
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, "web", conns[0].Server)
+	assert.Equal(t, "127.0.0.1:8080", conns[0].Client)
+	assert.Equal(t, "US", conns[0].Country)
+	assert.Equal(t, "10.0.0.5:443", conns[0].Backend)
+
+	assert.False(t, registry.Kill(conns[0].ID+1))
+	assert.True(t, registry.Kill(conns[0].ID))
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("connection was not closed")
+	}
+	assert.Empty(t, registry.List())
+	if assert.Len(t, log.records, 1) {
+		assert.Equal(t, "closed via admin API", log.records[0].Reason)
+	}
+}
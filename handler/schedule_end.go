@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"geoproxy/ipapi"
+	"geoproxy/metrics"
+	"geoproxy/rules"
+	"log"
+	"time"
+)
+
+// ReasonScheduleEnd is the access log reason for connections closed by
+// EnforceScheduleOnActive.
+const ReasonScheduleEnd = "closed at schedule end"
+
+// scheduleHorizon is how far ahead enforceSchedule looks for the end of the
+// client's window at a time. A connection still allowed at the horizon is
+// checked again from there.
+const scheduleHorizon = 24 * time.Hour
+
+var errNoLookup = errors.New("client was not looked up")
+
+// scheduleEnd returns the first time after from, and at most horizon later,
+// at which set no longer allows ip, or the zero time. Decisions only change
+// when a schedule window or calendar event starts or ends, so only those
+// times are evaluated, and a decision no schedule or event can change returns
+// at once. Times whose evaluation fails are skipped.
+func scheduleEnd(set *rules.Set, ip string, from time.Time, horizon time.Duration, lookup rules.Lookup) time.Time {
+	d, err := set.Evaluate(ip, from, lookup)
+	if err == nil && !set.Timed(d.Rule) {
+		return time.Time{}
+	}
+	var zone string
+	if set.UsesClientZone() {
+		if reply, err := lookup(); err == nil {
+			zone = reply.Timezone
+		}
+	}
+	last := from.Add(horizon)
+	for t := set.NextChange(from, zone); !t.IsZero() && !t.After(last); t = set.NextChange(t, zone) {
+		d, err := set.Evaluate(ip, t, lookup)
+		if err == nil && d.Action != rules.Allow {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// enforceSchedule closes the connection through closeConn once the rule set
+// that allowed it stops allowing the client, after ScheduleGracePeriod. The
+// first end is found before the connection is proxied, so a lookup it needs
+// happens here rather than on another goroutine; later checks, for
+// connections outliving the horizon, reuse that lookup. The returned func
+// stops the enforcement.
+func (h *ClientHandler) enforceSchedule(ctx context.Context, closeConn func()) (stop func()) {
+	horizon := scheduleHorizon
+	if h.MaxConnLifetime > 0 && h.MaxConnLifetime < horizon {
+		horizon = h.MaxConnLifetime
+	}
+	at := h.now()
+	end := scheduleEnd(h.ruleSet, h.clientIP, at, horizon, func() (ipapi.Reply, error) {
+		return h.lookup(ctx, h.clientIP)
+	})
+	reply, lookupErr := h.reply, h.lookupErr
+	if !h.looked {
+		lookupErr = errNoLookup
+	}
+	looked := func() (ipapi.Reply, error) { return reply, lookupErr }
+
+	done := make(chan struct{})
+	sleep := func(d time.Duration) bool {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-t.C:
+			return true
+		case <-done:
+			return false
+		}
+	}
+	go func() {
+		for end.IsZero() {
+			if !sleep(horizon) {
+				return
+			}
+			at = at.Add(horizon)
+			end = scheduleEnd(h.ruleSet, h.clientIP, at, horizon, looked)
+		}
+		if !sleep(end.Sub(at)) {
+			return
+		}
+		if h.ScheduleGracePeriod > 0 {
+			log.Printf("schedule ended for connection from %s to %s:%s; closing in %s",
+				h.clientAddr, h.BackendAddr, h.BackendPort, h.ScheduleGracePeriod)
+			if !sleep(h.ScheduleGracePeriod) {
+				return
+			}
+		}
+		log.Printf("closing connection from %s to %s:%s: schedule ended",
+			h.clientAddr, h.BackendAddr, h.BackendPort)
+		h.scheduleClosed.Store(true)
+		metrics.ScheduleClosures.With(h.ServerName).Inc()
+		closeConn()
+	}()
+	return func() { close(done) }
+}
@@ -0,0 +1,121 @@
+package handler
+
+import (
+	"context"
+	"geoproxy/calendar"
+	"geoproxy/ipapi"
+	"geoproxy/rules"
+	"testing"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+	"github.com/stretchr/testify/assert"
+)
+
+// officeHours allows clients from 09:00 to 17:00 UTC on weekdays.
+func officeHours() *rules.Set {
+	return rules.FromLegacy(rules.Legacy{
+		AllowedCountries: map[string]bool{"US": true},
+		DaysOfWeek: map[time.Weekday]bool{
+			time.Monday: true, time.Tuesday: true, time.Wednesday: true, time.Thursday: true, time.Friday: true,
+		},
+		StartTime: time.Date(0, 1, 1, 9, 0, 0, 0, time.UTC),
+		EndTime:   time.Date(0, 1, 1, 17, 0, 0, 0, time.UTC),
+		Location:  time.UTC,
+	})
+}
+
+func TestScheduleEnd(t *testing.T) {
+	set := officeHours()
+	lookup := func() (ipapi.Reply, error) { return ipapi.Reply{CountryCode: "US"}, nil }
+	monday := time.Date(2024, 5, 6, 0, 0, 0, 0, time.UTC)
+
+	// The end time is inclusive, so the window closes a minute after it.
+	assert.Equal(t, monday.Add(17*time.Hour+time.Minute),
+		scheduleEnd(set, "192.0.2.1", monday.Add(16*time.Hour+30*time.Minute), scheduleHorizon, lookup))
+	assert.Equal(t, monday.Add(17*time.Hour+time.Minute),
+		scheduleEnd(set, "192.0.2.1", monday.Add(17*time.Hour+30*time.Second), scheduleHorizon, lookup))
+	// Still open at the horizon.
+	assert.True(t, scheduleEnd(set, "192.0.2.1", monday.Add(10*time.Hour), time.Hour, lookup).IsZero())
+	// Friday's window is followed by the weekend.
+	friday := monday.AddDate(0, 0, 4)
+	assert.Equal(t, friday.Add(17*time.Hour+time.Minute),
+		scheduleEnd(set, "192.0.2.1", friday.Add(9*time.Hour), scheduleHorizon, lookup))
+
+	// A calendar exception ends the window early.
+	set.Calendar = &rules.Calendar{Events: []calendar.Event{
+		{Name: "maintenance", Start: monday.Add(12*time.Hour + 30*time.Minute), End: monday.Add(13 * time.Hour)},
+	}}
+	assert.Equal(t, monday.Add(12*time.Hour+30*time.Minute),
+		scheduleEnd(set, "192.0.2.1", monday.Add(10*time.Hour), scheduleHorizon, lookup))
+
+	// Without schedules or exceptions the decision never changes, which takes
+	// a single evaluation to tell.
+	lookups := 0
+	always := &rules.Set{Rules: []rules.Rule{{Action: rules.Allow, Countries: map[string]bool{"US": true}}}}
+	assert.True(t, scheduleEnd(always, "192.0.2.1", monday, scheduleHorizon, func() (ipapi.Reply, error) {
+		lookups++
+		return ipapi.Reply{CountryCode: "US"}, nil
+	}).IsZero())
+	assert.Equal(t, 1, lookups)
+}
+
+func TestHandlerEnforceSchedule(t *testing.T) {
+	log := &recordingAccessLog{}
+	client := newBlockingConn()
+	h := &ClientHandler{
+		Rules:       officeHours(),
+		IPApiClient: &GetCountryCodeMock{ReturnCountry: "US"},
+		TransferFunc: func(c Connection, _ Connection, _ *proxyproto.Header) {
+			_, _ = c.Read(make([]byte, 1))
+		},
+		BackendDialer:           &staticDialer{conn: newBlockingConn()},
+		BackendAddr:             "10.0.0.5",
+		BackendPort:             "22",
+		AccessLog:               log,
+		EnforceScheduleOnActive: true,
+		ScheduleGracePeriod:     20 * time.Millisecond,
+		// Moments before the window closes at 17:01.
+		Now: time.Date(2024, 5, 6, 17, 0, 59, 950*int(time.Millisecond), time.UTC),
+	}
+
+	done := make(chan struct{})
+	go func() {
+		h.HandleClient(context.Background(), client)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection was not closed at the end of the schedule")
+	}
+	assert.True(t, h.accepted)
+	if assert.Len(t, log.records, 1) {
+		assert.Equal(t, ReasonScheduleEnd, log.records[0].Reason)
+	}
+}
+
+func TestHandlerEnforceScheduleStops(t *testing.T) {
+	// A connection that ends on its own stops the enforcement; one allowed
+	// by alwaysAllowed isn't subject to it at all.
+	for _, alwaysAllowed := range []bool{false, true} {
+		log := &recordingAccessLog{}
+		h := &ClientHandler{
+			Rules:                   officeHours(),
+			IPApiClient:             &GetCountryCodeMock{ReturnCountry: "US"},
+			TransferFunc:            TransferFuncMock,
+			BackendDialer:           &staticDialer{conn: newBlockingConn()},
+			AccessLog:               log,
+			EnforceScheduleOnActive: true,
+			Now:                     time.Date(2024, 5, 6, 10, 0, 0, 0, time.UTC),
+		}
+		if alwaysAllowed {
+			h.AlwaysAllowedSet = ipSet(t, "127.0.0.1")
+		}
+		h.HandleClient(context.Background(), newBlockingConn())
+		assert.Equal(t, !alwaysAllowed, h.ruleSet != nil)
+		if assert.Len(t, log.records, 1) {
+			assert.NotEqual(t, ReasonScheduleEnd, log.records[0].Reason)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package handler
+
+import (
+	"fmt"
+	"geoproxy/common"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Lists a temporary rule can be added to.
+const (
+	TempDeny  = "deny"
+	TempAllow = "allow"
+)
+
+// TempRule is an alwaysDenied/alwaysAllowed entry added at runtime that
+// expires on its own.
+type TempRule struct {
+	List string `json:"list"`
+	// Server limits the rule to one server (by name); empty applies to all.
+	Server    string    `json:"server,omitempty"`
+	Entry     string    `json:"entry"`
+	ExpiresAt time.Time `json:"expiresAt"`
+
+	prefix netip.Prefix
+}
+
+// TempRules holds runtime allow/deny entries shared by every server. They are
+// kept in memory only.
+type TempRules struct {
+	mu    sync.RWMutex
+	rules map[string]TempRule
+	now   func() time.Time
+}
+
+func NewTempRules() *TempRules {
+	return &TempRules{rules: make(map[string]TempRule), now: time.Now}
+}
+
+func tempRuleKey(list, server, entry string) string {
+	return list + "|" + server + "|" + entry
+}
+
+// Add inserts or refreshes a rule. entry is an IP or CIDR.
+func (t *TempRules) Add(list, server, entry string, ttl time.Duration) (TempRule, error) {
+	if list != TempDeny && list != TempAllow {
+		return TempRule{}, fmt.Errorf("unknown list %q (expected %q or %q)", list, TempDeny, TempAllow)
+	}
+	if ttl <= 0 {
+		return TempRule{}, fmt.Errorf("ttl must be > 0")
+	}
+	prefix, err := common.ParseIPOrPrefix(entry)
+	if err != nil {
+		return TempRule{}, err
+	}
+	r := TempRule{
+		List:      list,
+		Server:    server,
+		Entry:     prefix.String(),
+		ExpiresAt: t.now().Add(ttl),
+		prefix:    prefix,
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pruneLocked(t.now())
+	t.rules[tempRuleKey(list, server, r.Entry)] = r
+	return r, nil
+}
+
+// pruneLocked drops the rules that expired by now. Add calls it so that a
+// stream of short-lived rules doesn't grow the map. t.mu must be held.
+func (t *TempRules) pruneLocked(now time.Time) {
+	for k, r := range t.rules {
+		if !now.Before(r.ExpiresAt) {
+			delete(t.rules, k)
+		}
+	}
+}
+
+// Remove deletes a rule and reports whether it existed.
+func (t *TempRules) Remove(list, server, entry string) bool {
+	prefix, err := common.ParseIPOrPrefix(entry)
+	if err != nil {
+		return false
+	}
+	key := tempRuleKey(list, server, prefix.String())
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.rules[key]
+	delete(t.rules, key)
+	return ok
+}
+
+// List returns the unexpired rules and drops the expired ones.
+func (t *TempRules) List() []TempRule {
+	now := t.now()
+	t.mu.Lock()
+	t.pruneLocked(now)
+	out := make([]TempRule, 0, len(t.rules))
+	for _, r := range t.rules {
+		out = append(out, r)
+	}
+	t.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].List != out[j].List {
+			return out[i].List < out[j].List
+		}
+		if out[i].Server != out[j].Server {
+			return out[i].Server < out[j].Server
+		}
+		return out[i].Entry < out[j].Entry
+	})
+	return out
+}
+
+// Match reports whether ip is on list for server.
+func (t *TempRules) Match(list, server, ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap().WithZone("")
+	now := t.now()
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, r := range t.rules {
+		if r.List != list || (r.Server != "" && r.Server != server) {
+			continue
+		}
+		if now.Before(r.ExpiresAt) && r.prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"geoproxy/mocks"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTempRules(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	rules := NewTempRules()
+	rules.now = func() time.Time { return now }
+
+	_, err := rules.Add(TempDeny, "", "10.0.0.0/8", time.Minute)
+	assert.NoError(t, err)
+	_, err = rules.Add(TempAllow, "web", "::ffff:192.0.2.1", time.Hour)
+	assert.NoError(t, err)
+	_, err = rules.Add(TempDeny, "", "bogus", time.Minute)
+	assert.Error(t, err)
+	_, err = rules.Add("maybe", "", "10.0.0.1", time.Minute)
+	assert.Error(t, err)
+	_, err = rules.Add(TempDeny, "", "10.0.0.1", 0)
+	assert.Error(t, err)
+
+	assert.True(t, rules.Match(TempDeny, "any", "10.1.2.3"))
+	assert.True(t, rules.Match(TempDeny, "any", "::ffff:10.1.2.3"))
+	assert.False(t, rules.Match(TempAllow, "any", "10.1.2.3"))
+	assert.True(t, rules.Match(TempAllow, "web", "192.0.2.1"))
+	assert.False(t, rules.Match(TempAllow, "ssh", "192.0.2.1"))
+	assert.Len(t, rules.List(), 2)
+
+	now = now.Add(2 * time.Minute)
+	assert.False(t, rules.Match(TempDeny, "any", "10.1.2.3"))
+	assert.Len(t, rules.List(), 1)
+
+	assert.True(t, rules.Remove(TempAllow, "web", "192.0.2.1"))
+	assert.False(t, rules.Remove(TempAllow, "web", "192.0.2.1"))
+	assert.Empty(t, rules.List())
+
+	// Adding rules drops the expired ones without waiting for List.
+	for i := 0; i < 100; i++ {
+		_, err = rules.Add(TempDeny, "", fmt.Sprintf("10.0.%d.1", i), time.Second)
+		assert.NoError(t, err)
+		now = now.Add(2 * time.Second)
+	}
+	rules.mu.RLock()
+	assert.Len(t, rules.rules, 1)
+	rules.mu.RUnlock()
+}
+
+func TestHandlerTempRules(t *testing.T) {
+	rules := NewTempRules()
+	newHandler := func(country string) *ClientHandler {
+		return &ClientHandler{
+			AllowedCountries: map[string]bool{"US": true},
+			AlwaysAllowedSet: ipSet(t, "127.0.0.1"),
+			IPApiClient:      &GetCountryCodeMock{ReturnCountry: country},
+			TransferFunc:     TransferFuncMock,
+			BackendDialer:    &staticDialer{conn: &mocks.MockNetConn{IPVersion: 4}},
+			BackendAddr:      "127.0.0.1",
+			BackendPort:      "8080",
+			ServerName:       "web",
+			TempRules:        rules,
+		}
+	}
+
+	// A temporary deny wins over alwaysAllowed.
+	_, err := rules.Add(TempDeny, "web", "127.0.0.1", time.Minute)
+	assert.NoError(t, err)
+	h := newHandler("US")
+	h.HandleClient(context.Background(), &mocks.MockNetConn{IPVersion: 4})
+	assert.False(t, h.accepted)
+	assert.Equal(t, "temporarily denied", h.DeniedReason)
+	assert.True(t, rules.Remove(TempDeny, "web", "127.0.0.1"))
+
+	// A temporary allow skips the geo check.
+	_, err = rules.Add(TempAllow, "", "127.0.0.0/8", time.Minute)
+	assert.NoError(t, err)
+	h = newHandler("CN")
+	h.AlwaysAllowedSet = nil
+	h.HandleClient(context.Background(), &mocks.MockNetConn{IPVersion: 4})
+	assert.True(t, h.accepted)
+	assert.Equal(t, "temporarily allowed", h.AllowedReason)
+}
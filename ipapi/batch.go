@@ -0,0 +1,139 @@
+package ipapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// MaxBatchSize is the most IPs ip-api accepts in one batch request.
+const MaxBatchSize = 100
+
+// pendingBatch collects the IPs waiting for the next batch request. Several
+// callers may wait on the same IP.
+type pendingBatch struct {
+	ips     []string
+	waiters map[string][]chan lookupResult
+}
+
+// Batcher gathers lookups over a short window and resolves them with a single
+// POST /batch request, then hands each caller its own answer.
+type Batcher struct {
+	Client BatchHTTPClient
+	// Window is how long the first lookup of a batch waits for others to join.
+	// A batch is sent early once it holds MaxBatchSize IPs.
+	Window           time.Duration
+	MaxResponseBytes int64
+
+	mu      sync.Mutex
+	current *pendingBatch
+}
+
+// Lookup queues ip for the next batch and waits for its result.
+func (b *Batcher) Lookup(ctx context.Context, ip string) (Reply, error) {
+	ch := make(chan lookupResult, 1)
+
+	b.mu.Lock()
+	pb := b.current
+	if pb == nil {
+		pb = &pendingBatch{waiters: make(map[string][]chan lookupResult)}
+		b.current = pb
+		time.AfterFunc(b.Window, func() { b.flushIfCurrent(pb) })
+	}
+	if _, ok := pb.waiters[ip]; !ok {
+		pb.ips = append(pb.ips, ip)
+	}
+	pb.waiters[ip] = append(pb.waiters[ip], ch)
+	full := len(pb.ips) >= MaxBatchSize
+	if full {
+		b.current = nil
+	}
+	b.mu.Unlock()
+
+	if full {
+		go b.flush(pb)
+	}
+
+	select {
+	case r := <-ch:
+		return r.reply, r.err
+	case <-ctx.Done():
+		return Reply{}, ctx.Err()
+	}
+}
+
+// flushIfCurrent sends pb when its window ends, unless it already went out
+// because it filled up.
+func (b *Batcher) flushIfCurrent(pb *pendingBatch) {
+	b.mu.Lock()
+	if b.current != pb {
+		b.mu.Unlock()
+		return
+	}
+	b.current = nil
+	b.mu.Unlock()
+	b.flush(pb)
+}
+
+func (b *Batcher) flush(pb *pendingBatch) {
+	// Waiters bound their own wait with ctx; the request itself is bounded by
+	// the HTTP client's timeout so it isn't tied to any one caller.
+	results, err := b.post(context.Background(), pb.ips)
+	for i, ip := range pb.ips {
+		r := lookupResult{err: err}
+		if err == nil {
+			r = results[i]
+		}
+		for _, ch := range pb.waiters[ip] {
+			ch <- r
+		}
+	}
+}
+
+func (b *Batcher) post(ctx context.Context, ips []string) ([]lookupResult, error) {
+	resp, err := b.Client.PostBatch(ctx, ips)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get country code: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("ipapi batch returned non-200 status: %d", resp.StatusCode)
+	}
+
+	limit := b.MaxResponseBytes
+	if limit <= 0 {
+		limit = 1 << 20 // 1MiB
+	}
+	var data []apiResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, limit)).Decode(&data); err != nil {
+		return nil, fmt.Errorf("failed to decode batch response: %v", err)
+	}
+	// Results are matched to the IPs by their query field, so a result ip-api
+	// leaves out fails just that IP. Without the field, they are taken in
+	// request order, provided none is missing.
+	byIP := make(map[string]apiResponse, len(data))
+	for i, d := range data {
+		key := d.Query
+		if key == "" && len(data) == len(ips) {
+			key = ips[i]
+		}
+		byIP[key] = d
+	}
+	results := make([]lookupResult, len(ips))
+	for i, ip := range ips {
+		d, ok := byIP[ip]
+		switch {
+		case !ok:
+			results[i] = lookupResult{err: fmt.Errorf("ipapi batch returned no result for ip: %s", ip)}
+		case d.Status != "success":
+			results[i] = lookupResult{err: fmt.Errorf("failed to get country code for ip: %s", ip)}
+		default:
+			results[i] = lookupResult{reply: d.reply()}
+		}
+	}
+	return results, nil
+}
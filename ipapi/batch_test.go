@@ -0,0 +1,178 @@
+package ipapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newBatchServer serves ip-api's /batch: IPs in 10.0.0.0/8 resolve to US and
+// everything else fails.
+func newBatchServer(t *testing.T) (*httptest.Server, *int32, *[]int) {
+	t.Helper()
+	var calls int32
+	var mu sync.Mutex
+	var sizes []int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/batch" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		atomic.AddInt32(&calls, 1)
+		var ips []string
+		if err := json.NewDecoder(r.Body).Decode(&ips); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		sizes = append(sizes, len(ips))
+		mu.Unlock()
+		out := make([]map[string]string, 0, len(ips))
+		for _, ip := range ips {
+			if len(ip) > 3 && ip[:3] == "10." {
+				out = append(out, map[string]string{"status": "success", "countryCode": "US", "region": "CA", "query": ip})
+			} else {
+				out = append(out, map[string]string{"status": "fail", "query": ip})
+			}
+		}
+		_ = json.NewEncoder(w).Encode(out)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls, &sizes
+}
+
+func TestBatcherCombinesLookups(t *testing.T) {
+	srv, calls, _ := newBatchServer(t)
+	b := &Batcher{
+		Client: &RealHTTPClient{Endpoint: srv.URL + "/json/"},
+		Window: 50 * time.Millisecond,
+	}
+	cfg := &GetCountryCodeConfig{Cache: newTestCache(t, 64), Batcher: b}
+
+	ips := []string{"10.0.0.1", "10.0.0.2", "10.0.0.2", "192.0.2.1"}
+	type outcome struct {
+		country string
+		err     error
+	}
+	out := make([]outcome, len(ips))
+	var wg sync.WaitGroup
+	for i, ip := range ips {
+		wg.Add(1)
+		go func(i int, ip string) {
+			defer wg.Done()
+			country, _, _, err := cfg.GetCountryCode(context.Background(), ip)
+			out[i] = outcome{country, err}
+		}(i, ip)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(calls))
+	assert.Equal(t, "US", out[0].country)
+	assert.Equal(t, "US", out[1].country)
+	assert.Equal(t, "US", out[2].country)
+	assert.NoError(t, out[0].err)
+	assert.Error(t, out[3].err)
+
+	_, _, marker, err := cfg.GetCountryCode(context.Background(), "10.0.0.1")
+	assert.NoError(t, err)
+	assert.Equal(t, "cached", marker)
+	assert.Equal(t, int32(1), atomic.LoadInt32(calls))
+}
+
+func TestBatcherFlushesFullBatchEarly(t *testing.T) {
+	srv, calls, sizes := newBatchServer(t)
+	b := &Batcher{
+		Client: &RealHTTPClient{Endpoint: srv.URL + "/json/"},
+		Window: time.Minute,
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < MaxBatchSize; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := b.Lookup(context.Background(), fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+			assert.NoError(t, err)
+		}(i)
+	}
+	done := make(chan struct{})
+	go func() { wg.Wait(); close(done) }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("full batch was not sent before the window ended")
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(calls))
+	assert.Equal(t, []int{MaxBatchSize}, *sizes)
+}
+
+func TestBatcherRequestError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	b := &Batcher{Client: &RealHTTPClient{Endpoint: srv.URL + "/json/"}, Window: time.Millisecond}
+
+	_, err := b.Lookup(context.Background(), "10.0.0.1")
+	assert.ErrorContains(t, err, "non-200")
+}
+
+func TestBatcherMatchesResultsByQuery(t *testing.T) {
+	// The results come back reversed and without 10.0.0.2.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode([]map[string]string{
+			{"status": "success", "countryCode": "DE", "query": "10.0.0.3"},
+			{"status": "success", "countryCode": "US", "query": "10.0.0.1"},
+		})
+	}))
+	defer srv.Close()
+	b := &Batcher{Client: &RealHTTPClient{Endpoint: srv.URL + "/json/"}, Window: 50 * time.Millisecond}
+
+	ips := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+	countries := make([]string, len(ips))
+	errs := make([]error, len(ips))
+	var wg sync.WaitGroup
+	for i, ip := range ips {
+		wg.Add(1)
+		go func(i int, ip string) {
+			defer wg.Done()
+			reply, err := b.Lookup(context.Background(), ip)
+			countries[i], errs[i] = reply.CountryCode, err
+		}(i, ip)
+	}
+	wg.Wait()
+
+	assert.Equal(t, []string{"US", "", "DE"}, countries)
+	assert.NoError(t, errs[0])
+	assert.ErrorContains(t, errs[1], "no result for ip: 10.0.0.2")
+	assert.NoError(t, errs[2])
+}
+
+func TestBatcherLookupHonoursContext(t *testing.T) {
+	b := &Batcher{Client: &RealHTTPClient{Endpoint: "http://127.0.0.1:1/json/"}, Window: time.Minute}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := b.Lookup(ctx, "10.0.0.1")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestRealHTTPClientBuildBatchURL(t *testing.T) {
+	for endpoint, want := range map[string]string{
+		"http://ip-api.com/json/":      "http://ip-api.com/batch?fields=countryCode%2Cregion%2Ccity%2Clat%2Clon%2Ctimezone%2Cstatus%2Cas%2Casname%2Corg%2Cisp%2Cmobile%2Cproxy%2Chosting%2Cquery",
+		"https://pro.ip-api.com/json":  "https://pro.ip-api.com/batch?fields=countryCode%2Cregion%2Ccity%2Clat%2Clon%2Ctimezone%2Cstatus%2Cas%2Casname%2Corg%2Cisp%2Cmobile%2Cproxy%2Chosting%2Cquery",
+		"http://127.0.0.1:8181/json/":  "http://127.0.0.1:8181/batch?fields=countryCode%2Cregion%2Ccity%2Clat%2Clon%2Ctimezone%2Cstatus%2Cas%2Casname%2Corg%2Cisp%2Cmobile%2Cproxy%2Chosting%2Cquery",
+		"http://example.test/geo/json": "http://example.test/geo/batch?fields=countryCode%2Cregion%2Ccity%2Clat%2Clon%2Ctimezone%2Cstatus%2Cas%2Casname%2Corg%2Cisp%2Cmobile%2Cproxy%2Chosting%2Cquery",
+	} {
+		got, err := (&RealHTTPClient{Endpoint: endpoint}).buildBatchURL()
+		assert.NoError(t, err)
+		assert.Equal(t, want, got, endpoint)
+	}
+}
@@ -0,0 +1,125 @@
+package ipapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"geoproxy/common"
+	"log"
+	"os"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2"
+)
+
+// cacheFileVersion is bumped whenever Reply changes, so snapshots missing
+// the new fields are dropped instead of serving empty values until they
+// expire. Version 2 added the ASN, network flags, city and time zone.
+const cacheFileVersion = 2
+
+type cacheFile struct {
+	Version int       `json:"version"`
+	SavedAt time.Time `json:"savedAt"`
+	// Fields are the lookupFields the replies were fetched with; a snapshot
+	// taken with other fields is dropped as well.
+	Fields  string           `json:"fields"`
+	Entries []cacheFileEntry `json:"entries"`
+}
+
+type cacheFileEntry struct {
+	IP    string `json:"ip"`
+	Reply Reply  `json:"reply"`
+}
+
+// replyExpired reports whether a cached reply is no longer usable, using the
+// same rules as GetCountryCode.
+func replyExpired(r Reply, now time.Time) bool {
+	if !r.FailureUntil.IsZero() {
+		return !now.Before(r.FailureUntil)
+	}
+	return r.ExpiresAt.IsZero() || now.After(r.ExpiresAt)
+}
+
+// SaveCache writes a snapshot of cache to path with common.WriteFileAtomic, so
+// a crash never leaves a truncated snapshot behind.
+func SaveCache(path string, cache *lru.Cache[string, Reply]) error {
+	now := time.Now()
+	snap := cacheFile{Version: cacheFileVersion, SavedAt: now, Fields: lookupFields}
+	// Keys are oldest first; keeping that order lets LoadCache rebuild recency.
+	for _, ip := range cache.Keys() {
+		reply, ok := cache.Peek(ip)
+		if !ok || replyExpired(reply, now) {
+			continue
+		}
+		snap.Entries = append(snap.Entries, cacheFileEntry{IP: ip, Reply: reply})
+	}
+
+	data, err := json.Marshal(&snap)
+	if err != nil {
+		return fmt.Errorf("failed to encode cache snapshot: %v", err)
+	}
+
+	if err := common.WriteFileAtomic(path, data); err != nil {
+		return fmt.Errorf("failed to write cache snapshot: %v", err)
+	}
+	return nil
+}
+
+// LoadCache adds the unexpired entries from the snapshot at path to cache and
+// returns how many were loaded. A missing file is not an error.
+func LoadCache(path string, cache *lru.Cache[string, Reply]) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to read cache snapshot: %v", err)
+	}
+	var snap cacheFile
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return 0, fmt.Errorf("failed to decode cache snapshot: %v", err)
+	}
+	if snap.Version != cacheFileVersion {
+		return 0, fmt.Errorf("unsupported cache snapshot version %d", snap.Version)
+	}
+	if snap.Fields != lookupFields {
+		return 0, fmt.Errorf("cache snapshot has different lookup fields %q", snap.Fields)
+	}
+
+	now := time.Now()
+	loaded := 0
+	for _, e := range snap.Entries {
+		if e.IP == "" || replyExpired(e.Reply, now) {
+			continue
+		}
+		cache.Add(e.IP, e.Reply)
+		loaded++
+	}
+	return loaded, nil
+}
+
+// RunCacheSnapshots saves cache to path every interval until ctx is done, then
+// writes one final snapshot.
+func RunCacheSnapshots(ctx context.Context, path string, cache *lru.Cache[string, Reply], interval time.Duration) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-tick:
+			if err := SaveCache(path, cache); err != nil {
+				log.Printf("failed to save ip cache: %v", err)
+			}
+		case <-ctx.Done():
+			if err := SaveCache(path, cache); err != nil {
+				log.Printf("failed to save ip cache: %v", err)
+				return
+			}
+			log.Printf("saved ip cache to %s (%d entries)", path, cache.Len())
+			return
+		}
+	}
+}
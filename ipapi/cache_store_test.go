@@ -0,0 +1,131 @@
+package ipapi
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSaveAndLoadCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	now := time.Now()
+
+	src := newTestCache(t, 16)
+	src.Add("1.1.1.1", Reply{CountryCode: "US", Region: "CA", ExpiresAt: now.Add(time.Hour)})
+	src.Add("2.2.2.2", Reply{FailureUntil: now.Add(time.Minute)})
+	src.Add("3.3.3.3", Reply{CountryCode: "DE", ExpiresAt: now.Add(-time.Minute)})
+	src.Add("4.4.4.4", Reply{FailureUntil: now.Add(-time.Second)})
+	src.Add("5.5.5.5", Reply{CountryCode: "FR"})
+
+	assert.NoError(t, SaveCache(path, src))
+
+	dst := newTestCache(t, 16)
+	n, err := LoadCache(path, dst)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []string{"1.1.1.1", "2.2.2.2"}, dst.Keys())
+
+	reply, ok := dst.Get("1.1.1.1")
+	assert.True(t, ok)
+	assert.Equal(t, "US", reply.CountryCode)
+	assert.Equal(t, "CA", reply.Region)
+	assert.WithinDuration(t, now.Add(time.Hour), reply.ExpiresAt, time.Second)
+
+	reply, ok = dst.Get("2.2.2.2")
+	assert.True(t, ok)
+	assert.False(t, reply.FailureUntil.IsZero())
+
+	// No temp files are left next to the snapshot.
+	entries, err := os.ReadDir(filepath.Dir(path))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestLoadCacheMissingFile(t *testing.T) {
+	n, err := LoadCache(filepath.Join(t.TempDir(), "missing.json"), newTestCache(t, 4))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestLoadCacheCorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`{"version":1,"entries":[`), 0o600))
+	_, err := LoadCache(path, newTestCache(t, 4))
+	assert.Error(t, err)
+
+	assert.NoError(t, os.WriteFile(path, []byte(`{"version":99,"entries":[]}`), 0o600))
+	_, err = LoadCache(path, newTestCache(t, 4))
+	assert.Error(t, err)
+}
+
+func TestLoadCacheOutdatedSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	expires := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+
+	// A version 1 snapshot predates the ASN and time zone fields.
+	assert.NoError(t, os.WriteFile(path, []byte(`{"version":1,"entries":[{"ip":"1.1.1.1","reply":{"countryCode":"US","expiresAt":"`+expires+`"}}]}`), 0o600))
+	cache := newTestCache(t, 4)
+	_, err := LoadCache(path, cache)
+	assert.Error(t, err)
+	assert.Zero(t, cache.Len())
+
+	assert.NoError(t, os.WriteFile(path, []byte(`{"version":2,"fields":"countryCode,region,status","entries":[{"ip":"1.1.1.1","reply":{"countryCode":"US","expiresAt":"`+expires+`"}}]}`), 0o600))
+	_, err = LoadCache(path, cache)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "lookup fields")
+	}
+	assert.Zero(t, cache.Len())
+}
+
+func TestSaveCacheKeepsPreviousSnapshotOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cache.json")
+	cache := newTestCache(t, 4)
+	cache.Add("1.1.1.1", Reply{CountryCode: "US", ExpiresAt: time.Now().Add(time.Hour)})
+	assert.NoError(t, SaveCache(path, cache))
+	before, err := os.ReadFile(path)
+	assert.NoError(t, err)
+
+	assert.Error(t, SaveCache(filepath.Join(dir, "missing-dir", "cache.json"), cache))
+
+	after, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, before, after)
+}
+
+func TestRunCacheSnapshots(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	cache := newTestCache(t, 4)
+	cache.Add("1.1.1.1", Reply{CountryCode: "US", ExpiresAt: time.Now().Add(time.Hour)})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		RunCacheSnapshots(ctx, path, cache, 10*time.Millisecond)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected periodic snapshot to be written")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	cache.Add("2.2.2.2", Reply{CountryCode: "DE", ExpiresAt: time.Now().Add(time.Hour)})
+	cancel()
+	<-done
+
+	loaded := newTestCache(t, 4)
+	n, err := LoadCache(path, loaded)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+}
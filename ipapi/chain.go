@@ -0,0 +1,156 @@
+package ipapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type ChainMode string
+
+const (
+	// ChainFallback asks providers in order and returns the first answer.
+	ChainFallback ChainMode = "fallback"
+	// ChainFirstSuccess asks all providers at once and returns the fastest answer.
+	ChainFirstSuccess ChainMode = "first-success"
+	// ChainConsensus asks all providers and requires Quorum of them to agree on
+	// the country.
+	ChainConsensus ChainMode = "consensus"
+)
+
+// NamedProvider labels a provider so chain errors say which one failed.
+type NamedProvider struct {
+	Name     string
+	Provider IPAPI
+}
+
+// ChainProvider combines several IPAPI implementations into one.
+type ChainProvider struct {
+	Providers []NamedProvider
+	Mode      ChainMode
+	// Quorum is the number of providers that must agree in consensus mode.
+	// 0 means a simple majority.
+	Quorum int
+}
+
+type chainResult struct {
+	index  int
+	reply  Reply
+	cached string
+	err    error
+}
+
+func (c *ChainProvider) GetCountryCode(ctx context.Context, ip string) (string, string, string, error) {
+	reply, cached, err := c.Lookup(ctx, ip)
+	if err != nil {
+		return "", "", cached, err
+	}
+	return reply.CountryCode, reply.Region, cached, nil
+}
+
+// Lookup returns the chosen provider's full reply, so ASN and organization
+// details come from the same answer as the country.
+func (c *ChainProvider) Lookup(ctx context.Context, ip string) (Reply, string, error) {
+	if len(c.Providers) == 0 {
+		return Reply{}, "-", fmt.Errorf("no geolocation providers configured")
+	}
+	switch c.Mode {
+	case ChainFirstSuccess:
+		return c.firstSuccess(ctx, ip)
+	case ChainConsensus:
+		return c.consensus(ctx, ip)
+	default:
+		return c.fallback(ctx, ip)
+	}
+}
+
+func (c *ChainProvider) fallback(ctx context.Context, ip string) (Reply, string, error) {
+	var errs []error
+	for _, p := range c.Providers {
+		reply, cached, err := Lookup(ctx, p.Provider, ip)
+		if err == nil {
+			return reply, cached, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", p.Name, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return Reply{}, "-", chainError(errs)
+}
+
+func (c *ChainProvider) queryAll(ctx context.Context, ip string) <-chan chainResult {
+	results := make(chan chainResult, len(c.Providers))
+	for i, p := range c.Providers {
+		go func(i int, p NamedProvider) {
+			reply, cached, err := Lookup(ctx, p.Provider, ip)
+			if err != nil {
+				err = fmt.Errorf("%s: %w", p.Name, err)
+			}
+			results <- chainResult{index: i, reply: reply, cached: cached, err: err}
+		}(i, p)
+	}
+	return results
+}
+
+func (c *ChainProvider) firstSuccess(ctx context.Context, ip string) (Reply, string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := c.queryAll(ctx, ip)
+	var errs []error
+	for range c.Providers {
+		r := <-results
+		if r.err == nil {
+			return r.reply, r.cached, nil
+		}
+		errs = append(errs, r.err)
+	}
+	return Reply{}, "-", chainError(errs)
+}
+
+func (c *ChainProvider) consensus(ctx context.Context, ip string) (Reply, string, error) {
+	quorum := c.Quorum
+	if quorum <= 0 {
+		quorum = len(c.Providers)/2 + 1
+	}
+
+	results := c.queryAll(ctx, ip)
+	answers := make([]*chainResult, len(c.Providers))
+	votes := make(map[string]int)
+	var errs []error
+	for range c.Providers {
+		r := <-results
+		if r.err != nil {
+			errs = append(errs, r.err)
+			continue
+		}
+		answers[r.index] = &r
+		votes[strings.ToUpper(strings.TrimSpace(r.reply.CountryCode))]++
+	}
+
+	best, bestVotes := "", 0
+	for country, n := range votes {
+		if n > bestVotes || (n == bestVotes && country < best) {
+			best, bestVotes = country, n
+		}
+	}
+	if bestVotes < quorum {
+		errs = append(errs, fmt.Errorf("%d of %d providers agree on %q, need %d", bestVotes, len(c.Providers), best, quorum))
+		return Reply{}, "-", chainError(errs)
+	}
+
+	// Report the answer of the highest-priority provider in the majority, so the
+	// region comes from the provider the operator trusts most.
+	for _, a := range answers {
+		if a != nil && strings.ToUpper(strings.TrimSpace(a.reply.CountryCode)) == best {
+			return a.reply, "consensus", nil
+		}
+	}
+	return Reply{CountryCode: best}, "consensus", nil
+}
+
+func chainError(errs []error) error {
+	return fmt.Errorf("all geolocation providers failed: %w", errors.Join(errs...))
+}
@@ -0,0 +1,181 @@
+package ipapi
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type stubProvider struct {
+	country string
+	region  string
+	err     error
+	delay   time.Duration
+	calls   int32
+}
+
+func (s *stubProvider) GetCountryCode(ctx context.Context, _ string) (string, string, string, error) {
+	atomic.AddInt32(&s.calls, 1)
+	if s.delay > 0 {
+		select {
+		case <-time.After(s.delay):
+		case <-ctx.Done():
+			return "", "", "-", ctx.Err()
+		}
+	}
+	if s.err != nil {
+		return "", "", "-", s.err
+	}
+	return s.country, s.region, "stub", nil
+}
+
+func TestChainFallback(t *testing.T) {
+	down := &stubProvider{err: errors.New("down")}
+	up := &stubProvider{country: "US", region: "CA"}
+	unused := &stubProvider{country: "DE"}
+	chain := &ChainProvider{
+		Mode:      ChainFallback,
+		Providers: []NamedProvider{{"a", down}, {"b", up}, {"c", unused}},
+	}
+
+	country, region, cached, err := chain.GetCountryCode(context.Background(), "1.2.3.4")
+	assert.NoError(t, err)
+	assert.Equal(t, "US", country)
+	assert.Equal(t, "CA", region)
+	assert.Equal(t, "stub", cached)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&unused.calls))
+
+	chain.Providers = []NamedProvider{{"a", down}, {"b", down}}
+	_, _, _, err = chain.GetCountryCode(context.Background(), "1.2.3.4")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "a: down")
+	assert.Contains(t, err.Error(), "b: down")
+}
+
+func TestChainFirstSuccess(t *testing.T) {
+	slow := &stubProvider{country: "DE", delay: time.Second}
+	fast := &stubProvider{country: "US", delay: time.Millisecond}
+	broken := &stubProvider{err: errors.New("down")}
+	chain := &ChainProvider{
+		Mode:      ChainFirstSuccess,
+		Providers: []NamedProvider{{"slow", slow}, {"broken", broken}, {"fast", fast}},
+	}
+
+	start := time.Now()
+	country, _, _, err := chain.GetCountryCode(context.Background(), "1.2.3.4")
+	assert.NoError(t, err)
+	assert.Equal(t, "US", country)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+
+	chain.Providers = []NamedProvider{{"broken", broken}}
+	_, _, _, err = chain.GetCountryCode(context.Background(), "1.2.3.4")
+	assert.Error(t, err)
+}
+
+func TestChainConsensus(t *testing.T) {
+	us1 := &stubProvider{country: "US", region: "CA"}
+	us2 := &stubProvider{country: "us", region: "NV"}
+	de := &stubProvider{country: "DE"}
+	down := &stubProvider{err: errors.New("down")}
+
+	chain := &ChainProvider{
+		Mode:      ChainConsensus,
+		Quorum:    2,
+		Providers: []NamedProvider{{"de", de}, {"us1", us1}, {"us2", us2}},
+	}
+	country, region, cached, err := chain.GetCountryCode(context.Background(), "1.2.3.4")
+	assert.NoError(t, err)
+	assert.Equal(t, "US", country)
+	assert.Equal(t, "CA", region)
+	assert.Equal(t, "consensus", cached)
+
+	chain.Providers = []NamedProvider{{"us1", us1}, {"de", de}, {"down", down}}
+	_, _, _, err = chain.GetCountryCode(context.Background(), "1.2.3.4")
+	assert.Error(t, err)
+
+	// Default quorum is a simple majority.
+	chain.Quorum = 0
+	chain.Providers = []NamedProvider{{"us1", us1}, {"us2", us2}, {"down", down}}
+	country, _, _, err = chain.GetCountryCode(context.Background(), "1.2.3.4")
+	assert.NoError(t, err)
+	assert.Equal(t, "US", country)
+}
+
+func TestChainNoProviders(t *testing.T) {
+	_, _, _, err := (&ChainProvider{}).GetCountryCode(context.Background(), "1.2.3.4")
+	assert.Error(t, err)
+}
+
+func TestStaticProvider(t *testing.T) {
+	p, err := NewStaticProvider([]StaticEntry{
+		{CIDR: "10.0.0.0/8", Country: "US"},
+		{CIDR: "10.1.0.0/16", Country: "DE", Region: "BE"},
+		{CIDR: "2001:db8::1", Country: "FR"},
+		{CIDR: "::ffff:192.0.2.0/120", Country: "NL"},
+	})
+	assert.NoError(t, err)
+
+	// IPv4-mapped entries match IPv4 clients.
+	country, _, _, err := p.GetCountryCode(context.Background(), "192.0.2.7")
+	assert.NoError(t, err)
+	assert.Equal(t, "NL", country)
+
+	country, region, cached, err := p.GetCountryCode(context.Background(), "10.1.2.3")
+	assert.NoError(t, err)
+	assert.Equal(t, "DE", country)
+	assert.Equal(t, "BE", region)
+	assert.Equal(t, "static", cached)
+
+	country, _, _, err = p.GetCountryCode(context.Background(), "::ffff:10.2.0.1")
+	assert.NoError(t, err)
+	assert.Equal(t, "US", country)
+
+	country, _, _, err = p.GetCountryCode(context.Background(), "2001:db8::1")
+	assert.NoError(t, err)
+	assert.Equal(t, "FR", country)
+
+	_, _, _, err = p.GetCountryCode(context.Background(), "192.168.0.1")
+	assert.Error(t, err)
+
+	_, err = NewStaticProvider([]StaticEntry{{CIDR: "bogus", Country: "US"}})
+	assert.Error(t, err)
+	_, err = NewStaticProvider([]StaticEntry{{CIDR: "10.0.0.0/8"}})
+	assert.Error(t, err)
+}
+
+type detailedStub struct {
+	stubProvider
+	reply Reply
+}
+
+func (d *detailedStub) Lookup(ctx context.Context, ip string) (Reply, string, error) {
+	if _, _, _, err := d.GetCountryCode(ctx, ip); err != nil {
+		return Reply{}, "-", err
+	}
+	return d.reply, "stub", nil
+}
+
+func TestChainLookupKeepsDetails(t *testing.T) {
+	detailed := &detailedStub{reply: Reply{CountryCode: "US", Region: "CA", ASN: 64500, Org: "Example"}}
+	plain := &stubProvider{country: "US"}
+	chain := &ChainProvider{
+		Mode:      ChainConsensus,
+		Providers: []NamedProvider{{"plain", plain}, {"detailed", detailed}},
+	}
+	reply, marker, err := chain.Lookup(context.Background(), "1.2.3.4")
+	assert.NoError(t, err)
+	assert.Equal(t, "consensus", marker)
+	// The highest-priority provider in the majority answers.
+	assert.Equal(t, uint32(0), reply.ASN)
+
+	chain.Mode = ChainFallback
+	chain.Providers = []NamedProvider{{"down", &stubProvider{err: errors.New("down")}}, {"detailed", detailed}}
+	reply, _, err = chain.Lookup(context.Background(), "1.2.3.4")
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(64500), reply.ASN)
+	assert.Equal(t, "Example", reply.Org)
+}
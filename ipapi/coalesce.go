@@ -0,0 +1,78 @@
+package ipapi
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+type lookupResult struct {
+	reply Reply
+	err   error
+}
+
+type flight struct {
+	done   chan struct{}
+	result lookupResult
+}
+
+// flightGroup makes sure only one upstream lookup per key is in flight at a
+// time; everyone else asking for the same key while it runs shares its result.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// do runs fn for key unless a call for key is already running, then waits for
+// the result. shared is true when the result came from another caller's call.
+// fn runs detached from ctx so one impatient caller can't fail the others; ctx
+// only bounds how long this caller waits.
+func (g *flightGroup) do(ctx context.Context, key string, fn func(context.Context) lookupResult) (lookupResult, bool) {
+	g.mu.Lock()
+	if g.flights == nil {
+		g.flights = make(map[string]*flight)
+	}
+	f, shared := g.flights[key]
+	if !shared {
+		f = &flight{done: make(chan struct{})}
+		g.flights[key] = f
+		go func() {
+			f.result = fn(context.WithoutCancel(ctx))
+			g.mu.Lock()
+			delete(g.flights, key)
+			g.mu.Unlock()
+			close(f.done)
+		}()
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.result, shared
+	case <-ctx.Done():
+		return lookupResult{err: ctx.Err()}, shared
+	}
+}
+
+// coalesceKey returns the flight key for ip: the address itself, or its
+// enclosing prefix when v4Bits/v6Bits are set.
+func coalesceKey(ip string, v4Bits, v6Bits int) string {
+	addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+	if err != nil {
+		return ip
+	}
+	addr = addr.Unmap().WithZone("")
+	bits := v6Bits
+	if addr.Is4() {
+		bits = v4Bits
+	}
+	if bits <= 0 || bits >= addr.BitLen() {
+		return addr.String()
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return addr.String()
+	}
+	return prefix.String()
+}
@@ -0,0 +1,157 @@
+package ipapi
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// gatedHTTPClient holds every request until release is closed so that callers
+// pile up behind the first one.
+type gatedHTTPClient struct {
+	release chan struct{}
+	calls   int32
+	err     error
+}
+
+func (c *gatedHTTPClient) Get(ctx context.Context, ip string) (*http.Response, error) {
+	atomic.AddInt32(&c.calls, 1)
+	select {
+	case <-c.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader(`{"countryCode":"US","region":"CA","status":"success"}`)),
+	}, nil
+}
+
+type lookupOutcome struct {
+	country string
+	marker  string
+	err     error
+}
+
+func lookupConcurrently(cfg *GetCountryCodeConfig, client *gatedHTTPClient, ips []string) []lookupOutcome {
+	out := make([]lookupOutcome, len(ips))
+	var wg sync.WaitGroup
+	for i, ip := range ips {
+		wg.Add(1)
+		go func(i int, ip string) {
+			defer wg.Done()
+			country, _, marker, err := cfg.GetCountryCode(context.Background(), ip)
+			out[i] = lookupOutcome{country: country, marker: marker, err: err}
+		}(i, ip)
+	}
+	// Give every goroutine time to join the in-flight lookup before it finishes.
+	time.Sleep(50 * time.Millisecond)
+	close(client.release)
+	wg.Wait()
+	return out
+}
+
+func TestGetCountryCodeCoalescesConcurrentLookups(t *testing.T) {
+	client := &gatedHTTPClient{release: make(chan struct{})}
+	cache := newTestCache(t, 16)
+	cfg := &GetCountryCodeConfig{HTTPClient: client, Cache: cache}
+
+	ips := make([]string, 50)
+	for i := range ips {
+		ips[i] = "1.2.3.4"
+	}
+	out := lookupConcurrently(cfg, client, ips)
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&client.calls))
+	coalesced := 0
+	for _, o := range out {
+		assert.NoError(t, o.err)
+		assert.Equal(t, "US", o.country)
+		if o.marker == "coalesced" {
+			coalesced++
+		}
+	}
+	assert.Equal(t, len(ips)-1, coalesced)
+
+	_, _, marker, err := cfg.GetCountryCode(context.Background(), "1.2.3.4")
+	assert.NoError(t, err)
+	assert.Equal(t, "cached", marker)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&client.calls))
+}
+
+func TestGetCountryCodeCoalescesErrors(t *testing.T) {
+	client := &gatedHTTPClient{release: make(chan struct{}), err: errors.New("boom")}
+	cfg := &GetCountryCodeConfig{HTTPClient: client, Cache: newTestCache(t, 16)}
+
+	out := lookupConcurrently(cfg, client, []string{"1.2.3.4", "1.2.3.4", "1.2.3.4"})
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&client.calls))
+	for _, o := range out {
+		assert.ErrorContains(t, o.err, "boom")
+	}
+}
+
+func TestGetCountryCodeCoalescesByPrefix(t *testing.T) {
+	client := &gatedHTTPClient{release: make(chan struct{})}
+	cache := newTestCache(t, 16)
+	cfg := &GetCountryCodeConfig{
+		HTTPClient:       client,
+		Cache:            cache,
+		CoalesceIPv4Bits: 24,
+		CoalesceIPv6Bits: 64,
+	}
+
+	out := lookupConcurrently(cfg, client, []string{"1.2.3.4", "1.2.3.5", "::ffff:1.2.3.6", "2001:db8::1", "2001:db8::2"})
+
+	// One lookup for 1.2.3.0/24 and one for 2001:db8::/64.
+	assert.Equal(t, int32(2), atomic.LoadInt32(&client.calls))
+	for _, o := range out {
+		assert.NoError(t, o.err)
+		assert.Equal(t, "US", o.country)
+	}
+	for _, ip := range []string{"1.2.3.4", "1.2.3.5", "2001:db8::1", "2001:db8::2"} {
+		_, found := cache.Get(ip)
+		assert.True(t, found, ip)
+	}
+}
+
+func TestGetCountryCodeCoalescedWaiterHonoursContext(t *testing.T) {
+	client := &gatedHTTPClient{release: make(chan struct{})}
+	cfg := &GetCountryCodeConfig{HTTPClient: client, Cache: newTestCache(t, 16)}
+
+	leader := make(chan error, 1)
+	go func() {
+		_, _, _, err := cfg.GetCountryCode(context.Background(), "1.2.3.4")
+		leader <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, _, _, err := cfg.GetCountryCode(ctx, "1.2.3.4")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// The impatient waiter must not have failed the shared lookup.
+	close(client.release)
+	assert.NoError(t, <-leader)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&client.calls))
+}
+
+func TestCoalesceKey(t *testing.T) {
+	assert.Equal(t, "1.2.3.4", coalesceKey("1.2.3.4", 0, 0))
+	assert.Equal(t, "1.2.3.4", coalesceKey("::ffff:1.2.3.4", 0, 0))
+	assert.Equal(t, "1.2.3.0/24", coalesceKey("1.2.3.4", 24, 64))
+	assert.Equal(t, "2001:db8::/64", coalesceKey("2001:db8::1", 24, 64))
+	assert.Equal(t, "bogus", coalesceKey("bogus", 24, 64))
+}
@@ -1,8 +1,11 @@
 package ipapi
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"geoproxy/metrics"
 	"net/http"
 	"net/url"
 	"strings"
@@ -14,6 +17,12 @@ type HTTPClient interface {
 	Get(ctx context.Context, ip string) (*http.Response, error)
 }
 
+// BatchHTTPClient is implemented by clients that can resolve several IPs in
+// one request via ip-api's POST /batch endpoint.
+type BatchHTTPClient interface {
+	PostBatch(ctx context.Context, ips []string) (*http.Response, error)
+}
+
 type RealHTTPClient struct {
 	Endpoint string
 	APIKey   string
@@ -43,12 +52,52 @@ func (r *RealHTTPClient) buildURL(ip string) (string, error) {
 
 	q := base.Query()
 	// Always request only the fields we actually use.
-	q.Set("fields", "countryCode,region,status")
+	q.Set("fields", lookupFields)
 	base.RawQuery = q.Encode()
 
 	return base.String(), nil
 }
 
+// buildBatchURL turns the lookup endpoint (".../json/") into the matching
+// batch endpoint (".../batch").
+func (r *RealHTTPClient) buildBatchURL() (string, error) {
+	base, err := url.Parse(r.Endpoint)
+	if err != nil {
+		return "", err
+	}
+	path := strings.TrimRight(base.Path, "/")
+	path = strings.TrimSuffix(path, "/json")
+	base.Path = path + "/batch"
+
+	q := base.Query()
+	// Batch results are matched back up to the IPs by the query field.
+	q.Set("fields", lookupFields+",query")
+	base.RawQuery = q.Encode()
+
+	return base.String(), nil
+}
+
+func (r *RealHTTPClient) PostBatch(ctx context.Context, ips []string) (*http.Response, error) {
+	u, err := r.buildBatchURL()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build ipapi batch url: %v", err)
+	}
+	body, err := json.Marshal(ips)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r.APIKey != "" {
+		req.Header.Set("X-API-Key", r.APIKey)
+	}
+	return r.do(req)
+}
+
 func (r *RealHTTPClient) Get(ctx context.Context, ip string) (*http.Response, error) {
 	u, err := r.buildURL(ip)
 	if err != nil {
@@ -62,5 +111,12 @@ func (r *RealHTTPClient) Get(ctx context.Context, ip string) (*http.Response, er
 	if r.APIKey != "" {
 		req.Header.Set("X-API-Key", r.APIKey)
 	}
-	return r.httpClient().Do(req)
+	return r.do(req)
+}
+
+func (r *RealHTTPClient) do(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := r.httpClient().Do(req)
+	metrics.IPAPIRequestDuration.Observe(time.Since(start).Seconds())
+	return resp, err
 }
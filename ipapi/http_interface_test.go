@@ -68,7 +68,7 @@ func TestRealHTTPClientGetWithAPIKey(t *testing.T) {
 	if q.Get("key") != "" {
 		t.Fatalf("expected key query param to be empty, got: %s", q.Get("key"))
 	}
-	if q.Get("fields") != "countryCode,region,status" {
+	if q.Get("fields") != "countryCode,region,city,lat,lon,timezone,status,as,asname,org,isp,mobile,proxy,hosting" {
 		t.Fatalf("unexpected fields: %s", q.Get("fields"))
 	}
 	if gotAPIKey != "testkey" {
@@ -3,9 +3,13 @@ package ipapi
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"geoproxy/metrics"
 	"io"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/golang-lru/v2"
@@ -17,11 +21,101 @@ type IPAPI interface {
 	GetCountryCode(ctx context.Context, ip string) (string, string, string, error)
 }
 
+// DetailedIPAPI is implemented by providers that know more about an IP than
+// its country and region, such as its ASN and organization.
+type DetailedIPAPI interface {
+	Lookup(ctx context.Context, ip string) (Reply, string, error)
+}
+
+// Lookup returns everything p knows about ip: the full reply from a
+// DetailedIPAPI, otherwise just the country and region. The string is the
+// cache marker, as from GetCountryCode.
+func Lookup(ctx context.Context, p IPAPI, ip string) (Reply, string, error) {
+	if d, ok := p.(DetailedIPAPI); ok {
+		return d.Lookup(ctx, ip)
+	}
+	country, region, cached, err := p.GetCountryCode(ctx, ip)
+	return Reply{CountryCode: country, Region: region}, cached, err
+}
+
 type Reply struct {
-	CountryCode  string
-	Region       string
-	FailureUntil time.Time
-	ExpiresAt    time.Time
+	CountryCode string `json:"countryCode,omitempty"`
+	Region      string `json:"region,omitempty"`
+	// ASN is the autonomous system number, 0 when unknown.
+	ASN    uint32 `json:"asn,omitempty"`
+	ASName string `json:"asname,omitempty"`
+	Org    string `json:"org,omitempty"`
+	ISP    string `json:"isp,omitempty"`
+	// Proxy, Hosting and Mobile are ip-api's flags for proxies, VPNs and Tor
+	// exits, hosting and data center ranges, and cellular networks.
+	Proxy   bool `json:"proxy,omitempty"`
+	Hosting bool `json:"hosting,omitempty"`
+	Mobile  bool `json:"mobile,omitempty"`
+	// City, Lat and Lon locate the client; Lat and Lon are 0 when unknown.
+	// Timezone is the client's IANA zone, e.g. "America/New_York".
+	City         string    `json:"city,omitempty"`
+	Lat          float64   `json:"lat,omitempty"`
+	Lon          float64   `json:"lon,omitempty"`
+	Timezone     string    `json:"timezone,omitempty"`
+	FailureUntil time.Time `json:"failureUntil,omitempty"`
+	ExpiresAt    time.Time `json:"expiresAt,omitempty"`
+}
+
+// lookupFields are the ip-api fields requested for every lookup.
+const lookupFields = "countryCode,region,city,lat,lon,timezone,status,as,asname,org,isp,mobile,proxy,hosting"
+
+// HasLocation reports whether the reply carries coordinates.
+func (r Reply) HasLocation() bool {
+	return r.Lat != 0 || r.Lon != 0
+}
+
+// apiResponse is one ip-api answer, from /json or /batch.
+type apiResponse struct {
+	Status      string  `json:"status"`
+	CountryCode string  `json:"countryCode"`
+	Region      string  `json:"region"`
+	City        string  `json:"city"`
+	Lat         float64 `json:"lat"`
+	Lon         float64 `json:"lon"`
+	Timezone    string  `json:"timezone"`
+	AS          string  `json:"as"`
+	ASName      string  `json:"asname"`
+	Org         string  `json:"org"`
+	ISP         string  `json:"isp"`
+	Mobile      bool    `json:"mobile"`
+	Proxy       bool    `json:"proxy"`
+	Hosting     bool    `json:"hosting"`
+	Query       string  `json:"query"`
+}
+
+func (a apiResponse) reply() Reply {
+	return Reply{
+		CountryCode: a.CountryCode,
+		Region:      a.Region,
+		City:        a.City,
+		Lat:         a.Lat,
+		Lon:         a.Lon,
+		Timezone:    a.Timezone,
+		ASN:         parseASN(a.AS),
+		ASName:      a.ASName,
+		Org:         a.Org,
+		ISP:         a.ISP,
+		Proxy:       a.Proxy,
+		Hosting:     a.Hosting,
+		Mobile:      a.Mobile,
+	}
+}
+
+// parseASN extracts the number from ip-api's "as" field, e.g.
+// "AS15169 Google LLC".
+func parseASN(as string) uint32 {
+	num, _, _ := strings.Cut(strings.TrimSpace(as), " ")
+	num = strings.TrimPrefix(strings.ToUpper(num), "AS")
+	n, err := strconv.ParseUint(num, 10, 32)
+	if err != nil {
+		return 0
+	}
+	return uint32(n)
 }
 
 const successCacheTTL = 24 * time.Hour
@@ -31,9 +125,28 @@ type GetCountryCodeConfig struct {
 	Cache            *lru.Cache[string, Reply]
 	MaxResponseBytes int64
 	FailureTTL       time.Duration
+	// CoalesceIPv4Bits and CoalesceIPv6Bits widen lookup coalescing from single
+	// addresses to prefixes (e.g. 24 and 64): while a lookup for one address is
+	// in flight, lookups for its neighbours wait for and reuse its answer.
+	// 0 coalesces per address.
+	CoalesceIPv4Bits int
+	CoalesceIPv6Bits int
+	// Batcher, when set, resolves cache misses through ip-api's batch endpoint
+	// instead of one request per IP.
+	Batcher *Batcher
+
+	flights flightGroup
 }
 
 func (g *GetCountryCodeConfig) GetCountryCode(ctx context.Context, ip string) (string, string, string, error) {
+	reply, cached, err := g.Lookup(ctx, ip)
+	if err != nil {
+		return "", "", cached, err
+	}
+	return reply.CountryCode, reply.Region, cached, nil
+}
+
+func (g *GetCountryCodeConfig) Lookup(ctx context.Context, ip string) (Reply, string, error) {
 	cache := g.Cache
 	if cache == nil {
 		cache = IPCache
@@ -42,7 +155,8 @@ func (g *GetCountryCodeConfig) GetCountryCode(ctx context.Context, ip string) (s
 		if reply, found := cache.Get(ip); found {
 			if !reply.FailureUntil.IsZero() {
 				if time.Now().Before(reply.FailureUntil) {
-					return "", "", "cached-failure", fmt.Errorf("cached ipapi lookup failure for ip: %s", ip)
+					metrics.IPCacheLookups.With("cached_failure").Inc()
+					return Reply{}, "cached-failure", fmt.Errorf("cached ipapi lookup failure for ip: %s", ip)
 				}
 				cache.Remove(ip)
 			} else {
@@ -50,27 +164,61 @@ func (g *GetCountryCodeConfig) GetCountryCode(ctx context.Context, ip string) (s
 				if reply.ExpiresAt.IsZero() || time.Now().After(reply.ExpiresAt) {
 					cache.Remove(ip)
 				} else {
-					return reply.CountryCode, reply.Region, "cached", nil
+					metrics.IPCacheLookups.With("hit").Inc()
+					return reply, "cached", nil
 				}
 			}
 		}
 	}
-	ipAPIConfig := &IPAPIConfig{HTTPClient: g.HTTPClient, MaxResponseBytes: g.MaxResponseBytes}
-	countryCode, region, err := ipAPIConfig.getIpAPI(ctx, ip)
-	if err != nil {
-		if cache != nil && g.FailureTTL > 0 {
-			cache.Add(ip, Reply{FailureUntil: time.Now().Add(g.FailureTTL)})
+	key := coalesceKey(ip, g.CoalesceIPv4Bits, g.CoalesceIPv6Bits)
+	res, shared := g.flights.do(ctx, key, func(ctx context.Context) lookupResult {
+		var res lookupResult
+		if g.Batcher != nil {
+			res.reply, res.err = g.Batcher.Lookup(ctx, ip)
+		} else {
+			ipAPIConfig := &IPAPIConfig{HTTPClient: g.HTTPClient, MaxResponseBytes: g.MaxResponseBytes}
+			res.reply, res.err = ipAPIConfig.getIpAPI(ctx, ip)
+		}
+		if errors.Is(res.err, ErrRateLimited) {
+			metrics.IPAPIErrors.With("rate_limited").Inc()
+		} else if res.err != nil {
+			metrics.IPAPIErrors.With("error").Inc()
+		}
+		g.store(cache, ip, res)
+		return res
+	})
+	marker := "-"
+	if !shared {
+		metrics.IPCacheLookups.With("miss").Inc()
+	} else {
+		metrics.IPCacheLookups.With("coalesced").Inc()
+		marker = "coalesced"
+		// With prefix coalescing the answer may have been looked up for a
+		// neighbouring address; remember it for this one too.
+		if ctx.Err() == nil {
+			g.store(cache, ip, res)
 		}
-		return "", "", "-", err
 	}
-	if cache != nil {
-		cache.Add(ip, Reply{
-			CountryCode: countryCode,
-			Region:      region,
-			ExpiresAt:   time.Now().Add(successCacheTTL),
-		})
+	if res.err != nil {
+		return Reply{}, "-", res.err
 	}
-	return countryCode, region, "-", nil
+	return res.reply, marker, nil
+}
+
+func (g *GetCountryCodeConfig) store(cache *lru.Cache[string, Reply], ip string, res lookupResult) {
+	if cache == nil {
+		return
+	}
+	if res.err != nil {
+		// Rate limiting says nothing about this IP, so don't cache it as a failure.
+		if g.FailureTTL > 0 && !errors.Is(res.err, ErrRateLimited) {
+			cache.Add(ip, Reply{FailureUntil: time.Now().Add(g.FailureTTL)})
+		}
+		return
+	}
+	reply := res.reply
+	reply.ExpiresAt = time.Now().Add(successCacheTTL)
+	cache.Add(ip, reply)
 }
 
 type IPAPIConfig struct {
@@ -78,17 +226,17 @@ type IPAPIConfig struct {
 	MaxResponseBytes int64
 }
 
-func (i *IPAPIConfig) getIpAPI(ctx context.Context, ip string) (string, string, error) {
+func (i *IPAPIConfig) getIpAPI(ctx context.Context, ip string) (Reply, error) {
 	// PathEscape the IP to prevent path traversal (SSRF)
 	escapedIP := url.PathEscape(ip)
 	resp, err := i.HTTPClient.Get(ctx, escapedIP)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to get country code: %v", err)
+		return Reply{}, fmt.Errorf("failed to get country code: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		return "", "", fmt.Errorf("ipapi returned non-200 status: %d", resp.StatusCode)
+		return Reply{}, fmt.Errorf("ipapi returned non-200 status: %d", resp.StatusCode)
 	}
 
 	limit := i.MaxResponseBytes
@@ -97,17 +245,13 @@ func (i *IPAPIConfig) getIpAPI(ctx context.Context, ip string) (string, string,
 	}
 	limited := io.LimitReader(resp.Body, limit)
 
-	var data struct {
-		CountryCode string `json:"countryCode"`
-		Region      string `json:"region"`
-		Status      string `json:"status"`
-	}
+	var data apiResponse
 	if err := json.NewDecoder(limited).Decode(&data); err != nil {
-		return "", "", fmt.Errorf("failed to decode response: %v", err)
+		return Reply{}, fmt.Errorf("failed to decode response: %v", err)
 	}
 
 	if data.Status != "success" {
-		return "--", "--", fmt.Errorf("failed to get country code for ip: %s", ip)
+		return Reply{CountryCode: "--", Region: "--"}, fmt.Errorf("failed to get country code for ip: %s", ip)
 	}
-	return data.CountryCode, data.Region, nil
+	return data.reply(), nil
 }
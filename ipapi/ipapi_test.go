@@ -44,16 +44,20 @@ func newTestCache(t *testing.T, size int) *lru.Cache[string, Reply] {
 func TestIPAPIGetIpAPISuccess(t *testing.T) {
 	client := &mockHTTPClient{
 		getFunc: func(_ context.Context, url string) (*http.Response, error) {
-			return responseWithBody(`{"countryCode":"US","region":"CA","status":"success"}`), nil
+			return responseWithBody(`{"countryCode":"US","region":"CA","status":"success","as":"AS15169 Google LLC","asname":"GOOGLE","org":"Google Public DNS","isp":"Google LLC"}`), nil
 		},
 	}
 	cfg := &IPAPIConfig{HTTPClient: client}
 
-	country, region, err := cfg.getIpAPI(context.Background(), "1.2.3.4")
+	reply, err := cfg.getIpAPI(context.Background(), "1.2.3.4")
 
 	assert.NoError(t, err)
-	assert.Equal(t, "US", country)
-	assert.Equal(t, "CA", region)
+	assert.Equal(t, "US", reply.CountryCode)
+	assert.Equal(t, "CA", reply.Region)
+	assert.Equal(t, uint32(15169), reply.ASN)
+	assert.Equal(t, "GOOGLE", reply.ASName)
+	assert.Equal(t, "Google Public DNS", reply.Org)
+	assert.Equal(t, "Google LLC", reply.ISP)
 	assert.Equal(t, 1, client.calls)
 	assert.Equal(t, "1.2.3.4", client.lastURL)
 }
@@ -66,7 +70,7 @@ func TestIPAPIGetIpAPIDecodeError(t *testing.T) {
 	}
 	cfg := &IPAPIConfig{HTTPClient: client}
 
-	_, _, err := cfg.getIpAPI(context.Background(), "1.2.3.4")
+	_, err := cfg.getIpAPI(context.Background(), "1.2.3.4")
 
 	assert.Error(t, err)
 }
@@ -79,11 +83,11 @@ func TestIPAPIGetIpAPIStatusError(t *testing.T) {
 	}
 	cfg := &IPAPIConfig{HTTPClient: client}
 
-	country, region, err := cfg.getIpAPI(context.Background(), "1.2.3.4")
+	reply, err := cfg.getIpAPI(context.Background(), "1.2.3.4")
 
 	assert.Error(t, err)
-	assert.Equal(t, "--", country)
-	assert.Equal(t, "--", region)
+	assert.Equal(t, "--", reply.CountryCode)
+	assert.Equal(t, "--", reply.Region)
 }
 
 func TestIPAPIGetIpAPIClientError(t *testing.T) {
@@ -94,7 +98,7 @@ func TestIPAPIGetIpAPIClientError(t *testing.T) {
 	}
 	cfg := &IPAPIConfig{HTTPClient: client}
 
-	_, _, err := cfg.getIpAPI(context.Background(), "1.2.3.4")
+	_, err := cfg.getIpAPI(context.Background(), "1.2.3.4")
 
 	assert.Error(t, err)
 }
@@ -277,3 +281,44 @@ func TestGetCountryCodeExpiredFailureCacheRetries(t *testing.T) {
 	assert.Error(t, err)
 	assert.Equal(t, 2, client.calls)
 }
+
+func TestLookupCachesDetails(t *testing.T) {
+	cache := newTestCache(t, 16)
+	client := &mockHTTPClient{
+		getFunc: func(_ context.Context, url string) (*http.Response, error) {
+			return responseWithBody(`{"countryCode":"US","region":"VA","city":"Ashburn","lat":39.0438,"lon":-77.4874,"timezone":"America/New_York","status":"success","as":"AS14618 Amazon.com, Inc.","asname":"AMAZON-AES","org":"AWS EC2 (us-east-1)","isp":"Amazon.com, Inc.","mobile":false,"proxy":false,"hosting":true}`), nil
+		},
+	}
+	cfg := &GetCountryCodeConfig{HTTPClient: client, Cache: cache}
+
+	reply, marker, err := cfg.Lookup(context.Background(), "3.80.0.1")
+	assert.NoError(t, err)
+	assert.Equal(t, "-", marker)
+	assert.Equal(t, uint32(14618), reply.ASN)
+
+	reply, marker, err = cfg.Lookup(context.Background(), "3.80.0.1")
+	assert.NoError(t, err)
+	assert.Equal(t, "cached", marker)
+	assert.Equal(t, uint32(14618), reply.ASN)
+	assert.Equal(t, "AWS EC2 (us-east-1)", reply.Org)
+	assert.True(t, reply.Hosting)
+	assert.Equal(t, "Ashburn", reply.City)
+	assert.Equal(t, 39.0438, reply.Lat)
+	assert.Equal(t, "America/New_York", reply.Timezone)
+	assert.False(t, reply.Proxy)
+	assert.Equal(t, 1, client.calls)
+}
+
+func TestParseASN(t *testing.T) {
+	assert.Equal(t, uint32(15169), parseASN("AS15169 Google LLC"))
+	assert.Equal(t, uint32(13335), parseASN("as13335"))
+	assert.Equal(t, uint32(0), parseASN(""))
+	assert.Equal(t, uint32(0), parseASN("ASbogus"))
+}
+
+func TestLookupWithoutDetails(t *testing.T) {
+	reply, marker, err := Lookup(context.Background(), &stubProvider{country: "DE", region: "BE"}, "1.2.3.4")
+	assert.NoError(t, err)
+	assert.Equal(t, "stub", marker)
+	assert.Equal(t, Reply{CountryCode: "DE", Region: "BE"}, reply)
+}
@@ -0,0 +1,168 @@
+package ipapi
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+const defaultMMDBCheckInterval = time.Minute
+
+// MMDBProvider resolves IPs against a local MaxMind GeoLite2/GeoIP2 Country or
+// City database. The file is loaded into memory, so replacing it on disk never
+// affects lookups in progress; changes are picked up on the next check.
+type MMDBProvider struct {
+	Path string
+	// CheckInterval is how often lookups may stat Path for changes (default 1m).
+	CheckInterval time.Duration
+
+	// reader and lastCheck (in Unix nanoseconds) are read by every lookup
+	// without taking mu, which only guards modTime and size.
+	reader    atomic.Pointer[maxminddb.Reader]
+	lastCheck atomic.Int64
+	mu        sync.Mutex
+	modTime   time.Time
+	size      int64
+	reloading atomic.Bool
+}
+
+type mmdbRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+	Subdivisions []struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"subdivisions"`
+	// City and Location are only present in City databases.
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Location struct {
+		Latitude  float64 `maxminddb:"latitude"`
+		Longitude float64 `maxminddb:"longitude"`
+		TimeZone  string  `maxminddb:"time_zone"`
+	} `maxminddb:"location"`
+}
+
+// NewMMDBProvider loads path and fails if it is not a readable MaxMind DB.
+func NewMMDBProvider(path string, checkInterval time.Duration) (*MMDBProvider, error) {
+	p := &MMDBProvider{Path: path, CheckInterval: checkInterval}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload re-reads the database file and swaps it in. On error the previously
+// loaded database stays active. The file is read without holding any lock,
+// so lookups carry on with the old database meanwhile.
+func (p *MMDBProvider) Reload() error {
+	p.lastCheck.Store(time.Now().UnixNano())
+	fi, err := os.Stat(p.Path)
+	if err != nil {
+		return fmt.Errorf("failed to stat mmdb %s: %v", p.Path, err)
+	}
+	data, err := os.ReadFile(p.Path)
+	if err != nil {
+		return fmt.Errorf("failed to read mmdb %s: %v", p.Path, err)
+	}
+	reader, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return fmt.Errorf("failed to open mmdb %s: %v", p.Path, err)
+	}
+	p.mu.Lock()
+	p.reader.Store(reader)
+	p.modTime = fi.ModTime()
+	p.size = fi.Size()
+	p.mu.Unlock()
+	return nil
+}
+
+// maybeReload checks the file at most once per CheckInterval and reloads it in
+// the background when its mtime or size changed.
+func (p *MMDBProvider) maybeReload() {
+	interval := p.CheckInterval
+	if interval <= 0 {
+		interval = defaultMMDBCheckInterval
+	}
+	last := p.lastCheck.Load()
+	now := time.Now()
+	if now.Sub(time.Unix(0, last)) < interval {
+		return
+	}
+	// Only the lookup that wins the swap checks the file.
+	if !p.lastCheck.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+	fi, err := os.Stat(p.Path)
+	if err != nil {
+		return
+	}
+	p.mu.Lock()
+	changed := !fi.ModTime().Equal(p.modTime) || fi.Size() != p.size
+	p.mu.Unlock()
+	if !changed || !p.reloading.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer p.reloading.Store(false)
+		if err := p.Reload(); err != nil {
+			log.Printf("mmdb reload failed; keeping previous database: %v", err)
+			return
+		}
+		log.Printf("reloaded mmdb %s", p.Path)
+	}()
+}
+
+func (p *MMDBProvider) GetCountryCode(ctx context.Context, ip string) (string, string, string, error) {
+	reply, cached, err := p.Lookup(ctx, ip)
+	return reply.CountryCode, reply.Region, cached, err
+}
+
+// Lookup is GetCountryCode plus the English city name and coordinates, when
+// the database has them.
+func (p *MMDBProvider) Lookup(_ context.Context, ip string) (Reply, string, error) {
+	p.maybeReload()
+	reader := p.reader.Load()
+	if reader == nil {
+		return Reply{}, "-", fmt.Errorf("mmdb %s is not loaded", p.Path)
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return Reply{}, "-", fmt.Errorf("failed to parse ip: %s", ip)
+	}
+
+	var rec mmdbRecord
+	if err := reader.Lookup(parsed, &rec); err != nil {
+		return Reply{}, "-", fmt.Errorf("mmdb lookup failed for ip %s: %v", ip, err)
+	}
+	country := rec.Country.ISOCode
+	if country == "" {
+		// Anycast and some hosting ranges only carry a registered country.
+		country = rec.RegisteredCountry.ISOCode
+	}
+	if country == "" {
+		return Reply{CountryCode: "--", Region: "--"}, "mmdb", fmt.Errorf("no mmdb country for ip: %s", ip)
+	}
+	reply := Reply{
+		CountryCode: country,
+		City:        rec.City.Names["en"],
+		Lat:         rec.Location.Latitude,
+		Lon:         rec.Location.Longitude,
+		Timezone:    rec.Location.TimeZone,
+	}
+	if len(rec.Subdivisions) > 0 {
+		reply.Region = rec.Subdivisions[0].ISOCode
+	}
+	return reply, "mmdb", nil
+}
@@ -0,0 +1,195 @@
+package ipapi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// mmdbFixture is a country/subdivision record written into a test database.
+// City, a non-zero Lat/Lon and TimeZone make it a City database record.
+type mmdbFixture struct {
+	Prefix      string
+	Country     string
+	Subdivision string
+	City        string
+	Lat, Lon    float64
+	TimeZone    string
+}
+
+// writeTestMMDB encodes a minimal MaxMind DB (IPv6 tree, 24-bit records) holding
+// the given networks and returns its path. IPv4 networks live under ::/96, the
+// same layout real GeoLite2 files use.
+func writeTestMMDB(t *testing.T, dir string, name string, fixtures []mmdbFixture) string {
+	t.Helper()
+
+	type node struct {
+		child [2]*node
+		data  int
+	}
+	newNode := func() *node { return &node{data: -1} }
+	root := newNode()
+
+	var data bytes.Buffer
+	for _, f := range fixtures {
+		prefix := netip.MustParsePrefix(f.Prefix)
+		bits := prefix.Bits()
+		raw := prefix.Addr().As16()
+		if prefix.Addr().Is4() {
+			// IPv4 networks live under ::/96, not the ::ffff:0:0/96 mapped range.
+			a := prefix.Addr().As4()
+			raw = [16]byte{}
+			copy(raw[12:], a[:])
+			bits += 96
+		}
+
+		offset := data.Len()
+		record := map[string]any{"country": map[string]any{"iso_code": f.Country}}
+		if f.Subdivision != "" {
+			record["subdivisions"] = []any{map[string]any{"iso_code": f.Subdivision}}
+		}
+		if f.City != "" {
+			record["city"] = map[string]any{"names": map[string]any{"en": f.City}}
+		}
+		if f.Lat != 0 || f.Lon != 0 || f.TimeZone != "" {
+			location := map[string]any{"latitude": f.Lat, "longitude": f.Lon}
+			if f.TimeZone != "" {
+				location["time_zone"] = f.TimeZone
+			}
+			record["location"] = location
+		}
+		encodeMMDBValue(&data, record)
+
+		n := root
+		for i := 0; i < bits; i++ {
+			bit := (raw[i/8] >> (7 - uint(i%8))) & 1
+			if n.child[bit] == nil {
+				n.child[bit] = newNode()
+			}
+			n = n.child[bit]
+		}
+		n.data = offset
+	}
+
+	// Number internal nodes breadth-first; leaves become data pointers.
+	var nodes []*node
+	index := map[*node]int{}
+	queue := []*node{root}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		index[n] = len(nodes)
+		nodes = append(nodes, n)
+		for _, c := range n.child {
+			if c != nil && c.data < 0 {
+				queue = append(queue, c)
+			}
+		}
+	}
+	nodeCount := len(nodes)
+	record := func(c *node) uint32 {
+		switch {
+		case c == nil:
+			return uint32(nodeCount)
+		case c.data >= 0:
+			return uint32(nodeCount + 16 + c.data)
+		default:
+			return uint32(index[c])
+		}
+	}
+
+	var out bytes.Buffer
+	for _, n := range nodes {
+		l, r := record(n.child[0]), record(n.child[1])
+		out.Write([]byte{byte(l >> 16), byte(l >> 8), byte(l), byte(r >> 16), byte(r >> 8), byte(r)})
+	}
+	out.Write(make([]byte, 16))
+	out.Write(data.Bytes())
+	out.WriteString("\xAB\xCD\xEFMaxMind.com")
+	encodeMMDBValue(&out, map[string]any{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint32(0),
+		"database_type":               "GeoProxy-Test",
+		"description":                 map[string]any{"en": "geoproxy test fixture"},
+		"ip_version":                  uint16(6),
+		"languages":                   []any{"en"},
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint16(24),
+	})
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, out.Bytes(), 0o600); err != nil {
+		t.Fatalf("write mmdb: %v", err)
+	}
+	return path
+}
+
+func writeMMDBControl(buf *bytes.Buffer, typ int, size int) {
+	var ctrl byte
+	extended := typ > 7
+	if extended {
+		ctrl = 0
+	} else {
+		ctrl = byte(typ << 5)
+	}
+	if size < 29 {
+		ctrl |= byte(size)
+		buf.WriteByte(ctrl)
+	} else {
+		ctrl |= 29
+		buf.WriteByte(ctrl)
+	}
+	if extended {
+		buf.WriteByte(byte(typ - 7))
+	}
+	if size >= 29 {
+		buf.WriteByte(byte(size - 29))
+	}
+}
+
+func encodeMMDBValue(buf *bytes.Buffer, v any) {
+	switch val := v.(type) {
+	case string:
+		writeMMDBControl(buf, 2, len(val))
+		buf.WriteString(val)
+	case float64:
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, math.Float64bits(val))
+		writeMMDBControl(buf, 3, 8)
+		buf.Write(b)
+	case uint16:
+		b := make([]byte, 2)
+		binary.BigEndian.PutUint16(b, val)
+		writeMMDBControl(buf, 5, 2)
+		buf.Write(b)
+	case uint32:
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, val)
+		writeMMDBControl(buf, 6, 4)
+		buf.Write(b)
+	case map[string]any:
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		writeMMDBControl(buf, 7, len(val))
+		for _, k := range keys {
+			encodeMMDBValue(buf, k)
+			encodeMMDBValue(buf, val[k])
+		}
+	case []any:
+		writeMMDBControl(buf, 11, len(val))
+		for _, item := range val {
+			encodeMMDBValue(buf, item)
+		}
+	default:
+		panic("unsupported mmdb fixture value")
+	}
+}
@@ -0,0 +1,121 @@
+package ipapi
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMMDBProviderLookup(t *testing.T) {
+	path := writeTestMMDB(t, t.TempDir(), "geo.mmdb", []mmdbFixture{
+		{Prefix: "1.2.3.0/24", Country: "US", Subdivision: "CA"},
+		{Prefix: "5.6.0.0/16", Country: "DE"},
+		{Prefix: "2001:db8::/32", Country: "FR", Subdivision: "IDF"},
+	})
+	p, err := NewMMDBProvider(path, time.Hour)
+	assert.NoError(t, err)
+
+	country, region, marker, err := p.GetCountryCode(context.Background(), "1.2.3.4")
+	assert.NoError(t, err)
+	assert.Equal(t, "US", country)
+	assert.Equal(t, "CA", region)
+	assert.Equal(t, "mmdb", marker)
+
+	country, region, _, err = p.GetCountryCode(context.Background(), "5.6.7.8")
+	assert.NoError(t, err)
+	assert.Equal(t, "DE", country)
+	assert.Equal(t, "", region)
+
+	country, region, _, err = p.GetCountryCode(context.Background(), "2001:db8::1")
+	assert.NoError(t, err)
+	assert.Equal(t, "FR", country)
+	assert.Equal(t, "IDF", region)
+
+	country, _, _, err = p.GetCountryCode(context.Background(), "::ffff:1.2.3.4")
+	assert.NoError(t, err)
+	assert.Equal(t, "US", country)
+
+	_, _, _, err = p.GetCountryCode(context.Background(), "9.9.9.9")
+	assert.Error(t, err)
+
+	_, _, _, err = p.GetCountryCode(context.Background(), "not-an-ip")
+	assert.Error(t, err)
+}
+
+func TestMMDBProviderCityLookup(t *testing.T) {
+	path := writeTestMMDB(t, t.TempDir(), "city.mmdb", []mmdbFixture{
+		{Prefix: "1.2.3.0/24", Country: "US", Subdivision: "WA", City: "Seattle", Lat: 47.6062, Lon: -122.3321, TimeZone: "America/Los_Angeles"},
+		{Prefix: "5.6.0.0/16", Country: "DE"},
+	})
+	p, err := NewMMDBProvider(path, time.Hour)
+	assert.NoError(t, err)
+
+	reply, marker, err := Lookup(context.Background(), p, "1.2.3.4")
+	assert.NoError(t, err)
+	assert.Equal(t, "mmdb", marker)
+	assert.Equal(t, Reply{CountryCode: "US", Region: "WA", City: "Seattle", Lat: 47.6062, Lon: -122.3321, Timezone: "America/Los_Angeles"}, reply)
+	assert.True(t, reply.HasLocation())
+
+	reply, _, err = p.Lookup(context.Background(), "5.6.7.8")
+	assert.NoError(t, err)
+	assert.Equal(t, "", reply.City)
+	assert.False(t, reply.HasLocation())
+}
+
+func TestNewMMDBProviderErrors(t *testing.T) {
+	_, err := NewMMDBProvider(filepath.Join(t.TempDir(), "missing.mmdb"), 0)
+	assert.Error(t, err)
+
+	bad := filepath.Join(t.TempDir(), "bad.mmdb")
+	assert.NoError(t, os.WriteFile(bad, []byte("not a database"), 0o600))
+	_, err = NewMMDBProvider(bad, 0)
+	assert.Error(t, err)
+}
+
+func TestMMDBProviderReloadsOnChange(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestMMDB(t, dir, "geo.mmdb", []mmdbFixture{
+		{Prefix: "1.2.3.0/24", Country: "US"},
+	})
+	p, err := NewMMDBProvider(path, time.Nanosecond)
+	assert.NoError(t, err)
+
+	// Replace the file atomically, the way geoipupdate does.
+	next := writeTestMMDB(t, dir, "geo.mmdb.tmp", []mmdbFixture{
+		{Prefix: "1.2.3.0/24", Country: "NL"},
+		{Prefix: "8.8.8.0/24", Country: "US", Subdivision: "VA"},
+	})
+	assert.NoError(t, os.Rename(next, path))
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		country, _, _, err := p.GetCountryCode(context.Background(), "1.2.3.4")
+		assert.NoError(t, err)
+		if country == "NL" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected reload to pick up new database, still got %q", country)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestMMDBProviderKeepsDatabaseOnBadReload(t *testing.T) {
+	path := writeTestMMDB(t, t.TempDir(), "geo.mmdb", []mmdbFixture{
+		{Prefix: "1.2.3.0/24", Country: "US"},
+	})
+	p, err := NewMMDBProvider(path, time.Hour)
+	assert.NoError(t, err)
+
+	assert.NoError(t, os.WriteFile(path, []byte("truncated"), 0o600))
+	assert.Error(t, p.Reload())
+
+	country, _, _, err := p.GetCountryCode(context.Background(), "1.2.3.4")
+	assert.NoError(t, err)
+	assert.Equal(t, "US", country)
+}
@@ -0,0 +1,217 @@
+package ipapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is returned (wrapped) when a lookup can't be made within the
+// allowed wait because the ip-api quota is exhausted. It is not cached as a
+// per-IP failure.
+var ErrRateLimited = errors.New("ipapi rate limited")
+
+// RateLimiter is a token bucket sized to ip-api's per-minute quota. It also
+// follows the X-Rl (requests remaining) and X-Ttl (seconds until the window
+// resets) headers ip-api returns, pausing until the reset when they say the
+// quota is used up.
+type RateLimiter struct {
+	// MaxWait bounds how long a caller may queue for a token before getting
+	// ErrRateLimited. 0 means callers never wait.
+	MaxWait time.Duration
+
+	mu      sync.Mutex
+	rate    float64 // tokens per second
+	burst   float64
+	tokens  float64
+	last    time.Time
+	resetAt time.Time
+	now     func() time.Time
+}
+
+// NewRateLimiter allows perMinute requests per minute, all of which may be
+// used in a burst.
+func NewRateLimiter(perMinute int, maxWait time.Duration) *RateLimiter {
+	return &RateLimiter{
+		MaxWait: maxWait,
+		rate:    float64(perMinute) / 60,
+		burst:   float64(perMinute),
+		tokens:  float64(perMinute),
+		now:     time.Now,
+	}
+}
+
+// advance refills the bucket up to now. While paused nothing refills; once the
+// reset time passes the bucket is full again, minus reservations already
+// queued behind the pause.
+func (l *RateLimiter) advance(now time.Time) {
+	if l.last.IsZero() {
+		l.last = now
+	}
+	if !l.resetAt.IsZero() {
+		if now.Before(l.resetAt) {
+			return
+		}
+		l.tokens = min(l.burst, l.burst+l.tokens)
+		l.last = l.resetAt
+		l.resetAt = time.Time{}
+	}
+	if now.After(l.last) {
+		l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+		l.last = now
+	}
+}
+
+// reserve takes a token and returns how long the caller must wait before using
+// it. If that exceeds MaxWait the token is returned and ok is false.
+func (l *RateLimiter) reserve() (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.advance(now)
+	l.tokens--
+
+	var wait time.Duration
+	if !l.resetAt.IsZero() {
+		wait = l.resetAt.Sub(now)
+		if deficit := -(l.burst + l.tokens); deficit > 0 {
+			wait += time.Duration(deficit / l.rate * float64(time.Second))
+		}
+	} else if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	if wait > l.MaxWait {
+		l.tokens++
+		return wait, false
+	}
+	return wait, true
+}
+
+func (l *RateLimiter) cancel() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens++
+}
+
+// Wait blocks until a request may be sent, or returns ErrRateLimited without
+// waiting if that would take longer than MaxWait.
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	wait, ok := l.reserve()
+	if !ok {
+		return fmt.Errorf("%w: quota exhausted for %s", ErrRateLimited, wait.Round(time.Second))
+	}
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.cancel()
+		return ctx.Err()
+	}
+}
+
+// Observe updates the bucket from an ip-api response. remaining < 0 means the
+// header was absent.
+func (l *RateLimiter) Observe(remaining int, ttl time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.advance(now)
+	if remaining < 0 {
+		return
+	}
+	if remaining == 0 && ttl > 0 {
+		l.tokens = min(l.tokens, 0)
+		l.resetAt = now.Add(ttl)
+		return
+	}
+	l.tokens = min(l.tokens, float64(remaining))
+}
+
+// ObserveResponse feeds the X-Rl/X-Ttl headers of resp into the limiter. A 429
+// without headers is treated as an exhausted quota for the rest of the minute.
+func (l *RateLimiter) ObserveResponse(resp *http.Response) {
+	remaining := headerInt(resp.Header, "X-Rl")
+	ttl := headerInt(resp.Header, "X-Ttl")
+	if resp.StatusCode == http.StatusTooManyRequests {
+		remaining = 0
+		if ttl < 0 {
+			ttl = 60
+		}
+	}
+	if ttl < 0 {
+		ttl = 0
+	}
+	l.Observe(remaining, time.Duration(ttl)*time.Second)
+}
+
+func headerInt(h http.Header, key string) int {
+	v := strings.TrimSpace(h.Get(key))
+	if v == "" {
+		return -1
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
+
+// RateLimitedHTTPClient puts a shared RateLimiter in front of an HTTPClient.
+type RateLimitedHTTPClient struct {
+	Client       HTTPClient
+	Limiter      *RateLimiter
+	BatchLimiter *RateLimiter
+}
+
+func (c *RateLimitedHTTPClient) Get(ctx context.Context, ip string) (*http.Response, error) {
+	if err := c.Limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	resp, err := c.Client.Get(ctx, ip)
+	if err != nil {
+		return nil, err
+	}
+	c.Limiter.ObserveResponse(resp)
+	if resp.StatusCode == http.StatusTooManyRequests {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("%w: ipapi returned 429", ErrRateLimited)
+	}
+	return resp, nil
+}
+
+// PostBatch sends a batch request through BatchLimiter, since ip-api counts
+// batch requests against their own, smaller quota. A nil BatchLimiter falls
+// back to Limiter.
+func (c *RateLimitedHTTPClient) PostBatch(ctx context.Context, ips []string) (*http.Response, error) {
+	batcher, ok := c.Client.(BatchHTTPClient)
+	if !ok {
+		return nil, fmt.Errorf("ipapi client %T does not support batch lookups", c.Client)
+	}
+	limiter := c.BatchLimiter
+	if limiter == nil {
+		limiter = c.Limiter
+	}
+	if err := limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	resp, err := batcher.PostBatch(ctx, ips)
+	if err != nil {
+		return nil, err
+	}
+	limiter.ObserveResponse(resp)
+	if resp.StatusCode == http.StatusTooManyRequests {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("%w: ipapi returned 429", ErrRateLimited)
+	}
+	return resp, nil
+}
@@ -0,0 +1,155 @@
+package ipapi
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestLimiter(perMinute int, maxWait time.Duration) (*RateLimiter, *fakeClock) {
+	clock := &fakeClock{t: time.Unix(1_700_000_000, 0)}
+	l := NewRateLimiter(perMinute, maxWait)
+	l.now = clock.now
+	return l, clock
+}
+
+func TestRateLimiterBurstThenRefill(t *testing.T) {
+	l, clock := newTestLimiter(60, 0)
+
+	for i := 0; i < 60; i++ {
+		wait, ok := l.reserve()
+		assert.True(t, ok)
+		assert.Zero(t, wait)
+	}
+	wait, ok := l.reserve()
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, wait)
+
+	clock.advance(time.Second)
+	_, ok = l.reserve()
+	assert.True(t, ok)
+}
+
+func TestRateLimiterQueuesWithinMaxWait(t *testing.T) {
+	l, _ := newTestLimiter(60, 2*time.Second)
+	for i := 0; i < 60; i++ {
+		l.reserve()
+	}
+	wait, ok := l.reserve()
+	assert.True(t, ok)
+	assert.Equal(t, time.Second, wait)
+	wait, ok = l.reserve()
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Second, wait)
+	_, ok = l.reserve()
+	assert.False(t, ok)
+}
+
+func TestRateLimiterPausesOnExhaustedHeaders(t *testing.T) {
+	l, clock := newTestLimiter(45, 0)
+	l.ObserveResponse(&http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"X-Rl": []string{"0"}, "X-Ttl": []string{"30"}},
+	})
+
+	wait, ok := l.reserve()
+	assert.False(t, ok)
+	assert.Equal(t, 30*time.Second, wait)
+
+	clock.advance(29 * time.Second)
+	_, ok = l.reserve()
+	assert.False(t, ok)
+
+	// After the window resets the whole quota is available again.
+	clock.advance(time.Second)
+	for i := 0; i < 45; i++ {
+		_, ok = l.reserve()
+		assert.True(t, ok)
+	}
+	_, ok = l.reserve()
+	assert.False(t, ok)
+}
+
+func TestRateLimiterFollowsRemainingHeader(t *testing.T) {
+	l, _ := newTestLimiter(45, 0)
+	l.Observe(2, 40*time.Second)
+	_, ok := l.reserve()
+	assert.True(t, ok)
+	_, ok = l.reserve()
+	assert.True(t, ok)
+	_, ok = l.reserve()
+	assert.False(t, ok)
+}
+
+func TestRateLimiterWaitCancelled(t *testing.T) {
+	l := NewRateLimiter(60, time.Minute)
+	for i := 0; i < 60; i++ {
+		assert.NoError(t, l.Wait(context.Background()))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, l.Wait(ctx), context.DeadlineExceeded)
+}
+
+func TestRateLimitedHTTPClient(t *testing.T) {
+	l, _ := newTestLimiter(45, 0)
+	inner := &mockHTTPClient{
+		getFunc: func(_ context.Context, _ string) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"X-Rl": []string{"0"}, "X-Ttl": []string{"60"}},
+				Body:       io.NopCloser(strings.NewReader(`{"countryCode":"US","status":"success"}`)),
+			}, nil
+		},
+	}
+	cache := newTestCache(t, 16)
+	cfg := &GetCountryCodeConfig{
+		HTTPClient: &RateLimitedHTTPClient{Client: inner, Limiter: l},
+		Cache:      cache,
+		FailureTTL: time.Minute,
+	}
+
+	country, _, _, err := cfg.GetCountryCode(context.Background(), "1.2.3.4")
+	assert.NoError(t, err)
+	assert.Equal(t, "US", country)
+
+	// The quota is now exhausted: fail fast without touching ip-api, and don't
+	// remember the failure against the IP.
+	_, _, marker, err := cfg.GetCountryCode(context.Background(), "5.6.7.8")
+	assert.True(t, errors.Is(err, ErrRateLimited))
+	assert.Equal(t, "-", marker)
+	assert.Equal(t, 1, inner.calls)
+	_, found := cache.Get("5.6.7.8")
+	assert.False(t, found)
+}
+
+func TestRateLimitedHTTPClientTooManyRequests(t *testing.T) {
+	l, _ := newTestLimiter(45, 0)
+	inner := &mockHTTPClient{
+		getFunc: func(_ context.Context, _ string) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusTooManyRequests,
+				Header:     http.Header{"X-Ttl": []string{"20"}},
+				Body:       io.NopCloser(strings.NewReader("")),
+			}, nil
+		},
+	}
+	client := &RateLimitedHTTPClient{Client: inner, Limiter: l}
+
+	_, err := client.Get(context.Background(), "1.2.3.4")
+	assert.ErrorIs(t, err, ErrRateLimited)
+	_, err = client.Get(context.Background(), "1.2.3.4")
+	assert.ErrorIs(t, err, ErrRateLimited)
+	assert.Equal(t, 1, inner.calls)
+}
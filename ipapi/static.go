@@ -0,0 +1,66 @@
+package ipapi
+
+import (
+	"context"
+	"fmt"
+	"geoproxy/common"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// StaticEntry maps an IP or CIDR to a fixed country and optional region.
+type StaticEntry struct {
+	CIDR    string
+	Country string
+	Region  string
+}
+
+type staticPrefix struct {
+	prefix  netip.Prefix
+	country string
+	region  string
+}
+
+// StaticProvider answers lookups from an operator-maintained CIDR table. The
+// most specific matching prefix wins.
+type StaticProvider struct {
+	prefixes []staticPrefix
+}
+
+func NewStaticProvider(entries []StaticEntry) (*StaticProvider, error) {
+	p := &StaticProvider{prefixes: make([]staticPrefix, 0, len(entries))}
+	for _, e := range entries {
+		prefix, err := common.ParseIPOrPrefix(e.CIDR)
+		if err != nil {
+			return nil, err
+		}
+		country := strings.TrimSpace(e.Country)
+		if country == "" {
+			return nil, fmt.Errorf("static entry %q has no country", e.CIDR)
+		}
+		p.prefixes = append(p.prefixes, staticPrefix{
+			prefix:  prefix,
+			country: country,
+			region:  strings.TrimSpace(e.Region),
+		})
+	}
+	sort.SliceStable(p.prefixes, func(i, j int) bool {
+		return p.prefixes[i].prefix.Bits() > p.prefixes[j].prefix.Bits()
+	})
+	return p, nil
+}
+
+func (p *StaticProvider) GetCountryCode(_ context.Context, ip string) (string, string, string, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return "", "", "-", fmt.Errorf("failed to parse ip: %s", ip)
+	}
+	addr = addr.Unmap().WithZone("")
+	for _, e := range p.prefixes {
+		if e.prefix.Contains(addr) {
+			return e.country, e.region, "static", nil
+		}
+	}
+	return "", "", "-", fmt.Errorf("no static entry for ip: %s", ip)
+}
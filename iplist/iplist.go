@@ -0,0 +1,252 @@
+// Package iplist loads IP/CIDR lists from plain-text files or HTTP URLs, such
+// as Spamhaus DROP or FireHOL netsets, and keeps them up to date.
+package iplist
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"geoproxy/common"
+	"geoproxy/config"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultRefreshInterval is how often a file is checked for changes and a
+	// URL is re-fetched.
+	DefaultRefreshInterval = 5 * time.Minute
+	// MaxListBytes caps the size of one list.
+	MaxListBytes = 64 << 20
+
+	fetchTimeout = 30 * time.Second
+)
+
+// Source is one list file or URL. Lookups use the last list that loaded
+// successfully; a refresh that fails to read or validate is logged and
+// ignored.
+type Source struct {
+	// Location is a file path or an http(s) URL.
+	Location string
+	// RefreshInterval is how often lookups may stat the file (reloading it when
+	// its mtime or size changed) or re-fetch the URL. Default 5m.
+	RefreshInterval time.Duration
+	Client          *http.Client
+
+	// set and lastCheck (in Unix nanoseconds) are read by every lookup
+	// without taking mu.
+	set        atomic.Pointer[common.IPSet]
+	lastCheck  atomic.Int64
+	mu         sync.Mutex
+	modTime    time.Time
+	size       int64
+	etag       string
+	lastMod    string
+	refreshing atomic.Bool
+}
+
+// New loads location and fails if it cannot be read or holds an invalid entry.
+func New(location string, refreshInterval time.Duration) (*Source, error) {
+	s := &Source{Location: location, RefreshInterval: refreshInterval}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// IsURL reports whether location is fetched over HTTP rather than read from
+// disk.
+func IsURL(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
+
+// Len returns the number of entries in the current list.
+func (s *Source) Len() int {
+	return s.set.Load().Len()
+}
+
+// Reload reads the list now and swaps it in. On error the previous list stays
+// active.
+func (s *Source) Reload() error {
+	_, err := s.reload()
+	return err
+}
+
+// reload reports whether a new list was swapped in; an unchanged URL (304 Not
+// Modified) is not an error.
+func (s *Source) reload() (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastCheck.Store(time.Now().UnixNano())
+	if IsURL(s.Location) {
+		return s.fetchLocked()
+	}
+	return true, s.readLocked()
+}
+
+func (s *Source) readLocked() error {
+	f, err := os.Open(s.Location)
+	if err != nil {
+		return fmt.Errorf("failed to open list %s: %v", s.Location, err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat list %s: %v", s.Location, err)
+	}
+	set, err := Parse(io.LimitReader(f, MaxListBytes+1))
+	if err != nil {
+		return fmt.Errorf("list %s: %v", s.Location, err)
+	}
+	s.set.Store(set)
+	s.modTime = fi.ModTime()
+	s.size = fi.Size()
+	return nil
+}
+
+func (s *Source) fetchLocked() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.Location, nil)
+	if err != nil {
+		return false, fmt.Errorf("invalid list URL %s: %v", s.Location, err)
+	}
+	if s.set.Load() != nil {
+		if s.etag != "" {
+			req.Header.Set("If-None-Match", s.etag)
+		}
+		if s.lastMod != "" {
+			req.Header.Set("If-Modified-Since", s.lastMod)
+		}
+	}
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: fetchTimeout}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("failed to fetch list %s: %v", s.Location, err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		if s.set.Load() != nil {
+			return false, nil
+		}
+		fallthrough
+	default:
+		return false, fmt.Errorf("failed to fetch list %s: %s", s.Location, resp.Status)
+	}
+	set, err := Parse(io.LimitReader(resp.Body, MaxListBytes+1))
+	if err != nil {
+		return false, fmt.Errorf("list %s: %v", s.Location, err)
+	}
+	s.set.Store(set)
+	s.etag = resp.Header.Get("ETag")
+	s.lastMod = resp.Header.Get("Last-Modified")
+	return true, nil
+}
+
+// maybeRefresh checks the source at most once per RefreshInterval and reloads
+// it in the background: files when their mtime or size changed, URLs always.
+func (s *Source) maybeRefresh() {
+	interval := s.RefreshInterval
+	if interval <= 0 {
+		interval = DefaultRefreshInterval
+	}
+	last := s.lastCheck.Load()
+	now := time.Now()
+	if now.Sub(time.Unix(0, last)) < interval {
+		return
+	}
+	// Only the lookup that wins the swap checks the source.
+	if !s.lastCheck.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+	s.mu.Lock()
+	changed := true
+	if !IsURL(s.Location) {
+		fi, err := os.Stat(s.Location)
+		// A missing file is reported by the reload, which keeps the old list.
+		changed = err != nil || !fi.ModTime().Equal(s.modTime) || fi.Size() != s.size
+	}
+	s.mu.Unlock()
+	if !changed || !s.refreshing.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer s.refreshing.Store(false)
+		changed, err := s.reload()
+		if err != nil {
+			log.Printf("ip list refresh failed; keeping previous list (%d entries): %v", s.Len(), err)
+			return
+		}
+		if changed {
+			log.Printf("reloaded ip list %s (%d entries)", s.Location, s.Len())
+		}
+	}()
+}
+
+// Contains reports whether ip is on the current list. It takes no lock; a
+// reload swaps the whole list in at once.
+func (s *Source) Contains(ip string) bool {
+	s.maybeRefresh()
+	return s.set.Load().Contains(ip)
+}
+
+// Parse reads one IP or CIDR per line. Blank lines and comments starting with
+// '#' or ';' are skipped, as is anything after the first field, so Spamhaus
+// DROP ("1.2.3.0/24 ; SBL123") and FireHOL netsets load as-is. Entries are
+// validated like the inline YAML lists; any invalid line fails the whole list.
+func Parse(r io.Reader) (*common.IPSet, error) {
+	set := &common.IPSet{}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	read := 0
+	for line := 1; sc.Scan(); line++ {
+		read += len(sc.Bytes()) + 1
+		if read > MaxListBytes {
+			return nil, fmt.Errorf("list is larger than %d bytes", MaxListBytes)
+		}
+		text := sc.Text()
+		if i := strings.IndexAny(text, "#;"); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if err := config.ValidateIPOrCIDREntries(fields[:1]); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		prefix, err := common.ParseIPOrPrefix(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		set.Add(prefix)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// Union matches an address against several matchers, e.g. an inline list and
+// the lists loaded from files.
+type Union []common.IPMatcher
+
+func (u Union) Contains(ip string) bool {
+	for _, m := range u {
+		if m.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,119 @@
+package iplist
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	set, err := Parse(strings.NewReader(`; Spamhaus DROP List 2024/05/01
+; Last-Modified: Wed, 01 May 2024 12:00:00 GMT
+1.10.16.0/20 ; SBL256894
+2.56.192.0/22 ; SBL459831
+
+# FireHOL style
+  198.51.100.7
+2001:db8::/32	# documentation
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, set.Len())
+	assert.True(t, set.Contains("1.10.20.1"))
+	assert.True(t, set.Contains("198.51.100.7"))
+	assert.True(t, set.Contains("2001:db8::1"))
+	assert.False(t, set.Contains("198.51.100.8"))
+
+	_, err = Parse(strings.NewReader("10.0.0.0/8\nnot-a-cidr\n"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "line 2")
+	}
+}
+
+func TestSourceFileRefresh(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deny.txt")
+	assert.NoError(t, os.WriteFile(path, []byte("192.0.2.0/24\n"), 0o600))
+
+	src, err := New(path, time.Millisecond)
+	assert.NoError(t, err)
+	assert.True(t, src.Contains("192.0.2.1"))
+
+	assert.NoError(t, os.WriteFile(path, []byte("192.0.2.0/24\n203.0.113.0/24\n"), 0o600))
+	assert.Eventually(t, func() bool { return src.Contains("203.0.113.1") }, 2*time.Second, 5*time.Millisecond)
+
+	// A broken refresh keeps the last good list.
+	assert.NoError(t, os.WriteFile(path, []byte("garbage\n"), 0o600))
+	assert.Error(t, src.Reload())
+	assert.True(t, src.Contains("203.0.113.1"))
+	assert.NoError(t, os.Remove(path))
+	assert.Error(t, src.Reload())
+	assert.Equal(t, 2, src.Len())
+
+	_, err = New(path, 0)
+	assert.Error(t, err)
+}
+
+func TestSourceURL(t *testing.T) {
+	var body atomic.Value
+	body.Store("198.51.100.0/24\n")
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	var conditional atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			conditional.Add(1)
+		}
+		if s := int(status.Load()); s != http.StatusOK {
+			w.WriteHeader(s)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte(body.Load().(string)))
+	}))
+	defer srv.Close()
+
+	src, err := New(srv.URL+"/drop.txt", time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, src.Contains("198.51.100.9"))
+
+	status.Store(http.StatusNotModified)
+	assert.NoError(t, src.Reload())
+	assert.Equal(t, int32(1), conditional.Load())
+	assert.True(t, src.Contains("198.51.100.9"))
+
+	status.Store(http.StatusInternalServerError)
+	assert.Error(t, src.Reload())
+	assert.True(t, src.Contains("198.51.100.9"))
+
+	status.Store(http.StatusOK)
+	body.Store("bogus\n")
+	assert.Error(t, src.Reload())
+	assert.True(t, src.Contains("198.51.100.9"))
+
+	body.Store("203.0.113.0/24\n")
+	assert.NoError(t, src.Reload())
+	assert.False(t, src.Contains("198.51.100.9"))
+	assert.True(t, src.Contains("203.0.113.9"))
+
+	status.Store(http.StatusNotFound)
+	_, err = New(srv.URL+"/missing.txt", 0)
+	assert.Error(t, err)
+}
+
+func TestUnion(t *testing.T) {
+	a, err := Parse(strings.NewReader("10.0.0.0/8\n"))
+	assert.NoError(t, err)
+	b, err := Parse(strings.NewReader("192.0.2.1\n"))
+	assert.NoError(t, err)
+	u := Union{a, b}
+	assert.True(t, u.Contains("10.1.1.1"))
+	assert.True(t, u.Contains("192.0.2.1"))
+	assert.False(t, u.Contains("192.0.2.2"))
+	assert.False(t, Union{}.Contains("10.1.1.1"))
+}
@@ -9,17 +9,27 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
+	// Embedded so server timezones work on hosts without a zoneinfo database.
+	_ "time/tzdata"
 
 	"github.com/hashicorp/golang-lru/v2"
 
+	"geoproxy/accesslog"
+	"geoproxy/admin"
+	"geoproxy/ban"
+	"geoproxy/calendar"
 	"geoproxy/common"
 	"geoproxy/config"
 	"geoproxy/handler"
 	"geoproxy/ipapi"
+	"geoproxy/iplist"
+	"geoproxy/metrics"
+	"geoproxy/rules"
 	"geoproxy/server"
 )
 
@@ -27,7 +37,7 @@ func main() {
 	if err := run(os.Args[1:], runDeps{
 		logger:     log.Default(),
 		flagOutput: os.Stderr,
-		startServer: func(s server.ServerConfig, wg *sync.WaitGroup, ctx context.Context) {
+		startServer: func(s *server.ServerConfig, wg *sync.WaitGroup, ctx context.Context) {
 			go s.StartServer(wg, ctx)
 		},
 	}); err != nil {
@@ -38,7 +48,44 @@ func main() {
 type runDeps struct {
 	logger      *log.Logger
 	flagOutput  io.Writer
-	startServer func(server.ServerConfig, *sync.WaitGroup, context.Context)
+	startServer func(*server.ServerConfig, *sync.WaitGroup, context.Context)
+}
+
+// runOptions holds the command-line settings that apply to every server and
+// stay fixed across configuration reloads.
+type runOptions struct {
+	configFile         string
+	ipapiEndpointFlag  string
+	ipapiTimeout       time.Duration
+	ipapiMaxBytes      int64
+	ipapiFailureTTL    time.Duration
+	ipapiRate          int
+	ipapiMaxWait       time.Duration
+	coalesceAggregate  bool
+	ipapiBatchWindow   time.Duration
+	backendDialTimeout time.Duration
+	idleTimeout        time.Duration
+	maxConnLifetime    time.Duration
+	maxConns           int
+	maxConnsPerIP      int
+	connLimitAggregate bool
+	proxyProtoTimeout  time.Duration
+	configWatch        time.Duration
+	lruSize            int
+	metricsListen      string
+	accessLogDest      string
+	accessLogFormat    string
+	accessLogMaxSize   int64
+	accessLogBackups   int
+	adminListen        string
+	// accessLog is opened from the access log flags and shared by every server.
+	accessLog handler.AccessLogger
+	// conns and tempRules back the admin API and are shared by every server.
+	conns     *handler.ConnRegistry
+	tempRules *handler.TempRules
+	// bans is the dynamic ban list shared by every server and kept across
+	// reloads.
+	bans *ban.List
 }
 
 func run(args []string, deps runDeps) error {
@@ -49,7 +96,7 @@ func run(args []string, deps runDeps) error {
 		deps.flagOutput = os.Stderr
 	}
 	if deps.startServer == nil {
-		deps.startServer = func(s server.ServerConfig, wg *sync.WaitGroup, ctx context.Context) {
+		deps.startServer = func(s *server.ServerConfig, wg *sync.WaitGroup, ctx context.Context) {
 			go s.StartServer(wg, ctx)
 		}
 	}
@@ -61,13 +108,25 @@ func run(args []string, deps runDeps) error {
 	ipapiTimeout := fs.Duration("ipapi-timeout", 5*time.Second, "timeout for ipapi HTTP requests (e.g. 5s)")
 	ipapiMaxBytes := fs.Int64("ipapi-max-bytes", 1<<20, "maximum bytes to read from ipapi responses (default 1MiB)")
 	ipapiFailureTTL := fs.Duration("ipapi-failure-ttl", 30*time.Second, "duration to cache ipapi lookup failures per IP (0 disables)")
+	ipapiRate := fs.Int("ipapi-rate", 45, "maximum ip-api requests per minute on the free endpoint (0 disables client-side rate limiting)")
+	ipapiMaxWait := fs.Duration("ipapi-max-wait", time.Second, "how long a lookup may wait for ip-api rate limit quota before failing as rate limited")
+	coalesceAggregate := fs.Bool("ipapi-coalesce-aggregate", false, "share in-flight ipapi lookups across each IPv4 /24 and IPv6 /64 instead of per address")
+	ipapiBatchWindow := fs.Duration("ipapi-batch-window", 0, "gather ipapi lookups for this long and resolve them with one batch request (0 disables; e.g. 50ms)")
 	backendDialTimeout := fs.Duration("backend-dial-timeout", 5*time.Second, "timeout for backend TCP dials (e.g. 5s)")
 	idleTimeout := fs.Duration("idle-timeout", 60*time.Second, "idle timeout for proxied connections (0 disables)")
 	maxConnLifetime := fs.Duration("max-conn-lifetime", 2*time.Hour, "maximum lifetime for a proxied connection (0 disables; e.g. 24h)")
 	maxConns := fs.Int("max-conns", 1024, "maximum concurrent client connections per server (0 disables)")
 	maxConnsPerIP := fs.Int("max-conns-per-ip", 10, "maximum concurrent client connections per source IP per server (0 disables)")
+	connLimitAggregate := fs.Bool("conn-limit-aggregate", false, "apply -max-conns-per-ip per IPv4 /24 and IPv6 /64 instead of per address")
 	proxyProtoTimeout := fs.Duration("proxyproto-timeout", 1*time.Second, "timeout for receiving HAProxy PROXY protocol headers from trusted proxies (e.g. 1s)")
 	lruSize := fs.Int("lru", 10000, "size of the IP address LRU cache")
+	metricsListen := fs.String("metrics-listen", "", "serve Prometheus metrics at /metrics on this address (e.g. 127.0.0.1:9100; empty disables)")
+	accessLogDest := fs.String("access-log", "", "write one structured record per connection to stdout, syslog, or a file path (empty disables)")
+	accessLogFormat := fs.String("access-log-format", "json", "access log format: json or logfmt")
+	accessLogMaxSize := fs.Int64("access-log-max-size", 100<<20, "rotate the access log file when it reaches this many bytes (0 disables)")
+	accessLogBackups := fs.Int("access-log-max-backups", 5, "number of rotated access log files to keep")
+	adminListen := fs.String("admin-listen", "", "serve the admin API on a unix socket (unix:/path) or a loopback host:port (empty disables)")
+	configWatch := fs.Duration("config-watch", 0, "poll the configuration file at this interval and reload it when it changes (0 disables; SIGHUP always reloads)")
 	if err := fs.Parse(args); err != nil {
 		return err
 	}
@@ -83,217 +142,883 @@ func run(args []string, deps runDeps) error {
 	if *ipapiFailureTTL < 0 {
 		return fmt.Errorf("-ipapi-failure-ttl must be >= 0")
 	}
+	if *ipapiRate < 0 {
+		return fmt.Errorf("-ipapi-rate must be >= 0")
+	}
+	if *ipapiMaxWait < 0 {
+		return fmt.Errorf("-ipapi-max-wait must be >= 0")
+	}
+	if *ipapiBatchWindow < 0 {
+		return fmt.Errorf("-ipapi-batch-window must be >= 0")
+	}
+	if *accessLogMaxSize < 0 {
+		return fmt.Errorf("-access-log-max-size must be >= 0")
+	}
+	if *accessLogBackups < 0 {
+		return fmt.Errorf("-access-log-max-backups must be >= 0")
+	}
+	if *configWatch < 0 {
+		return fmt.Errorf("-config-watch must be >= 0")
+	}
+	opts := runOptions{
+		configFile:         *configFile,
+		ipapiEndpointFlag:  *ipapiEndpointFlag,
+		ipapiTimeout:       *ipapiTimeout,
+		ipapiMaxBytes:      *ipapiMaxBytes,
+		ipapiFailureTTL:    *ipapiFailureTTL,
+		ipapiRate:          *ipapiRate,
+		ipapiMaxWait:       *ipapiMaxWait,
+		coalesceAggregate:  *coalesceAggregate,
+		ipapiBatchWindow:   *ipapiBatchWindow,
+		backendDialTimeout: *backendDialTimeout,
+		idleTimeout:        *idleTimeout,
+		maxConnLifetime:    *maxConnLifetime,
+		maxConns:           *maxConns,
+		maxConnsPerIP:      *maxConnsPerIP,
+		connLimitAggregate: *connLimitAggregate,
+		proxyProtoTimeout:  *proxyProtoTimeout,
+		configWatch:        *configWatch,
+		lruSize:            *lruSize,
+		metricsListen:      *metricsListen,
+		accessLogDest:      *accessLogDest,
+		accessLogFormat:    *accessLogFormat,
+		accessLogMaxSize:   *accessLogMaxSize,
+		accessLogBackups:   *accessLogBackups,
+		adminListen:        *adminListen,
+	}
+
+	cfg, ipapiEndpoint, err := loadConfig(opts)
+	if err != nil {
+		return err
+	}
+
+	deps.logger.Printf("Starting GeoProxy\n")
+	deps.logger.Printf("Configuration file: %s\n", opts.configFile)
+	deps.logger.Printf("Geo provider: %s\n", cfg.GeoProvider)
+	if cfg.GeoProvider == config.GeoProviderMMDB {
+		deps.logger.Printf("MMDB path: %s\n", cfg.MMDBPath)
+	}
+	if cfg.GeoProvider == config.GeoProviderChain {
+		deps.logger.Printf("Geo chain mode: %s\n", cfg.GeoChain.Mode)
+		for _, p := range cfg.GeoChain.Providers {
+			deps.logger.Printf("Geo chain provider: %s %s\n", p.Type, p.Path)
+		}
+	}
+	deps.logger.Printf("IPAPI endpoint: %s\n", ipapiEndpoint)
+	deps.logger.Printf("IPAPI timeout: %s\n", opts.ipapiTimeout.String())
+	deps.logger.Printf("IPAPI max bytes: %d\n", opts.ipapiMaxBytes)
+	deps.logger.Printf("IPAPI failure TTL: %s\n", opts.ipapiFailureTTL.String())
+	deps.logger.Printf("IPAPI rate limit: %d/min\n", opts.ipapiRate)
+	deps.logger.Printf("IPAPI max wait: %s\n", opts.ipapiMaxWait.String())
+	deps.logger.Printf("IPAPI coalesce aggregate: %v\n", opts.coalesceAggregate)
+	deps.logger.Printf("IPAPI batch window: %s\n", opts.ipapiBatchWindow.String())
+	deps.logger.Printf("Backend dial timeout: %s\n", opts.backendDialTimeout.String())
+	deps.logger.Printf("Idle timeout: %s\n", opts.idleTimeout.String())
+	deps.logger.Printf("Max conn lifetime: %s\n", opts.maxConnLifetime.String())
+	deps.logger.Printf("Max conns: %d\n", opts.maxConns)
+	deps.logger.Printf("Max conns per IP: %d\n", opts.maxConnsPerIP)
+	deps.logger.Printf("Conn limit aggregate: %v\n", opts.connLimitAggregate)
+	deps.logger.Printf("Proxy protocol timeout: %s\n", opts.proxyProtoTimeout.String())
+	deps.logger.Printf("LRU cache size: %d\n", opts.lruSize)
+	deps.logger.Printf("Config watch interval: %s\n", opts.configWatch.String())
+	if cfg.CacheFile != "" {
+		deps.logger.Printf("Cache file: %s\n", cfg.CacheFile)
+	}
+
+	cache, err := lru.New[string, ipapi.Reply](opts.lruSize)
+	if err != nil {
+		return fmt.Errorf("failed to initialize IP cache: %v", err)
+	}
+	ipapi.IPCache = cache
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if opts.accessLogDest != "" {
+		al, err := accesslog.Open(opts.accessLogDest, opts.accessLogFormat, opts.accessLogMaxSize, opts.accessLogBackups)
+		if err != nil {
+			return err
+		}
+		defer al.Close()
+		opts.accessLog = al
+		deps.logger.Printf("Access log: %s (%s)\n", opts.accessLogDest, opts.accessLogFormat)
+	}
+
+	if opts.metricsListen != "" {
+		addr, err := metrics.Serve(ctx, opts.metricsListen)
+		if err != nil {
+			return fmt.Errorf("failed to start metrics listener: %v", err)
+		}
+		deps.logger.Printf("Metrics listening on %s\n", addr)
+	}
+
+	if cfg.CacheFile != "" {
+		n, err := ipapi.LoadCache(cfg.CacheFile, cache)
+		if err != nil {
+			// A corrupt snapshot only costs lookups; don't refuse to start.
+			deps.logger.Printf("failed to load ip cache from %s: %v", cfg.CacheFile, err)
+		} else {
+			deps.logger.Printf("loaded %d ip cache entries from %s", n, cfg.CacheFile)
+		}
+		interval := cfg.CacheSnapshotInterval
+		if interval == 0 {
+			interval = 5 * time.Minute
+		}
+		snapCtx, stopSnapshots := context.WithCancel(context.Background())
+		snapDone := make(chan struct{})
+		go func() {
+			ipapi.RunCacheSnapshots(snapCtx, cfg.CacheFile, cache, interval)
+			close(snapDone)
+		}()
+		defer func() {
+			stopSnapshots()
+			<-snapDone
+		}()
+	}
+
+	opts.bans = ban.New(banPolicy(cfg.Ban))
+	opts.bans.File = cfg.Ban.File
+	if cfg.Ban.File != "" {
+		n, err := opts.bans.Load()
+		if err != nil {
+			deps.logger.Printf("failed to load ban list from %s: %v", cfg.Ban.File, err)
+		} else {
+			deps.logger.Printf("loaded %d bans from %s", n, cfg.Ban.File)
+		}
+		saveCtx, stopSaves := context.WithCancel(context.Background())
+		savesDone := make(chan struct{})
+		go func() {
+			opts.bans.RunSaves(saveCtx)
+			close(savesDone)
+		}()
+		defer func() {
+			stopSaves()
+			<-savesDone
+		}()
+	}
+	if cfg.Ban.Enabled() {
+		deps.logger.Printf("Ban duration: %s max rejections: %d per %s max connections: %d per %s\n",
+			cfg.Ban.Duration, cfg.Ban.MaxRejections, cfg.Ban.RejectionWindow, cfg.Ban.MaxConnections, cfg.Ban.ConnectionWindow)
+	}
+
+	for _, c := range cfg.Servers {
+		logServerConfig(deps.logger, c)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	if opts.adminListen != "" {
+		opts.conns = handler.NewConnRegistry()
+		opts.tempRules = handler.NewTempRules()
+	}
+	sup := newSupervisor(ctx, deps, opts)
+	if opts.adminListen != "" {
+		api := &admin.API{
+			Servers:   sup.Servers,
+			Conns:     opts.conns,
+			Cache:     ipapi.IPCache,
+			TempRules: opts.tempRules,
+			Bans:      opts.bans,
+		}
+		addr, err := api.Serve(ctx, opts.adminListen)
+		if err != nil {
+			return fmt.Errorf("failed to start admin listener: %v", err)
+		}
+		deps.logger.Printf("Admin API listening on %s\n", addr)
+	}
+	if err := sup.apply(cfg, ipapiEndpoint); err != nil {
+		return err
+	}
+	sup.run(hup)
+	return nil
+}
 
-	cfg, err := config.ReadConfig(*configFile)
+// loadConfig reads and validates the configuration file and resolves the ipapi
+// endpoint for it. It is used both at startup and on reload.
+func loadConfig(opts runOptions) (*config.Config, string, error) {
+	cfg, err := config.ReadConfig(opts.configFile)
 	if err != nil {
-		return fmt.Errorf("failed to read configuration file: %v", err)
+		return nil, "", fmt.Errorf("failed to read configuration file: %v", err)
 	}
 
 	var ipapiEndpoint string
 	if cfg.APIKey != "" {
 		// Pro accounts must use HTTPS and we don't allow overriding it.
-		if strings.TrimSpace(*ipapiEndpointFlag) != "" {
-			return fmt.Errorf("-ipapi cannot be used when apiKey is set; endpoint is forced to https://pro.ip-api.com/json/")
+		if strings.TrimSpace(opts.ipapiEndpointFlag) != "" {
+			return nil, "", fmt.Errorf("-ipapi cannot be used when apiKey is set; endpoint is forced to https://pro.ip-api.com/json/")
 		}
 		ipapiEndpoint = "https://pro.ip-api.com/json/"
 	} else {
-		ipapiEndpoint = strings.TrimSpace(*ipapiEndpointFlag)
+		ipapiEndpoint = strings.TrimSpace(opts.ipapiEndpointFlag)
 		if ipapiEndpoint == "" {
 			ipapiEndpoint = "http://ip-api.com/json/"
 		}
 		if err := validateFreeIPAPIEndpoint(ipapiEndpoint); err != nil {
-			return err
+			return nil, "", err
 		}
 	}
 
-	deps.logger.Printf("Starting GeoProxy\n")
-	deps.logger.Printf("Configuration file: %s\n", *configFile)
-	deps.logger.Printf("IPAPI endpoint: %s\n", ipapiEndpoint)
-	deps.logger.Printf("IPAPI timeout: %s\n", ipapiTimeout.String())
-	deps.logger.Printf("IPAPI max bytes: %d\n", *ipapiMaxBytes)
-	deps.logger.Printf("IPAPI failure TTL: %s\n", ipapiFailureTTL.String())
-	deps.logger.Printf("Backend dial timeout: %s\n", backendDialTimeout.String())
-	deps.logger.Printf("Idle timeout: %s\n", idleTimeout.String())
-	deps.logger.Printf("Max conn lifetime: %s\n", maxConnLifetime.String())
-	deps.logger.Printf("Max conns: %d\n", *maxConns)
-	deps.logger.Printf("Max conns per IP: %d\n", *maxConnsPerIP)
-	deps.logger.Printf("Proxy protocol timeout: %s\n", proxyProtoTimeout.String())
-	deps.logger.Printf("LRU cache size: %d\n", *lruSize)
-
-	cache, err := lru.New[string, ipapi.Reply](*lruSize)
+	seen := make(map[string]bool, len(cfg.Servers))
+	for _, c := range cfg.Servers {
+		if err := validateServerConfig(c); err != nil {
+			return nil, "", err
+		}
+		key := serverKey(c)
+		if seen[key] {
+			return nil, "", fmt.Errorf("duplicate listen address %s", key)
+		}
+		seen[key] = true
+	}
+	return cfg, ipapiEndpoint, nil
+}
+
+func logServerConfig(logger *log.Logger, c config.ServerConfig) {
+	logger.Print("----------")
+	logger.Printf("Server %s:%s\n", c.ListenIP, c.ListenPort)
+	if c.Name != "" {
+		logger.Printf("Name: %s\n", c.Name)
+	}
+	if len(c.Backends) > 0 {
+		for _, b := range c.Backends {
+			logger.Printf("Backend %s:%s weight %d\n", b.IP, b.Port, b.Weight)
+		}
+		logger.Printf("Load balancing: %s\n", c.LoadBalancing)
+	} else {
+		logger.Printf("Backend %s:%s\n", c.BackendIP, c.BackendPort)
+	}
+	logger.Printf("Allowed countries: %v\n", c.AllowedCountries)
+	logger.Printf("Allowed regions: %v\n", c.AllowedRegions)
+	logger.Printf("Always allowed: %v\n", c.AlwaysAllowed)
+	logger.Printf("Always denied: %v\n", c.AlwaysDenied)
+	logger.Printf("Denied countries: %v\n", c.DeniedCountries)
+	logger.Printf("Denied regions: %v\n", c.DeniedRegions)
+	logger.Printf("RecvProxyProtocol: %v\n", c.RecvProxyProtocol)
+	logger.Printf("SendProxyProtocol: %v\n", c.SendProxyProtocol)
+	logger.Printf("ProxyProtocolVersion: %d\n", c.ProxyProtocolVersion)
+	logger.Printf("TrustedProxies: %v\n", c.TrustedProxies)
+	logger.Printf("Days of week: %v\n", c.DaysOfWeek)
+	logger.Printf("Start date: %s\n", c.StartDate)
+	logger.Printf("End date: %s\n", c.EndDate)
+	logger.Printf("Start time: %s\n", c.StartTime)
+	logger.Printf("End time: %s\n", c.EndTime)
+	if c.Timezone != "" {
+		logger.Printf("Timezone: %s\n", c.Timezone)
+	}
+	for i, s := range c.Schedules {
+		logger.Printf("Schedule %d: %+v\n", i+1, s)
+	}
+	for _, e := range c.Exceptions {
+		logger.Printf("Exception: %+v\n", e)
+	}
+	if len(c.CalendarFiles) > 0 {
+		logger.Printf("Calendar files: %v\n", c.CalendarFiles)
+	}
+	if c.EnforceScheduleOnActive {
+		logger.Printf("Enforce schedule on active connections, grace period: %s\n", c.ScheduleGracePeriod)
+	}
+	logger.Printf("On lookup failure: %s\n", c.OnLookupFailure)
+	logger.Printf("Lookup failure allowed: %v\n", c.LookupFailureAllowed)
+	for i, r := range c.Rules {
+		logger.Printf("Rule %d: %+v\n", i+1, r)
+	}
+	if len(c.Rules) > 0 {
+		logger.Printf("Default action: %s\n", c.DefaultAction)
+	}
+}
+
+func validateServerConfig(c config.ServerConfig) error {
+	loc, err := serverLocation(c)
 	if err != nil {
-		return fmt.Errorf("failed to initialize IP cache: %v", err)
+		return fmt.Errorf("invalid timezone for server %s:%s: %v", c.ListenIP, c.ListenPort, err)
 	}
-	ipapi.IPCache = cache
+	if _, err := parseWindows(c.Schedules, loc); err != nil {
+		return fmt.Errorf("invalid schedules for server %s:%s: %v", c.ListenIP, c.ListenPort, err)
+	}
+	if _, err := parseExceptions(c.Exceptions); err != nil {
+		return fmt.Errorf("invalid exceptions for server %s:%s: %v", c.ListenIP, c.ListenPort, err)
+	}
+	if len(c.Rules) > 0 {
+		if _, err := compileRules(c.Rules, c.DefaultAction, loc, false); err != nil {
+			return fmt.Errorf("invalid rules for server %s:%s: %v", c.ListenIP, c.ListenPort, err)
+		}
+	} else if len(c.AllowedCountries) == 0 && len(c.DeniedCountries) == 0 {
+		return fmt.Errorf("no countries specified for server %s:%s", c.ListenIP, c.ListenPort)
+	}
+	if c.SendProxyProtocol {
+		if c.ProxyProtocolVersion != 1 && c.ProxyProtocolVersion != 2 {
+			return fmt.Errorf("invalid proxyProtocolVersion %d for server %s:%s (expected 1 or 2)", c.ProxyProtocolVersion, c.ListenIP, c.ListenPort)
+		}
+	}
+	if (c.StartDate != "" && c.EndDate == "") || (c.StartDate == "" && c.EndDate != "") {
+		return fmt.Errorf("both startDate and endDate must be set for server %s:%s", c.ListenIP, c.ListenPort)
+	}
+	if len(c.DaysOfWeek) > 0 && (c.StartDate != "" || c.EndDate != "") {
+		return fmt.Errorf("daysOfWeek cannot be combined with startDate/endDate for server %s:%s", c.ListenIP, c.ListenPort)
+	}
+	if c.StartDate != "" && c.EndDate != "" {
+		startDate, err := time.ParseInLocation("2006-01-02", c.StartDate, time.Local)
+		if err != nil {
+			return fmt.Errorf("failed to parse start date %s: %v", c.StartDate, err)
+		}
+		endDate, err := time.ParseInLocation("2006-01-02", c.EndDate, time.Local)
+		if err != nil {
+			return fmt.Errorf("failed to parse end date %s: %v", c.EndDate, err)
+		}
+		if startDate.After(endDate) {
+			return fmt.Errorf("start date %s is after end date %s", c.StartDate, c.EndDate)
+		}
+	}
+	if (c.StartTime != "" && c.EndTime == "") || (c.StartTime == "" && c.EndTime != "") {
+		return fmt.Errorf("both startTime and endTime must be set for server %s:%s", c.ListenIP, c.ListenPort)
+	}
+	if c.StartTime != "" && c.EndTime != "" {
+		_, err := time.ParseInLocation("15:04", c.StartTime, time.Local)
+		if err != nil {
+			return fmt.Errorf("failed to parse start time %s: %v", c.StartTime, err)
+		}
+		_, err = time.ParseInLocation("15:04", c.EndTime, time.Local)
+		if err != nil {
+			return fmt.Errorf("failed to parse end time %s: %v", c.EndTime, err)
+		}
+	}
+	if len(c.DaysOfWeek) > 0 {
+		_, err := parseDaysOfWeek(c.DaysOfWeek)
+		if err != nil {
+			return fmt.Errorf("failed to parse days of week %v: %v", c.DaysOfWeek, err)
+		}
+	}
+	if c.RecvProxyProtocol && len(c.TrustedProxies) == 0 {
+		return fmt.Errorf("recvProxyProtocol is true but trustedProxies is empty for server %s:%s; configure trustedProxies to avoid PROXY protocol spoofing", c.ListenIP, c.ListenPort)
+	}
+	return nil
+}
 
-	for _, c := range cfg.Servers {
-		deps.logger.Print("----------")
-		deps.logger.Printf("Server %s:%s\n", c.ListenIP, c.ListenPort)
-		deps.logger.Printf("Backend %s:%s\n", c.BackendIP, c.BackendPort)
-		deps.logger.Printf("Allowed countries: %v\n", c.AllowedCountries)
-		deps.logger.Printf("Allowed regions: %v\n", c.AllowedRegions)
-		deps.logger.Printf("Always allowed: %v\n", c.AlwaysAllowed)
-		deps.logger.Printf("Always denied: %v\n", c.AlwaysDenied)
-		deps.logger.Printf("Denied countries: %v\n", c.DeniedCountries)
-		deps.logger.Printf("Denied regions: %v\n", c.DeniedRegions)
-		deps.logger.Printf("RecvProxyProtocol: %v\n", c.RecvProxyProtocol)
-		deps.logger.Printf("SendProxyProtocol: %v\n", c.SendProxyProtocol)
-		deps.logger.Printf("ProxyProtocolVersion: %d\n", c.ProxyProtocolVersion)
-		deps.logger.Printf("TrustedProxies: %v\n", c.TrustedProxies)
-		deps.logger.Printf("Days of week: %v\n", c.DaysOfWeek)
-		deps.logger.Printf("Start date: %s\n", c.StartDate)
-		deps.logger.Printf("End date: %s\n", c.EndDate)
-		deps.logger.Printf("Start time: %s\n", c.StartTime)
-		deps.logger.Printf("End time: %s\n", c.EndTime)
-
-		if len(c.AllowedCountries) == 0 && len(c.DeniedCountries) == 0 {
-			return fmt.Errorf("no countries specified for server %s:%s", c.ListenIP, c.ListenPort)
-		}
-		if c.SendProxyProtocol {
-			if c.ProxyProtocolVersion != 1 && c.ProxyProtocolVersion != 2 {
-				return fmt.Errorf("invalid proxyProtocolVersion %d for server %s:%s (expected 1 or 2)", c.ProxyProtocolVersion, c.ListenIP, c.ListenPort)
-			}
+// buildServer turns a validated server block into a runnable ServerConfig.
+func buildServer(logger *log.Logger, c config.ServerConfig, geo ipapi.IPAPI, opts runOptions, ipList func(string) (*iplist.Source, error), torExits common.IPMatcher) (*server.ServerConfig, error) {
+	trustedProxies := c.TrustedProxies
+	if !c.RecvProxyProtocol {
+		if len(trustedProxies) > 0 {
+			logger.Printf("trustedProxies ignored because recvProxyProtocol is false on %s:%s", c.ListenIP, c.ListenPort)
+		}
+		trustedProxies = nil
+	}
+
+	loc, err := serverLocation(c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load timezone %s: %v", c.Timezone, err)
+	}
+	var startTime time.Time
+	var endTime time.Time
+	var startDate time.Time
+	var endDate time.Time
+	if c.StartDate != "" && c.EndDate != "" {
+		startDate, err = time.ParseInLocation("2006-01-02", c.StartDate, loc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse start date %s: %v", c.StartDate, err)
+		}
+		endDate, err = time.ParseInLocation("2006-01-02", c.EndDate, loc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse end date %s: %v", c.EndDate, err)
+		}
+	}
+	if c.StartTime != "" && c.EndTime != "" {
+		startTime, err = time.ParseInLocation("15:04", c.StartTime, loc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse start time %s: %v", c.StartTime, err)
+		}
+		endTime, err = time.ParseInLocation("15:04", c.EndTime, loc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse end time %s: %v", c.EndTime, err)
+		}
+	}
+	daysOfWeek, err := parseDaysOfWeek(c.DaysOfWeek)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse days of week %v: %v", c.DaysOfWeek, err)
+	}
+	alwaysAllowed, err := common.NewIPSet(c.AlwaysAllowed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile alwaysAllowed: %v", err)
+	}
+	alwaysDenied, err := common.NewIPSet(c.AlwaysDenied)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile alwaysDenied: %v", err)
+	}
+	lookupFailureAllowed, err := common.NewIPSet(c.LookupFailureAllowed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile lookupFailureAllowed: %v", err)
+	}
+	alwaysAllowedSet, err := withListFiles(alwaysAllowed, c.AlwaysAllowedFiles, ipList)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load alwaysAllowedFiles: %v", err)
+	}
+	alwaysDeniedSet, err := withListFiles(alwaysDenied, c.AlwaysDeniedFiles, ipList)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load alwaysDeniedFiles: %v", err)
+	}
+	schedules, err := parseWindows(c.Schedules, loc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse schedules: %v", err)
+	}
+	ruleSet := rules.FromLegacy(rules.Legacy{
+		AllowedCountries: common.MakeNormalizedUpperSet(c.AllowedCountries),
+		AllowedRegions:   common.MakeNormalizedUpperSet(c.AllowedRegions),
+		DeniedCountries:  common.MakeNormalizedUpperSet(c.DeniedCountries),
+		DeniedRegions:    common.MakeNormalizedUpperSet(c.DeniedRegions),
+		StartDate:        startDate,
+		EndDate:          endDate,
+		StartTime:        startTime,
+		EndTime:          endTime,
+		DaysOfWeek:       daysOfWeek,
+		Schedules:        schedules,
+		Location:         loc,
+		ClientZone:       c.Timezone == config.TimezoneClient,
+	})
+	if len(c.Rules) > 0 {
+		ruleSet, err = compileRules(c.Rules, c.DefaultAction, loc, c.Timezone == config.TimezoneClient)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile rules: %v", err)
 		}
-		if (c.StartDate != "" && c.EndDate == "") || (c.StartDate == "" && c.EndDate != "") {
-			return fmt.Errorf("both startDate and endDate must be set for server %s:%s", c.ListenIP, c.ListenPort)
+	}
+	events, err := parseExceptions(c.Exceptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse exceptions: %v", err)
+	}
+	for _, path := range c.CalendarFiles {
+		loaded, err := calendar.Load(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load calendarFiles: %v", err)
 		}
-		if len(c.DaysOfWeek) > 0 && (c.StartDate != "" || c.EndDate != "") {
-			return fmt.Errorf("daysOfWeek cannot be combined with startDate/endDate for server %s:%s", c.ListenIP, c.ListenPort)
+		events = append(events, loaded...)
+	}
+	if len(events) > 0 {
+		ruleSet.Calendar = &rules.Calendar{
+			Events:     events,
+			Location:   loc,
+			ClientZone: c.Timezone == config.TimezoneClient,
+		}
+	}
+	// A nil *ban.List must not end up in the interface as a non-nil value.
+	var bans handler.BanList
+	if opts.bans != nil {
+		bans = opts.bans
+	}
+	return &server.ServerConfig{
+		Name:              serverName(c),
+		ListenIP:          c.ListenIP,
+		ListenPort:        c.ListenPort,
+		BackendIP:         c.BackendIP,
+		BackendPort:       c.BackendPort,
+		NetListener:       &server.RealNetListener{},
+		RecvProxyProtocol: c.RecvProxyProtocol,
+		TrustedProxies:    trustedProxies,
+		MaxConns:          opts.maxConns,
+		ProxyProtoTimeout: opts.proxyProtoTimeout,
+		HandlerFactory: &server.HandlerFactory{
+			BackendDialer:        &server.RealDialer{Timeout: opts.backendDialTimeout},
+			IPApiClient:          geo,
+			AllowedCountries:     common.MakeNormalizedUpperSet(c.AllowedCountries),
+			AllowedRegions:       common.MakeNormalizedUpperSet(c.AllowedRegions),
+			DeniedCountries:      common.MakeNormalizedUpperSet(c.DeniedCountries),
+			DeniedRegions:        common.MakeNormalizedUpperSet(c.DeniedRegions),
+			TransferFunc:         handler.TransferData,
+			BackendIP:            c.BackendIP,
+			BackendPort:          c.BackendPort,
+			SendProxyProtocol:    c.SendProxyProtocol,
+			ProxyProtocolVersion: c.ProxyProtocolVersion,
+			MaxConnLifetime:      opts.maxConnLifetime,
+			StartTime:            startTime,
+			EndTime:              endTime,
+			StartDate:            startDate,
+			EndDate:              endDate,
+			DaysOfWeek:           daysOfWeek,
+			IdleTimeout:          opts.idleTimeout,
+			ConnLimiter:          newConnLimiter(opts.maxConnsPerIP, opts.connLimitAggregate),
+			OnLookupFailure:      c.OnLookupFailure,
+			ServerName:           serverName(c),
+			ListenAddr:           serverKey(c),
+			AccessLog:            opts.accessLog,
+			Conns:                opts.conns,
+			TempRules:            opts.tempRules,
+			Bans:                 bans,
+
+			AlwaysAllowedSet:        alwaysAllowedSet,
+			AlwaysDeniedSet:         alwaysDeniedSet,
+			LookupFailureAllowedSet: lookupFailureAllowed,
+			AllowedASNs:             asnSet(c.AllowedASNs),
+			DeniedASNs:              asnSet(c.DeniedASNs),
+			AllowedOrgs:             lowerAll(c.AllowedOrgs),
+			DeniedOrgs:              lowerAll(c.DeniedOrgs),
+			DenyHosting:             c.DenyHosting,
+			DenyProxy:               c.DenyProxy,
+			DenyMobile:              c.DenyMobile,
+			DenyTor:                 c.DenyTor,
+			TorExits:                torExits,
+			AllowedCities:           common.MakeSet(c.AllowedCities),
+			AllowedRadius:           geoRadius(c.AllowedRadius),
+			Rules:                   ruleSet,
+			EnforceScheduleOnActive: c.EnforceScheduleOnActive,
+			ScheduleGracePeriod:     c.ScheduleGracePeriod,
+			Balancer:                newBalancer(c),
+		},
+	}, nil
+}
+
+// compileRules builds a server's rule set from its validated configuration.
+func compileRules(entries []config.RuleConfig, defaultAction string, loc *time.Location, clientZone bool) (*rules.Set, error) {
+	set := &rules.Set{Default: rules.Action(defaultAction)}
+	for i, e := range entries {
+		r := rules.Rule{
+			Action:    rules.Action(e.Action),
+			Tag:       e.Tag,
+			Countries: common.MakeNormalizedUpperSet(e.Countries),
+			Regions:   common.MakeNormalizedUpperSet(e.Regions),
+			ASNs:      asnSet(e.ASNs),
+			Invert:    e.Invert,
 		}
-		if c.StartDate != "" && c.EndDate != "" {
-			startDate, err := time.ParseInLocation("2006-01-02", c.StartDate, time.Local)
+		if len(e.CIDRs) > 0 {
+			cidrs, err := common.NewIPSet(e.CIDRs)
 			if err != nil {
-				return fmt.Errorf("failed to parse start date %s: %v", c.StartDate, err)
+				return nil, fmt.Errorf("rule %d: %v", i+1, err)
 			}
-			endDate, err := time.ParseInLocation("2006-01-02", c.EndDate, time.Local)
+			r.CIDRs = cidrs
+		}
+		if e.Schedule != nil {
+			window, err := parseWindow(*e.Schedule, loc)
 			if err != nil {
-				return fmt.Errorf("failed to parse end date %s: %v", c.EndDate, err)
-			}
-			if startDate.After(endDate) {
-				return fmt.Errorf("start date %s is after end date %s", c.StartDate, c.EndDate)
+				return nil, fmt.Errorf("rule %d: %v", i+1, err)
 			}
+			r.Schedule = &rules.Schedule{Windows: []rules.Window{window}, Location: loc, ClientZone: clientZone}
+		}
+		set.Rules = append(set.Rules, r)
+	}
+	return set, nil
+}
+
+// parseWindow parses one schedule window in loc. Only the dates' and times'
+// wall-clock fields are compared; the zone itself is applied by
+// rules.Schedule when it is checked.
+func parseWindow(c config.ScheduleConfig, loc *time.Location) (rules.Window, error) {
+	var s rules.Window
+	var err error
+	if (c.StartDate == "") != (c.EndDate == "") {
+		return s, fmt.Errorf("both startDate and endDate must be set")
+	}
+	if c.StartDate != "" {
+		if s.StartDate, err = time.ParseInLocation("2006-01-02", c.StartDate, loc); err != nil {
+			return s, fmt.Errorf("failed to parse start date %s: %v", c.StartDate, err)
 		}
-		if (c.StartTime != "" && c.EndTime == "") || (c.StartTime == "" && c.EndTime != "") {
-			return fmt.Errorf("both startTime and endTime must be set for server %s:%s", c.ListenIP, c.ListenPort)
+		if s.EndDate, err = time.ParseInLocation("2006-01-02", c.EndDate, loc); err != nil {
+			return s, fmt.Errorf("failed to parse end date %s: %v", c.EndDate, err)
 		}
-		if c.StartTime != "" && c.EndTime != "" {
-			_, err := time.ParseInLocation("15:04", c.StartTime, time.Local)
-			if err != nil {
-				return fmt.Errorf("failed to parse start time %s: %v", c.StartTime, err)
+		if s.StartDate.After(s.EndDate) {
+			return s, fmt.Errorf("start date %s is after end date %s", c.StartDate, c.EndDate)
+		}
+	}
+	if (c.StartTime == "") != (c.EndTime == "") {
+		return s, fmt.Errorf("both startTime and endTime must be set")
+	}
+	if c.StartTime != "" {
+		if s.StartTime, err = time.ParseInLocation("15:04", c.StartTime, loc); err != nil {
+			return s, fmt.Errorf("failed to parse start time %s: %v", c.StartTime, err)
+		}
+		if s.EndTime, err = time.ParseInLocation("15:04", c.EndTime, loc); err != nil {
+			return s, fmt.Errorf("failed to parse end time %s: %v", c.EndTime, err)
+		}
+	}
+	if s.DaysOfWeek, err = parseDaysOfWeek(c.DaysOfWeek); err != nil {
+		return s, fmt.Errorf("failed to parse days of week %v: %v", c.DaysOfWeek, err)
+	}
+	return s, nil
+}
+
+// parseWindows parses a server's schedules list.
+func parseWindows(entries []config.ScheduleConfig, loc *time.Location) ([]rules.Window, error) {
+	windows := make([]rules.Window, 0, len(entries))
+	for i, e := range entries {
+		w, err := parseWindow(e, loc)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %d: %v", i+1, err)
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+// parseExceptions converts the exceptions into floating calendar events,
+// which are read in the server's time zone.
+func parseExceptions(entries []config.ExceptionConfig) ([]calendar.Event, error) {
+	events := make([]calendar.Event, 0, len(entries))
+	for _, e := range entries {
+		ev := calendar.Event{Name: e.Name, Floating: true}
+		var err error
+		if e.Date != "" {
+			if ev.Start, err = time.Parse("2006-01-02", e.Date); err != nil {
+				return nil, fmt.Errorf("%s: failed to parse date %s: %v", e.Name, e.Date, err)
 			}
-			_, err = time.ParseInLocation("15:04", c.EndTime, time.Local)
-			if err != nil {
-				return fmt.Errorf("failed to parse end time %s: %v", c.EndTime, err)
+			ev.End = ev.Start.AddDate(0, 0, 1)
+		} else {
+			if ev.Start, _, err = parseExceptionTime(e.Start); err != nil {
+				return nil, fmt.Errorf("%s: failed to parse start %s: %v", e.Name, e.Start, err)
 			}
-		}
-		if len(c.DaysOfWeek) > 0 {
-			_, err = parseDaysOfWeek(c.DaysOfWeek)
-			if err != nil {
-				return fmt.Errorf("failed to parse days of week %v: %v", c.DaysOfWeek, err)
+			var dateOnly bool
+			if ev.End, dateOnly, err = parseExceptionTime(e.End); err != nil {
+				return nil, fmt.Errorf("%s: failed to parse end %s: %v", e.Name, e.End, err)
+			}
+			if dateOnly {
+				ev.End = ev.End.AddDate(0, 0, 1)
 			}
 		}
-		if c.RecvProxyProtocol && len(c.TrustedProxies) == 0 {
-			return fmt.Errorf("recvProxyProtocol is true but trustedProxies is empty for server %s:%s; configure trustedProxies to avoid PROXY protocol spoofing", c.ListenIP, c.ListenPort)
+		if !ev.End.After(ev.Start) {
+			return nil, fmt.Errorf("%s: end is not after start", e.Name)
 		}
+		events = append(events, ev)
 	}
+	return events, nil
+}
 
-	wg := sync.WaitGroup{}
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
-	defer stop()
-	for _, c := range cfg.Servers {
-		wg.Add(1)
-		deps.logger.Printf("proxy server listening on %s:%s countries: %v regions: %v always allowed: %v always denied: %v",
-			c.ListenIP,
-			c.ListenPort,
-			c.AllowedCountries,
-			c.AllowedRegions,
-			c.AlwaysAllowed,
-			c.AlwaysDenied)
-
-		trustedProxies := c.TrustedProxies
-		if !c.RecvProxyProtocol {
-			if len(trustedProxies) > 0 {
-				deps.logger.Printf("trustedProxies ignored because recvProxyProtocol is false on %s:%s", c.ListenIP, c.ListenPort)
+// parseExceptionTime parses "2006-01-02 15:04" or a bare date.
+func parseExceptionTime(value string) (t time.Time, dateOnly bool, err error) {
+	if t, err = time.Parse("2006-01-02 15:04", value); err == nil {
+		return t, false, nil
+	}
+	t, err = time.Parse("2006-01-02", value)
+	return t, true, err
+}
+
+// serverLocation returns the time zone of the server's schedules. For
+// timezone: client it is UTC, which only serves to parse the dates and times;
+// the client's zone is applied per connection.
+func serverLocation(c config.ServerConfig) (*time.Location, error) {
+	if c.Timezone == "" {
+		return time.Local, nil
+	}
+	if c.Timezone == config.TimezoneClient {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(c.Timezone)
+}
+
+// asnSet converts the validated, bare-number ASNs from the config into a set.
+func asnSet(asns []string) map[uint32]bool {
+	if len(asns) == 0 {
+		return nil
+	}
+	set := make(map[uint32]bool, len(asns))
+	for _, a := range asns {
+		n, err := strconv.ParseUint(a, 10, 32)
+		if err == nil {
+			set[uint32(n)] = true
+		}
+	}
+	return set
+}
+
+func geoRadius(entries []config.GeoRadiusConfig) []common.GeoRadius {
+	out := make([]common.GeoRadius, 0, len(entries))
+	for _, e := range entries {
+		out = append(out, common.GeoRadius{Lat: e.Lat, Lon: e.Lon, RadiusKm: e.RadiusKm})
+	}
+	return out
+}
+
+// newBalancer returns the balancer over a server's backends, nil when it has
+// a single backendIP/backendPort.
+func newBalancer(c config.ServerConfig) *handler.Balancer {
+	if len(c.Backends) == 0 {
+		return nil
+	}
+	backends := make([]*handler.Backend, 0, len(c.Backends))
+	for _, b := range c.Backends {
+		backends = append(backends, &handler.Backend{Addr: b.IP, Port: b.Port, Weight: b.Weight})
+	}
+	return handler.NewBalancer(c.LoadBalancing, backends)
+}
+
+func lowerAll(entries []string) []string {
+	out := make([]string, 0, len(entries))
+	for _, e := range entries {
+		out = append(out, strings.ToLower(strings.TrimSpace(e)))
+	}
+	return out
+}
+
+// geoProvider returns the lookup backend selected by cfg.
+func (s *supervisor) geoProvider(cfg *config.Config, ipapiEndpoint string) (ipapi.IPAPI, error) {
+	switch cfg.GeoProvider {
+	case config.GeoProviderMMDB:
+		return s.mmdbProvider(cfg.MMDBPath, cfg.MMDBCheckInterval)
+	case config.GeoProviderChain:
+		return s.chainProvider(cfg, ipapiEndpoint)
+	default:
+		return s.ipapiProvider(ipapiEndpoint, cfg.APIKey, ipapi.IPCache), nil
+	}
+}
+
+// ipapiProvider builds an ip-api lookup. Free-endpoint clients share one rate
+// limiter so every server and reload draws from the same per-minute quota.
+func (s *supervisor) ipapiProvider(endpoint string, apiKey string, cache *lru.Cache[string, ipapi.Reply]) *ipapi.GetCountryCodeConfig {
+	var client ipapi.HTTPClient = &ipapi.RealHTTPClient{
+		Endpoint: endpoint,
+		APIKey:   apiKey,
+		Timeout:  s.opts.ipapiTimeout,
+	}
+	if apiKey == "" && s.rateLimiter != nil {
+		client = &ipapi.RateLimitedHTTPClient{Client: client, Limiter: s.rateLimiter, BatchLimiter: s.batchRateLimiter}
+	}
+	g := &ipapi.GetCountryCodeConfig{
+		HTTPClient:       client,
+		Cache:            cache,
+		MaxResponseBytes: s.opts.ipapiMaxBytes,
+		FailureTTL:       s.opts.ipapiFailureTTL,
+	}
+	if s.opts.coalesceAggregate {
+		g.CoalesceIPv4Bits = 24
+		g.CoalesceIPv6Bits = 64
+	}
+	if s.opts.ipapiBatchWindow > 0 {
+		// Clients without batch support fall back to single lookups.
+		if batcher, ok := client.(ipapi.BatchHTTPClient); ok {
+			g.Batcher = &ipapi.Batcher{
+				Client:           batcher,
+				Window:           s.opts.ipapiBatchWindow,
+				MaxResponseBytes: s.opts.ipapiMaxBytes,
 			}
-			trustedProxies = nil
+		} else {
+			s.deps.logger.Printf("ipapi client %T does not support batch lookups; -ipapi-batch-window ignored\n", client)
+		}
+	}
+	return g
+}
+
+// mmdbProvider reuses an already loaded database across reloads while its
+// settings are unchanged so the file isn't re-read.
+func (s *supervisor) mmdbProvider(path string, checkInterval time.Duration) (*ipapi.MMDBProvider, error) {
+	s.mmdbsUsed[path] = true
+	if p, ok := s.mmdbs[path]; ok && p.CheckInterval == checkInterval {
+		return p, nil
+	}
+	p, err := ipapi.NewMMDBProvider(path, checkInterval)
+	if err != nil {
+		return nil, err
+	}
+	s.mmdbs[path] = p
+	return p, nil
+}
+
+// withListFiles combines an inline alwaysAllowed/alwaysDenied list with the
+// list files and URLs at locations, loaded through ipList. Without locations
+// the inline list is returned as is.
+func withListFiles(inline *common.IPSet, locations []string, ipList func(string) (*iplist.Source, error)) (common.IPMatcher, error) {
+	if len(locations) == 0 {
+		return inline, nil
+	}
+	matchers := iplist.Union{inline}
+	for _, location := range locations {
+		src, err := ipList(location)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, src)
+	}
+	return matchers, nil
+}
+
+// ipList returns the list source for location, loading it on first use.
+func (s *supervisor) ipList(location string, refreshInterval time.Duration) (*iplist.Source, error) {
+	s.listsUsed[location] = true
+	if src, ok := s.lists[location]; ok && src.RefreshInterval == refreshInterval {
+		return src, nil
+	}
+	src, err := iplist.New(location, refreshInterval)
+	if err != nil {
+		return nil, err
+	}
+	s.deps.logger.Printf("loaded ip list %s (%d entries)", location, src.Len())
+	s.lists[location] = src
+	return src, nil
+}
+
+func (s *supervisor) chainProvider(cfg *config.Config, ipapiEndpoint string) (*ipapi.ChainProvider, error) {
+	freeEndpoint := ipapiEndpoint
+	if cfg.APIKey != "" {
+		freeEndpoint = "http://ip-api.com/json/"
+	}
+
+	chain := &ipapi.ChainProvider{
+		Mode:   ipapi.ChainMode(cfg.GeoChain.Mode),
+		Quorum: cfg.GeoChain.Quorum,
+	}
+	sharedCacheUsed := false
+	// Each ip-api provider needs its own cache; otherwise a cached failure from
+	// one would short-circuit the next one in the chain.
+	nextCache := func() (*lru.Cache[string, ipapi.Reply], error) {
+		if !sharedCacheUsed {
+			sharedCacheUsed = true
+			return ipapi.IPCache, nil
 		}
+		return lru.New[string, ipapi.Reply](s.opts.lruSize)
+	}
 
-		var startTime time.Time
-		var endTime time.Time
-		var startDate time.Time
-		var endDate time.Time
-		if c.StartDate != "" && c.EndDate != "" {
-			startDate, err = time.ParseInLocation("2006-01-02", c.StartDate, time.Local)
+	for i, pc := range cfg.GeoChain.Providers {
+		var p ipapi.IPAPI
+		switch pc.Type {
+		case config.GeoProviderMMDB:
+			m, err := s.mmdbProvider(pc.Path, pc.CheckInterval)
 			if err != nil {
-				return fmt.Errorf("failed to parse start date %s: %v", c.StartDate, err)
+				return nil, err
 			}
-			endDate, err = time.ParseInLocation("2006-01-02", c.EndDate, time.Local)
-			if err != nil {
-				return fmt.Errorf("failed to parse end date %s: %v", c.EndDate, err)
+			p = m
+		case config.GeoProviderStatic:
+			entries := make([]ipapi.StaticEntry, 0, len(pc.Entries))
+			for _, e := range pc.Entries {
+				entries = append(entries, ipapi.StaticEntry{CIDR: e.CIDR, Country: e.Country, Region: e.Region})
 			}
-		}
-		if c.StartTime != "" && c.EndTime != "" {
-			startTime, err = time.ParseInLocation("15:04", c.StartTime, time.Local)
+			st, err := ipapi.NewStaticProvider(entries)
 			if err != nil {
-				return fmt.Errorf("failed to parse start time %s: %v", c.StartTime, err)
+				return nil, err
 			}
-			endTime, err = time.ParseInLocation("15:04", c.EndTime, time.Local)
+			p = st
+		default:
+			cache, err := nextCache()
 			if err != nil {
-				return fmt.Errorf("failed to parse end time %s: %v", c.EndTime, err)
+				return nil, fmt.Errorf("failed to initialize IP cache: %v", err)
+			}
+			switch pc.Type {
+			case config.GeoProviderIPAPIPro:
+				p = s.ipapiProvider("https://pro.ip-api.com/json/", cfg.APIKey, cache)
+			case config.GeoProviderIPAPIFree:
+				p = s.ipapiProvider(freeEndpoint, "", cache)
+			default:
+				p = s.ipapiProvider(ipapiEndpoint, cfg.APIKey, cache)
 			}
 		}
-		daysOfWeek, err := parseDaysOfWeek(c.DaysOfWeek)
-		if err != nil {
-			return fmt.Errorf("failed to parse days of week %v: %v", c.DaysOfWeek, err)
-		}
-		s := server.ServerConfig{
-			ListenIP:          c.ListenIP,
-			ListenPort:        c.ListenPort,
-			BackendIP:         c.BackendIP,
-			BackendPort:       c.BackendPort,
-			NetListener:       &server.RealNetListener{},
-			RecvProxyProtocol: c.RecvProxyProtocol,
-			TrustedProxies:    trustedProxies,
-			MaxConns:          *maxConns,
-			ProxyProtoTimeout: *proxyProtoTimeout,
-			HandlerFactory: &server.HandlerFactory{
-				BackendDialer: &server.RealDialer{Timeout: *backendDialTimeout},
-				IPApiClient: &ipapi.GetCountryCodeConfig{
-					HTTPClient: &ipapi.RealHTTPClient{
-						Endpoint: ipapiEndpoint,
-						APIKey:   cfg.APIKey,
-						Timeout:  *ipapiTimeout,
-					},
-					Cache:            ipapi.IPCache,
-					MaxResponseBytes: *ipapiMaxBytes,
-					FailureTTL:       *ipapiFailureTTL,
-				},
-				AllowedCountries:     common.MakeNormalizedUpperSet(c.AllowedCountries),
-				AllowedRegions:       common.MakeNormalizedUpperSet(c.AllowedRegions),
-				DeniedCountries:      common.MakeNormalizedUpperSet(c.DeniedCountries),
-				DeniedRegions:        common.MakeNormalizedUpperSet(c.DeniedRegions),
-				AlwaysAllowed:        c.AlwaysAllowed,
-				AlwaysDenied:         c.AlwaysDenied,
-				CheckIps:             &common.CheckIPs{},
-				TransferFunc:         handler.TransferData,
-				BackendIP:            c.BackendIP,
-				BackendPort:          c.BackendPort,
-				SendProxyProtocol:    c.SendProxyProtocol,
-				ProxyProtocolVersion: c.ProxyProtocolVersion,
-				MaxConnLifetime:      *maxConnLifetime,
-				StartTime:            startTime,
-				EndTime:              endTime,
-				StartDate:            startDate,
-				EndDate:              endDate,
-				DaysOfWeek:           daysOfWeek,
-				IdleTimeout:          *idleTimeout,
-				ConnLimiter:          handler.NewPerIPConnLimiter(*maxConnsPerIP),
-			},
-		}
-		deps.startServer(s, &wg, ctx)
-	}
-	wg.Wait()
-	return nil
+		chain.Providers = append(chain.Providers, ipapi.NamedProvider{
+			Name:     fmt.Sprintf("%s[%d]", pc.Type, i),
+			Provider: p,
+		})
+	}
+	return chain, nil
+}
+
+func banPolicy(c config.BanConfig) ban.Policy {
+	return ban.Policy{
+		Duration:         c.Duration,
+		MaxRejections:    c.MaxRejections,
+		RejectionWindow:  c.RejectionWindow,
+		MaxConnections:   c.MaxConnections,
+		ConnectionWindow: c.ConnectionWindow,
+		IPv4Prefix:       c.IPv4Prefix,
+		IPv6Prefix:       c.IPv6Prefix,
+	}
+}
+
+func newConnLimiter(maxConnsPerIP int, aggregate bool) *handler.PerIPConnLimiter {
+	if aggregate {
+		return handler.NewPrefixConnLimiter(maxConnsPerIP, 24, 64)
+	}
+	return handler.NewPerIPConnLimiter(maxConnsPerIP)
 }
 
 func validateFreeIPAPIEndpoint(endpoint string) error {
@@ -3,25 +3,30 @@ package main
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"geoproxy/handler"
 	"geoproxy/ipapi"
+	"geoproxy/rules"
 	"geoproxy/server"
+
+	"github.com/hashicorp/golang-lru/v2"
 )
 
 type startCapture struct {
 	calls   int
-	configs []server.ServerConfig
+	configs []*server.ServerConfig
 }
 
-func (s *startCapture) start(cfg server.ServerConfig, wg *sync.WaitGroup, _ context.Context) {
+func (s *startCapture) start(cfg *server.ServerConfig, wg *sync.WaitGroup, _ context.Context) {
 	s.calls++
 	s.configs = append(s.configs, cfg)
 	wg.Done()
@@ -212,9 +217,13 @@ func TestRunDefaultIPAPIEndpointFreeAccount(t *testing.T) {
 	if !ok {
 		t.Fatalf("expected IPApiClient to be *ipapi.GetCountryCodeConfig, got %T", factory.IPApiClient)
 	}
-	realClient, ok := ipCfg.HTTPClient.(*ipapi.RealHTTPClient)
+	limited, ok := ipCfg.HTTPClient.(*ipapi.RateLimitedHTTPClient)
 	if !ok {
-		t.Fatalf("expected HTTPClient to be *ipapi.RealHTTPClient, got %T", ipCfg.HTTPClient)
+		t.Fatalf("expected HTTPClient to be *ipapi.RateLimitedHTTPClient, got %T", ipCfg.HTTPClient)
+	}
+	realClient, ok := limited.Client.(*ipapi.RealHTTPClient)
+	if !ok {
+		t.Fatalf("expected wrapped client to be *ipapi.RealHTTPClient, got %T", limited.Client)
 	}
 	if realClient.Endpoint != "http://ip-api.com/json/" {
 		t.Fatalf("unexpected default endpoint: %q", realClient.Endpoint)
@@ -328,6 +337,44 @@ func TestRunValidationErrors(t *testing.T) {
 `,
 			wantErr: "start date",
 		},
+		{
+			name: "invalid rule schedule",
+			content: `servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "8000"
+    backendIP: "127.0.0.1"
+    backendPort: "9000"
+    rules:
+      - action: allow
+        schedule: {daysOfWeek: ["Someday"]}
+`,
+			wantErr: "invalid rules",
+		},
+		{
+			name: "invalid exception",
+			content: `servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "8000"
+    backendIP: "127.0.0.1"
+    backendPort: "9000"
+    allowedCountries: ["US"]
+    exceptions: [{name: "Christmas", date: "2024-25-12"}]
+`,
+			wantErr: "invalid exceptions",
+		},
+		{
+			name: "missing mmdb file",
+			content: `geoProvider: "mmdb"
+mmdbPath: "/nonexistent/geoproxy-test.mmdb"
+servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "8000"
+    backendIP: "127.0.0.1"
+    backendPort: "9000"
+    allowedCountries: ["US"]
+`,
+			wantErr: "mmdb",
+		},
 		{
 			name: "recv proxy protocol requires trusted proxies",
 			content: `servers:
@@ -408,6 +455,132 @@ func TestRunDefaultTimeouts(t *testing.T) {
 	}
 }
 
+func TestRunConnLimitAggregate(t *testing.T) {
+	path := writeConfig(t, `servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "8012"
+    backendIP: "127.0.0.1"
+    backendPort: "9012"
+    allowedCountries: ["US"]
+`)
+	capture := &startCapture{}
+	err := run([]string{"-config", path, "-max-conns-per-ip", "1", "-conn-limit-aggregate"}, runDeps{
+		logger:      log.New(io.Discard, "", 0),
+		flagOutput:  io.Discard,
+		startServer: capture.start,
+	})
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	factory := capture.configs[0].HandlerFactory.(*server.HandlerFactory)
+	limiter, ok := factory.ConnLimiter.(*handler.PerIPConnLimiter)
+	if !ok {
+		t.Fatalf("expected ConnLimiter to be *handler.PerIPConnLimiter, got %T", factory.ConnLimiter)
+	}
+	if !limiter.Acquire("1.2.3.4") {
+		t.Fatal("expected first acquire to succeed")
+	}
+	if limiter.Acquire("1.2.3.5") {
+		t.Fatal("expected acquire from the same /24 to fail")
+	}
+	limiter.Release("1.2.3.4")
+}
+
+func TestRunGeoChain(t *testing.T) {
+	path := writeConfig(t, `apiKey: "abc"
+geoProvider: "chain"
+geoChain:
+  mode: "fallback"
+  providers:
+    - type: "static"
+      entries:
+        - cidr: "10.0.0.0/8"
+          country: "US"
+    - type: "ipapi-pro"
+    - type: "ipapi-free"
+servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "8013"
+    backendIP: "127.0.0.1"
+    backendPort: "9013"
+    allowedCountries: ["US"]
+`)
+	capture := &startCapture{}
+	err := run([]string{"-config", path}, runDeps{
+		logger:      log.New(io.Discard, "", 0),
+		flagOutput:  io.Discard,
+		startServer: capture.start,
+	})
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	factory := capture.configs[0].HandlerFactory.(*server.HandlerFactory)
+	chain, ok := factory.IPApiClient.(*ipapi.ChainProvider)
+	if !ok {
+		t.Fatalf("expected IPApiClient to be *ipapi.ChainProvider, got %T", factory.IPApiClient)
+	}
+	if chain.Mode != ipapi.ChainFallback || len(chain.Providers) != 3 {
+		t.Fatalf("unexpected chain: mode=%s providers=%d", chain.Mode, len(chain.Providers))
+	}
+	if _, ok := chain.Providers[0].Provider.(*ipapi.StaticProvider); !ok {
+		t.Fatalf("expected static provider first, got %T", chain.Providers[0].Provider)
+	}
+	pro := chain.Providers[1].Provider.(*ipapi.GetCountryCodeConfig)
+	free := chain.Providers[2].Provider.(*ipapi.GetCountryCodeConfig)
+	if got := pro.HTTPClient.(*ipapi.RealHTTPClient); got.Endpoint != "https://pro.ip-api.com/json/" || got.APIKey != "abc" {
+		t.Fatalf("unexpected pro client: %+v", got)
+	}
+	if got := free.HTTPClient.(*ipapi.RateLimitedHTTPClient).Client.(*ipapi.RealHTTPClient); got.Endpoint != "http://ip-api.com/json/" || got.APIKey != "" {
+		t.Fatalf("unexpected free client: %+v", got)
+	}
+	if pro.Cache == free.Cache {
+		t.Fatal("expected ip-api providers in a chain to use separate caches")
+	}
+}
+
+func TestRunPersistsIPCache(t *testing.T) {
+	cacheFile := filepath.Join(t.TempDir(), "ipcache.json")
+	saved, err := lru.New[string, ipapi.Reply](4)
+	if err != nil {
+		t.Fatalf("new cache: %v", err)
+	}
+	saved.Add("1.2.3.4", ipapi.Reply{CountryCode: "US", ExpiresAt: time.Now().Add(time.Hour)})
+	if err := ipapi.SaveCache(cacheFile, saved); err != nil {
+		t.Fatalf("write cache: %v", err)
+	}
+	path := writeConfig(t, `cacheFile: "`+cacheFile+`"
+servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "8014"
+    backendIP: "127.0.0.1"
+    backendPort: "9014"
+    allowedCountries: ["US"]
+`)
+	loaded := 0
+	err = run([]string{"-config", path}, runDeps{
+		logger:     log.New(io.Discard, "", 0),
+		flagOutput: io.Discard,
+		startServer: func(s *server.ServerConfig, wg *sync.WaitGroup, _ context.Context) {
+			loaded = ipapi.IPCache.Len()
+			ipapi.IPCache.Add("5.6.7.8", ipapi.Reply{CountryCode: "DE", ExpiresAt: time.Now().Add(time.Hour)})
+			wg.Done()
+		},
+	})
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if loaded != 1 {
+		t.Fatalf("expected 1 cache entry loaded at startup, got %d", loaded)
+	}
+	data, err := os.ReadFile(cacheFile)
+	if err != nil {
+		t.Fatalf("read cache: %v", err)
+	}
+	if !bytes.Contains(data, []byte("5.6.7.8")) || !bytes.Contains(data, []byte("1.2.3.4")) {
+		t.Fatalf("expected shutdown snapshot to contain both entries, got %s", data)
+	}
+}
+
 func TestRunRejectsIPAPIWithoutScheme(t *testing.T) {
 	path := writeConfig(t, `servers:
   - listenIP: "127.0.0.1"
@@ -426,3 +599,609 @@ func TestRunRejectsIPAPIWithoutScheme(t *testing.T) {
 		t.Fatalf("expected error")
 	}
 }
+
+func TestRunIPAPIRateLimitFlag(t *testing.T) {
+	path := writeConfig(t, `servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "8002"
+    backendIP: "127.0.0.1"
+    backendPort: "9002"
+    allowedCountries: ["US"]
+`)
+
+	capture := &startCapture{}
+	err := run([]string{"-config", path, "-ipapi-rate", "0"}, runDeps{
+		logger:      log.New(io.Discard, "", 0),
+		flagOutput:  io.Discard,
+		startServer: capture.start,
+	})
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	factory := capture.configs[0].HandlerFactory.(*server.HandlerFactory)
+	ipCfg := factory.IPApiClient.(*ipapi.GetCountryCodeConfig)
+	if _, ok := ipCfg.HTTPClient.(*ipapi.RealHTTPClient); !ok {
+		t.Fatalf("expected -ipapi-rate 0 to disable rate limiting, got %T", ipCfg.HTTPClient)
+	}
+
+	err = run([]string{"-config", path, "-ipapi-rate", "-1"}, runDeps{
+		logger:      log.New(io.Discard, "", 0),
+		flagOutput:  io.Discard,
+		startServer: capture.start,
+	})
+	if err == nil {
+		t.Fatalf("expected error for negative -ipapi-rate")
+	}
+}
+
+func TestRunIPAPIBatchWindow(t *testing.T) {
+	path := writeConfig(t, `servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "8002"
+    backendIP: "127.0.0.1"
+    backendPort: "9002"
+    allowedCountries: ["US"]
+`)
+
+	capture := &startCapture{}
+	err := run([]string{"-config", path, "-ipapi-batch-window", "50ms"}, runDeps{
+		logger:      log.New(io.Discard, "", 0),
+		flagOutput:  io.Discard,
+		startServer: capture.start,
+	})
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	factory := capture.configs[0].HandlerFactory.(*server.HandlerFactory)
+	ipCfg := factory.IPApiClient.(*ipapi.GetCountryCodeConfig)
+	if ipCfg.Batcher == nil || ipCfg.Batcher.Window != 50*time.Millisecond {
+		t.Fatalf("expected a 50ms batcher, got %+v", ipCfg.Batcher)
+	}
+	if _, ok := ipCfg.Batcher.Client.(*ipapi.RateLimitedHTTPClient); !ok {
+		t.Fatalf("expected batch requests to be rate limited, got %T", ipCfg.Batcher.Client)
+	}
+}
+
+func TestRunAccessLog(t *testing.T) {
+	path := writeConfig(t, `servers:
+  - name: "web"
+    listenIP: "127.0.0.1"
+    listenPort: "8002"
+    backendIP: "127.0.0.1"
+    backendPort: "9002"
+    allowedCountries: ["US"]
+`)
+	logPath := filepath.Join(t.TempDir(), "access.log")
+
+	capture := &startCapture{}
+	err := run([]string{"-config", path, "-access-log", logPath, "-access-log-format", "logfmt"}, runDeps{
+		logger:      log.New(io.Discard, "", 0),
+		flagOutput:  io.Discard,
+		startServer: capture.start,
+	})
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	factory := capture.configs[0].HandlerFactory.(*server.HandlerFactory)
+	if factory.AccessLog == nil {
+		t.Fatalf("expected access log to be configured")
+	}
+	if factory.ServerName != "web" || factory.ListenAddr != "127.0.0.1:8002" {
+		t.Fatalf("unexpected server labels: %q %q", factory.ServerName, factory.ListenAddr)
+	}
+	if _, err := os.Stat(logPath); err != nil {
+		t.Fatalf("expected access log file to be created: %v", err)
+	}
+
+	err = run([]string{"-config", path, "-access-log", logPath, "-access-log-format", "xml"}, runDeps{
+		logger:      log.New(io.Discard, "", 0),
+		flagOutput:  io.Discard,
+		startServer: capture.start,
+	})
+	if err == nil {
+		t.Fatalf("expected error for unknown access log format")
+	}
+}
+
+func TestRunAdminListen(t *testing.T) {
+	path := writeConfig(t, `servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "8002"
+    backendIP: "127.0.0.1"
+    backendPort: "9002"
+    allowedCountries: ["US"]
+`)
+
+	capture := &startCapture{}
+	err := run([]string{"-config", path, "-admin-listen", "127.0.0.1:0"}, runDeps{
+		logger:      log.New(io.Discard, "", 0),
+		flagOutput:  io.Discard,
+		startServer: capture.start,
+	})
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	factory := capture.configs[0].HandlerFactory.(*server.HandlerFactory)
+	if factory.Conns == nil || factory.TempRules == nil {
+		t.Fatalf("expected connection registry and temporary rules to be configured")
+	}
+
+	err = run([]string{"-config", path, "-admin-listen", "0.0.0.0:0"}, runDeps{
+		logger:      log.New(io.Discard, "", 0),
+		flagOutput:  io.Discard,
+		startServer: capture.start,
+	})
+	if err == nil {
+		t.Fatalf("expected non-loopback admin address to be refused")
+	}
+}
+
+func TestRunBanList(t *testing.T) {
+	dir := t.TempDir()
+	banFile := filepath.Join(dir, "bans.json")
+	expires := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	if err := os.WriteFile(banFile, []byte(`{"bans":[{"key":"203.0.113.0/24","reason":"test","expiresAt":"`+expires+`"}]}`), 0o600); err != nil {
+		t.Fatalf("write ban file: %v", err)
+	}
+	path := writeConfig(t, `ban:
+  maxRejections: 5
+  ipv4Prefix: 24
+  file: "`+banFile+`"
+servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "8003"
+    backendIP: "127.0.0.1"
+    backendPort: "9003"
+    allowedCountries: ["US"]
+`)
+
+	capture := &startCapture{}
+	err := run([]string{"-config", path}, runDeps{
+		logger:      log.New(io.Discard, "", 0),
+		flagOutput:  io.Discard,
+		startServer: capture.start,
+	})
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	factory := capture.configs[0].HandlerFactory.(*server.HandlerFactory)
+	if factory.Bans == nil {
+		t.Fatalf("expected ban list to be configured")
+	}
+	if !factory.Bans.Banned("203.0.113.7") {
+		t.Fatalf("expected ban loaded from %s to apply", banFile)
+	}
+}
+
+func TestRunCompilesIPLists(t *testing.T) {
+	path := writeConfig(t, `servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "8004"
+    backendIP: "127.0.0.1"
+    backendPort: "9004"
+    allowedCountries: ["US"]
+    alwaysAllowed: ["192.0.2.0/24"]
+    alwaysDenied: ["2001:db8::/32"]
+`)
+
+	capture := &startCapture{}
+	err := run([]string{"-config", path}, runDeps{
+		logger:      log.New(io.Discard, "", 0),
+		flagOutput:  io.Discard,
+		startServer: capture.start,
+	})
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	factory := capture.configs[0].HandlerFactory.(*server.HandlerFactory)
+	if factory.AlwaysAllowedSet == nil || !factory.AlwaysAllowedSet.Contains("::ffff:192.0.2.9") {
+		t.Fatalf("expected alwaysAllowed to be compiled")
+	}
+	if factory.AlwaysDeniedSet == nil || !factory.AlwaysDeniedSet.Contains("2001:db8::1") {
+		t.Fatalf("expected alwaysDenied to be compiled")
+	}
+	if factory.LookupFailureAllowedSet == nil || factory.LookupFailureAllowedSet.Contains("192.0.2.9") {
+		t.Fatalf("expected an empty lookupFailureAllowed set")
+	}
+}
+
+func TestRunListFiles(t *testing.T) {
+	dir := t.TempDir()
+	denyFile := filepath.Join(dir, "deny.txt")
+	if err := os.WriteFile(denyFile, []byte("; corporate blocklist\n203.0.113.0/24 ; abuse\n"), 0o600); err != nil {
+		t.Fatalf("write list: %v", err)
+	}
+	path := writeConfig(t, `servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "8005"
+    backendIP: "127.0.0.1"
+    backendPort: "9005"
+    allowedCountries: ["US"]
+    alwaysDenied: ["198.51.100.1"]
+    alwaysDeniedFiles: ["`+denyFile+`"]
+`)
+
+	capture := &startCapture{}
+	err := run([]string{"-config", path}, runDeps{
+		logger:      log.New(io.Discard, "", 0),
+		flagOutput:  io.Discard,
+		startServer: capture.start,
+	})
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	factory := capture.configs[0].HandlerFactory.(*server.HandlerFactory)
+	if !factory.AlwaysDeniedSet.Contains("203.0.113.5") || !factory.AlwaysDeniedSet.Contains("198.51.100.1") {
+		t.Fatalf("expected inline and file entries to be denied")
+	}
+
+	// A list that fails to load at startup is a configuration error.
+	if err := os.WriteFile(denyFile, []byte("bogus\n"), 0o600); err != nil {
+		t.Fatalf("write list: %v", err)
+	}
+	err = run([]string{"-config", path}, runDeps{
+		logger:      log.New(io.Discard, "", 0),
+		flagOutput:  io.Discard,
+		startServer: capture.start,
+	})
+	if err == nil {
+		t.Fatalf("expected invalid list file to be rejected")
+	}
+}
+
+func TestRunNetworkRules(t *testing.T) {
+	path := writeConfig(t, `servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "8006"
+    backendIP: "127.0.0.1"
+    backendPort: "9006"
+    allowedCountries: ["US"]
+    deniedASNs: ["AS14061", "16276"]
+    allowedOrgs: [" Google "]
+    denyHosting: true
+    denyProxy: true
+    allowedCities: ["Portland, US"]
+    allowedRadius: [{lat: 47.6062, lon: -122.3321, radiusKm: 50}]
+`)
+
+	capture := &startCapture{}
+	err := run([]string{"-config", path}, runDeps{
+		logger:      log.New(io.Discard, "", 0),
+		flagOutput:  io.Discard,
+		startServer: capture.start,
+	})
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	factory := capture.configs[0].HandlerFactory.(*server.HandlerFactory)
+	if !factory.DeniedASNs[14061] || !factory.DeniedASNs[16276] || len(factory.DeniedASNs) != 2 {
+		t.Fatalf("unexpected deniedASNs: %v", factory.DeniedASNs)
+	}
+	if factory.AllowedASNs != nil {
+		t.Fatalf("expected no allowedASNs, got %v", factory.AllowedASNs)
+	}
+	if len(factory.AllowedOrgs) != 1 || factory.AllowedOrgs[0] != "google" {
+		t.Fatalf("unexpected allowedOrgs: %q", factory.AllowedOrgs)
+	}
+	if !factory.DenyHosting || !factory.DenyProxy || factory.DenyMobile {
+		t.Fatalf("unexpected deny flags: hosting=%v proxy=%v mobile=%v", factory.DenyHosting, factory.DenyProxy, factory.DenyMobile)
+	}
+	if !factory.AllowedCities["portland,us"] || len(factory.AllowedRadius) != 1 || factory.AllowedRadius[0].RadiusKm != 50 {
+		t.Fatalf("unexpected location rules: %v %v", factory.AllowedCities, factory.AllowedRadius)
+	}
+}
+
+func TestRunTorExitList(t *testing.T) {
+	exits := filepath.Join(t.TempDir(), "torbulkexitlist")
+	if err := os.WriteFile(exits, []byte("185.220.101.1\n185.220.101.2\n"), 0o600); err != nil {
+		t.Fatalf("write list: %v", err)
+	}
+	path := writeConfig(t, `torExitList: "`+exits+`"
+servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "8007"
+    backendIP: "127.0.0.1"
+    backendPort: "9007"
+    allowedCountries: ["US"]
+    denyTor: true
+  - listenIP: "127.0.0.1"
+    listenPort: "8008"
+    backendIP: "127.0.0.1"
+    backendPort: "9008"
+    allowedCountries: ["US"]
+`)
+
+	capture := &startCapture{}
+	err := run([]string{"-config", path}, runDeps{
+		logger:      log.New(io.Discard, "", 0),
+		flagOutput:  io.Discard,
+		startServer: capture.start,
+	})
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	for _, cfg := range capture.configs {
+		factory := cfg.HandlerFactory.(*server.HandlerFactory)
+		if cfg.ListenPort == "8007" {
+			if !factory.DenyTor || factory.TorExits == nil || !factory.TorExits.Contains("185.220.101.2") {
+				t.Fatalf("expected the Tor exit list on the denyTor server")
+			}
+		} else if factory.DenyTor {
+			t.Fatalf("unexpected denyTor on %s", cfg.ListenPort)
+		}
+	}
+
+	if err := os.Remove(exits); err != nil {
+		t.Fatalf("remove list: %v", err)
+	}
+	err = run([]string{"-config", path}, runDeps{
+		logger:      log.New(io.Discard, "", 0),
+		flagOutput:  io.Discard,
+		startServer: capture.start,
+	})
+	if err == nil {
+		t.Fatalf("expected a missing Tor exit list to be rejected")
+	}
+}
+
+func TestRunRules(t *testing.T) {
+	path := writeConfig(t, `servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "8009"
+    backendIP: "127.0.0.1"
+    backendPort: "9009"
+    rules:
+      - action: allow
+        tag: de-weekdays
+        countries: ["de"]
+        schedule:
+          daysOfWeek: ["Mon", "Tue", "Wed", "Thu", "Fri"]
+          startTime: "08:00"
+          endTime: "18:00"
+      - action: allow
+        countries: ["US"]
+    defaultAction: deny
+  - listenIP: "127.0.0.1"
+    listenPort: "8010"
+    backendIP: "127.0.0.1"
+    backendPort: "9010"
+    allowedCountries: ["US"]
+    daysOfWeek: ["Sat"]
+`)
+
+	capture := &startCapture{}
+	err := run([]string{"-config", path}, runDeps{
+		logger:      log.New(io.Discard, "", 0),
+		flagOutput:  io.Discard,
+		startServer: capture.start,
+	})
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	for _, cfg := range capture.configs {
+		set := cfg.HandlerFactory.(*server.HandlerFactory).Rules
+		if set == nil {
+			t.Fatalf("expected rules on %s", cfg.ListenPort)
+		}
+		if cfg.ListenPort == "8009" {
+			if len(set.Rules) != 2 || set.Default != rules.Deny {
+				t.Fatalf("unexpected rules: %+v", set)
+			}
+			r := set.Rules[0]
+			if r.Action != rules.Allow || r.Tag != "de-weekdays" || !r.Countries["DE"] || r.Schedule == nil || !r.Schedule.Windows[0].DaysOfWeek[time.Friday] || r.Schedule.Windows[0].StartTime.Hour() != 8 {
+				t.Fatalf("unexpected first rule: %+v", r)
+			}
+			continue
+		}
+		// Legacy fields: deny outside daysOfWeek, then allow US.
+		if len(set.Rules) != 2 || set.Rules[0].Tag != rules.ReasonDay || !set.Rules[1].Countries["US"] {
+			t.Fatalf("unexpected legacy rules: %+v", set.Rules)
+		}
+	}
+}
+
+func TestRunSchedulesTimezone(t *testing.T) {
+	path := writeConfig(t, `servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "8011"
+    backendIP: "127.0.0.1"
+    backendPort: "9011"
+    allowedCountries: ["DE"]
+    timezone: "Europe/Berlin"
+    schedules:
+      - daysOfWeek: ["Mon", "Tue", "Wed", "Thu", "Fri"]
+        startTime: "08:00"
+        endTime: "18:00"
+      - daysOfWeek: ["Sat"]
+        startTime: "10:00"
+        endTime: "12:00"
+`)
+
+	capture := &startCapture{}
+	err := run([]string{"-config", path}, runDeps{
+		logger:      log.New(io.Discard, "", 0),
+		flagOutput:  io.Discard,
+		startServer: capture.start,
+	})
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	set := capture.configs[0].HandlerFactory.(*server.HandlerFactory).Rules
+	if len(set.Rules) != 2 || set.Rules[0].Tag != rules.ReasonSchedule {
+		t.Fatalf("unexpected rules: %+v", set.Rules)
+	}
+	schedule := set.Rules[0].Schedule
+	if schedule.Location == nil || schedule.Location.String() != "Europe/Berlin" || len(schedule.Windows) != 2 {
+		t.Fatalf("unexpected schedule: %+v", schedule)
+	}
+	// 06:30 UTC on a summer Monday is 08:30 in Berlin.
+	if !schedule.Active(time.Date(2024, 7, 15, 6, 30, 0, 0, time.UTC)) {
+		t.Fatalf("expected the schedule to follow Berlin time")
+	}
+
+	path = writeConfig(t, `servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "8011"
+    backendIP: "127.0.0.1"
+    backendPort: "9011"
+    allowedCountries: ["US"]
+    timezone: client
+    startTime: "09:00"
+    endTime: "17:00"
+`)
+	capture = &startCapture{}
+	err = run([]string{"-config", path}, runDeps{
+		logger:      log.New(io.Discard, "", 0),
+		flagOutput:  io.Discard,
+		startServer: capture.start,
+	})
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	schedule = capture.configs[0].HandlerFactory.(*server.HandlerFactory).Rules.Rules[0].Schedule
+	if !schedule.ClientZone {
+		t.Fatalf("expected the schedule to use the client's zone: %+v", schedule)
+	}
+	// 14:00 UTC is 10:00 in New York and 23:00 in Tokyo.
+	now := time.Date(2024, 7, 15, 14, 0, 0, 0, time.UTC)
+	if !schedule.ActiveIn(now, "America/New_York") || schedule.ActiveIn(now, "Asia/Tokyo") {
+		t.Fatalf("expected the schedule to follow the client's zone")
+	}
+
+	path = writeConfig(t, `servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "8011"
+    backendIP: "127.0.0.1"
+    backendPort: "9011"
+    allowedCountries: ["DE"]
+    schedules: [{daysOfWeek: ["Someday"]}]
+`)
+	err = run([]string{"-config", path}, runDeps{
+		logger:      log.New(io.Discard, "", 0),
+		flagOutput:  io.Discard,
+		startServer: capture.start,
+	})
+	if err == nil {
+		t.Fatalf("expected an invalid schedule to be rejected")
+	}
+}
+
+func TestRunCalendar(t *testing.T) {
+	ics := filepath.Join(t.TempDir(), "holidays.ics")
+	if err := os.WriteFile(ics, []byte("BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\n"+
+		"DTSTART;VALUE=DATE:20001226\r\nRRULE:FREQ=YEARLY\r\nSUMMARY:Boxing Day\r\n"+
+		"END:VEVENT\r\nEND:VCALENDAR\r\n"), 0o600); err != nil {
+		t.Fatalf("write ics: %v", err)
+	}
+	path := writeConfig(t, `servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "8012"
+    backendIP: "127.0.0.1"
+    backendPort: "9012"
+    allowedCountries: ["GB"]
+    timezone: "Europe/London"
+    exceptions:
+      - name: "Christmas"
+        date: "2024-12-25"
+      - name: "Maintenance"
+        start: "2024-06-03 02:00"
+        end: "2024-06-03 06:00"
+    calendarFiles: ["`+ics+`"]
+`)
+
+	capture := &startCapture{}
+	err := run([]string{"-config", path}, runDeps{
+		logger:      log.New(io.Discard, "", 0),
+		flagOutput:  io.Discard,
+		startServer: capture.start,
+	})
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	cal := capture.configs[0].HandlerFactory.(*server.HandlerFactory).Rules.Calendar
+	if cal == nil || len(cal.Events) != 3 || cal.Location.String() != "Europe/London" {
+		t.Fatalf("unexpected calendar: %+v", cal)
+	}
+	tests := []struct {
+		now  time.Time
+		want string
+	}{
+		{time.Date(2024, 12, 25, 9, 0, 0, 0, time.UTC), "Christmas"},
+		{time.Date(2025, 12, 26, 9, 0, 0, 0, time.UTC), "Boxing Day"},
+		// 02:30 BST is 01:30 UTC.
+		{time.Date(2024, 6, 3, 1, 30, 0, 0, time.UTC), "Maintenance"},
+		{time.Date(2024, 6, 3, 5, 30, 0, 0, time.UTC), ""},
+	}
+	for _, tc := range tests {
+		e := cal.Active(tc.now, "")
+		if (e == nil) != (tc.want == "") || (e != nil && e.Name != tc.want) {
+			t.Fatalf("Active(%v) = %+v, want %q", tc.now, e, tc.want)
+		}
+	}
+
+	if err := os.Remove(ics); err != nil {
+		t.Fatalf("remove ics: %v", err)
+	}
+	err = run([]string{"-config", path}, runDeps{
+		logger:      log.New(io.Discard, "", 0),
+		flagOutput:  io.Discard,
+		startServer: capture.start,
+	})
+	if err == nil || !strings.Contains(err.Error(), "calendarFiles") {
+		t.Fatalf("expected a missing calendar file to fail, got %v", err)
+	}
+}
+
+func TestRunBackends(t *testing.T) {
+	path := writeConfig(t, `servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "8013"
+    allowedCountries: ["US"]
+    loadBalancing: "source-ip-hash"
+    backends:
+      - ip: "10.0.0.1"
+        port: "22"
+        weight: 2
+      - ip: "10.0.0.2"
+        port: "22"
+      - ip: "10.0.0.3"
+        port: "2222"
+  - listenIP: "127.0.0.1"
+    listenPort: "8014"
+    backendIP: "127.0.0.1"
+    backendPort: "9014"
+    allowedCountries: ["US"]
+`)
+
+	capture := &startCapture{}
+	err := run([]string{"-config", path}, runDeps{
+		logger:      log.New(io.Discard, "", 0),
+		flagOutput:  io.Discard,
+		startServer: capture.start,
+	})
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	balancer := capture.configs[0].HandlerFactory.(*server.HandlerFactory).Balancer
+	if balancer == nil {
+		t.Fatalf("expected a balancer")
+	}
+	var got []string
+	for _, b := range balancer.Backends() {
+		got = append(got, fmt.Sprintf("%s weight %d", b.Address(), b.Weight))
+	}
+	want := []string{"10.0.0.1:22 weight 2", "10.0.0.2:22 weight 1", "10.0.0.3:2222 weight 1"}
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Fatalf("backends = %v, want %v", got, want)
+	}
+	// source-ip-hash keeps a client on one backend.
+	first := balancer.Order("198.51.100.7")[0]
+	for range 5 {
+		if b := balancer.Order("198.51.100.7")[0]; b != first {
+			t.Fatalf("client moved from %s to %s", first.Address(), b.Address())
+		}
+	}
+	if b := capture.configs[1].HandlerFactory.(*server.HandlerFactory).Balancer; b != nil {
+		t.Fatalf("unexpected balancer for a single backend: %+v", b)
+	}
+}
@@ -0,0 +1,36 @@
+package metrics
+
+// GeoProxy's metrics. The server label is the server's configured name, or its
+// listener address (ip:port) when it has none.
+var (
+	ConnectionsAccepted = Default.NewCounterVec("geoproxy_connections_accepted_total",
+		"Client connections accepted and proxied to the backend.", "server")
+	ConnectionsRejected = Default.NewCounterVec("geoproxy_connections_rejected_total",
+		"Client connections rejected, by deny reason.", "server", "reason")
+	ActiveConnections = Default.NewGaugeVec("geoproxy_active_connections",
+		"Connections currently being proxied.", "server")
+	MaxConnsInUse = Default.NewGaugeVec("geoproxy_max_conns_in_use",
+		"Slots of the -max-conns semaphore currently taken.", "server")
+	MaxConnsLimit = Default.NewGaugeVec("geoproxy_max_conns_limit",
+		"Size of the -max-conns semaphore (0 means unlimited).", "server")
+	BackendDialFailures = Default.NewCounterVec("geoproxy_backend_dial_failures_total",
+		"Failed dials to the backend.", "server")
+	BytesTransferred = Default.NewCounterVec("geoproxy_bytes_total",
+		"Bytes proxied, by direction (client_to_backend or backend_to_client).", "server", "direction")
+	ScheduleClosures = Default.NewCounterVec("geoproxy_schedule_closures_total",
+		"Established connections closed because their schedule ended (enforceScheduleOnActive).", "server")
+
+	IPCacheLookups = Default.NewCounterVec("geoproxy_ipapi_cache_lookups_total",
+		"ip-api cache lookups by result (hit, miss, cached_failure, coalesced).", "result")
+	IPAPIRequestDuration = Default.NewHistogram("geoproxy_ipapi_request_duration_seconds",
+		"Latency of ip-api HTTP requests, including batch requests.",
+		[]float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10})
+	IPAPIErrors = Default.NewCounterVec("geoproxy_ipapi_errors_total",
+		"Failed ip-api lookups by kind (error or rate_limited).", "kind")
+)
+
+// Directions for BytesTransferred.
+const (
+	ClientToBackend = "client_to_backend"
+	BackendToClient = "backend_to_client"
+)
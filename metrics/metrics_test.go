@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func scrape(t *testing.T, r *Registry) string {
+	t.Helper()
+	var b strings.Builder
+	if err := r.WriteText(&b); err != nil {
+		t.Fatalf("WriteText: %v", err)
+	}
+	return b.String()
+}
+
+func TestRegistryWriteText(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("test_requests_total", "Requests.", "server", "reason")
+	g := r.NewGaugeVec("test_active", "Active.", "server")
+	h := r.NewHistogram("test_latency_seconds", "Latency.", []float64{0.5, 0.1})
+
+	c.With("b:1", "denied").Add(2)
+	c.With("a:1", `say "hi"`).Inc()
+	g.With("a:1").Inc()
+	g.With("a:1").Inc()
+	g.With("a:1").Dec()
+	h.Observe(0.05)
+	h.Observe(0.3)
+	h.Observe(2)
+
+	want := `# HELP test_requests_total Requests.
+# TYPE test_requests_total counter
+test_requests_total{server="a:1",reason="say \"hi\""} 1
+test_requests_total{server="b:1",reason="denied"} 2
+# HELP test_active Active.
+# TYPE test_active gauge
+test_active{server="a:1"} 1
+# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{le="0.1"} 1
+test_latency_seconds_bucket{le="0.5"} 2
+test_latency_seconds_bucket{le="+Inf"} 3
+test_latency_seconds_sum 2.35
+test_latency_seconds_count 3
+`
+	assert.Equal(t, want, scrape(t, r))
+}
+
+func TestCounterVecWrongLabelCount(t *testing.T) {
+	c := NewRegistry().NewCounterVec("x_total", "X.", "a")
+	assert.Panics(t, func() { c.With("1", "2") })
+}
+
+func TestServe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	IPCacheLookups.With("hit").Inc()
+
+	addr, err := Serve(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Serve: %v", err)
+	}
+	resp, err := http.Get("http://" + addr.String() + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Content-Type"), "text/plain")
+	assert.Contains(t, string(body), "# TYPE geoproxy_connections_accepted_total counter")
+	assert.Contains(t, string(body), `geoproxy_ipapi_cache_lookups_total{result="hit"}`)
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"geoproxy/common"
+	"geoproxy/config"
+	"geoproxy/ipapi"
+	"geoproxy/iplist"
+	"geoproxy/server"
+)
+
+// managedServer is one running listener owned by the supervisor.
+type managedServer struct {
+	key    string
+	cfg    config.ServerConfig
+	server *server.ServerConfig
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// supervisor starts the configured listeners and applies configuration reloads
+// to them. Listeners whose address and PROXY protocol settings are unchanged keep
+// running and only get new rules; established sessions are never interrupted.
+type supervisor struct {
+	ctx     context.Context
+	deps    runDeps
+	opts    runOptions
+	servers map[string]*managedServer
+	exited  chan *managedServer
+	quit    chan struct{}
+	mmdbs   map[string]*ipapi.MMDBProvider
+	// lists are the alwaysAllowedFiles/alwaysDeniedFiles sources by location,
+	// kept across reloads so they don't have to be fetched again.
+	lists map[string]*iplist.Source
+	// mmdbsUsed and listsUsed record which mmdbs and lists the configuration
+	// being applied uses, so that apply can drop the others.
+	mmdbsUsed map[string]bool
+	listsUsed map[string]bool
+
+	// active is the server list from the last applied configuration, for the
+	// admin API.
+	activeMu sync.Mutex
+	active   []config.ServerConfig
+
+	rateLimiter      *ipapi.RateLimiter
+	batchRateLimiter *ipapi.RateLimiter
+
+	configMod  time.Time
+	configSize int64
+}
+
+// freeBatchRate is the free ip-api quota for POST /batch, in requests per
+// minute. It is separate from the per-IP lookup quota.
+const freeBatchRate = 15
+
+func newSupervisor(ctx context.Context, deps runDeps, opts runOptions) *supervisor {
+	s := &supervisor{
+		ctx:     ctx,
+		deps:    deps,
+		opts:    opts,
+		servers: make(map[string]*managedServer),
+		exited:  make(chan *managedServer),
+		quit:    make(chan struct{}),
+		mmdbs:   make(map[string]*ipapi.MMDBProvider),
+		lists:   make(map[string]*iplist.Source),
+
+		mmdbsUsed: make(map[string]bool),
+		listsUsed: make(map[string]bool),
+	}
+	if opts.ipapiRate > 0 {
+		s.rateLimiter = ipapi.NewRateLimiter(opts.ipapiRate, opts.ipapiMaxWait)
+		s.batchRateLimiter = ipapi.NewRateLimiter(freeBatchRate, opts.ipapiMaxWait)
+	}
+	s.configMod, s.configSize = statConfig(opts.configFile)
+	return s
+}
+
+func serverKey(c config.ServerConfig) string {
+	return fmt.Sprintf("%s:%s", c.ListenIP, c.ListenPort)
+}
+
+// serverName is how a server is labelled in metrics and access logs.
+func serverName(c config.ServerConfig) string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return serverKey(c)
+}
+
+// sameListener reports whether two server blocks can share a listener, i.e. only
+// their per-connection rules differ.
+func sameListener(a, b config.ServerConfig) bool {
+	// The name labels the listener's own metrics, so a rename restarts it.
+	return a.Name == b.Name &&
+		a.ListenIP == b.ListenIP &&
+		a.ListenPort == b.ListenPort &&
+		a.RecvProxyProtocol == b.RecvProxyProtocol &&
+		reflect.DeepEqual(a.TrustedProxies, b.TrustedProxies)
+}
+
+// apply brings the running listeners in line with cfg. Every server block is
+// built before anything is touched, so an invalid configuration leaves the
+// current listeners as they are.
+func (s *supervisor) apply(cfg *config.Config, ipapiEndpoint string) error {
+	clear(s.mmdbsUsed)
+	clear(s.listsUsed)
+	geo, err := s.geoProvider(cfg, ipapiEndpoint)
+	if err != nil {
+		return err
+	}
+	ipList := func(location string) (*iplist.Source, error) {
+		return s.ipList(location, cfg.ListRefreshInterval)
+	}
+	// The Tor exit list is only loaded when a server uses it.
+	var torExits common.IPMatcher
+	for _, c := range cfg.Servers {
+		if c.DenyTor {
+			src, err := ipList(cfg.TorExitList)
+			if err != nil {
+				return fmt.Errorf("failed to load torExitList: %v", err)
+			}
+			torExits = src
+			break
+		}
+	}
+	built := make(map[string]*server.ServerConfig, len(cfg.Servers))
+	for _, c := range cfg.Servers {
+		srv, err := buildServer(s.deps.logger, c, geo, s.opts, ipList, torExits)
+		if err != nil {
+			return err
+		}
+		built[serverKey(c)] = srv
+	}
+
+	wanted := make(map[string]bool, len(cfg.Servers))
+	for _, c := range cfg.Servers {
+		wanted[serverKey(c)] = true
+	}
+	for key, m := range s.servers {
+		if !wanted[key] {
+			s.deps.logger.Printf("stopping proxy server on %s (removed from configuration)", key)
+			s.stop(m)
+		}
+	}
+
+	for _, c := range cfg.Servers {
+		key := serverKey(c)
+		srv := built[key]
+		m, ok := s.servers[key]
+		if ok && sameListener(m.cfg, c) {
+			factory := srv.CurrentHandlerFactory()
+			if nf, ok := factory.(*server.HandlerFactory); ok {
+				if of, ok := m.server.CurrentHandlerFactory().(*server.HandlerFactory); ok {
+					// Keep per-IP counts so sessions that predate the reload still count.
+					nf.ConnLimiter = of.ConnLimiter
+					// Likewise the backends' connection counts.
+					nf.Balancer = nf.Balancer.Reuse(of.Balancer)
+				}
+			}
+			if !reflect.DeepEqual(m.cfg, c) {
+				s.deps.logger.Printf("updating rules for proxy server on %s", key)
+			}
+			m.server.SetHandlerFactory(factory)
+			m.cfg = c
+			continue
+		}
+		if ok {
+			s.deps.logger.Printf("restarting proxy server on %s (listener settings changed)", key)
+			s.stop(m)
+		}
+		s.start(c, srv)
+	}
+
+	if s.opts.bans != nil {
+		// Existing bans and counters are kept; only the thresholds change. The
+		// ban file is fixed at startup.
+		s.opts.bans.SetPolicy(banPolicy(cfg.Ban))
+		if cfg.Ban.File != s.opts.bans.File {
+			s.deps.logger.Printf("ban file changes take effect on restart (still using %q)", s.opts.bans.File)
+		}
+	}
+
+	s.dropUnused()
+
+	s.activeMu.Lock()
+	s.active = append([]config.ServerConfig(nil), cfg.Servers...)
+	s.activeMu.Unlock()
+	return nil
+}
+
+// dropUnused forgets the mmdbs and lists the applied configuration no longer
+// uses. Both are held in memory, with nothing to close, so they are freed
+// once the handlers from before the reload have finished with them.
+func (s *supervisor) dropUnused() {
+	for path := range s.mmdbs {
+		if !s.mmdbsUsed[path] {
+			s.deps.logger.Printf("dropped mmdb %s (no longer configured)", path)
+			delete(s.mmdbs, path)
+		}
+	}
+	for location := range s.lists {
+		if !s.listsUsed[location] {
+			s.deps.logger.Printf("dropped ip list %s (no longer configured)", location)
+			delete(s.lists, location)
+		}
+	}
+}
+
+// Servers returns the server blocks currently applied.
+func (s *supervisor) Servers() []config.ServerConfig {
+	s.activeMu.Lock()
+	defer s.activeMu.Unlock()
+	return append([]config.ServerConfig(nil), s.active...)
+}
+
+func (s *supervisor) start(c config.ServerConfig, srv *server.ServerConfig) {
+	s.deps.logger.Printf("proxy server listening on %s:%s countries: %v regions: %v always allowed: %v always denied: %v",
+		c.ListenIP,
+		c.ListenPort,
+		c.AllowedCountries,
+		c.AllowedRegions,
+		c.AlwaysAllowed,
+		c.AlwaysDenied)
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	m := &managedServer{
+		key:    serverKey(c),
+		cfg:    c,
+		server: srv,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	s.servers[m.key] = m
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	s.deps.startServer(srv, wg, ctx)
+	go func() {
+		wg.Wait()
+		close(m.done)
+		select {
+		case s.exited <- m:
+		case <-s.quit:
+		}
+	}()
+}
+
+// stop closes the listener and waits for its accept loop to exit so the address
+// can be reused. Handlers already running are left alone.
+func (s *supervisor) stop(m *managedServer) {
+	m.cancel()
+	<-m.done
+	if s.servers[m.key] == m {
+		delete(s.servers, m.key)
+	}
+}
+
+func (s *supervisor) reload(trigger string) {
+	s.deps.logger.Printf("reloading configuration from %s (%s)", s.opts.configFile, trigger)
+	s.configMod, s.configSize = statConfig(s.opts.configFile)
+	cfg, ipapiEndpoint, err := loadConfig(s.opts)
+	if err != nil {
+		s.deps.logger.Printf("configuration reload failed; keeping current configuration: %v", err)
+		return
+	}
+	if err := s.apply(cfg, ipapiEndpoint); err != nil {
+		s.deps.logger.Printf("configuration reload failed; keeping current configuration: %v", err)
+		return
+	}
+	s.deps.logger.Printf("configuration reloaded: %d server(s) running", len(s.servers))
+}
+
+// run services reload requests until every listener has exited, which happens
+// on shutdown or when all listeners fail.
+func (s *supervisor) run(hup <-chan os.Signal) {
+	defer close(s.quit)
+
+	var watch <-chan time.Time
+	if s.opts.configWatch > 0 {
+		ticker := time.NewTicker(s.opts.configWatch)
+		defer ticker.Stop()
+		watch = ticker.C
+	}
+
+	for len(s.servers) > 0 {
+		select {
+		case m := <-s.exited:
+			if s.servers[m.key] == m {
+				delete(s.servers, m.key)
+			}
+		case <-hup:
+			if s.ctx.Err() == nil {
+				s.reload("SIGHUP")
+			}
+		case <-watch:
+			mod, size := statConfig(s.opts.configFile)
+			if s.ctx.Err() == nil && (!mod.Equal(s.configMod) || size != s.configSize) {
+				s.reload("file changed")
+			}
+		}
+	}
+}
+
+func statConfig(path string) (time.Time, int64) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, -1
+	}
+	return fi.ModTime(), fi.Size()
+}
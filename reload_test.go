@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"geoproxy/handler"
+	"geoproxy/server"
+)
+
+// blockingStarter emulates StartServer: it runs until the server context is
+// canceled and records which listeners are currently up.
+type blockingStarter struct {
+	mu      sync.Mutex
+	running map[string]*server.ServerConfig
+	starts  int
+}
+
+func (b *blockingStarter) start(s *server.ServerConfig, wg *sync.WaitGroup, ctx context.Context) {
+	key := s.ListenIP + ":" + s.ListenPort
+	b.mu.Lock()
+	if b.running == nil {
+		b.running = make(map[string]*server.ServerConfig)
+	}
+	b.running[key] = s
+	b.starts++
+	b.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		if b.running[key] == s {
+			delete(b.running, key)
+		}
+		b.mu.Unlock()
+		wg.Done()
+	}()
+}
+
+func (b *blockingStarter) get(key string) *server.ServerConfig {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.running[key]
+}
+
+func newTestSupervisor(t *testing.T, content string) (*supervisor, *blockingStarter, string, context.CancelFunc) {
+	t.Helper()
+	path := writeConfig(t, content)
+	starter := &blockingStarter{}
+	ctx, cancel := context.WithCancel(context.Background())
+	opts := runOptions{configFile: path, maxConnsPerIP: 1, proxyProtoTimeout: time.Second}
+	sup := newSupervisor(ctx, runDeps{logger: log.New(io.Discard, "", 0), startServer: starter.start}, opts)
+	cfg, endpoint, err := loadConfig(opts)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if err := sup.apply(cfg, endpoint); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	return sup, starter, path, cancel
+}
+
+func rewriteConfig(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+}
+
+func TestSupervisorReloadDiffsServers(t *testing.T) {
+	sup, starter, path, cancel := newTestSupervisor(t, `servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "8100"
+    backendIP: "127.0.0.1"
+    backendPort: "9100"
+    allowedCountries: ["US"]
+  - listenIP: "127.0.0.1"
+    listenPort: "8101"
+    backendIP: "127.0.0.1"
+    backendPort: "9101"
+    allowedCountries: ["US"]
+`)
+	defer cancel()
+
+	kept := starter.get("127.0.0.1:8100")
+	if kept == nil || starter.get("127.0.0.1:8101") == nil {
+		t.Fatal("expected both servers to be running")
+	}
+	oldFactory := kept.CurrentHandlerFactory().(*server.HandlerFactory)
+	if !oldFactory.ConnLimiter.Acquire("1.2.3.4") {
+		t.Fatal("expected acquire to succeed")
+	}
+
+	rewriteConfig(t, path, `servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "8100"
+    backendIP: "127.0.0.1"
+    backendPort: "9100"
+    allowedCountries: ["DE"]
+  - listenIP: "127.0.0.1"
+    listenPort: "8102"
+    backendIP: "127.0.0.1"
+    backendPort: "9102"
+    allowedCountries: ["US"]
+`)
+	sup.reload("test")
+
+	if starter.get("127.0.0.1:8100") != kept {
+		t.Fatal("expected unchanged listener to keep running")
+	}
+	if starter.get("127.0.0.1:8101") != nil {
+		t.Fatal("expected removed listener to be stopped")
+	}
+	if starter.get("127.0.0.1:8102") == nil {
+		t.Fatal("expected new listener to be started")
+	}
+	if starter.starts != 3 {
+		t.Fatalf("expected 3 starts, got %d", starter.starts)
+	}
+
+	newFactory := kept.CurrentHandlerFactory().(*server.HandlerFactory)
+	if newFactory == oldFactory {
+		t.Fatal("expected handler factory to be swapped")
+	}
+	if !newFactory.AllowedCountries["DE"] || newFactory.AllowedCountries["US"] {
+		t.Fatalf("unexpected allowed countries after reload: %v", newFactory.AllowedCountries)
+	}
+	if newFactory.ConnLimiter.Acquire("1.2.3.4") {
+		t.Fatal("expected connection limiter state to survive reload")
+	}
+}
+
+func TestSupervisorReloadRestartsOnListenerChange(t *testing.T) {
+	sup, starter, path, cancel := newTestSupervisor(t, `servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "8110"
+    backendIP: "127.0.0.1"
+    backendPort: "9110"
+    allowedCountries: ["US"]
+`)
+	defer cancel()
+	before := starter.get("127.0.0.1:8110")
+
+	rewriteConfig(t, path, `servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "8110"
+    backendIP: "127.0.0.1"
+    backendPort: "9110"
+    allowedCountries: ["US"]
+    recvProxyProtocol: true
+    trustedProxies: ["10.0.0.1"]
+`)
+	sup.reload("test")
+
+	after := starter.get("127.0.0.1:8110")
+	if after == nil || after == before {
+		t.Fatal("expected listener to be restarted")
+	}
+	if !after.RecvProxyProtocol {
+		t.Fatal("expected restarted listener to use new proxy protocol settings")
+	}
+}
+
+func TestSupervisorReloadKeepsConfigOnError(t *testing.T) {
+	sup, starter, path, cancel := newTestSupervisor(t, `servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "8120"
+    backendIP: "127.0.0.1"
+    backendPort: "9120"
+    allowedCountries: ["US"]
+`)
+	defer cancel()
+	before := starter.get("127.0.0.1:8120")
+	factory := before.CurrentHandlerFactory()
+
+	rewriteConfig(t, path, `servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "8120"
+    backendIP: "127.0.0.1"
+    backendPort: "9120"
+`)
+	sup.reload("test")
+
+	if starter.get("127.0.0.1:8120") != before {
+		t.Fatal("expected listener to keep running after failed reload")
+	}
+	if before.CurrentHandlerFactory() != factory {
+		t.Fatal("expected handler factory to be unchanged after failed reload")
+	}
+}
+
+func TestSupervisorRunWatchesConfigFile(t *testing.T) {
+	path := writeConfig(t, `servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "8130"
+    backendIP: "127.0.0.1"
+    backendPort: "9130"
+    allowedCountries: ["US"]
+`)
+	starter := &blockingStarter{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	opts := runOptions{configFile: path, configWatch: 10 * time.Millisecond, proxyProtoTimeout: time.Second}
+	sup := newSupervisor(ctx, runDeps{logger: log.New(io.Discard, "", 0), startServer: starter.start}, opts)
+	cfg, endpoint, err := loadConfig(opts)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if err := sup.apply(cfg, endpoint); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		sup.run(make(chan os.Signal))
+		close(done)
+	}()
+
+	rewriteConfig(t, path, `servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "8131"
+    backendIP: "127.0.0.1"
+    backendPort: "9131"
+    allowedCountries: ["US", "CA"]
+`)
+	deadline := time.Now().Add(2 * time.Second)
+	for starter.get("127.0.0.1:8131") == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("expected watcher to pick up the new listener")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected supervisor to exit after shutdown")
+	}
+}
+
+func TestLoadConfigRejectsDuplicateListenAddress(t *testing.T) {
+	path := writeConfig(t, `servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "8140"
+    backendIP: "127.0.0.1"
+    backendPort: "9140"
+    allowedCountries: ["US"]
+  - listenIP: "127.0.0.1"
+    listenPort: "8140"
+    backendIP: "127.0.0.1"
+    backendPort: "9141"
+    allowedCountries: ["US"]
+`)
+	if _, _, err := loadConfig(runOptions{configFile: path}); err == nil {
+		t.Fatal("expected duplicate listen address error")
+	}
+}
+
+func TestSupervisorReloadKeepsBalancer(t *testing.T) {
+	backends := `    backends:
+      - ip: "10.0.0.1"
+        port: "22"
+      - ip: "10.0.0.2"
+        port: "22"
+        weight: %d
+`
+	config := func(countries, strategy string, weight int) string {
+		return `servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "8130"
+    allowedCountries: ["` + countries + `"]
+    loadBalancing: "` + strategy + `"
+` + fmt.Sprintf(backends, weight)
+	}
+	sup, starter, path, cancel := newTestSupervisor(t, config("US", "least-connections", 2))
+	defer cancel()
+	srv := starter.get("127.0.0.1:8130")
+	balancer := func() *handler.Balancer {
+		return srv.CurrentHandlerFactory().(*server.HandlerFactory).Balancer
+	}
+	old := balancer()
+
+	// Same backends: sessions that predate the reload still count.
+	rewriteConfig(t, path, config("DE", "least-connections", 2))
+	sup.reload("test")
+	if balancer() != old {
+		t.Fatal("expected the balancer to survive a reload with the same backends")
+	}
+
+	// Another strategy keeps the backends and their counts.
+	rewriteConfig(t, path, config("DE", "round-robin", 2))
+	sup.reload("test")
+	if b := balancer(); b == old || b.Backends()[0] != old.Backends()[0] {
+		t.Fatal("expected a new balancer over the same backends after a strategy change")
+	}
+
+	// Changed weights start afresh.
+	old = balancer()
+	rewriteConfig(t, path, config("DE", "round-robin", 3))
+	sup.reload("test")
+	if b := balancer(); b == old || b.Backends()[1].Weight != 3 {
+		t.Fatal("expected a new balancer after the weights changed")
+	}
+}
+
+func TestSupervisorReloadDropsUnusedLists(t *testing.T) {
+	dir := t.TempDir()
+	config := func(list string) string {
+		c := `servers:
+  - listenIP: "127.0.0.1"
+    listenPort: "8131"
+    backendIP: "127.0.0.1"
+    backendPort: "9131"
+    allowedCountries: ["US"]
+`
+		if list == "" {
+			return c
+		}
+		path := filepath.Join(dir, list)
+		if err := os.WriteFile(path, []byte("203.0.113.0/24\n"), 0o600); err != nil {
+			t.Fatalf("write list: %v", err)
+		}
+		return c + `    alwaysDeniedFiles: ["` + path + `"]
+`
+	}
+	sup, _, path, cancel := newTestSupervisor(t, config("a.txt"))
+	defer cancel()
+	if _, ok := sup.lists[filepath.Join(dir, "a.txt")]; !ok || len(sup.lists) != 1 {
+		t.Fatalf("expected only a.txt to be loaded, got %v", sup.lists)
+	}
+
+	rewriteConfig(t, path, config("b.txt"))
+	sup.reload("test")
+	if _, ok := sup.lists[filepath.Join(dir, "b.txt")]; !ok || len(sup.lists) != 1 {
+		t.Fatalf("expected a.txt to be dropped for b.txt, got %v", sup.lists)
+	}
+
+	rewriteConfig(t, path, config(""))
+	sup.reload("test")
+	if len(sup.lists) != 0 {
+		t.Fatalf("expected no lists, got %v", sup.lists)
+	}
+}
@@ -0,0 +1,88 @@
+package rules
+
+import "time"
+
+// Deny reasons of the settings that predate rules. FromLegacy keeps them so
+// logs and metrics don't change when a config has no rules.
+const (
+	ReasonDate            = "connection not allowed on this date"
+	ReasonDay             = "connection not allowed on this day"
+	ReasonTime            = "connection not allowed at this time"
+	ReasonCountryOrRegion = "country or region denied"
+	// ReasonSchedule is used for the schedules list, which has no legacy
+	// counterpart.
+	ReasonSchedule = "connection not allowed by schedule"
+)
+
+// Legacy holds a server's schedule and country/region settings. Country and
+// region sets hold upper-case codes.
+type Legacy struct {
+	AllowedCountries map[string]bool
+	AllowedRegions   map[string]bool
+	DeniedCountries  map[string]bool
+	DeniedRegions    map[string]bool
+	StartDate        time.Time
+	EndDate          time.Time
+	StartTime        time.Time
+	EndTime          time.Time
+	DaysOfWeek       map[time.Weekday]bool
+	// Schedules are further windows, any of which must be active.
+	Schedules []Window
+	// Location is the time zone of the schedule fields; nil means local.
+	Location *time.Location
+	// ClientZone reads the schedule fields in the client's time zone; see
+	// Schedule.ClientZone.
+	ClientZone bool
+}
+
+// FromLegacy translates the settings into the equivalent rules:
+//
+//  1. deny outside startDate..endDate, outside daysOfWeek, outside
+//     startTime..endTime, and outside every window of schedules, in that
+//     order
+//  2. deny deniedCountries
+//  3. deny allowedCountries in deniedRegions; deniedRegions take precedence
+//     over allowedRegions, which are then ignored
+//  4. allow allowedCountries (in allowedRegions, when set)
+//  5. deny everything else
+func FromLegacy(l Legacy) *Set {
+	s := &Set{Default: Deny, DefaultTag: ReasonCountryOrRegion}
+	outside := func(reason string, windows ...Window) {
+		s.Rules = append(s.Rules, Rule{
+			Action:   Deny,
+			Tag:      reason,
+			Schedule: &Schedule{Windows: windows, Location: l.Location, ClientZone: l.ClientZone},
+			Invert:   true,
+		})
+	}
+	if !l.StartDate.IsZero() && !l.EndDate.IsZero() {
+		outside(ReasonDate, Window{StartDate: l.StartDate, EndDate: l.EndDate})
+	}
+	if len(l.DaysOfWeek) > 0 {
+		outside(ReasonDay, Window{DaysOfWeek: l.DaysOfWeek})
+	}
+	if !l.StartTime.IsZero() && !l.EndTime.IsZero() {
+		outside(ReasonTime, Window{StartTime: l.StartTime, EndTime: l.EndTime})
+	}
+	if len(l.Schedules) > 0 {
+		outside(ReasonSchedule, l.Schedules...)
+	}
+	if len(l.DeniedCountries) > 0 {
+		s.Rules = append(s.Rules, Rule{Action: Deny, Tag: ReasonCountryOrRegion, Countries: l.DeniedCountries})
+	}
+	if len(l.AllowedCountries) > 0 {
+		allow := Rule{Action: Allow, Countries: l.AllowedCountries}
+		if len(l.DeniedRegions) > 0 {
+			s.Rules = append(s.Rules, Rule{
+				Action:    Deny,
+				Tag:       ReasonCountryOrRegion,
+				Countries: l.AllowedCountries,
+				Regions:   l.DeniedRegions,
+			})
+		} else if len(l.AllowedRegions) > 0 {
+			allow.Regions = l.AllowedRegions
+		}
+		s.Rules = append(s.Rules, allow)
+	}
+	return s
+}
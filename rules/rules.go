@@ -0,0 +1,419 @@
+// Package rules evaluates a server's ordered allow/deny rules. The first rule
+// whose conditions all match decides; when none does, the default action
+// applies.
+package rules
+
+import (
+	"fmt"
+	"geoproxy/calendar"
+	"geoproxy/common"
+	"geoproxy/ipapi"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Action is what a rule does with a matching client.
+type Action string
+
+const (
+	Allow Action = "allow"
+	Deny  Action = "deny"
+)
+
+// ReasonNoMatch is the deny reason when no rule matched and the default
+// action is deny.
+const ReasonNoMatch = "no rule matched"
+
+// Rule matches clients on every condition that is set. Within a condition,
+// any entry may match: a rule with Countries {DE, AT} and a Schedule matches
+// clients from DE or AT during the schedule. A rule without conditions
+// matches every client.
+type Rule struct {
+	Action Action
+	// Tag is logged with the decision and used as its reason. Deny rules
+	// without a tag are reported by position, e.g. "denied by rule 2".
+	Tag       string
+	CIDRs     common.IPMatcher
+	Countries map[string]bool
+	Regions   map[string]bool
+	ASNs      map[uint32]bool
+	Schedule  *Schedule
+	// Invert makes the rule apply to clients that don't match its conditions.
+	Invert bool
+}
+
+// NeedsLookup reports whether matching the rule requires geolocation.
+func (r *Rule) NeedsLookup() bool {
+	return len(r.Countries) > 0 || len(r.Regions) > 0 || len(r.ASNs) > 0 ||
+		(r.Schedule != nil && r.Schedule.ClientZone)
+}
+
+// Set is a server's rule list.
+type Set struct {
+	Rules   []Rule
+	Default Action
+	// DefaultTag is the reason used when the default action applies. It
+	// defaults to ReasonNoMatch for deny and "" for allow.
+	DefaultTag string
+	// Calendar, when set, denies clients during its events before any rule
+	// is evaluated.
+	Calendar *Calendar
+}
+
+// Decision is the outcome of Evaluate. Rule is the 1-based position of the
+// deciding rule, or 0 for the default action and calendar events.
+type Decision struct {
+	Action Action
+	Reason string
+	Rule   int
+}
+
+// Lookup returns the client's geolocation. Evaluate calls it at most once,
+// and only when a rule needs it.
+type Lookup func() (ipapi.Reply, error)
+
+// Evaluate returns the decision for ip at now. Conditions that don't need a
+// lookup are checked first, so clients that a rule can't match never cost a
+// lookup. A lookup error is returned as is; the caller decides what a failed
+// lookup means.
+func (s *Set) Evaluate(ip string, now time.Time, lookup Lookup) (Decision, error) {
+	var (
+		reply     ipapi.Reply
+		looked    bool
+		lookupErr error
+	)
+	geo := func() (ipapi.Reply, error) {
+		if !looked {
+			looked = true
+			reply, lookupErr = lookup()
+		}
+		return reply, lookupErr
+	}
+	if c := s.Calendar; c != nil && len(c.Events) > 0 {
+		var clientZone string
+		if c.ClientZone {
+			reply, err := geo()
+			if err != nil {
+				return Decision{}, err
+			}
+			clientZone = reply.Timezone
+		}
+		if e := c.Active(now, clientZone); e != nil {
+			return Decision{Action: Deny, Reason: EventReason(e.Name)}, nil
+		}
+	}
+	for i := range s.Rules {
+		r := &s.Rules[i]
+		matched, err := r.matches(ip, now, geo)
+		if err != nil {
+			return Decision{}, err
+		}
+		if matched != r.Invert {
+			return Decision{Action: r.Action, Reason: r.reason(i + 1), Rule: i + 1}, nil
+		}
+	}
+	reason := s.DefaultTag
+	if reason == "" && s.Default != Allow {
+		reason = ReasonNoMatch
+	}
+	action := s.Default
+	if action == "" {
+		action = Deny
+	}
+	return Decision{Action: action, Reason: reason}, nil
+}
+
+// Timed reports whether a decision by rule n, or by the default action when n
+// is 0, can change over time: whether the calendar has events, or a rule up
+// to n has a schedule. Later rules only come into play once rule n stops
+// matching, which needs a schedule of its own.
+func (s *Set) Timed(n int) bool {
+	if s.Calendar != nil && len(s.Calendar.Events) > 0 {
+		return true
+	}
+	if n <= 0 || n > len(s.Rules) {
+		n = len(s.Rules)
+	}
+	for i := range s.Rules[:n] {
+		if sch := s.Rules[i].Schedule; sch != nil && len(sch.Windows) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// UsesClientZone reports whether any schedule or the calendar is read in the
+// client's time zone.
+func (s *Set) UsesClientZone() bool {
+	if s.Calendar != nil && s.Calendar.ClientZone {
+		return true
+	}
+	for i := range s.Rules {
+		if sch := s.Rules[i].Schedule; sch != nil && sch.ClientZone {
+			return true
+		}
+	}
+	return false
+}
+
+// NextChange returns the first time after now at which a schedule window or
+// calendar event of the set may start or end for a client in clientZone, or
+// the zero time if there is none. Decisions can only change at these times,
+// so evaluating at each in turn finds the next change without checking every
+// minute.
+func (s *Set) NextChange(now time.Time, clientZone string) time.Time {
+	var next time.Time
+	for i := range s.Rules {
+		if sch := s.Rules[i].Schedule; sch != nil {
+			next = earliest(next, sch.NextChange(now, clientZone))
+		}
+	}
+	if s.Calendar != nil {
+		next = earliest(next, s.Calendar.NextChange(now, clientZone))
+	}
+	return next
+}
+
+// earliest returns the earlier of a and b, ignoring zero times.
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
+func (r *Rule) matches(ip string, now time.Time, geo Lookup) (bool, error) {
+	if r.CIDRs != nil && !r.CIDRs.Contains(ip) {
+		return false, nil
+	}
+	if r.Schedule != nil && !r.Schedule.ClientZone && !r.Schedule.Active(now) {
+		return false, nil
+	}
+	if !r.NeedsLookup() {
+		return true, nil
+	}
+	reply, err := geo()
+	if err != nil {
+		return false, err
+	}
+	if r.Schedule != nil && r.Schedule.ClientZone && !r.Schedule.ActiveIn(now, reply.Timezone) {
+		return false, nil
+	}
+	if len(r.Countries) > 0 && !r.Countries[normalize(reply.CountryCode)] {
+		return false, nil
+	}
+	if len(r.Regions) > 0 && !r.Regions[normalize(reply.Region)] {
+		return false, nil
+	}
+	if len(r.ASNs) > 0 && !r.ASNs[reply.ASN] {
+		return false, nil
+	}
+	return true, nil
+}
+
+func (r *Rule) reason(position int) string {
+	if r.Tag != "" || r.Action == Allow {
+		return r.Tag
+	}
+	return fmt.Sprintf("denied by rule %d", position)
+}
+
+func normalize(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// Schedule limits a rule to one or more windows, read as wall-clock times in
+// Location. A schedule without windows is always active.
+type Schedule struct {
+	Windows []Window
+	// Location is the time zone of the windows; nil means the local zone.
+	// Converting to it before comparing keeps windows on local time across
+	// DST changes.
+	Location *time.Location
+	// ClientZone reads the windows in the client's time zone from the lookup
+	// instead of Location. A client whose zone is unknown is outside every
+	// window.
+	ClientZone bool
+}
+
+// Active reports whether now falls within any of the windows.
+func (s *Schedule) Active(now time.Time) bool {
+	return s.ActiveIn(now, "")
+}
+
+// ActiveIn is Active for a client in the IANA zone clientZone, which is only
+// used when s.ClientZone is set.
+func (s *Schedule) ActiveIn(now time.Time, clientZone string) bool {
+	if len(s.Windows) == 0 {
+		return true
+	}
+	now, ok := inZone(now, s.Location, s.ClientZone, clientZone)
+	if !ok {
+		return false
+	}
+	for i := range s.Windows {
+		if s.Windows[i].Active(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// NextChange returns the first time after now at which one of the windows may
+// open or close: the next midnight, start time or minute after an end time
+// in the schedule's zone, or a change of that zone's UTC offset. It returns
+// the zero time for a schedule that never changes.
+func (s *Schedule) NextChange(now time.Time, clientZone string) time.Time {
+	if len(s.Windows) == 0 {
+		return time.Time{}
+	}
+	local, ok := inZone(now, s.Location, s.ClientZone, clientZone)
+	if !ok {
+		return time.Time{}
+	}
+	y, m, d := local.Date()
+	loc := local.Location()
+	next := time.Date(y, m, d+1, 0, 0, 0, 0, loc)
+	after := func(t time.Time) {
+		if t.After(now) {
+			next = earliest(next, t)
+		}
+	}
+	for i := range s.Windows {
+		w := &s.Windows[i]
+		if w.StartTime.IsZero() || w.EndTime.IsZero() {
+			continue
+		}
+		after(time.Date(y, m, d, w.StartTime.Hour(), w.StartTime.Minute(), 0, 0, loc))
+		// The end time is inclusive.
+		after(time.Date(y, m, d, w.EndTime.Hour(), w.EndTime.Minute()+1, 0, 0, loc))
+	}
+	// Wall-clock times can be skipped over at a DST change.
+	if _, end := local.ZoneBounds(); !end.IsZero() {
+		after(end)
+	}
+	return next
+}
+
+// inZone converts now to the zone a schedule or calendar is read in: the
+// client's zone when useClient is set, otherwise loc. ok is false when the
+// client's zone is unknown.
+func inZone(now time.Time, loc *time.Location, useClient bool, clientZone string) (time.Time, bool) {
+	if useClient {
+		loc = loadZone(clientZone)
+		if loc == nil {
+			return now, false
+		}
+	}
+	if loc != nil {
+		now = now.In(loc)
+	}
+	return now, true
+}
+
+// Calendar holds exceptions to a server's schedule, such as public holidays,
+// during which clients are denied.
+type Calendar struct {
+	Events []calendar.Event
+	// Location and ClientZone set the zone floating events are read in, as
+	// for Schedule.
+	Location   *time.Location
+	ClientZone bool
+}
+
+// EventReason is the deny reason during the calendar event name. Each event
+// keeps its own reason, so the name shows up in logs and metrics.
+func EventReason(name string) string {
+	return "connection not allowed during " + name
+}
+
+// Active returns the first event that now falls within, or nil. Floating
+// events are skipped for a client whose zone is unknown.
+func (c *Calendar) Active(now time.Time, clientZone string) *calendar.Event {
+	local, ok := inZone(now, c.Location, c.ClientZone, clientZone)
+	for i := range c.Events {
+		e := &c.Events[i]
+		if e.Floating && !ok {
+			continue
+		}
+		if e.Active(local) {
+			return e
+		}
+	}
+	return nil
+}
+
+// NextChange returns the first time after now at which an event may start or
+// end, or the zero time if there is none. Floating events are skipped for a
+// client whose zone is unknown.
+func (c *Calendar) NextChange(now time.Time, clientZone string) time.Time {
+	local, ok := inZone(now, c.Location, c.ClientZone, clientZone)
+	var next time.Time
+	floating := false
+	for i := range c.Events {
+		e := &c.Events[i]
+		if e.Floating && !ok {
+			continue
+		}
+		floating = floating || e.Floating
+		next = earliest(next, e.Next(local))
+	}
+	if floating {
+		if _, end := local.ZoneBounds(); !end.IsZero() && end.After(now) {
+			next = earliest(next, end)
+		}
+	}
+	return next
+}
+
+// zones caches the client zones seen so far; a nil entry marks a name that
+// failed to load.
+var zones sync.Map
+
+// loadZone returns the location named name, or nil if it is empty or
+// unknown.
+func loadZone(name string) *time.Location {
+	if name == "" {
+		return nil
+	}
+	if loc, ok := zones.Load(name); ok {
+		return loc.(*time.Location)
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil || name == "Local" {
+		loc = nil
+	}
+	zones.Store(name, loc)
+	return loc
+}
+
+// Window is a date range, days of the week and a time of day. Zero fields are
+// not checked. A time window whose end is before its start wraps past
+// midnight; days and dates are still those of the current moment.
+type Window struct {
+	StartDate  time.Time
+	EndDate    time.Time
+	DaysOfWeek map[time.Weekday]bool
+	StartTime  time.Time
+	EndTime    time.Time
+}
+
+// Active reports whether now, already in the window's time zone, falls
+// within the window.
+func (w *Window) Active(now time.Time) bool {
+	if !w.StartDate.IsZero() && !w.EndDate.IsZero() {
+		if ok, err := common.CheckDateRange(w.StartDate, w.EndDate, now); err != nil || !ok {
+			return false
+		}
+	}
+	if len(w.DaysOfWeek) > 0 && !w.DaysOfWeek[now.Weekday()] {
+		return false
+	}
+	if !w.StartTime.IsZero() && !w.EndTime.IsZero() {
+		if ok, err := common.CheckTime(w.StartTime, w.EndTime, now); err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
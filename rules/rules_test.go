@@ -0,0 +1,353 @@
+package rules
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"geoproxy/calendar"
+	"geoproxy/common"
+	"geoproxy/ipapi"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingLookup returns reply and counts how often it was called.
+func countingLookup(reply ipapi.Reply, err error) (Lookup, *int) {
+	calls := 0
+	return func() (ipapi.Reply, error) {
+		calls++
+		return reply, err
+	}, &calls
+}
+
+func mustIPSet(t *testing.T, entries ...string) *common.IPSet {
+	t.Helper()
+	set, err := common.NewIPSet(entries)
+	if err != nil {
+		t.Fatalf("NewIPSet: %v", err)
+	}
+	return set
+}
+
+func TestEvaluateFirstMatch(t *testing.T) {
+	weekdays := &Schedule{Windows: []Window{{DaysOfWeek: map[time.Weekday]bool{
+		time.Monday: true, time.Tuesday: true, time.Wednesday: true, time.Thursday: true, time.Friday: true,
+	}}}}
+	set := &Set{
+		Rules: []Rule{
+			{Action: Allow, Tag: "de-weekdays", Countries: map[string]bool{"DE": true}, Schedule: weekdays},
+			{Action: Allow, Countries: map[string]bool{"US": true}},
+			{Action: Deny, Tag: "everyone else"},
+		},
+	}
+	monday := time.Date(2024, 5, 6, 12, 0, 0, 0, time.UTC)
+	saturday := time.Date(2024, 5, 4, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		country string
+		now     time.Time
+		want    Decision
+	}{
+		{"DE on a weekday", "de", monday, Decision{Action: Allow, Reason: "de-weekdays", Rule: 1}},
+		{"DE on a weekend", "DE", saturday, Decision{Action: Deny, Reason: "everyone else", Rule: 3}},
+		{"US on a weekend", "US", saturday, Decision{Action: Allow, Reason: "", Rule: 2}},
+		{"FR", "FR", monday, Decision{Action: Deny, Reason: "everyone else", Rule: 3}},
+	}
+	for _, tc := range tests {
+		lookup, _ := countingLookup(ipapi.Reply{CountryCode: tc.country}, nil)
+		got, err := set.Evaluate("192.0.2.1", tc.now, lookup)
+		assert.NoError(t, err, tc.name)
+		assert.Equal(t, tc.want, got, tc.name)
+	}
+}
+
+func TestEvaluateLookupIsLazy(t *testing.T) {
+	set := &Set{
+		Rules: []Rule{
+			{Action: Deny, CIDRs: mustIPSet(t, "198.51.100.0/24")},
+			{Action: Allow, CIDRs: mustIPSet(t, "10.0.0.0/8"), Countries: map[string]bool{"US": true}},
+			{Action: Allow, Countries: map[string]bool{"US": true}},
+			{Action: Allow, ASNs: map[uint32]bool{15169: true}},
+		},
+		Default: Deny,
+	}
+
+	lookup, calls := countingLookup(ipapi.Reply{CountryCode: "US"}, nil)
+	got, err := set.Evaluate("198.51.100.7", time.Now(), lookup)
+	assert.NoError(t, err)
+	assert.Equal(t, Decision{Action: Deny, Reason: "denied by rule 1", Rule: 1}, got)
+	assert.Equal(t, 0, *calls)
+
+	// Rule 2 fails on its CIDR before it needs the lookup; rules 3 and 4
+	// share a single one.
+	lookup, calls = countingLookup(ipapi.Reply{CountryCode: "DE", ASN: 15169}, nil)
+	got, err = set.Evaluate("192.0.2.1", time.Now(), lookup)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, got.Rule)
+	assert.Equal(t, 1, *calls)
+
+	lookupErr := errors.New("boom")
+	lookup, _ = countingLookup(ipapi.Reply{}, lookupErr)
+	_, err = set.Evaluate("192.0.2.1", time.Now(), lookup)
+	assert.ErrorIs(t, err, lookupErr)
+}
+
+func TestEvaluateInvertAndDefault(t *testing.T) {
+	office := &Schedule{Windows: []Window{{
+		StartTime: time.Date(0, 1, 1, 9, 0, 0, 0, time.UTC),
+		EndTime:   time.Date(0, 1, 1, 17, 0, 0, 0, time.UTC),
+	}}}
+	set := &Set{
+		Rules:   []Rule{{Action: Deny, Tag: "after hours", Schedule: office, Invert: true}},
+		Default: Allow,
+	}
+	lookup, calls := countingLookup(ipapi.Reply{}, nil)
+
+	got, err := set.Evaluate("192.0.2.1", time.Date(2024, 5, 6, 20, 0, 0, 0, time.UTC), lookup)
+	assert.NoError(t, err)
+	assert.Equal(t, Decision{Action: Deny, Reason: "after hours", Rule: 1}, got)
+
+	got, err = set.Evaluate("192.0.2.1", time.Date(2024, 5, 6, 10, 0, 0, 0, time.UTC), lookup)
+	assert.NoError(t, err)
+	assert.Equal(t, Decision{Action: Allow}, got)
+	assert.Equal(t, 0, *calls)
+
+	empty := &Set{}
+	got, err = empty.Evaluate("192.0.2.1", time.Now(), lookup)
+	assert.NoError(t, err)
+	assert.Equal(t, Decision{Action: Deny, Reason: ReasonNoMatch}, got)
+}
+
+func TestWindowActive(t *testing.T) {
+	w := &Window{
+		StartDate:  time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:    time.Date(2024, 5, 31, 0, 0, 0, 0, time.UTC),
+		DaysOfWeek: map[time.Weekday]bool{time.Friday: true},
+		StartTime:  time.Date(0, 1, 1, 22, 0, 0, 0, time.UTC),
+		EndTime:    time.Date(0, 1, 1, 2, 0, 0, 0, time.UTC),
+	}
+	assert.True(t, w.Active(time.Date(2024, 5, 3, 23, 30, 0, 0, time.UTC)))
+	assert.False(t, w.Active(time.Date(2024, 5, 3, 12, 0, 0, 0, time.UTC)))  // outside the hours
+	assert.False(t, w.Active(time.Date(2024, 5, 4, 23, 30, 0, 0, time.UTC))) // Saturday
+	assert.False(t, w.Active(time.Date(2024, 6, 7, 23, 30, 0, 0, time.UTC))) // after the range
+	assert.True(t, (&Window{}).Active(time.Now()))
+}
+
+func TestScheduleTimeZone(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("no tz database: %v", err)
+	}
+	weekdays := map[time.Weekday]bool{
+		time.Monday: true, time.Tuesday: true, time.Wednesday: true, time.Thursday: true, time.Friday: true,
+	}
+	clock := func(h, m int) time.Time { return time.Date(0, 1, 1, h, m, 0, 0, time.UTC) }
+	s := &Schedule{
+		Windows: []Window{
+			{DaysOfWeek: weekdays, StartTime: clock(8, 0), EndTime: clock(18, 0)},
+			{DaysOfWeek: map[time.Weekday]bool{time.Saturday: true}, StartTime: clock(10, 0), EndTime: clock(12, 0)},
+		},
+		Location: berlin,
+	}
+
+	tests := []struct {
+		name string
+		now  time.Time
+		want bool
+	}{
+		// 07:30 UTC is 08:30 in Berlin in winter (CET, UTC+1)...
+		{"winter morning", time.Date(2024, 1, 15, 7, 30, 0, 0, time.UTC), true},
+		{"winter before opening", time.Date(2024, 1, 15, 6, 30, 0, 0, time.UTC), false},
+		// ...and 09:30 in summer (CEST, UTC+2), so 06:30 UTC is already open.
+		{"summer morning", time.Date(2024, 7, 15, 6, 30, 0, 0, time.UTC), true},
+		{"summer evening", time.Date(2024, 7, 15, 16, 30, 0, 0, time.UTC), false},
+		{"saturday window", time.Date(2024, 7, 13, 9, 0, 0, 0, time.UTC), true},
+		{"saturday afternoon", time.Date(2024, 7, 13, 11, 0, 0, 0, time.UTC), false},
+		// The day is Berlin's: 15:30 UTC on Friday is 17:30 there, still open,
+		// while 22:30 UTC on Friday is already Saturday 00:30.
+		{"friday evening", time.Date(2024, 7, 12, 15, 30, 0, 0, time.UTC), true},
+		{"friday night", time.Date(2024, 7, 12, 22, 30, 0, 0, time.UTC), false},
+		// DST starts at 02:00 on 2024-03-31; 07:00 UTC is 09:00 CEST, a Sunday.
+		{"dst sunday", time.Date(2024, 3, 31, 7, 0, 0, 0, time.UTC), false},
+		// The first Monday after the change opens at 06:00 UTC.
+		{"dst monday", time.Date(2024, 4, 1, 6, 0, 0, 0, time.UTC), true},
+		{"dst monday early", time.Date(2024, 4, 1, 5, 59, 0, 0, time.UTC), false},
+	}
+	for _, tc := range tests {
+		assert.Equal(t, tc.want, s.Active(tc.now), tc.name)
+	}
+	assert.True(t, (&Schedule{}).Active(time.Now()))
+}
+
+func TestFromLegacy(t *testing.T) {
+	set := FromLegacy(Legacy{
+		AllowedCountries: map[string]bool{"US": true, "CA": true},
+		AllowedRegions:   map[string]bool{"WA": true},
+		DeniedCountries:  map[string]bool{"CA": true},
+		DaysOfWeek:       map[time.Weekday]bool{time.Monday: true},
+	})
+	monday := time.Date(2024, 5, 6, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		reply  ipapi.Reply
+		now    time.Time
+		action Action
+		reason string
+	}{
+		{"allowed", ipapi.Reply{CountryCode: "US", Region: "WA"}, monday, Allow, ""},
+		{"wrong region", ipapi.Reply{CountryCode: "US", Region: "OR"}, monday, Deny, ReasonCountryOrRegion},
+		{"denied country wins", ipapi.Reply{CountryCode: "CA", Region: "WA"}, monday, Deny, ReasonCountryOrRegion},
+		{"other country", ipapi.Reply{CountryCode: "FR"}, monday, Deny, ReasonCountryOrRegion},
+		{"wrong day", ipapi.Reply{CountryCode: "US", Region: "WA"}, monday.AddDate(0, 0, 1), Deny, ReasonDay},
+	}
+	for _, tc := range tests {
+		lookup, _ := countingLookup(tc.reply, nil)
+		got, err := set.Evaluate("192.0.2.1", tc.now, lookup)
+		assert.NoError(t, err, tc.name)
+		assert.Equal(t, tc.action, got.Action, tc.name)
+		assert.Equal(t, tc.reason, got.Reason, tc.name)
+	}
+
+	// Denied regions take precedence over allowed regions.
+	set = FromLegacy(Legacy{
+		AllowedCountries: map[string]bool{"US": true},
+		AllowedRegions:   map[string]bool{"WA": true},
+		DeniedRegions:    map[string]bool{"TX": true},
+	})
+	lookup, _ := countingLookup(ipapi.Reply{CountryCode: "US", Region: "OR"}, nil)
+	got, err := set.Evaluate("192.0.2.1", monday, lookup)
+	assert.NoError(t, err)
+	assert.Equal(t, Allow, got.Action)
+	lookup, _ = countingLookup(ipapi.Reply{CountryCode: "US", Region: "TX"}, nil)
+	got, err = set.Evaluate("192.0.2.1", monday, lookup)
+	assert.NoError(t, err)
+	assert.Equal(t, Deny, got.Action)
+}
+
+func TestScheduleClientZone(t *testing.T) {
+	schedule := &Schedule{
+		Windows: []Window{{
+			StartTime: time.Date(0, 1, 1, 9, 0, 0, 0, time.UTC),
+			EndTime:   time.Date(0, 1, 1, 17, 0, 0, 0, time.UTC),
+		}},
+		ClientZone: true,
+	}
+	// 14:00 UTC is 10:00 in New York, 16:00 in Berlin and 23:00 in Tokyo.
+	now := time.Date(2024, 7, 15, 14, 0, 0, 0, time.UTC)
+	assert.True(t, schedule.ActiveIn(now, "America/New_York"))
+	assert.True(t, schedule.ActiveIn(now, "Europe/Berlin"))
+	assert.False(t, schedule.ActiveIn(now, "Asia/Tokyo"))
+	assert.False(t, schedule.ActiveIn(now, ""))
+	assert.False(t, schedule.ActiveIn(now, "Nowhere/Special"))
+	assert.False(t, schedule.Active(now))
+
+	set := &Set{Rules: []Rule{{Action: Allow, Tag: "business hours", Schedule: schedule}}}
+	assert.True(t, set.Rules[0].NeedsLookup())
+	d, err := set.Evaluate("192.0.2.1", now, func() (ipapi.Reply, error) {
+		return ipapi.Reply{Timezone: "America/New_York"}, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, Allow, d.Action)
+	d, err = set.Evaluate("192.0.2.1", now, func() (ipapi.Reply, error) {
+		return ipapi.Reply{Timezone: "Asia/Tokyo"}, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, ReasonNoMatch, d.Reason)
+}
+
+func TestEvaluateCalendar(t *testing.T) {
+	set := &Set{
+		Rules: []Rule{{Action: Allow}},
+		Calendar: &Calendar{Events: []calendar.Event{
+			{Name: "Christmas", Start: time.Date(2024, 12, 25, 0, 0, 0, 0, time.UTC), End: time.Date(2024, 12, 26, 0, 0, 0, 0, time.UTC), Floating: true},
+		}},
+	}
+	noLookup := func() (ipapi.Reply, error) { return ipapi.Reply{}, errors.New("unexpected lookup") }
+
+	d, err := set.Evaluate("192.0.2.1", time.Date(2024, 12, 25, 12, 0, 0, 0, time.UTC), noLookup)
+	assert.NoError(t, err)
+	assert.Equal(t, Decision{Action: Deny, Reason: "connection not allowed during Christmas"}, d)
+
+	d, err = set.Evaluate("192.0.2.1", time.Date(2024, 12, 26, 12, 0, 0, 0, time.UTC), noLookup)
+	assert.NoError(t, err)
+	assert.Equal(t, Allow, d.Action)
+
+	// In the client's zone, it is already Christmas in Tokyo.
+	set.Calendar.ClientZone = true
+	now := time.Date(2024, 12, 24, 16, 0, 0, 0, time.UTC)
+	d, err = set.Evaluate("192.0.2.1", now, func() (ipapi.Reply, error) { return ipapi.Reply{Timezone: "Asia/Tokyo"}, nil })
+	assert.NoError(t, err)
+	assert.Equal(t, Deny, d.Action)
+	d, err = set.Evaluate("192.0.2.1", now, func() (ipapi.Reply, error) { return ipapi.Reply{Timezone: "America/New_York"}, nil })
+	assert.NoError(t, err)
+	assert.Equal(t, Allow, d.Action)
+	_, err = set.Evaluate("192.0.2.1", now, noLookup)
+	assert.Error(t, err)
+}
+
+func TestNextChange(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("no tz database: %v", err)
+	}
+	clock := func(h, m int) time.Time { return time.Date(0, 1, 1, h, m, 0, 0, time.UTC) }
+	set := &Set{
+		Rules: []Rule{
+			{Action: Deny, Tag: "night", Schedule: &Schedule{
+				Windows:  []Window{{StartTime: clock(1, 30), EndTime: clock(2, 30)}},
+				Location: berlin,
+			}},
+			{Action: Allow, Schedule: &Schedule{
+				Windows: []Window{
+					{DaysOfWeek: map[time.Weekday]bool{time.Friday: true, time.Monday: true}, StartTime: clock(22, 0), EndTime: clock(3, 15)},
+					{StartDate: time.Date(2024, 4, 2, 0, 0, 0, 0, time.UTC), EndDate: time.Date(2024, 4, 2, 0, 0, 0, 0, time.UTC)},
+				},
+				Location: berlin,
+			}},
+		},
+		Calendar: &Calendar{
+			Events: []calendar.Event{{
+				Name:       "standup",
+				Start:      time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC),
+				End:        time.Date(2024, 1, 1, 9, 20, 0, 0, time.UTC),
+				Floating:   true,
+				Recurrence: &calendar.Recurrence{Freq: calendar.Daily},
+			}},
+			Location: berlin,
+		},
+	}
+	assert.True(t, set.Timed(0))
+	assert.False(t, set.UsesClientZone())
+	noLookup := func() (ipapi.Reply, error) { return ipapi.Reply{}, errors.New("unexpected lookup") }
+
+	// Between two changes, over the start of summer time on 2024-03-31, the
+	// decision is the same every minute.
+	now := time.Date(2024, 3, 29, 0, 0, 0, 0, time.UTC)
+	changes := 0
+	for now.Before(time.Date(2024, 4, 4, 0, 0, 0, 0, time.UTC)) {
+		next := set.NextChange(now, "")
+		if !assert.True(t, next.After(now), now) {
+			return
+		}
+		want, err := set.Evaluate("192.0.2.1", now, noLookup)
+		assert.NoError(t, err)
+		for m := now.Add(time.Minute); m.Before(next); m = m.Add(time.Minute) {
+			got, _ := set.Evaluate("192.0.2.1", m, noLookup)
+			if got != want {
+				t.Fatalf("decision changed at %s, between changes at %s and %s", m, now, next)
+			}
+		}
+		now = next
+		changes++
+	}
+	// Midnights, window edges and standups, not every minute.
+	assert.Less(t, changes, 100)
+
+	assert.False(t, (&Set{Rules: []Rule{{Action: Allow, Countries: map[string]bool{"DE": true}}}}).Timed(0))
+	assert.True(t, (&Set{Rules: []Rule{{Action: Allow}}}).NextChange(now, "").IsZero())
+	// A schedule after the deciding rule doesn't matter.
+	assert.False(t, (&Set{Rules: []Rule{{Action: Allow}, set.Rules[1]}}).Timed(1))
+}
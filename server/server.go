@@ -6,6 +6,8 @@ import (
 	"geoproxy/common"
 	"geoproxy/handler"
 	"geoproxy/ipapi"
+	"geoproxy/metrics"
+	"geoproxy/rules"
 	"log"
 	"net"
 	"sync"
@@ -22,10 +24,7 @@ type HandlerFactory struct {
 	AllowedRegions       map[string]bool
 	DeniedCountries      map[string]bool
 	DeniedRegions        map[string]bool
-	AlwaysAllowed        []string
-	AlwaysDenied         []string
 	IPApiClient          ipapi.IPAPI
-	CheckIps             common.CheckIP
 	TransferFunc         func(handler.Connection, handler.Connection, *proxyproto.Header)
 	BackendDialer        handler.BackendDialer
 	BackendIP            string
@@ -40,6 +39,32 @@ type HandlerFactory struct {
 	DaysOfWeek           map[time.Weekday]bool
 	IdleTimeout          time.Duration
 	ConnLimiter          handler.ConnLimiter
+	OnLookupFailure      string
+	ServerName           string
+	ListenAddr           string
+	AccessLog            handler.AccessLogger
+	Conns                *handler.ConnRegistry
+	TempRules            *handler.TempRules
+	Bans                 handler.BanList
+	// Compiled alwaysAllowed, alwaysDenied and lookupFailureAllowed lists.
+	AlwaysAllowedSet        common.IPMatcher
+	AlwaysDeniedSet         common.IPMatcher
+	LookupFailureAllowedSet common.IPMatcher
+	AllowedASNs             map[uint32]bool
+	DeniedASNs              map[uint32]bool
+	AllowedOrgs             []string
+	DeniedOrgs              []string
+	DenyHosting             bool
+	DenyProxy               bool
+	DenyMobile              bool
+	DenyTor                 bool
+	TorExits                common.IPMatcher
+	AllowedCities           map[string]bool
+	AllowedRadius           []common.GeoRadius
+	Rules                   *rules.Set
+	EnforceScheduleOnActive bool
+	ScheduleGracePeriod     time.Duration
+	Balancer                *handler.Balancer
 }
 
 func (h *HandlerFactory) NewClientHandler() handler.Handler {
@@ -48,10 +73,7 @@ func (h *HandlerFactory) NewClientHandler() handler.Handler {
 		AllowedRegions:       h.AllowedRegions,
 		DeniedCountries:      h.DeniedCountries,
 		DeniedRegions:        h.DeniedRegions,
-		AlwaysAllowed:        h.AlwaysAllowed,
-		AlwaysDenied:         h.AlwaysDenied,
 		IPApiClient:          h.IPApiClient,
-		CheckIps:             h.CheckIps,
 		TransferFunc:         h.TransferFunc,
 		BackendDialer:        h.BackendDialer,
 		BackendAddr:          h.BackendIP,
@@ -66,16 +88,45 @@ func (h *HandlerFactory) NewClientHandler() handler.Handler {
 		DaysOfWeek:           h.DaysOfWeek,
 		IdleTimeout:          h.IdleTimeout,
 		ConnLimiter:          h.ConnLimiter,
+		OnLookupFailure:      h.OnLookupFailure,
+		ServerName:           h.ServerName,
+		ListenAddr:           h.ListenAddr,
+		AccessLog:            h.AccessLog,
+		Conns:                h.Conns,
+		TempRules:            h.TempRules,
+		Bans:                 h.Bans,
+
+		AlwaysAllowedSet:        h.AlwaysAllowedSet,
+		AlwaysDeniedSet:         h.AlwaysDeniedSet,
+		LookupFailureAllowedSet: h.LookupFailureAllowedSet,
+		AllowedASNs:             h.AllowedASNs,
+		DeniedASNs:              h.DeniedASNs,
+		AllowedOrgs:             h.AllowedOrgs,
+		DeniedOrgs:              h.DeniedOrgs,
+		DenyHosting:             h.DenyHosting,
+		DenyProxy:               h.DenyProxy,
+		DenyMobile:              h.DenyMobile,
+		DenyTor:                 h.DenyTor,
+		TorExits:                h.TorExits,
+		AllowedCities:           h.AllowedCities,
+		AllowedRadius:           h.AllowedRadius,
+		Rules:                   h.Rules,
+		EnforceScheduleOnActive: h.EnforceScheduleOnActive,
+		ScheduleGracePeriod:     h.ScheduleGracePeriod,
+		Balancer:                h.Balancer,
 	}
 }
 
 type ServerConfig struct {
+	// Name labels the server's metrics; the listen address is used when empty.
+	Name              string
 	ListenIP          string
 	ListenPort        string
 	BackendIP         string
 	BackendPort       string
 	NetListener       NetListener
 	HandlerFactory    ClientHandlerFactory
+	handlerFactoryMu  sync.RWMutex
 	serverErrorMu     sync.Mutex
 	serverError       error
 	RecvProxyProtocol bool
@@ -140,6 +191,12 @@ func (s *ServerConfig) StartServer(wg *sync.WaitGroup, ctx context.Context) {
 	if s.MaxConns > 0 {
 		sem = make(chan struct{}, s.MaxConns)
 	}
+	name := s.Name
+	if name == "" {
+		name = listenAddr
+	}
+	metrics.MaxConnsLimit.With(name).Set(int64(s.MaxConns))
+	inUse := metrics.MaxConnsInUse.With(name)
 
 	for {
 		clientConn, err := listener.Accept()
@@ -158,8 +215,10 @@ func (s *ServerConfig) StartServer(wg *sync.WaitGroup, ctx context.Context) {
 		if sem != nil {
 			select {
 			case sem <- struct{}{}:
+				inUse.Inc()
 			default:
 				// Avoid touching proxyproto.Conn.RemoteAddr() here (can block on PROXY header read).
+				metrics.ConnectionsRejected.With(name, "too many active connections").Inc()
 				log.Printf("too many active connections on %s; rejecting connection", listenAddr)
 				_ = clientConn.Close()
 				continue
@@ -170,10 +229,13 @@ func (s *ServerConfig) StartServer(wg *sync.WaitGroup, ctx context.Context) {
 		// proxyproto.Conn.RemoteAddr() will attempt to read the PROXY header and can
 		// block this accept loop (slowloris/DoS).
 
-		handler := s.HandlerFactory.NewClientHandler()
+		handler := s.CurrentHandlerFactory().NewClientHandler()
 		go func() {
 			if sem != nil {
-				defer func() { <-sem }()
+				defer func() {
+					<-sem
+					inUse.Dec()
+				}()
 			}
 			handler.HandleClient(ctx, clientConn)
 		}()
@@ -195,6 +257,20 @@ func checkCanceled(ctx context.Context) error {
 	}
 }
 
+// SetHandlerFactory swaps the factory used for connections accepted from now on.
+// Handlers that are already running keep the rules they were created with.
+func (s *ServerConfig) SetHandlerFactory(f ClientHandlerFactory) {
+	s.handlerFactoryMu.Lock()
+	defer s.handlerFactoryMu.Unlock()
+	s.HandlerFactory = f
+}
+
+func (s *ServerConfig) CurrentHandlerFactory() ClientHandlerFactory {
+	s.handlerFactoryMu.RLock()
+	defer s.handlerFactoryMu.RUnlock()
+	return s.HandlerFactory
+}
+
 func (s *ServerConfig) setServerError(err error) {
 	s.serverErrorMu.Lock()
 	defer s.serverErrorMu.Unlock()
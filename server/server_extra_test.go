@@ -6,7 +6,10 @@ import (
 	"testing"
 	"time"
 
+	"geoproxy/ban"
+	"geoproxy/common"
 	"geoproxy/handler"
+	"geoproxy/rules"
 
 	"github.com/pires/go-proxyproto"
 	"github.com/stretchr/testify/assert"
@@ -42,9 +45,6 @@ func TestHandlerFactoryNewClientHandler(t *testing.T) {
 		AllowedRegions:       map[string]bool{"CA": true},
 		DeniedCountries:      map[string]bool{"CN": true},
 		DeniedRegions:        map[string]bool{"BJ": true},
-		AlwaysAllowed:        []string{"127.0.0.1"},
-		AlwaysDenied:         []string{"10.0.0.1"},
-		CheckIps:             nil,
 		TransferFunc:         nil,
 		BackendIP:            "127.0.0.1",
 		BackendPort:          "8080",
@@ -56,6 +56,24 @@ func TestHandlerFactoryNewClientHandler(t *testing.T) {
 		EndDate:              endDate,
 		DaysOfWeek:           days,
 		IdleTimeout:          10 * time.Second,
+		OnLookupFailure:      handler.LookupFailureFallback,
+		ServerName:           "web",
+		ListenAddr:           "127.0.0.1:8080",
+		Bans:                 ban.New(ban.Policy{}),
+		AlwaysAllowedSet:     &common.IPSet{},
+		DeniedASNs:           map[uint32]bool{14061: true},
+		AllowedOrgs:          []string{"google"},
+		DenyHosting:          true,
+		DenyMobile:           true,
+		AllowedCities:        map[string]bool{"seattle": true},
+		AllowedRadius:        []common.GeoRadius{{Lat: 47.6, Lon: -122.3, RadiusKm: 50}},
+		Rules:                &rules.Set{Default: rules.Allow},
+
+		AlwaysDeniedSet:         &common.IPSet{},
+		LookupFailureAllowedSet: &common.IPSet{},
+		EnforceScheduleOnActive: true,
+		ScheduleGracePeriod:     time.Minute,
+		Balancer:                handler.NewBalancer(handler.BalanceRoundRobin, nil),
 	}
 
 	h := factory.NewClientHandler()
@@ -65,8 +83,6 @@ func TestHandlerFactoryNewClientHandler(t *testing.T) {
 		assert.Equal(t, factory.AllowedRegions, clientHandler.AllowedRegions)
 		assert.Equal(t, factory.DeniedCountries, clientHandler.DeniedCountries)
 		assert.Equal(t, factory.DeniedRegions, clientHandler.DeniedRegions)
-		assert.Equal(t, factory.AlwaysAllowed, clientHandler.AlwaysAllowed)
-		assert.Equal(t, factory.AlwaysDenied, clientHandler.AlwaysDenied)
 		assert.Equal(t, factory.SendProxyProtocol, clientHandler.SendProxyProtocol)
 		assert.Equal(t, factory.ProxyProtocolVersion, clientHandler.ProxyProtocolVersion)
 
@@ -78,6 +94,24 @@ func TestHandlerFactoryNewClientHandler(t *testing.T) {
 		assert.Equal(t, factory.EndDate, clientHandler.EndDate)
 		assert.Equal(t, factory.DaysOfWeek, clientHandler.DaysOfWeek)
 		assert.Equal(t, factory.IdleTimeout, clientHandler.IdleTimeout)
+		assert.Equal(t, factory.OnLookupFailure, clientHandler.OnLookupFailure)
+		assert.Equal(t, factory.ServerName, clientHandler.ServerName)
+		assert.Equal(t, factory.ListenAddr, clientHandler.ListenAddr)
+		assert.Same(t, factory.Bans, clientHandler.Bans)
+		assert.Same(t, factory.AlwaysAllowedSet, clientHandler.AlwaysAllowedSet)
+		assert.Same(t, factory.AlwaysDeniedSet, clientHandler.AlwaysDeniedSet)
+		assert.Same(t, factory.LookupFailureAllowedSet, clientHandler.LookupFailureAllowedSet)
+		assert.Equal(t, factory.DeniedASNs, clientHandler.DeniedASNs)
+		assert.Equal(t, factory.AllowedOrgs, clientHandler.AllowedOrgs)
+		assert.Equal(t, factory.DenyHosting, clientHandler.DenyHosting)
+		assert.Equal(t, factory.DenyProxy, clientHandler.DenyProxy)
+		assert.Equal(t, factory.DenyMobile, clientHandler.DenyMobile)
+		assert.Equal(t, factory.AllowedCities, clientHandler.AllowedCities)
+		assert.Equal(t, factory.AllowedRadius, clientHandler.AllowedRadius)
+		assert.Same(t, factory.Rules, clientHandler.Rules)
+		assert.True(t, clientHandler.EnforceScheduleOnActive)
+		assert.Equal(t, time.Minute, clientHandler.ScheduleGracePeriod)
+		assert.Same(t, factory.Balancer, clientHandler.Balancer)
 	}
 }
 
@@ -110,3 +144,13 @@ func TestStartServerSendProxyProtocol(t *testing.T) {
 		t.Fatalf("expected proxy protocol header to be sent")
 	}
 }
+
+func TestSetHandlerFactory(t *testing.T) {
+	first := &captureHandlerFactory{handler: &captureHandler{}}
+	second := &captureHandlerFactory{handler: &captureHandler{}}
+	s := &ServerConfig{HandlerFactory: first}
+
+	assert.Same(t, first, s.CurrentHandlerFactory())
+	s.SetHandlerFactory(second)
+	assert.Same(t, second, s.CurrentHandlerFactory())
+}
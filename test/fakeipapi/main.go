@@ -14,6 +14,18 @@ type Response struct {
     Status      string `json:"status"`
     CountryCode string `json:"countryCode"`
     Region      string `json:"region"`
+    City        string  `json:"city,omitempty"`
+    Lat         float64 `json:"lat,omitempty"`
+    Lon         float64 `json:"lon,omitempty"`
+    Timezone    string  `json:"timezone,omitempty"`
+    AS          string `json:"as,omitempty"`
+    ASName      string `json:"asname,omitempty"`
+    Org         string `json:"org,omitempty"`
+    ISP         string `json:"isp,omitempty"`
+    Mobile      bool   `json:"mobile"`
+    Proxy       bool   `json:"proxy"`
+    Hosting     bool   `json:"hosting"`
+    Query       string `json:"query,omitempty"`
 }
 
 // Global variable to hold the country code and region
@@ -45,10 +57,63 @@ func handleJSON(w http.ResponseWriter, r *http.Request) {
     }
 }
 
+// handleBatch mimics ip-api's POST /batch: the body is a JSON array of IPs (or
+// objects with a "query" field) and the reply is one result per IP, in order.
+func handleBatch(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "POST required", http.StatusMethodNotAllowed)
+        return
+    }
+
+    var raw []json.RawMessage
+    if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+        http.Error(w, "Invalid request", http.StatusBadRequest)
+        return
+    }
+    if len(raw) > 100 {
+        http.Error(w, "Too many IPs", http.StatusUnprocessableEntity)
+        return
+    }
+
+    results := make([]Response, 0, len(raw))
+    for _, item := range raw {
+        var ip string
+        if err := json.Unmarshal(item, &ip); err != nil {
+            var obj struct {
+                Query string `json:"query"`
+            }
+            if err := json.Unmarshal(item, &obj); err != nil {
+                http.Error(w, "Invalid request", http.StatusBadRequest)
+                return
+            }
+            ip = obj.Query
+        }
+        result := response
+        result.Query = ip
+        results = append(results, result)
+    }
+    log.Printf("Batch of %d IPs\n", len(results))
+
+    w.Header().Set("Content-Type", "application/json")
+    if err := json.NewEncoder(w).Encode(results); err != nil {
+        log.Printf("Error encoding response: %v", err)
+        http.Error(w, "Error encoding JSON", http.StatusInternalServerError)
+    }
+}
+
 func main() {
     // Define command line flags
     countryCode := flag.String("countryCode", "US", "a string")
     region := flag.String("region", "WA", "a string")
+    city := flag.String("city", "", "a string")
+    lat := flag.Float64("lat", 0, "latitude")
+    lon := flag.Float64("lon", 0, "longitude")
+    timezone := flag.String("timezone", "", "IANA time zone, e.g. \"Europe/Berlin\"")
+    as := flag.String("as", "", "AS number and name, e.g. \"AS64500 Example\"")
+    org := flag.String("org", "", "organization")
+    mobile := flag.Bool("mobile", false, "report a cellular network")
+    proxy := flag.Bool("proxy", false, "report a proxy, VPN or Tor exit")
+    hosting := flag.Bool("hosting", false, "report a hosting provider")
     flag.Parse()
 
     // Initialize the response struct with command line arguments
@@ -56,10 +121,21 @@ func main() {
         Status:      "success",
         CountryCode: *countryCode,
         Region:      *region,
+        City:        *city,
+        Lat:         *lat,
+        Lon:         *lon,
+        Timezone:    *timezone,
+        AS:          *as,
+        Org:         *org,
+        ISP:         *org,
+        Mobile:      *mobile,
+        Proxy:       *proxy,
+        Hosting:     *hosting,
     }
 
     // Define a handler for the /json/ route
     http.HandleFunc("/json/", handleJSON)
+    http.HandleFunc("/batch", handleBatch)
 
     // Start the web server on port 8080
     fmt.Println("Server is running on http://localhost:8181")